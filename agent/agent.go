@@ -1,27 +1,37 @@
 package agent
 
 import (
+	"strconv"
+
 	"github.com/redhill42/iota/alarm"
 	"github.com/redhill42/iota/auth"
+	"github.com/redhill42/iota/auth/oidc"
 	"github.com/redhill42/iota/auth/userdb"
 	"github.com/redhill42/iota/config"
 	"github.com/redhill42/iota/device"
+	"github.com/redhill42/iota/integration"
 	"github.com/redhill42/iota/mqtt"
+	"github.com/redhill42/iota/mqtt/mosquitto"
 	"github.com/redhill42/iota/tsdb"
 
 	// Load all plugins
 	_ "github.com/redhill42/iota/auth/userdb/file"
+	_ "github.com/redhill42/iota/auth/userdb/ldap"
 	_ "github.com/redhill42/iota/auth/userdb/mongodb"
+	_ "github.com/redhill42/iota/auth/userdb/sqldb"
+	_ "github.com/redhill42/iota/integration/modbus"
 )
 
 // Agent maintains all external services
 type Agent struct {
 	Users         *userdb.UserDatabase
 	Authz         *auth.Authenticator
+	OIDC          *oidc.Provider // nil if no identity provider configured
 	MQTTBroker    *mqtt.Broker
 	TSDB          tsdb.TSDB
 	DeviceManager *device.Manager
 	AlarmManager  *alarm.Manager
+	Integrations  []integration.Integration
 }
 
 func New() (agent *Agent, err error) {
@@ -37,17 +47,20 @@ func New() (agent *Agent, err error) {
 		return nil, err
 	}
 
-	var username = config.GetOption("mqtt", "user")
-	var password = config.GetOption("mqtt", "password")
-	if username == "" && password == "" {
-		pw, err := agent.Users.GetPassword("mqtt", 32)
-		if err != nil {
-			return nil, err
-		}
-		username = "iota"
-		password = string(pw)
+	oidcConfig, err := oidc.Configure()
+	if err != nil {
+		return nil, err
+	}
+	if oidcConfig != nil {
+		agent.OIDC = oidc.New(oidcConfig)
+	}
+
+	embedded, _ := strconv.ParseBool(config.GetOrDefault("mqtt.embedded", "false"))
+	if embedded {
+		agent.MQTTBroker, err = mqtt.NewEmbeddedBroker(mosquitto.AuthUnpwdCheck, mosquitto.AuthAclCheck)
+	} else {
+		agent.MQTTBroker, err = newMQTTClient(agent.Users)
 	}
-	agent.MQTTBroker, err = mqtt.NewBroker(username, password)
 	if err != nil {
 		return nil, err
 	}
@@ -62,16 +75,77 @@ func New() (agent *Agent, err error) {
 		return nil, err
 	}
 
-	agent.AlarmManager, err = alarm.NewManager()
+	// The embedded MQTT broker checks client access with the same logic
+	// as the mosquitto auth plugin
+	if embedded {
+		err = mosquitto.Init(agent.Users, agent.Authz, agent.DeviceManager)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	agent.AlarmManager, err = alarm.NewManager(agent.MQTTBroker)
 	if err != nil {
 		return nil, err
 	}
 
+	// Propagate alarms up device and group hierarchies, and expose the
+	// highest severity of active alarms as a device attribute
+	agent.AlarmManager.SetRelationFunc(agent.DeviceManager.Related)
+
+	// Alarms raised by devices belong to the tenant of the devices
+	agent.AlarmManager.SetTenantFunc(func(originator string) (string, error) {
+		tenant, err := agent.DeviceManager.GetTenant(originator)
+		if _, ok := err.(device.DeviceNotFoundError); ok {
+			return "", nil
+		}
+		return tenant, err
+	})
+	agent.DeviceManager.AddReadOnlyAttribute("alarm-severity", func(devices map[string]string) (map[string]interface{}, error) {
+		severities, err := agent.AlarmManager.HighestSeverities(devices)
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]interface{}, len(severities))
+		for id, severity := range severities {
+			values[id] = severity
+		}
+		return values, nil
+	})
+
+	// Integrations must be started by only one API server in a cluster,
+	// or the external systems are polled multiple times
+	integrations, _ := strconv.ParseBool(config.GetOrDefault("integration.enabled", "true"))
+	if integrations {
+		agent.Integrations, err = integration.Start(integration.NewSink(agent.DeviceManager, agent.TSDB))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return agent, nil
 }
 
+// newMQTTClient creates a broker that connects to an external MQTT broker.
+func newMQTTClient(users *userdb.UserDatabase) (*mqtt.Broker, error) {
+	var username = config.GetOption("mqtt", "user")
+	var password = config.GetOption("mqtt", "password")
+	if username == "" && password == "" {
+		pw, err := users.GetPassword("mqtt", 32)
+		if err != nil {
+			return nil, err
+		}
+		username = "iota"
+		password = string(pw)
+	}
+	return mqtt.NewBroker(username, password)
+}
+
 // Close shutdown all external services
 func (agent *Agent) Close() {
+	for _, in := range agent.Integrations {
+		in.Close()
+	}
 	agent.Users.Close()
 	agent.DeviceManager.Close()
 	agent.AlarmManager.Close()
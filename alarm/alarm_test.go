@@ -0,0 +1,183 @@
+package alarm_test
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/redhill42/iota/alarm"
+)
+
+func TestAlarmManager(t *testing.T) {
+	os.Setenv("IOTA_DEVICEDB_URL", "mongodb://127.0.0.1:27017/alarm_test")
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Alarm Manager Suite")
+}
+
+var _ = Describe("AlarmManager", func() {
+	const (
+		SENSOR  = "sensor"
+		GATEWAY = "gateway"
+		SITE    = "site"
+	)
+
+	var mgr *alarm.Manager
+
+	BeforeEach(func() {
+		var err error
+		mgr, err = alarm.NewManager(nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		mgr.SetRelationFunc(func(originator string) ([]string, error) {
+			if originator == SENSOR {
+				return []string{GATEWAY, SITE}, nil
+			}
+			return nil, nil
+		})
+	})
+
+	AfterEach(func() {
+		alarms, _ := mgr.FindAll("")
+		for _, a := range alarms {
+			mgr.Delete(a.ID)
+		}
+		mgr.Close()
+	})
+
+	Describe("Propagation", func() {
+		It("should propagate alarm to related entities", func() {
+			a := alarm.Alarm{Name: "overheat", Originator: SENSOR, Propagate: true}
+			Expect(mgr.Upsert(&a)).To(Succeed())
+			Expect(a.PropagatedTo).To(Equal([]string{GATEWAY, SITE}))
+
+			alarms, err := mgr.FindEntity("", GATEWAY)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(alarms).To(HaveLen(1))
+			Expect(alarms[0].ID).To(Equal(a.ID))
+		})
+
+		It("should not propagate alarm unless requested", func() {
+			a := alarm.Alarm{Name: "overheat", Originator: SENSOR}
+			Expect(mgr.Upsert(&a)).To(Succeed())
+			Expect(a.PropagatedTo).To(BeEmpty())
+
+			alarms, err := mgr.FindEntity("", GATEWAY)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(alarms).To(BeEmpty())
+		})
+
+		It("should ignore client provided propagation targets", func() {
+			a := alarm.Alarm{Name: "overheat", Originator: GATEWAY, PropagatedTo: []string{SITE}}
+			Expect(mgr.Upsert(&a)).To(Succeed())
+
+			alarms, err := mgr.FindEntity("", SITE)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(alarms).To(BeEmpty())
+		})
+	})
+
+	Describe("Highest severity", func() {
+		It("should aggregate active alarms of the entity", func() {
+			minor := alarm.Alarm{Name: "battery", Originator: GATEWAY, Severity: alarm.Minor}
+			major := alarm.Alarm{Name: "overheat", Originator: SENSOR, Severity: alarm.Major, Propagate: true}
+			Expect(mgr.Upsert(&minor)).To(Succeed())
+			Expect(mgr.Upsert(&major)).To(Succeed())
+
+			severity, ok, err := mgr.HighestSeverity("", GATEWAY)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(severity).To(Equal(alarm.Major))
+
+			Expect(mgr.Clear(major.ID)).To(Succeed())
+			severity, ok, err = mgr.HighestSeverity("", GATEWAY)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(severity).To(Equal(alarm.Minor))
+		})
+
+		It("should report nothing without active alarms", func() {
+			_, ok, err := mgr.HighestSeverity("", SITE)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should aggregate active alarms of many entities", func() {
+			minor := alarm.Alarm{Name: "battery", Originator: GATEWAY, Severity: alarm.Minor}
+			major := alarm.Alarm{Name: "overheat", Originator: SENSOR, Severity: alarm.Major, Propagate: true}
+			Expect(mgr.Upsert(&minor)).To(Succeed())
+			Expect(mgr.Upsert(&major)).To(Succeed())
+
+			severities, err := mgr.HighestSeverities(map[string]string{GATEWAY: "", SENSOR: "", SITE: ""})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(severities).To(Equal(map[string]alarm.Severity{GATEWAY: alarm.Major, SENSOR: alarm.Major}))
+		})
+	})
+
+	Describe("Tenant", func() {
+		BeforeEach(func() {
+			mgr.SetTenantFunc(func(originator string) (string, error) {
+				if originator == SENSOR {
+					return "acme", nil
+				}
+				return "", nil
+			})
+		})
+
+		AfterEach(func() {
+			mgr.SetTenantFunc(nil)
+		})
+
+		It("should scope alarms to the tenant of the originator", func() {
+			a := alarm.Alarm{Name: "overheat", Originator: SENSOR, Severity: alarm.Major, Propagate: true}
+			Expect(mgr.Upsert(&a)).To(Succeed())
+			Expect(a.Tenant).To(Equal("acme"))
+
+			alarms, err := mgr.FindEntity("acme", GATEWAY)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(alarms).To(HaveLen(1))
+
+			alarms, err = mgr.FindEntity("other", GATEWAY)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(alarms).To(BeEmpty())
+
+			alarms, err = mgr.FindAll("other")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(alarms).To(BeEmpty())
+
+			Expect(mgr.CheckTenant(a.ID, "acme")).To(Succeed())
+			Expect(mgr.CheckTenant(a.ID, "other")).To(MatchError(alarm.NotFoundError(a.ID)))
+		})
+
+		It("should aggregate severity of alarms in the tenant", func() {
+			a := alarm.Alarm{Name: "overheat", Originator: SENSOR, Severity: alarm.Major, Propagate: true}
+			Expect(mgr.Upsert(&a)).To(Succeed())
+
+			severity, ok, err := mgr.HighestSeverity("acme", GATEWAY)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(severity).To(Equal(alarm.Major))
+
+			_, ok, err = mgr.HighestSeverity("other", GATEWAY)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeFalse())
+
+			severities, err := mgr.HighestSeverities(map[string]string{SENSOR: "acme", GATEWAY: "other"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(severities).To(Equal(map[string]alarm.Severity{SENSOR: alarm.Major}))
+		})
+
+		It("should not raise alarms on originators of other tenants", func() {
+			a := alarm.Alarm{Name: "overheat", Originator: SENSOR}
+			Expect(mgr.UpsertTenant("other", &a)).To(MatchError(alarm.NotFoundError(SENSOR)))
+
+			b := alarm.Alarm{Name: "offline", Originator: SITE}
+			Expect(mgr.UpsertTenant("acme", &b)).To(Succeed())
+			Expect(b.Tenant).To(Equal("acme"))
+
+			c := alarm.Alarm{Name: "offline", Originator: SITE}
+			Expect(mgr.UpsertTenant("other", &c)).To(MatchError(alarm.NotFoundError("offline")))
+		})
+	})
+})
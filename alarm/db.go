@@ -37,6 +37,18 @@ type Alarm struct {
 	Details     map[string]interface{} `json:"details"`
 	UpdateTime  time.Time              `json:"updateTime"`
 	ClearTime   time.Time              `json:"clearTime"`
+
+	// Propagate indicates that the alarm should also be raised on entities
+	// related to the originator, such as parent devices or device groups.
+	Propagate bool `json:"propagate"`
+
+	// PropagatedTo contains the related entities the alarm propagated to.
+	// It is maintained by the alarm manager and cannot be set by clients.
+	PropagatedTo []string `json:"propagatedTo,omitempty"`
+
+	// Tenant is the tenant of the alarm, which is the tenant of the
+	// originator if the originator is a device.
+	Tenant string `json:"tenant,omitempty" bson:",omitempty"`
 }
 
 func (a *Alarm) GetID() string {
@@ -47,6 +59,10 @@ func (a *Alarm) Marshal() ([]byte, error) {
 	return json.Marshal(a)
 }
 
+func (a *Alarm) GetTenant() string {
+	return a.Tenant
+}
+
 type alarmKey struct {
 	Name       string
 	Originator string
@@ -96,6 +112,18 @@ func openDatabase() (*alarmDB, error) {
 		return nil, err
 	}
 
+	err = alarms.EnsureIndexKey("propagatedto")
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	err = alarms.EnsureIndexKey("tenant")
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
 	return &alarmDB{session}, nil
 }
 
@@ -197,10 +225,120 @@ func (db *alarmDB) FindName(name, originator string) (*Alarm, error) {
 	return &rec.Alarm, err
 }
 
-func (db *alarmDB) FindAll() ([]*Alarm, error) {
+// FindAll returns all alarms of the tenant, or alarms of all tenants if the
+// tenant is empty.
+func (db *alarmDB) FindAll(tenant string) ([]*Alarm, error) {
+	return db.findAll(tenantQuery(tenant, bson.M{}))
+}
+
+// entityQuery selects alarms raised by the given entity or propagated to it.
+func entityQuery(entity string) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"originator": entity},
+		{"propagatedto": entity},
+	}}
+}
+
+// tenantQuery restricts the query to alarms of the tenant if the tenant is
+// not empty.
+func tenantQuery(tenant string, query bson.M) bson.M {
+	if tenant != "" {
+		query["tenant"] = tenant
+	}
+	return query
+}
+
+// FindEntity returns all alarms raised by the given entity, including
+// alarms propagated to the entity from related entities. Only alarms of
+// the tenant are returned if the tenant is not empty.
+func (db *alarmDB) FindEntity(tenant, entity string) ([]*Alarm, error) {
+	return db.findAll(tenantQuery(tenant, entityQuery(entity)))
+}
+
+// HighestSeverity returns the highest severity of active alarms raised by
+// or propagated to the given entity. Only alarms of the tenant are counted
+// if the tenant is not empty. The boolean result is false if the entity
+// has no active alarms.
+func (db *alarmDB) HighestSeverity(tenant, entity string) (Severity, bool, error) {
+	var rec struct {
+		Severity Severity
+	}
+
+	query := tenantQuery(tenant, entityQuery(entity))
+	query["status"] = Active
+
+	err := db.do(func(c *mgo.Collection) error {
+		return c.Find(query).Select(bson.M{"severity": 1}).Sort("severity").One(&rec)
+	})
+	if err == mgo.ErrNotFound {
+		return 0, false, nil
+	}
+	return rec.Severity, err == nil, err
+}
+
+// HighestSeverities returns the highest severities of active alarms raised
+// by or propagated to the entities, which are given with their tenants, in
+// one query. Only alarms of the tenant of an entity are counted if the
+// tenant is not empty. Entities without active alarms are omitted from
+// the result.
+func (db *alarmDB) HighestSeverities(entities map[string]string) (map[string]Severity, error) {
+	result := make(map[string]Severity)
+	if len(entities) == 0 {
+		return result, nil
+	}
+
+	ids := make([]string, 0, len(entities))
+	byTenant := make(map[string][]string)
+	for id, tenant := range entities {
+		ids = append(ids, id)
+		byTenant[tenant] = append(byTenant[tenant], id)
+	}
+	tenants := make([]bson.M, 0, len(byTenant))
+	for tenant, ids := range byTenant {
+		tenants = append(tenants, tenantQuery(tenant, bson.M{"entity": bson.M{"$in": ids}}))
+	}
+
+	pipeline := []bson.M{
+		{"$match": bson.M{
+			"status": Active,
+			"$or": []bson.M{
+				{"originator": bson.M{"$in": ids}},
+				{"propagatedto": bson.M{"$in": ids}},
+			},
+		}},
+		{"$project": bson.M{
+			"severity": 1,
+			"tenant":   1,
+			"entity": bson.M{"$setUnion": []interface{}{
+				[]interface{}{"$originator"},
+				bson.M{"$ifNull": []interface{}{"$propagatedto", []interface{}{}}},
+			}},
+		}},
+		{"$unwind": "$entity"},
+		{"$match": bson.M{"$or": tenants}},
+		{"$group": bson.M{"_id": "$entity", "severity": bson.M{"$min": "$severity"}}},
+	}
+
+	var rec []struct {
+		Entity   string `bson:"_id"`
+		Severity Severity
+	}
+	err := db.do(func(c *mgo.Collection) error {
+		return c.Pipe(pipeline).All(&rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rec {
+		result[r.Entity] = r.Severity
+	}
+	return result, nil
+}
+
+func (db *alarmDB) findAll(query bson.M) ([]*Alarm, error) {
 	rec := make([]alarmRec, 0)
 	err := db.do(func(c *mgo.Collection) error {
-		return c.Find(bson.M{}).All(&rec)
+		return c.Find(query).All(&rec)
 	})
 	if err != nil {
 		return nil, err
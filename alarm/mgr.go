@@ -1,21 +1,71 @@
 package alarm
 
+import (
+	"encoding/json"
+
+	"github.com/redhill42/iota/mqtt"
+	"github.com/sirupsen/logrus"
+)
+
+// updateEvent is broadcast to other API servers of the cluster when an
+// alarm is updated.
+const updateEvent = "alarms"
+
 type UpdateCallback func(alarm *Alarm)
 
+// RelationFunc returns the entities related to the given originator. Alarms
+// raised by the originator with propagation enabled are also raised on
+// these entities.
+type RelationFunc func(originator string) ([]string, error)
+
+// TenantFunc returns the tenant of an originator. The originator has no
+// tenant if an empty string is returned.
+type TenantFunc func(originator string) (string, error)
+
 type Manager struct {
 	*alarmDB
+	broker          *mqtt.Broker
 	updateCallbacks []UpdateCallback
+	relations       RelationFunc
+	tenants         TenantFunc
 }
 
-func NewManager() (*Manager, error) {
+func NewManager(broker *mqtt.Broker) (*Manager, error) {
 	db, err := openDatabase()
 	if err != nil {
 		return nil, err
 	}
-	return &Manager{alarmDB: db}, nil
+
+	mgr := &Manager{alarmDB: db, broker: broker}
+	if broker != nil {
+		// Receive alarm updates from other API servers
+		if err = broker.OnBroadcast(updateEvent, mgr.remoteUpdate); err != nil {
+			return nil, err
+		}
+	}
+	return mgr, nil
 }
 
 func (mgr *Manager) Upsert(alarm *Alarm) error {
+	alarm.PropagatedTo = nil
+	if alarm.Propagate && mgr.relations != nil {
+		related, err := mgr.relations(alarm.Originator)
+		if err != nil {
+			return err
+		}
+		alarm.PropagatedTo = related
+	}
+
+	if mgr.tenants != nil {
+		tenant, err := mgr.tenants(alarm.Originator)
+		if err != nil {
+			return err
+		}
+		if tenant != "" {
+			alarm.Tenant = tenant
+		}
+	}
+
 	err := mgr.alarmDB.Upsert(alarm)
 	if err != nil {
 		return err
@@ -23,9 +73,92 @@ func (mgr *Manager) Upsert(alarm *Alarm) error {
 	for _, cb := range mgr.updateCallbacks {
 		cb(alarm)
 	}
+	if mgr.broker != nil {
+		if err = mgr.broker.Broadcast(updateEvent, alarm); err != nil {
+			logrus.WithError(err).Error("Failed to broadcast alarm update")
+		}
+	}
 	return nil
 }
 
+// remoteUpdate invokes update callbacks for alarms updated by other API
+// servers.
+func (mgr *Manager) remoteUpdate(payload []byte) {
+	alarm := new(Alarm)
+	if err := json.Unmarshal(payload, alarm); err != nil {
+		logrus.WithError(err).Error("Invalid alarm update event")
+		return
+	}
+	for _, cb := range mgr.updateCallbacks {
+		cb(alarm)
+	}
+}
+
 func (mgr *Manager) OnUpdate(callback UpdateCallback) {
 	mgr.updateCallbacks = append(mgr.updateCallbacks, callback)
 }
+
+// SetRelationFunc sets the function used to resolve entities that alarms
+// propagate to.
+func (mgr *Manager) SetRelationFunc(f RelationFunc) {
+	mgr.relations = f
+}
+
+// SetTenantFunc sets the function used to resolve the tenant of alarms from
+// their originators. Alarms raised by originators without tenant keep the
+// tenant set by the client.
+func (mgr *Manager) SetTenantFunc(f TenantFunc) {
+	mgr.tenants = f
+}
+
+// UpsertTenant raises the alarm in the tenant, or behaves like Upsert if
+// the tenant is empty. The alarm can't be raised on originators of other
+// tenants, and existing alarms of other tenants can't be overwritten.
+func (mgr *Manager) UpsertTenant(tenant string, alarm *Alarm) error {
+	if tenant != "" {
+		if mgr.tenants != nil {
+			t, err := mgr.tenants(alarm.Originator)
+			if err != nil {
+				return err
+			}
+			if t != "" && t != tenant {
+				return NotFoundError(alarm.Originator)
+			}
+		}
+		existing, err := mgr.FindName(alarm.Name, alarm.Originator)
+		if err == nil && existing.Tenant != tenant {
+			return NotFoundError(alarm.Name)
+		}
+		if _, ok := err.(NotFoundError); err != nil && !ok {
+			return err
+		}
+		alarm.Tenant = tenant
+	}
+	return mgr.Upsert(alarm)
+}
+
+// CheckTenant returns NotFoundError if the alarm doesn't belong to the
+// tenant. All alarms are accessible if the tenant is empty.
+func (mgr *Manager) CheckTenant(id, tenant string) error {
+	if tenant == "" {
+		return nil
+	}
+	alarm, err := mgr.Find(id)
+	if err == nil && alarm.Tenant != tenant {
+		err = NotFoundError(id)
+	}
+	return err
+}
+
+// CheckTenantName is like CheckTenant but identifies the alarm by name and
+// originator.
+func (mgr *Manager) CheckTenantName(name, originator, tenant string) error {
+	if tenant == "" {
+		return nil
+	}
+	alarm, err := mgr.FindName(name, originator)
+	if err == nil && alarm.Tenant != tenant {
+		err = NotFoundError(name)
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+
+	"github.com/redhill42/iota/api/types"
+)
+
+func (api *APIClient) GetAPIKeys(ctx context.Context, tenant string) ([]*types.APIKey, error) {
+	var query url.Values
+	if tenant != "" {
+		query = url.Values{"tenant": []string{tenant}}
+	}
+
+	var keys []*types.APIKey
+	resp, err := api.Get(ctx, "/apikeys", query, nil)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&keys)
+		resp.EnsureClosed()
+	}
+	return keys, err
+}
+
+// CreateAPIKey creates an API key and returns the key, which can't be
+// retrieved again.
+func (api *APIClient) CreateAPIKey(ctx context.Context, key *types.APIKey) (*types.APIKeyCreated, error) {
+	var created types.APIKeyCreated
+	resp, err := api.Post(ctx, "/apikeys", nil, key, nil)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&created)
+		resp.EnsureClosed()
+	}
+	return &created, err
+}
+
+func (api *APIClient) RevokeAPIKey(ctx context.Context, name string) error {
+	resp, err := api.Delete(ctx, "/apikeys/"+name, nil, nil)
+	if err == nil {
+		resp.EnsureClosed()
+	}
+	return err
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"net/http"
+
 	"github.com/redhill42/iota/api/types"
 )
 
-func (api *APIClient) Authenticate(ctx context.Context, username, password string) (token string, err error) {
+func (api *APIClient) Authenticate(ctx context.Context, username, password string) (*types.Token, error) {
 	var v types.Token
 
 	auth := string(base64.StdEncoding.EncodeToString([]byte(username + ":" + password)))
@@ -17,7 +20,81 @@ func (api *APIClient) Authenticate(ctx context.Context, username, password strin
 		err = json.NewDecoder(resp.Body).Decode(&v)
 		resp.EnsureClosed()
 	}
-	return v.Token, err
+	return &v, err
+}
+
+// AuthenticateTOTP completes a login challenged for a second factor with
+// the TOTP code or a recovery code.
+func (api *APIClient) AuthenticateTOTP(ctx context.Context, challenge, code string) (*types.Token, error) {
+	var v types.Token
+
+	req := types.SecondFactorRequest{Challenge: challenge, Code: code}
+	resp, err := api.Post(ctx, "/auth/totp", nil, &req, nil)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&v)
+		resp.EnsureClosed()
+	}
+	return &v, err
+}
+
+// RefreshToken obtains a new access token and refresh token with the
+// refresh token returned from login.
+func (api *APIClient) RefreshToken(ctx context.Context, refreshToken string) (*types.Token, error) {
+	var v types.Token
+
+	req := types.RefreshRequest{RefreshToken: refreshToken}
+	resp, err := api.Post(ctx, "/auth/refresh", nil, &req, nil)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&v)
+		resp.EnsureClosed()
+	}
+	return &v, err
+}
+
+// Logout revokes the login session of the refresh token, or all login
+// sessions of the user if all is true.
+func (api *APIClient) Logout(ctx context.Context, refreshToken string, all bool) error {
+	req := types.RefreshRequest{RefreshToken: refreshToken, All: all}
+	resp, err := api.Post(ctx, "/auth/logout", nil, &req, nil)
+	if err == nil {
+		resp.EnsureClosed()
+	}
+	return err
+}
+
+// ErrLoginPending is returned by DeviceToken until the user approves the
+// device login.
+var ErrLoginPending = errors.New("Login pending")
+
+// LoginDevice starts a device login with the identity provider of the
+// server.
+func (api *APIClient) LoginDevice(ctx context.Context) (*types.DeviceLogin, error) {
+	var v types.DeviceLogin
+
+	resp, err := api.Post(ctx, "/auth/oidc/device", nil, nil, nil)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&v)
+		resp.EnsureClosed()
+	}
+	return &v, err
+}
+
+// DeviceToken obtains tokens of the device login after the user approved
+// the login. ErrLoginPending is returned if the login is not yet approved.
+func (api *APIClient) DeviceToken(ctx context.Context, deviceCode string) (*types.Token, error) {
+	var v types.Token
+
+	req := types.DeviceTokenRequest{DeviceCode: deviceCode}
+	resp, err := api.Post(ctx, "/auth/oidc/token", nil, &req, nil)
+	if err == nil {
+		if resp.StatusCode == http.StatusAccepted {
+			err = ErrLoginPending
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&v)
+		}
+		resp.EnsureClosed()
+	}
+	return &v, err
 }
 
 func (api *APIClient) SetToken(token string) {
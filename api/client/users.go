@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+
+	"github.com/redhill42/iota/api/types"
+)
+
+func (api *APIClient) GetUsers(ctx context.Context, tenant string) ([]*types.User, error) {
+	var query url.Values
+	if tenant != "" {
+		query = url.Values{"tenant": []string{tenant}}
+	}
+
+	var users []*types.User
+	resp, err := api.Get(ctx, "/users", query, nil)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&users)
+		resp.EnsureClosed()
+	}
+	return users, err
+}
+
+func (api *APIClient) GetUser(ctx context.Context, name string) (*types.User, error) {
+	var user types.User
+	resp, err := api.Get(ctx, "/users/"+name, nil, nil)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&user)
+		resp.EnsureClosed()
+	}
+	return &user, err
+}
+
+func (api *APIClient) CreateUser(ctx context.Context, user *types.UserCreate) error {
+	resp, err := api.Post(ctx, "/users", nil, user, nil)
+	if err == nil {
+		resp.EnsureClosed()
+	}
+	return err
+}
+
+func (api *APIClient) UpdateUser(ctx context.Context, name string, updates map[string]interface{}) error {
+	resp, err := api.Put(ctx, "/users/"+name, nil, updates, nil)
+	if err == nil {
+		resp.EnsureClosed()
+	}
+	return err
+}
+
+func (api *APIClient) DeleteUser(ctx context.Context, name string) error {
+	resp, err := api.Delete(ctx, "/users/"+name, nil, nil)
+	if err == nil {
+		resp.EnsureClosed()
+	}
+	return err
+}
+
+func (api *APIClient) EnableUser(ctx context.Context, name string, enable bool) error {
+	action := "/disable"
+	if enable {
+		action = "/enable"
+	}
+	resp, err := api.Post(ctx, "/users/"+name+action, nil, nil, nil)
+	if err == nil {
+		resp.EnsureClosed()
+	}
+	return err
+}
+
+func (api *APIClient) ChangePassword(ctx context.Context, name, oldPassword, newPassword string) error {
+	req := types.PasswordChange{OldPassword: oldPassword, Password: newPassword}
+	resp, err := api.Post(ctx, "/users/"+name+"/password", nil, req, nil)
+	if err == nil {
+		resp.EnsureClosed()
+	}
+	return err
+}
+
+// RevokeSessions logs out the user from all login sessions.
+func (api *APIClient) RevokeSessions(ctx context.Context, name string) error {
+	resp, err := api.Delete(ctx, "/users/"+name+"/sessions", nil, nil)
+	if err == nil {
+		resp.EnsureClosed()
+	}
+	return err
+}
+
+// GetLogins returns login events of the user, or login events of all users
+// managed by the current user if the name is empty. The query selects the
+// events by "user", "ip", "result", "since" and "limit".
+func (api *APIClient) GetLogins(ctx context.Context, name string, query url.Values) ([]*types.LoginEvent, error) {
+	path := "/logins"
+	if name != "" {
+		path = "/users/" + name + "/logins"
+	}
+
+	var events []*types.LoginEvent
+	resp, err := api.Get(ctx, path, query, nil)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&events)
+		resp.EnsureClosed()
+	}
+	return events, err
+}
+
+// EnrollTOTP starts a TOTP enrollment of the user, which is enabled when
+// confirmed by ConfirmTOTP.
+func (api *APIClient) EnrollTOTP(ctx context.Context, name string) (*types.TOTPEnrollment, error) {
+	var enroll types.TOTPEnrollment
+	resp, err := api.Post(ctx, "/users/"+name+"/totp", nil, nil, nil)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&enroll)
+		resp.EnsureClosed()
+	}
+	return &enroll, err
+}
+
+// ConfirmTOTP enables the second factor of the user with a code of the
+// enrollment, and returns the recovery codes.
+func (api *APIClient) ConfirmTOTP(ctx context.Context, name, code string) ([]string, error) {
+	var codes types.RecoveryCodes
+	resp, err := api.Post(ctx, "/users/"+name+"/totp/confirm", nil, types.TOTPConfirm{Code: code}, nil)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&codes)
+		resp.EnsureClosed()
+	}
+	return codes.RecoveryCodes, err
+}
+
+// DisableTOTP disables the second factor of the user. The code is a
+// current code or a recovery code of the logged in user, it's not
+// required to disable the second factor of other users.
+func (api *APIClient) DisableTOTP(ctx context.Context, name, code string) error {
+	var req interface{}
+	if code != "" {
+		req = types.TOTPConfirm{Code: code}
+	}
+	resp, err := api.DeleteWithBody(ctx, "/users/"+name+"/totp", nil, req, nil)
+	if err == nil {
+		resp.EnsureClosed()
+	}
+	return err
+}
@@ -1,12 +1,18 @@
 package server
 
 import (
+	"net/http"
+
 	"github.com/redhill42/iota/agent"
+	"github.com/redhill42/iota/api/server/httputils"
 	"github.com/redhill42/iota/api/server/middleware"
 	"github.com/redhill42/iota/api/server/router/alarms"
+	"github.com/redhill42/iota/api/server/router/apikeys"
 	"github.com/redhill42/iota/api/server/router/devices"
 	"github.com/redhill42/iota/api/server/router/jsonrpc"
 	"github.com/redhill42/iota/api/server/router/system"
+	"github.com/redhill42/iota/api/server/router/users"
+	"github.com/redhill42/iota/auth/jwks"
 )
 
 const _CONTEXT_ROOT = "/api"
@@ -24,10 +30,24 @@ func NewAPIServer(agent *agent.Agent) (api *Server, err error) {
 		jsonrpc.NewRouter(agent),
 		devices.NewRouter(agent),
 		alarms.NewRouter(agent),
+		users.NewRouter(agent),
+		apikeys.NewRouter(agent),
 	)
 
+	// Publish public keys for external services to verify tokens.
+	api.Mux.Path("/.well-known/jwks.json").Methods("GET").HandlerFunc(jwksHandler(agent))
+
 	// Forward MQTT request to API server.
 	err = agent.MQTTBroker.Forward(api.Mux)
 
 	return api, err
 }
+
+// jwksHandler returns the public keys that verify user and device tokens.
+func jwksHandler(agent *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys := append(agent.Authz.Keys().PublicKeys(), agent.DeviceManager.Keys().PublicKeys()...)
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		httputils.WriteJSON(w, http.StatusOK, jwks.JSONWebKeySet{Keys: keys})
+	}
+}
@@ -22,6 +22,10 @@ const APIVersionKey key = 0
 // UserKey is the key for userdb.User values in contexts.
 const UserKey key = 1
 
+// ForwardedKey is the key in contexts of requests forwarded from MQTT or
+// CoAP messages.
+const ForwardedKey key = 2
+
 // APIFunc is an adapter to allow the use of ordinary functions as API endpoints.
 // Any function that has the appropriate signature can be registered as an API endpoint.
 type APIFunc func(w http.ResponseWriter, r *http.Request, vars map[string]string) error
@@ -109,3 +113,31 @@ func UserFromContext(ctx context.Context) (user *userdb.BasicUser) {
 	}
 	return val.(*userdb.BasicUser)
 }
+
+// TenantFromContext returns the tenant of the authenticated user, which is
+// empty for system users.
+func TenantFromContext(ctx context.Context) string {
+	if user := UserFromContext(ctx); user != nil {
+		return user.Tenant
+	}
+	return ""
+}
+
+// IsForwarded returns true if the request is forwarded from an MQTT or
+// CoAP message. Forwarded requests are served by a bounded pool of workers
+// and must not be held.
+func IsForwarded(ctx context.Context) bool {
+	forwarded, _ := ctx.Value(ForwardedKey).(bool)
+	return forwarded
+}
+
+// RequirePermission wraps the handler to reject requests of users that
+// don't have the permission.
+func RequirePermission(perm string, handler APIFunc) APIFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		if user := UserFromContext(r.Context()); user == nil || !user.HasPermission(perm) {
+			return userdb.PermissionDeniedError(perm)
+		}
+		return handler(w, r, vars)
+	}
+}
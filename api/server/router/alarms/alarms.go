@@ -8,6 +8,7 @@ import (
 	"github.com/redhill42/iota/api/server/httputils"
 	"github.com/redhill42/iota/api/server/router"
 	"github.com/redhill42/iota/api/server/websocket"
+	"github.com/redhill42/iota/auth/userdb"
 )
 
 const alarmPath = "/alarms/{id:[0-9a-f]+}"
@@ -27,18 +28,18 @@ func NewRouter(agent *agent.Agent) router.Router {
 
 	r := &alarmsRouter{Agent: agent, hub: h}
 	r.routes = []router.Route{
-		router.NewGetRoute("/alarms", r.list),
-		router.NewPostRoute("/alarms", r.upsert),
-		router.NewGetRoute(alarmPath, r.read),
-		router.NewDeleteRoute(alarmPath, r.delete),
-		router.NewPostRoute(alarmPath+"/clear", r.clear),
+		router.NewGetRoute("/alarms", httputils.RequirePermission(userdb.AlarmRead, r.list)),
+		router.NewPostRoute("/alarms", httputils.RequirePermission(userdb.AlarmWrite, r.upsert)),
+		router.NewGetRoute(alarmPath, httputils.RequirePermission(userdb.AlarmRead, r.read)),
+		router.NewDeleteRoute(alarmPath, httputils.RequirePermission(userdb.AlarmWrite, r.delete)),
+		router.NewPostRoute(alarmPath+"/clear", httputils.RequirePermission(userdb.AlarmWrite, r.clear)),
 
 		router.NewPostRoute("/me/alarm", r.upsertMe),
 		router.NewGetRoute("/me/alarm/{name:[^/]+}", r.readMe),
 		router.NewDeleteRoute("/me/alarm/{name:[^/]+}", r.deleteMe),
 		router.NewPostRoute("/me/alarm/{name:[^/]+}/clear", r.clearMe),
 
-		router.NewGetRoute("/alarms/{id:[0-9a-f]+|\\+}/subscribe", r.subscribe),
+		router.NewGetRoute("/alarms/{id:[0-9a-f]+|\\+}/subscribe", httputils.RequirePermission(userdb.AlarmRead, r.subscribe)),
 	}
 	return r
 }
@@ -47,8 +48,22 @@ func (ar *alarmsRouter) Routes() []router.Route {
 	return ar.routes
 }
 
+// checkTenant returns NotFoundError if the alarm doesn't belong to the
+// tenant of the user.
+func (ar *alarmsRouter) checkTenant(r *http.Request, id string) error {
+	return ar.AlarmManager.CheckTenant(id, httputils.TenantFromContext(r.Context()))
+}
+
 func (ar *alarmsRouter) list(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
-	result, err := ar.AlarmManager.FindAll()
+	var result []*alarm.Alarm
+	var err error
+
+	tenant := httputils.TenantFromContext(r.Context())
+	if entity := r.FormValue("entity"); entity != "" {
+		result, err = ar.AlarmManager.FindEntity(tenant, entity)
+	} else {
+		result, err = ar.AlarmManager.FindAll(tenant)
+	}
 	if err != nil {
 		return err
 	}
@@ -60,7 +75,7 @@ func (ar *alarmsRouter) upsert(w http.ResponseWriter, r *http.Request, vars map[
 	if err = httputils.ReadJSON(r, &rec); err != nil {
 		return err
 	}
-	if err = ar.AlarmManager.Upsert(&rec); err != nil {
+	if err = ar.AlarmManager.UpsertTenant(httputils.TenantFromContext(r.Context()), &rec); err != nil {
 		return err
 	}
 	w.Header().Set("Location", r.RequestURI+"/"+rec.ID)
@@ -85,6 +100,9 @@ func (ar *alarmsRouter) read(w http.ResponseWriter, r *http.Request, vars map[st
 	if err != nil {
 		return err
 	}
+	if tenant := httputils.TenantFromContext(r.Context()); tenant != "" && rec.Tenant != tenant {
+		return alarm.NotFoundError(vars["id"])
+	}
 	return httputils.WriteJSON(w, http.StatusOK, &rec)
 }
 
@@ -97,6 +115,9 @@ func (ar *alarmsRouter) readMe(w http.ResponseWriter, r *http.Request, vars map[
 }
 
 func (ar *alarmsRouter) delete(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := ar.checkTenant(r, vars["id"]); err != nil {
+		return err
+	}
 	if err := ar.AlarmManager.Delete(vars["id"]); err != nil {
 		return err
 	} else {
@@ -115,6 +136,9 @@ func (ar *alarmsRouter) deleteMe(w http.ResponseWriter, r *http.Request, vars ma
 }
 
 func (ar *alarmsRouter) clear(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := ar.checkTenant(r, vars["id"]); err != nil {
+		return err
+	}
 	if err := ar.AlarmManager.Clear(vars["id"]); err != nil {
 		return err
 	} else {
@@ -133,5 +157,10 @@ func (ar *alarmsRouter) clearMe(w http.ResponseWriter, r *http.Request, vars map
 }
 
 func (ar *alarmsRouter) subscribe(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars["id"] != "+" {
+		if err := ar.checkTenant(r, vars["id"]); err != nil {
+			return err
+		}
+	}
 	return ar.hub.ServeWS(w, r, vars["id"])
 }
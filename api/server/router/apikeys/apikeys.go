@@ -0,0 +1,119 @@
+package apikeys
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/redhill42/iota/agent"
+	"github.com/redhill42/iota/api/server/httputils"
+	"github.com/redhill42/iota/api/server/router"
+	"github.com/redhill42/iota/api/types"
+	"github.com/redhill42/iota/auth/userdb"
+)
+
+const keyPath = "/apikeys/{name:[^/]+}"
+
+type apikeysRouter struct {
+	*agent.Agent
+	routes []router.Route
+}
+
+func NewRouter(agent *agent.Agent) router.Router {
+	r := &apikeysRouter{Agent: agent}
+	r.routes = []router.Route{
+		router.NewGetRoute("/apikeys", httputils.RequirePermission(userdb.UserManage, r.list)),
+		router.NewPostRoute("/apikeys", httputils.RequirePermission(userdb.UserManage, r.create)),
+		router.NewGetRoute(keyPath, httputils.RequirePermission(userdb.UserManage, r.read)),
+		router.NewDeleteRoute(keyPath, httputils.RequirePermission(userdb.UserManage, r.revoke)),
+	}
+	return r
+}
+
+func (kr *apikeysRouter) Routes() []router.Route {
+	return kr.routes
+}
+
+// keyInfo returns the information of an API key without the key hash.
+func keyInfo(key *userdb.APIKey) *types.APIKey {
+	info := &types.APIKey{
+		Name:       key.Name,
+		Account:    key.Account,
+		Role:       key.Role,
+		Tenant:     key.Tenant,
+		AllowedIPs: key.AllowedIPs,
+		CreatedBy:  key.CreatedBy,
+	}
+	if !key.Expires.IsZero() {
+		info.Expires = &key.Expires
+	}
+	if !key.Created.IsZero() {
+		info.Created = &key.Created
+	}
+	return info
+}
+
+// list returns API keys of the tenant of the admin. System users may
+// select API keys of a tenant with the "tenant" parameter.
+func (kr *apikeysRouter) list(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	tenant := httputils.TenantFromContext(r.Context())
+	if tenant == "" {
+		tenant = r.FormValue("tenant")
+	}
+
+	keys, err := kr.Users.ListAPIKeys(tenant)
+	if err != nil {
+		return err
+	}
+	result := make([]*types.APIKey, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, keyInfo(key))
+	}
+	return httputils.WriteJSON(w, http.StatusOK, result)
+}
+
+func (kr *apikeysRouter) create(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	var req types.APIKey
+	if err := httputils.ReadJSON(r, &req); err != nil {
+		return err
+	}
+
+	key := &userdb.APIKey{
+		Name:       req.Name,
+		Account:    req.Account,
+		Role:       req.Role,
+		Tenant:     req.Tenant,
+		AllowedIPs: req.AllowedIPs,
+	}
+	if req.Expires != nil {
+		key.Expires = req.Expires.UTC()
+		if !key.Expires.After(time.Now()) {
+			return userdb.InvalidArgumentError("Expiration time must be in the future")
+		}
+	}
+
+	admin := httputils.UserFromContext(r.Context())
+	secret, err := kr.Users.CreateAPIKey(admin, key)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Location", r.RequestURI+"/"+key.Name)
+	return httputils.WriteJSON(w, http.StatusCreated, types.APIKeyCreated{APIKey: *keyInfo(key), Key: secret})
+}
+
+func (kr *apikeysRouter) read(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	admin := httputils.UserFromContext(r.Context())
+	key, err := kr.Users.FindManagedAPIKey(admin, vars["name"])
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, keyInfo(key))
+}
+
+func (kr *apikeysRouter) revoke(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	admin := httputils.UserFromContext(r.Context())
+	if err := kr.Authz.RevokeAPIKey(admin, vars["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -1,15 +1,19 @@
 package devices
 
 import (
+	"errors"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/redhill42/iota/agent"
 	"github.com/redhill42/iota/api/server/httputils"
 	"github.com/redhill42/iota/api/server/router"
 	"github.com/redhill42/iota/api/server/websocket"
 	"github.com/redhill42/iota/api/types"
+	"github.com/redhill42/iota/auth/userdb"
 	"github.com/redhill42/iota/device"
 )
 
@@ -26,28 +30,33 @@ func NewRouter(agent *agent.Agent) router.Router {
 	h := websocket.NewHub()
 	go h.Run()
 	agent.DeviceManager.OnUpdate(func(rec device.Record) {
-		h.Updates() <- rec
+		tenant, _ := agent.DeviceManager.GetTenant(rec.GetID())
+		h.Updates() <- tenantRecord{rec, tenant}
 	})
 
 	r := &devicesRouter{Agent: agent, hub: h}
 	r.routes = []router.Route{
-		router.NewGetRoute("/devices", r.list),
-		router.NewPostRoute("/devices", r.create),
-		router.NewGetRoute(devicePath, r.read),
-		router.NewPutRoute(devicePath, r.update),
-		router.NewDeleteRoute(devicePath, r.delete),
-		router.NewPostRoute(devicePath+"/rpc", r.rpc),
+		router.NewGetRoute("/devices", httputils.RequirePermission(userdb.DeviceRead, r.list)),
+		router.NewPostRoute("/devices", httputils.RequirePermission(userdb.DeviceWrite, r.create)),
+		router.NewGetRoute(devicePath, httputils.RequirePermission(userdb.DeviceRead, r.read)),
+		router.NewPutRoute(devicePath, httputils.RequirePermission(userdb.DeviceWrite, r.update)),
+		router.NewDeleteRoute(devicePath, httputils.RequirePermission(userdb.DeviceDelete, r.delete)),
+		router.NewPostRoute(devicePath+"/rpc", httputils.RequirePermission(userdb.DeviceWrite, r.rpc)),
 
-		router.NewGetRoute(devicePath+"/subscribe", r.subscribe),
+		router.NewGetRoute(devicePath+"/subscribe", httputils.RequirePermission(userdb.DeviceRead, r.subscribe)),
 
-		router.NewGetRoute("/claims", r.getClaims),
-		router.NewPostRoute(claimPath+"/approve", r.approve),
-		router.NewPostRoute(claimPath+"/reject", r.reject),
+		router.NewGetRoute("/claims", httputils.RequirePermission(userdb.DeviceRead, r.getClaims)),
+		router.NewPostRoute(claimPath+"/approve", httputils.RequirePermission(userdb.DeviceApprove, r.approve)),
+		router.NewPostRoute(claimPath+"/reject", httputils.RequirePermission(userdb.DeviceApprove, r.reject)),
 
 		router.NewPostRoute("/me/claim", r.claim),
 		router.NewGetRoute("/me/attributes", r.read),
 		router.NewPostRoute("/me/attributes", r.update),
 		router.NewPostRoute("/me/measurement", r.measurement),
+
+		router.NewGetRoute("/me/rpc", r.pollRPC),
+		router.NewPostRoute("/me/rpc/{requestId:[^/]+}", r.replyRPC),
+		router.NewGetRoute("/me/attributes/updates", r.pollUpdates),
 	}
 	return r
 }
@@ -56,12 +65,28 @@ func (dr *devicesRouter) Routes() []router.Route {
 	return dr.routes
 }
 
+// tenantRecord delivers device updates to subscribers of the device tenant.
+type tenantRecord struct {
+	device.Record
+	tenant string
+}
+
+func (r tenantRecord) GetTenant() string {
+	return r.tenant
+}
+
+// checkTenant returns DeviceNotFoundError if the device doesn't belong to
+// the tenant of the user.
+func (dr *devicesRouter) checkTenant(r *http.Request, id string) error {
+	return dr.DeviceManager.CheckTenant(id, httputils.TenantFromContext(r.Context()))
+}
+
 func (dr *devicesRouter) list(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	var keys []string
 	if r.FormValue("keys") != "" {
 		keys = strings.Split(r.FormValue("keys"), ",")
 	}
-	result, err := dr.DeviceManager.FindAll(keys)
+	result, err := dr.DeviceManager.FindAll(httputils.TenantFromContext(r.Context()), keys)
 	if err != nil {
 		return err
 	}
@@ -83,6 +108,9 @@ func (dr *devicesRouter) create(w http.ResponseWriter, r *http.Request, vars map
 		http.Error(w, "Missing \"id\" attribute", http.StatusBadRequest)
 		return nil
 	}
+	if tenant := httputils.TenantFromContext(r.Context()); tenant != "" {
+		req["tenant"] = tenant
+	}
 	if token, err = dr.DeviceManager.CreateToken(id); err != nil {
 		return err
 	}
@@ -98,6 +126,9 @@ func (dr *devicesRouter) read(w http.ResponseWriter, r *http.Request, vars map[s
 	if r.FormValue("keys") != "" {
 		keys = strings.Split(r.FormValue("keys"), ",")
 	}
+	if err := dr.checkTenant(r, vars["id"]); err != nil {
+		return err
+	}
 	info, err := dr.DeviceManager.Find(vars["id"], keys)
 	if err != nil {
 		return err
@@ -110,9 +141,21 @@ func (dr *devicesRouter) update(w http.ResponseWriter, r *http.Request, vars map
 		req device.Record
 		err error
 	)
+	if err = dr.checkTenant(r, vars["id"]); err != nil {
+		return err
+	}
 	if err = httputils.ReadJSON(r, &req); err != nil {
 		return err
 	}
+
+	// Only system users can move devices between tenants
+	user := httputils.UserFromContext(r.Context())
+	if tenant, ok := req["tenant"]; ok && user != nil && user.Tenant == "" {
+		t, _ := tenant.(string)
+		if err = dr.DeviceManager.SetTenant(vars["id"], t); err != nil {
+			return err
+		}
+	}
 	if err = dr.DeviceManager.Update(vars["id"], req); err != nil {
 		return err
 	} else {
@@ -122,6 +165,9 @@ func (dr *devicesRouter) update(w http.ResponseWriter, r *http.Request, vars map
 }
 
 func (dr *devicesRouter) delete(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := dr.checkTenant(r, vars["id"]); err != nil {
+		return err
+	}
 	if err := dr.DeviceManager.Remove(vars["id"]); err != nil {
 		return err
 	} else {
@@ -131,6 +177,9 @@ func (dr *devicesRouter) delete(w http.ResponseWriter, r *http.Request, vars map
 }
 
 func (dr *devicesRouter) rpc(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := dr.checkTenant(r, vars["id"]); err != nil {
+		return err
+	}
 	req, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return err
@@ -148,7 +197,100 @@ func (dr *devicesRouter) rpc(w http.ResponseWriter, r *http.Request, vars map[st
 	return err
 }
 
+// Long polling timeouts, devices should poll again before HTTP proxies time
+// out idle connections.
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 2 * time.Minute
+)
+
+// pollTimeout parses the "timeout" parameter of a long polling request,
+// which is a duration such as "30s" or the number of seconds. Requests
+// forwarded from MQTT or CoAP messages never wait, so that they can't hold
+// the workers of other devices.
+func pollTimeout(r *http.Request) (time.Duration, error) {
+	if httputils.IsForwarded(r.Context()) {
+		return 0, nil
+	}
+
+	s := r.FormValue("timeout")
+	if s == "" {
+		return defaultPollTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(s)
+	if err != nil {
+		secs, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, httputils.NewStatusError(http.StatusBadRequest, errors.New("Invalid timeout: "+s))
+		}
+		timeout = time.Duration(secs) * time.Second
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	if timeout > maxPollTimeout {
+		timeout = maxPollTimeout
+	}
+	return timeout, nil
+}
+
+// pollRPC delivers RPC requests to devices that can't subscribe to MQTT
+// topics. It waits until requests arrive or timeout, and replies 204 No
+// Content if no request arrived.
+func (dr *devicesRouter) pollRPC(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	timeout, err := pollTimeout(r)
+	if err != nil {
+		return err
+	}
+	requests, err := dr.DeviceManager.PollRPC(r.Context(), vars["id"], timeout)
+	if err != nil {
+		return err
+	}
+	if len(requests) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return httputils.WriteJSON(w, http.StatusOK, requests)
+}
+
+func (dr *devicesRouter) replyRPC(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	resp, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if err = dr.DeviceManager.ReplyRPC(vars["id"], vars["requestId"], resp); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// pollUpdates delivers attribute updates to devices that can't subscribe
+// to MQTT topics. It waits until updates arrive or timeout, and replies
+// 204 No Content if no update arrived.
+func (dr *devicesRouter) pollUpdates(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	timeout, err := pollTimeout(r)
+	if err != nil {
+		return err
+	}
+	updates, err := dr.DeviceManager.PollUpdates(r.Context(), vars["id"], timeout)
+	if err != nil {
+		return err
+	}
+	if updates == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return httputils.WriteJSON(w, http.StatusOK, updates)
+}
+
 func (dr *devicesRouter) subscribe(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars["id"] != "+" {
+		if err := dr.checkTenant(r, vars["id"]); err != nil {
+			return err
+		}
+	}
 	return dr.hub.ServeWS(w, r, vars["id"])
 }
 
@@ -158,9 +300,12 @@ func (dr *devicesRouter) measurement(w http.ResponseWriter, r *http.Request, var
 		return err
 	}
 
-	// Add device id tag
+	// Add device id and tenant tags
 	record := strings.Split(string(body), " ")
 	record[0] += ",device=" + vars["id"]
+	if tenant, err := dr.DeviceManager.GetTenant(vars["id"]); err == nil && tenant != "" {
+		record[0] += ",tenant=" + tenant
+	}
 
 	// Write record to time series database
 	dr.TSDB.WriteRecord(strings.Join(record, " "))
@@ -192,7 +337,10 @@ func (dr *devicesRouter) claim(w http.ResponseWriter, r *http.Request, vars map[
 }
 
 func (dr *devicesRouter) getClaims(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
-	claims := dr.DeviceManager.GetClaims()
+	claims, err := dr.DeviceManager.GetClaims(httputils.TenantFromContext(r.Context()))
+	if err != nil {
+		return err
+	}
 	return httputils.WriteJSON(w, http.StatusOK, claims)
 }
 
@@ -203,7 +351,7 @@ func (dr *devicesRouter) approve(w http.ResponseWriter, r *http.Request, vars ma
 	if err := httputils.ReadJSON(r, &updates); err != nil {
 		return err
 	}
-	if token, err := dr.DeviceManager.Approve(id, updates); err != nil {
+	if token, err := dr.DeviceManager.Approve(httputils.TenantFromContext(r.Context()), id, updates); err != nil {
 		return err
 	} else {
 		return httputils.WriteJSON(w, http.StatusOK, types.Token{Token: token})
@@ -211,7 +359,7 @@ func (dr *devicesRouter) approve(w http.ResponseWriter, r *http.Request, vars ma
 }
 
 func (dr *devicesRouter) reject(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
-	if err := dr.DeviceManager.Reject(vars["id"]); err != nil {
+	if err := dr.DeviceManager.Reject(httputils.TenantFromContext(r.Context()), vars["id"]); err != nil {
 		return err
 	} else {
 		w.WriteHeader(http.StatusNoContent)
@@ -2,10 +2,12 @@ package devices_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"os"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -14,9 +16,12 @@ import (
 	"github.com/redhill42/iota/agent"
 	"github.com/redhill42/iota/api/server"
 	"github.com/redhill42/iota/api/server/httputils"
+	"github.com/redhill42/iota/api/server/middleware"
 	"github.com/redhill42/iota/api/server/router/devices"
 	"github.com/redhill42/iota/api/types"
+	"github.com/redhill42/iota/auth/userdb"
 	"github.com/redhill42/iota/device"
+	"github.com/redhill42/iota/mqtt"
 )
 
 func TestDevicesRouter(t *testing.T) {
@@ -103,6 +108,10 @@ var _ = Describe("DevicesRouter", func() {
 			return err
 		}
 
+		// Requests are sent on behalf of an administrator
+		admin := &userdb.BasicUser{Name: "admin", Roles: []string{userdb.RoleAdmin}}
+		r = r.WithContext(context.WithValue(r.Context(), httputils.UserKey, admin))
+
 		w := fakeWriter{}
 		mux.ServeHTTP(&w, r)
 
@@ -262,4 +271,201 @@ var _ = Describe("DevicesRouter", func() {
 			Expect(err).To(MatchError(device.DeviceNotFoundError(deviceId)))
 		})
 	})
+
+	Describe("Permissions", func() {
+		requestAs := func(role, method, path string) int {
+			r, err := http.NewRequest(method, path, nil)
+			Expect(err).NotTo(HaveOccurred())
+			user := &userdb.BasicUser{Name: role, Roles: []string{role}}
+			r = r.WithContext(context.WithValue(r.Context(), httputils.UserKey, user))
+			w := fakeWriter{}
+			mux.ServeHTTP(&w, r)
+			return w.statusCode
+		}
+
+		It("should allow viewers to read devices", func() {
+			deviceId := "permission-test"
+			_, err := createDevice(deviceId, nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer deleteDevice(deviceId)
+
+			Expect(requestAs(userdb.RoleViewer, "GET", "/devices/"+deviceId)).To(Equal(http.StatusOK))
+			Expect(requestAs(userdb.RoleViewer, "DELETE", "/devices/"+deviceId)).To(Equal(http.StatusForbidden))
+			Expect(requestAs(userdb.RoleOperator, "DELETE", "/devices/"+deviceId)).To(Equal(http.StatusForbidden))
+			Expect(requestAs(userdb.RoleViewer, "POST", "/claims/abc/approve")).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Describe("Tenants", func() {
+		requestAs := func(tenant, method, path string, req interface{}) *fakeWriter {
+			var body bytes.Buffer
+			if req != nil {
+				Expect(json.NewEncoder(&body).Encode(req)).To(Succeed())
+			}
+			r, err := http.NewRequest(method, path, &body)
+			Expect(err).NotTo(HaveOccurred())
+			r.Header.Set("Content-Type", "application/json")
+			user := &userdb.BasicUser{Name: tenant, Roles: []string{userdb.RoleAdmin}, Tenant: tenant}
+			r = r.WithContext(context.WithValue(r.Context(), httputils.UserKey, user))
+			w := &fakeWriter{}
+			mux.ServeHTTP(w, r)
+			return w
+		}
+
+		It("should hide devices of other tenants", func() {
+			deviceId := "tenant-test"
+			_, err := createDevice(deviceId, map[string]interface{}{"tenant": "acme"})
+			Expect(err).NotTo(HaveOccurred())
+			defer deleteDevice(deviceId)
+
+			info, err := getDevice(deviceId)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info).To(HaveKeyWithValue("tenant", "acme"))
+
+			Expect(requestAs("acme", "GET", "/devices/"+deviceId, nil).statusCode).To(Equal(http.StatusOK))
+			Expect(requestAs("other", "GET", "/devices/"+deviceId, nil).statusCode).To(Equal(http.StatusNotFound))
+			Expect(requestAs("other", "DELETE", "/devices/"+deviceId, nil).statusCode).To(Equal(http.StatusNotFound))
+
+			var list []map[string]interface{}
+			w := requestAs("other", "GET", "/devices", nil)
+			Expect(json.Unmarshal(w.body.Bytes(), &list)).To(Succeed())
+			for _, d := range list {
+				Expect(d["id"]).NotTo(Equal(deviceId))
+			}
+		})
+
+		It("should create devices in the tenant of the user", func() {
+			deviceId := "tenant-create-test"
+			w := requestAs("acme", "POST", "/devices", map[string]interface{}{"id": deviceId, "tenant": "other"})
+			Expect(w.statusCode).To(Equal(http.StatusCreated))
+			defer deleteDevice(deviceId)
+
+			info, err := getDevice(deviceId)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info).To(HaveKeyWithValue("tenant", "acme"))
+		})
+
+		It("should only allow system users to move devices", func() {
+			deviceId := "tenant-move-test"
+			_, err := createDevice(deviceId, map[string]interface{}{"tenant": "acme"})
+			Expect(err).NotTo(HaveOccurred())
+			defer deleteDevice(deviceId)
+
+			w := requestAs("acme", "PUT", "/devices/"+deviceId, map[string]interface{}{"tenant": "other"})
+			Expect(w.statusCode).To(Equal(http.StatusNoContent))
+			Expect(getDevice(deviceId)).To(HaveKeyWithValue("tenant", "acme"))
+
+			Expect(updateDevice(deviceId, map[string]interface{}{"tenant": "other"})).To(Succeed())
+			Expect(getDevice(deviceId)).To(HaveKeyWithValue("tenant", "other"))
+		})
+	})
+})
+
+var _ = Describe("Long polling", func() {
+	const deviceId = "long-polling-test"
+
+	var (
+		broker *mqtt.Broker
+		mgr    *device.Manager
+		mux    *mux.Router
+		token  string
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		allow := func(string, string, string, string) bool { return true }
+		broker, err = mqtt.NewEmbeddedBroker(allow, func(string, string, string, int) bool { return true })
+		Expect(err).NotTo(HaveOccurred())
+
+		mgr, err = device.NewManager(broker)
+		Expect(err).NotTo(HaveOccurred())
+		token, err = mgr.CreateToken(deviceId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mgr.Create(deviceId, token, device.Record{})).To(Succeed())
+
+		agent := new(agent.Agent)
+		agent.DeviceManager = mgr
+		agent.MQTTBroker = broker
+
+		srv := server.New("")
+		srv.UseMiddleware(middleware.NewAuthMiddleware(agent, ""))
+		srv.InitRouter(devices.NewRouter(agent))
+		mux = srv.Mux
+	})
+
+	AfterEach(func() {
+		mgr.Remove(deviceId)
+		mgr.Close()
+		broker.Close()
+	})
+
+	poll := func(method, path string, body []byte) *fakeWriter {
+		r, err := http.NewRequest(method, path, bytes.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := &fakeWriter{}
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	It("should reply no content on timeout", func() {
+		Expect(poll("GET", "/me/rpc?timeout=10ms", nil).statusCode).To(Equal(http.StatusNoContent))
+		Expect(poll("GET", "/me/attributes/updates?timeout=0", nil).statusCode).To(Equal(http.StatusNoContent))
+		Expect(poll("GET", "/me/rpc?timeout=never", nil).statusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should not hold requests forwarded from messages", func() {
+		r, err := http.NewRequest("GET", "/me/rpc?timeout=1m", nil)
+		Expect(err).NotTo(HaveOccurred())
+		r.Header.Set("Authorization", "Bearer "+token)
+		r = r.WithContext(context.WithValue(r.Context(), httputils.ForwardedKey, true))
+		w := &fakeWriter{}
+		start := time.Now()
+		mux.ServeHTTP(w, r)
+		Expect(w.statusCode).To(Equal(http.StatusNoContent))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+
+	It("should deliver RPC requests and responses", func() {
+		// The first poll starts buffering messages sent to the device
+		Expect(poll("GET", "/me/rpc?timeout=0", nil).statusCode).To(Equal(http.StatusNoContent))
+
+		result := make(chan []byte, 1)
+		go func() {
+			defer GinkgoRecover()
+			resp, err := mgr.RPC(context.Background(), deviceId, []byte(`{"jsonrpc":"2.0","method":"ping","id":1}`))
+			Expect(err).NotTo(HaveOccurred())
+			result <- resp
+		}()
+
+		w := poll("GET", "/me/rpc?timeout=5s", nil)
+		Expect(w.statusCode).To(Equal(http.StatusOK))
+		var requests []device.PendingRPC
+		Expect(json.Unmarshal(w.body.Bytes(), &requests)).To(Succeed())
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Request).To(MatchJSON(`{"jsonrpc":"2.0","method":"ping","id":1}`))
+
+		w = poll("POST", "/me/rpc/"+requests[0].ID, []byte(`{"jsonrpc":"2.0","result":"pong","id":1}`))
+		Expect(w.statusCode).To(Equal(http.StatusNoContent))
+		Eventually(result, 5*time.Second).Should(Receive(MatchJSON(`{"jsonrpc":"2.0","result":"pong","id":1}`)))
+	})
+
+	It("should deliver attribute updates", func() {
+		Expect(poll("GET", "/me/attributes/updates?timeout=0", nil).statusCode).To(Equal(http.StatusNoContent))
+		Expect(mgr.Update(deviceId, device.Record{"a": "1"})).To(Succeed())
+		Expect(mgr.Update(deviceId, device.Record{"b": "2"})).To(Succeed())
+
+		w := poll("GET", "/me/attributes/updates?timeout=5s", nil)
+		Expect(w.statusCode).To(Equal(http.StatusOK))
+		var updates map[string]interface{}
+		Expect(json.Unmarshal(w.body.Bytes(), &updates)).To(Succeed())
+		Expect(updates).To(HaveKeyWithValue("a", "1"))
+		Eventually(func() map[string]interface{} {
+			if w := poll("GET", "/me/attributes/updates?timeout=0", nil); w.statusCode == http.StatusOK {
+				json.Unmarshal(w.body.Bytes(), &updates)
+			}
+			return updates
+		}).Should(HaveKeyWithValue("b", "2"))
+	})
 })
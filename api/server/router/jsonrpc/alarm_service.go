@@ -1,8 +1,12 @@
 package jsonrpc
 
 import (
+	"context"
+
 	"github.com/redhill42/iota/agent"
 	"github.com/redhill42/iota/alarm"
+	"github.com/redhill42/iota/api/server/httputils"
+	"github.com/redhill42/iota/auth/userdb"
 )
 
 type AlarmService struct {
@@ -13,35 +17,95 @@ func newAlarmService(ag *agent.Agent) *AlarmService {
 	return &AlarmService{ag.AlarmManager}
 }
 
-func (s *AlarmService) Upsert(alarm *alarm.Alarm) (string, error) {
-	err := s.mgr.Upsert(alarm)
+func (s *AlarmService) Upsert(ctx context.Context, alarm *alarm.Alarm) (string, error) {
+	if err := permit(ctx, userdb.AlarmWrite); err != nil {
+		return "", err
+	}
+	err := s.mgr.UpsertTenant(httputils.TenantFromContext(ctx), alarm)
 	return alarm.ID, err
 }
 
-func (s *AlarmService) Find(id string) (*alarm.Alarm, error) {
+func (s *AlarmService) Find(ctx context.Context, id string) (*alarm.Alarm, error) {
+	if err := permit(ctx, userdb.AlarmRead); err != nil {
+		return nil, err
+	}
+	if err := s.mgr.CheckTenant(id, httputils.TenantFromContext(ctx)); err != nil {
+		return nil, err
+	}
 	return s.mgr.Find(id)
 }
 
-func (s *AlarmService) FindName(name, originator string) (*alarm.Alarm, error) {
+func (s *AlarmService) FindName(ctx context.Context, name, originator string) (*alarm.Alarm, error) {
+	if err := permit(ctx, userdb.AlarmRead); err != nil {
+		return nil, err
+	}
+	if err := s.mgr.CheckTenantName(name, originator, httputils.TenantFromContext(ctx)); err != nil {
+		return nil, err
+	}
 	return s.mgr.FindName(name, originator)
 }
 
-func (s *AlarmService) FindAll() ([]*alarm.Alarm, error) {
-	return s.mgr.FindAll()
+func (s *AlarmService) FindAll(ctx context.Context) ([]*alarm.Alarm, error) {
+	if err := permit(ctx, userdb.AlarmRead); err != nil {
+		return nil, err
+	}
+	return s.mgr.FindAll(httputils.TenantFromContext(ctx))
+}
+
+func (s *AlarmService) FindEntity(ctx context.Context, entity string) ([]*alarm.Alarm, error) {
+	if err := permit(ctx, userdb.AlarmRead); err != nil {
+		return nil, err
+	}
+	return s.mgr.FindEntity(httputils.TenantFromContext(ctx), entity)
+}
+
+func (s *AlarmService) HighestSeverity(ctx context.Context, entity string) (*alarm.Severity, error) {
+	if err := permit(ctx, userdb.AlarmRead); err != nil {
+		return nil, err
+	}
+	severity, ok, err := s.mgr.HighestSeverity(httputils.TenantFromContext(ctx), entity)
+	if !ok {
+		return nil, err
+	}
+	return &severity, nil
 }
 
-func (s *AlarmService) Delete(id string) error {
+func (s *AlarmService) Delete(ctx context.Context, id string) error {
+	if err := permit(ctx, userdb.AlarmWrite); err != nil {
+		return err
+	}
+	if err := s.mgr.CheckTenant(id, httputils.TenantFromContext(ctx)); err != nil {
+		return err
+	}
 	return s.mgr.Delete(id)
 }
 
-func (s *AlarmService) DeleteName(name, originator string) error {
+func (s *AlarmService) DeleteName(ctx context.Context, name, originator string) error {
+	if err := permit(ctx, userdb.AlarmWrite); err != nil {
+		return err
+	}
+	if err := s.mgr.CheckTenantName(name, originator, httputils.TenantFromContext(ctx)); err != nil {
+		return err
+	}
 	return s.mgr.DeleteName(name, originator)
 }
 
-func (s *AlarmService) Clear(id string) error {
+func (s *AlarmService) Clear(ctx context.Context, id string) error {
+	if err := permit(ctx, userdb.AlarmWrite); err != nil {
+		return err
+	}
+	if err := s.mgr.CheckTenant(id, httputils.TenantFromContext(ctx)); err != nil {
+		return err
+	}
 	return s.mgr.Clear(id)
 }
 
-func (s *AlarmService) ClearName(name, originator string) error {
+func (s *AlarmService) ClearName(ctx context.Context, name, originator string) error {
+	if err := permit(ctx, userdb.AlarmWrite); err != nil {
+		return err
+	}
+	if err := s.mgr.CheckTenantName(name, originator, httputils.TenantFromContext(ctx)); err != nil {
+		return err
+	}
 	return s.mgr.ClearName(name, originator)
 }
@@ -0,0 +1,107 @@
+package jsonrpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/redhill42/iota/agent"
+	"github.com/redhill42/iota/api/server/httputils"
+	"github.com/redhill42/iota/api/types"
+	"github.com/redhill42/iota/auth"
+	"github.com/redhill42/iota/auth/userdb"
+)
+
+type APIKeyService struct {
+	users *userdb.UserDatabase
+	authz *auth.Authenticator
+}
+
+func newAPIKeyService(ag *agent.Agent) *APIKeyService {
+	return &APIKeyService{ag.Users, ag.Authz}
+}
+
+func keyInfo(key *userdb.APIKey) *types.APIKey {
+	info := &types.APIKey{
+		Name:       key.Name,
+		Account:    key.Account,
+		Role:       key.Role,
+		Tenant:     key.Tenant,
+		AllowedIPs: key.AllowedIPs,
+		CreatedBy:  key.CreatedBy,
+	}
+	if !key.Expires.IsZero() {
+		info.Expires = &key.Expires
+	}
+	if !key.Created.IsZero() {
+		info.Created = &key.Created
+	}
+	return info
+}
+
+func (s *APIKeyService) List(ctx context.Context, tenant *string) ([]*types.APIKey, error) {
+	if err := permit(ctx, userdb.UserManage); err != nil {
+		return nil, err
+	}
+	t := httputils.TenantFromContext(ctx)
+	if t == "" && tenant != nil {
+		t = *tenant
+	}
+
+	keys, err := s.users.ListAPIKeys(t)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*types.APIKey, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, keyInfo(key))
+	}
+	return result, nil
+}
+
+func (s *APIKeyService) Get(ctx context.Context, name string) (*types.APIKey, error) {
+	admin, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.users.FindManagedAPIKey(admin, name)
+	if err != nil {
+		return nil, err
+	}
+	return keyInfo(key), nil
+}
+
+// Create creates an API key. The key is only returned once.
+func (s *APIKeyService) Create(ctx context.Context, req types.APIKey) (*types.APIKeyCreated, error) {
+	admin, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &userdb.APIKey{
+		Name:       req.Name,
+		Account:    req.Account,
+		Role:       req.Role,
+		Tenant:     req.Tenant,
+		AllowedIPs: req.AllowedIPs,
+	}
+	if req.Expires != nil {
+		key.Expires = req.Expires.UTC()
+		if !key.Expires.After(time.Now()) {
+			return nil, userdb.InvalidArgumentError("Expiration time must be in the future")
+		}
+	}
+
+	secret, err := s.users.CreateAPIKey(admin, key)
+	if err != nil {
+		return nil, err
+	}
+	return &types.APIKeyCreated{APIKey: *keyInfo(key), Key: secret}, nil
+}
+
+func (s *APIKeyService) Revoke(ctx context.Context, name string) (interface{}, error) {
+	admin, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.authz.RevokeAPIKey(admin, name)
+}
@@ -1,7 +1,11 @@
 package jsonrpc
 
 import (
+	"context"
+
 	"github.com/redhill42/iota/agent"
+	"github.com/redhill42/iota/api/server/httputils"
+	"github.com/redhill42/iota/auth/userdb"
 	"github.com/redhill42/iota/device"
 )
 
@@ -13,14 +17,26 @@ func newDeviceService(ag *agent.Agent) *DeviceService {
 	return &DeviceService{ag.DeviceManager}
 }
 
-func (s *DeviceService) Create(id string, attributes device.Record) (token string, err error) {
+func (s *DeviceService) Create(ctx context.Context, id string, attributes device.Record) (token string, err error) {
+	if err := permit(ctx, userdb.DeviceWrite); err != nil {
+		return "", err
+	}
+	if tenant := httputils.TenantFromContext(ctx); tenant != "" {
+		attributes["tenant"] = tenant
+	}
 	if token, err = s.mgr.CreateToken(id); err == nil {
 		err = s.mgr.Create(id, token, attributes)
 	}
 	return token, err
 }
 
-func (s *DeviceService) Get(id string, keys *[]string) (device.Record, error) {
+func (s *DeviceService) Get(ctx context.Context, id string, keys *[]string) (device.Record, error) {
+	if err := permit(ctx, userdb.DeviceRead); err != nil {
+		return nil, err
+	}
+	if err := s.mgr.CheckTenant(id, httputils.TenantFromContext(ctx)); err != nil {
+		return nil, err
+	}
 	if keys == nil {
 		return s.mgr.Find(id, nil)
 	} else {
@@ -28,30 +44,64 @@ func (s *DeviceService) Get(id string, keys *[]string) (device.Record, error) {
 	}
 }
 
-func (s *DeviceService) Update(id string, updates device.Record) (interface{}, error) {
+func (s *DeviceService) Update(ctx context.Context, id string, updates device.Record) (interface{}, error) {
+	if err := permit(ctx, userdb.DeviceWrite); err != nil {
+		return nil, err
+	}
+	tenant := httputils.TenantFromContext(ctx)
+	if err := s.mgr.CheckTenant(id, tenant); err != nil {
+		return nil, err
+	}
+
+	// Only system users can move devices between tenants
+	if t, ok := updates["tenant"]; ok && tenant == "" {
+		t, _ := t.(string)
+		if err := s.mgr.SetTenant(id, t); err != nil {
+			return nil, err
+		}
+	}
 	return nil, s.mgr.Update(id, updates)
 }
 
-func (s *DeviceService) Delete(id string) (interface{}, error) {
+func (s *DeviceService) Delete(ctx context.Context, id string) (interface{}, error) {
+	if err := permit(ctx, userdb.DeviceDelete); err != nil {
+		return nil, err
+	}
+	if err := s.mgr.CheckTenant(id, httputils.TenantFromContext(ctx)); err != nil {
+		return nil, err
+	}
 	return nil, s.mgr.Remove(id)
 }
 
-func (s *DeviceService) List(keys *[]string) ([]device.Record, error) {
+func (s *DeviceService) List(ctx context.Context, keys *[]string) ([]device.Record, error) {
+	if err := permit(ctx, userdb.DeviceRead); err != nil {
+		return nil, err
+	}
+	tenant := httputils.TenantFromContext(ctx)
 	if keys == nil {
-		return s.mgr.FindAll(nil)
+		return s.mgr.FindAll(tenant, nil)
 	} else {
-		return s.mgr.FindAll(*keys)
+		return s.mgr.FindAll(tenant, *keys)
 	}
 }
 
-func (s *DeviceService) GetClaims() ([]device.Record, error) {
-	return s.mgr.GetClaims(), nil
+func (s *DeviceService) GetClaims(ctx context.Context) ([]device.Record, error) {
+	if err := permit(ctx, userdb.DeviceRead); err != nil {
+		return nil, err
+	}
+	return s.mgr.GetClaims(httputils.TenantFromContext(ctx))
 }
 
-func (s *DeviceService) Approve(claimId string, updates device.Record) (string, error) {
-	return s.mgr.Approve(claimId, updates)
+func (s *DeviceService) Approve(ctx context.Context, claimId string, updates device.Record) (string, error) {
+	if err := permit(ctx, userdb.DeviceApprove); err != nil {
+		return "", err
+	}
+	return s.mgr.Approve(httputils.TenantFromContext(ctx), claimId, updates)
 }
 
-func (s *DeviceService) Reject(claimId string) (interface{}, error) {
-	return nil, s.mgr.Reject(claimId)
+func (s *DeviceService) Reject(ctx context.Context, claimId string) (interface{}, error) {
+	if err := permit(ctx, userdb.DeviceApprove); err != nil {
+		return nil, err
+	}
+	return nil, s.mgr.Reject(httputils.TenantFromContext(ctx), claimId)
 }
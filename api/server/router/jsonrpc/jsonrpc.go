@@ -1,10 +1,13 @@
 package jsonrpc
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/redhill42/iota/agent"
+	"github.com/redhill42/iota/api/server/httputils"
 	"github.com/redhill42/iota/api/server/router"
+	"github.com/redhill42/iota/auth/userdb"
 	"github.com/redhill42/iota/pkg/rpc"
 )
 
@@ -21,6 +24,12 @@ func NewRouter(ag *agent.Agent) router.Router {
 	if err := s.RegisterName("alarm", newAlarmService(ag)); err != nil {
 		panic(err)
 	}
+	if err := s.RegisterName("user", newUserService(ag)); err != nil {
+		panic(err)
+	}
+	if err := s.RegisterName("apikey", newAPIKeyService(ag)); err != nil {
+		panic(err)
+	}
 
 	r := &rpcRouter{s: s}
 	r.routes = []router.Route{
@@ -37,3 +46,13 @@ func (rr *rpcRouter) rpc(w http.ResponseWriter, r *http.Request, _ map[string]st
 	rr.s.ServeHTTP(w, r)
 	return nil
 }
+
+// permit returns an error if the user who sent the request doesn't have
+// the permission. The user is put in the request context by the auth
+// middleware.
+func permit(ctx context.Context, perm string) error {
+	if user := httputils.UserFromContext(ctx); user == nil || !user.HasPermission(perm) {
+		return userdb.PermissionDeniedError(perm)
+	}
+	return nil
+}
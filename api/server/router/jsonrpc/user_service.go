@@ -0,0 +1,175 @@
+package jsonrpc
+
+import (
+	"context"
+
+	"github.com/redhill42/iota/agent"
+	"github.com/redhill42/iota/api/server/httputils"
+	"github.com/redhill42/iota/api/types"
+	"github.com/redhill42/iota/auth"
+	"github.com/redhill42/iota/auth/userdb"
+)
+
+type UserService struct {
+	users *userdb.UserDatabase
+	authz *auth.Authenticator
+}
+
+func newUserService(ag *agent.Agent) *UserService {
+	return &UserService{ag.Users, ag.Authz}
+}
+
+// currentUser returns the user who sent the request.
+func currentUser(ctx context.Context) (*userdb.BasicUser, error) {
+	user := httputils.UserFromContext(ctx)
+	if user == nil {
+		return nil, userdb.PermissionDeniedError(userdb.UserManage)
+	}
+	return user, nil
+}
+
+func userInfo(user *userdb.BasicUser) *types.User {
+	return &types.User{
+		Name:     user.Name,
+		Roles:    user.Roles,
+		Tenant:   user.Tenant,
+		Inactive: user.Inactive,
+	}
+}
+
+func (s *UserService) List(ctx context.Context, tenant *string) ([]*types.User, error) {
+	if err := permit(ctx, userdb.UserManage); err != nil {
+		return nil, err
+	}
+	t := httputils.TenantFromContext(ctx)
+	if t == "" && tenant != nil {
+		t = *tenant
+	}
+
+	users, err := s.users.List(t)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*types.User, 0, len(users))
+	for _, user := range users {
+		result = append(result, userInfo(user))
+	}
+	return result, nil
+}
+
+func (s *UserService) Get(ctx context.Context, name string) (*types.User, error) {
+	current, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current.Name == name {
+		var user userdb.BasicUser
+		if err = s.users.Find(name, &user); err != nil {
+			return nil, err
+		}
+		return userInfo(&user), nil
+	}
+
+	user, err := s.users.FindManaged(current, name)
+	if err != nil {
+		return nil, err
+	}
+	return userInfo(user), nil
+}
+
+func (s *UserService) Create(ctx context.Context, req types.UserCreate) (*types.User, error) {
+	admin, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user := &userdb.BasicUser{Name: req.Name, Roles: req.Roles, Tenant: req.Tenant}
+	if err = s.users.CreateManaged(admin, user, req.Password); err != nil {
+		return nil, err
+	}
+	return userInfo(user), nil
+}
+
+func (s *UserService) Update(ctx context.Context, name string, updates userdb.Args) (interface{}, error) {
+	admin, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.authz.UpdateProfile(admin, name, updates)
+}
+
+func (s *UserService) Delete(ctx context.Context, name string) (interface{}, error) {
+	admin, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.users.FindManaged(admin, name); err != nil {
+		return nil, err
+	}
+	if err = s.users.Remove(name); err != nil {
+		return nil, err
+	}
+	return nil, s.authz.RevokeSessions(name)
+}
+
+func (s *UserService) Enable(ctx context.Context, name string) (interface{}, error) {
+	return nil, s.setInactive(ctx, name, false)
+}
+
+func (s *UserService) Disable(ctx context.Context, name string) (interface{}, error) {
+	return nil, s.setInactive(ctx, name, true)
+}
+
+func (s *UserService) setInactive(ctx context.Context, name string, inactive bool) error {
+	admin, err := currentUser(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err = s.users.FindManaged(admin, name); err != nil {
+		return err
+	}
+	if err = s.users.SetInactive(name, inactive); err != nil || !inactive {
+		return err
+	}
+	return s.authz.RevokeSessions(name)
+}
+
+func (s *UserService) ResetPassword(ctx context.Context, name, password string) (interface{}, error) {
+	admin, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.users.FindManaged(admin, name); err != nil {
+		return nil, err
+	}
+	if err = s.users.ResetPassword(name, password); err != nil {
+		return nil, err
+	}
+	return nil, s.authz.RevokeSessions(name)
+}
+
+// ChangePassword changes the password of the user who sent the request.
+func (s *UserService) ChangePassword(ctx context.Context, oldPassword, newPassword string) (interface{}, error) {
+	current, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.users.ChangePassword(current.Name, oldPassword, newPassword); err != nil {
+		return nil, err
+	}
+	return nil, s.authz.RevokeSessions(current.Name)
+}
+
+// RevokeSessions logs out the current user or a user managed by the
+// current user from all sessions.
+func (s *UserService) RevokeSessions(ctx context.Context, name string) (interface{}, error) {
+	current, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current.Name != name {
+		if _, err = s.users.FindManaged(current, name); err != nil {
+			return nil, err
+		}
+	}
+	return nil, s.authz.RevokeSessions(name)
+}
@@ -0,0 +1,131 @@
+package system
+
+import (
+	"net/http"
+
+	"github.com/redhill42/iota/api/server/httputils"
+	"github.com/redhill42/iota/api/server/router"
+	"github.com/redhill42/iota/api/types"
+	"github.com/redhill42/iota/auth"
+	"github.com/redhill42/iota/auth/oidc"
+	"github.com/sirupsen/logrus"
+)
+
+// The login cookie binds the login state to the browser that started the
+// login, so that a login can't be completed in another browser.
+const _LOGIN_COOKIE = "iota_login"
+
+func (s *systemRouter) oidcRoutes() {
+	s.routes = append(s.routes,
+		router.NewGetRoute("/auth/oidc/login", s.getOIDCLogin),
+		router.NewGetRoute("/auth/oidc/callback", s.getOIDCCallback),
+		router.NewPostRoute("/auth/oidc/device", s.postOIDCDevice),
+		router.NewPostRoute("/auth/oidc/token", s.postOIDCToken),
+	)
+}
+
+// getOIDCLogin redirects the browser to the identity provider to login
+// with the authorization code flow.
+func (s *systemRouter) getOIDCLogin(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	state, nonce, err := s.Authz.NewLoginState()
+	if err != nil {
+		return err
+	}
+	uri, err := s.OIDC.AuthCodeURL(r.Context(), state, nonce)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     _LOGIN_COOKIE,
+		Value:    nonce,
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, uri, http.StatusFound)
+	return nil
+}
+
+// getOIDCCallback receives the authorization code from the identity
+// provider, and logs in the user of the ID token.
+func (s *systemRouter) getOIDCCallback(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	http.SetCookie(w, &http.Cookie{Name: _LOGIN_COOKIE, Path: "/", MaxAge: -1})
+
+	token, err := s.oidcCallback(r)
+	if err != nil {
+		logrus.WithError(err).Debug("Login with identity provider failed")
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return nil
+	}
+	return httputils.WriteJSON(w, http.StatusOK, tokenResponse(token))
+}
+
+func (s *systemRouter) oidcCallback(r *http.Request) (*auth.Token, error) {
+	if code := r.FormValue("error"); code != "" {
+		return nil, &oidc.Error{Code: code, Description: r.FormValue("error_description")}
+	}
+
+	nonce, err := s.Authz.VerifyLoginState(r.FormValue("state"))
+	if err != nil {
+		return nil, err
+	}
+	if cookie, err := r.Cookie(_LOGIN_COOKIE); err != nil || cookie.Value != nonce {
+		return nil, auth.SessionError("login started in another browser")
+	}
+
+	id, err := s.OIDC.Exchange(r.Context(), r.FormValue("code"), nonce)
+	if err != nil {
+		return nil, err
+	}
+	_, token, err := s.Authz.AuthenticateIdentity(id, s.OIDC.Config())
+	return token, err
+}
+
+// postOIDCDevice starts a device login with the identity provider.
+func (s *systemRouter) postOIDCDevice(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	da, err := s.OIDC.DeviceAuth(r.Context())
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, types.DeviceLogin{
+		DeviceCode:              da.DeviceCode,
+		UserCode:                da.UserCode,
+		VerificationURI:         da.VerificationURI,
+		VerificationURIComplete: da.VerificationURIComplete,
+		ExpiresIn:               da.ExpiresIn,
+		Interval:                da.Interval,
+	})
+}
+
+// postOIDCToken polls the device login. The status is 202 until the user
+// approves the login, or 429 if the client should poll slower.
+func (s *systemRouter) postOIDCToken(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	var req types.DeviceTokenRequest
+	if err := httputils.ReadJSON(r, &req); err != nil {
+		return err
+	}
+
+	id, err := s.OIDC.DeviceToken(r.Context(), req.DeviceCode)
+	if oidc.IsPending(err) {
+		if err.(*oidc.Error).Code == oidc.SlowDown {
+			http.Error(w, oidc.SlowDown, http.StatusTooManyRequests)
+		} else {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		return nil
+	}
+
+	var token *auth.Token
+	if err == nil {
+		_, token, err = s.Authz.AuthenticateIdentity(id, s.OIDC.Config())
+	}
+	if err != nil {
+		logrus.WithError(err).Debug("Device login with identity provider failed")
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return nil
+	}
+	return httputils.WriteJSON(w, http.StatusOK, tokenResponse(token))
+}
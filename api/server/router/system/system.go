@@ -1,14 +1,19 @@
 package system
 
 import (
+	"encoding/json"
+	"expvar"
 	"net/http"
 	"runtime"
+	"time"
 
 	"github.com/redhill42/iota/agent"
 	"github.com/redhill42/iota/api"
 	"github.com/redhill42/iota/api/server/httputils"
 	"github.com/redhill42/iota/api/server/router"
 	"github.com/redhill42/iota/api/types"
+	"github.com/redhill42/iota/auth"
+	"github.com/redhill42/iota/auth/userdb"
 	"github.com/sirupsen/logrus"
 )
 
@@ -21,8 +26,16 @@ func NewRouter(agent *agent.Agent) router.Router {
 	r := &systemRouter{Agent: agent}
 	r.routes = []router.Route{
 		router.NewGetRoute("/version", r.getVersion),
+		router.NewGetRoute("/health", r.getHealth),
 		router.NewGetRoute("/swagger.json", r.getSwaggerJson),
+		router.NewGetRoute("/metrics", httputils.RequirePermission(userdb.SystemRead, r.getMetrics)),
 		router.NewPostRoute("/auth", r.postAuth),
+		router.NewPostRoute("/auth/totp", r.postAuthTOTP),
+		router.NewPostRoute("/auth/refresh", r.postRefresh),
+		router.NewPostRoute("/auth/logout", r.postLogout),
+	}
+	if agent.OIDC != nil {
+		r.oidcRoutes()
 	}
 	return r
 }
@@ -43,6 +56,31 @@ func (s *systemRouter) getVersion(w http.ResponseWriter, r *http.Request, vars m
 	return httputils.WriteJSON(w, http.StatusOK, v)
 }
 
+// getHealth reports whether the server is able to serve requests. The
+// status code is 503 if the MQTT broker is not connected.
+func (s *systemRouter) getHealth(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	health := types.Health{Status: "ok", MQTT: s.MQTTBroker.Status()}
+	status := http.StatusOK
+	if !health.MQTT.Connected {
+		health.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	return httputils.WriteJSON(w, status, health)
+}
+
+// getMetrics returns all published runtime metrics as a JSON object. The
+// metrics are not separated by tenant, so users of a tenant can't read them.
+func (s *systemRouter) getMetrics(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if httputils.TenantFromContext(r.Context()) != "" {
+		return userdb.PermissionDeniedError(userdb.SystemRead)
+	}
+	metrics := make(map[string]json.RawMessage)
+	expvar.Do(func(kv expvar.KeyValue) {
+		metrics[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+	return httputils.WriteJSON(w, http.StatusOK, metrics)
+}
+
 func (s *systemRouter) postAuth(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	username, password, ok := r.BasicAuth()
 	if !ok {
@@ -50,12 +88,96 @@ func (s *systemRouter) postAuth(w http.ResponseWriter, r *http.Request, vars map
 		return nil
 	}
 
-	_, token, err := s.Authz.Authenticate(username, password)
+	_, token, err := s.Authz.AuthenticateFrom(username, password, auth.RemoteIP(r))
+	if challenge, ok := err.(*auth.ChallengeError); ok {
+		return httputils.WriteJSON(w, http.StatusOK, challengeResponse(challenge))
+	}
+	if err != nil {
+		loginFailed(w, logrus.WithField("username", username), err)
+		return nil
+	}
+
+	return httputils.WriteJSON(w, http.StatusOK, tokenResponse(token))
+}
+
+// postAuthTOTP completes a login challenged for a second factor with the
+// TOTP code or a recovery code.
+func (s *systemRouter) postAuthTOTP(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	var req types.SecondFactorRequest
+	if err := httputils.ReadJSON(r, &req); err != nil {
+		return err
+	}
+
+	_, token, recoveryCodes, err := s.Authz.AuthenticateSecondFactor(req.Challenge, req.Code, auth.RemoteIP(r))
+	if err != nil {
+		loginFailed(w, logrus.NewEntry(logrus.StandardLogger()), err)
+		return nil
+	}
+
+	resp := tokenResponse(token)
+	resp.RecoveryCodes = recoveryCodes
+	return httputils.WriteJSON(w, http.StatusOK, resp)
+}
+
+// loginFailed replies the failure of a login, without telling why the
+// login failed unless locked out.
+func loginFailed(w http.ResponseWriter, log *logrus.Entry, err error) {
+	if locked, ok := err.(*userdb.LoginLockedError); ok {
+		log.Debug("Login locked")
+		w.Header().Set("Retry-After", locked.RetryAfter())
+		http.Error(w, locked.Error(), http.StatusTooManyRequests)
+		return
+	}
+	log.WithError(err).Debug("Login failed")
+	http.Error(w, "Login failed", http.StatusUnauthorized)
+}
+
+// postRefresh exchanges a refresh token for a new access token and refresh
+// token.
+func (s *systemRouter) postRefresh(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	var req types.RefreshRequest
+	if err := httputils.ReadJSON(r, &req); err != nil {
+		return err
+	}
+
+	token, err := s.Authz.Refresh(req.RefreshToken)
 	if err != nil {
-		logrus.WithField("username", username).WithError(err).Debug("Login failed")
-		http.Error(w, "Login failed", http.StatusUnauthorized)
+		logrus.WithError(err).Debug("Refresh failed")
+		http.Error(w, "Session expired", http.StatusUnauthorized)
 		return nil
 	}
+	return httputils.WriteJSON(w, http.StatusOK, tokenResponse(token))
+}
+
+// postLogout revokes the login session of the refresh token, or all login
+// sessions of the user.
+func (s *systemRouter) postLogout(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	var req types.RefreshRequest
+	if err := httputils.ReadJSON(r, &req); err != nil {
+		return err
+	}
+	if err := s.Authz.Logout(req.RefreshToken, req.All); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
 
-	return httputils.WriteJSON(w, http.StatusOK, types.Token{Token: token})
+func challengeResponse(challenge *auth.ChallengeError) types.Token {
+	resp := types.Token{Challenge: challenge.Challenge}
+	if challenge.Enroll != nil {
+		resp.Enroll = &types.TOTPEnrollment{
+			Secret: challenge.Enroll.Secret,
+			URI:    challenge.Enroll.URI,
+		}
+	}
+	return resp
+}
+
+func tokenResponse(token *auth.Token) types.Token {
+	return types.Token{
+		Token:        token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		ExpiresIn:    int64(time.Until(token.ExpiresAt) / time.Second),
+	}
 }
@@ -0,0 +1,361 @@
+package users
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redhill42/iota/agent"
+	"github.com/redhill42/iota/api/server/httputils"
+	"github.com/redhill42/iota/api/server/router"
+	"github.com/redhill42/iota/api/types"
+	"github.com/redhill42/iota/auth/userdb"
+)
+
+const userPath = "/users/{name:[^/]+}"
+
+type usersRouter struct {
+	*agent.Agent
+	routes []router.Route
+}
+
+func NewRouter(agent *agent.Agent) router.Router {
+	r := &usersRouter{Agent: agent}
+	r.routes = []router.Route{
+		router.NewGetRoute("/users", httputils.RequirePermission(userdb.UserManage, r.list)),
+		router.NewPostRoute("/users", httputils.RequirePermission(userdb.UserManage, r.create)),
+		router.NewGetRoute(userPath, r.read),
+		router.NewPutRoute(userPath, r.update),
+		router.NewDeleteRoute(userPath, r.delete),
+		router.NewPostRoute(userPath+"/enable", r.enable),
+		router.NewPostRoute(userPath+"/disable", r.disable),
+		router.NewPostRoute(userPath+"/password", r.password),
+		router.NewDeleteRoute(userPath+"/sessions", r.revokeSessions),
+		router.NewGetRoute(userPath+"/logins", r.userLogins),
+		router.NewPostRoute(userPath+"/totp", r.enrollTOTP),
+		router.NewPostRoute(userPath+"/totp/confirm", r.confirmTOTP),
+		router.NewDeleteRoute(userPath+"/totp", r.disableTOTP),
+		router.NewGetRoute("/logins", httputils.RequirePermission(userdb.UserManage, r.logins)),
+	}
+	return r
+}
+
+func (ur *usersRouter) Routes() []router.Route {
+	return ur.routes
+}
+
+// userInfo returns the user information without password.
+func userInfo(user *userdb.BasicUser) *types.User {
+	return &types.User{
+		Name:     user.Name,
+		Roles:    user.Roles,
+		Tenant:   user.Tenant,
+		Inactive: user.Inactive,
+	}
+}
+
+// list returns users of the tenant of the admin. System users may select
+// users of a tenant with the "tenant" parameter.
+func (ur *usersRouter) list(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	tenant := httputils.TenantFromContext(r.Context())
+	if tenant == "" {
+		tenant = r.FormValue("tenant")
+	}
+
+	users, err := ur.Users.List(tenant)
+	if err != nil {
+		return err
+	}
+	result := make([]*types.User, 0, len(users))
+	for _, user := range users {
+		result = append(result, userInfo(user))
+	}
+	return httputils.WriteJSON(w, http.StatusOK, result)
+}
+
+func (ur *usersRouter) create(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	var req types.UserCreate
+	if err := httputils.ReadJSON(r, &req); err != nil {
+		return err
+	}
+
+	user := &userdb.BasicUser{Name: req.Name, Roles: req.Roles, Tenant: req.Tenant}
+	admin := httputils.UserFromContext(r.Context())
+	if err := ur.Users.CreateManaged(admin, user, req.Password); err != nil {
+		return err
+	}
+	w.Header().Set("Location", r.RequestURI+"/"+user.Name)
+	return httputils.WriteJSON(w, http.StatusCreated, userInfo(user))
+}
+
+// read returns the information of the current user or a user managed by
+// the current user.
+func (ur *usersRouter) read(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	current := httputils.UserFromContext(r.Context())
+	if current.Name == vars["name"] {
+		var user userdb.BasicUser
+		if err := ur.Users.Find(current.Name, &user); err != nil {
+			return err
+		}
+		return httputils.WriteJSON(w, http.StatusOK, userInfo(&user))
+	}
+
+	user, err := ur.Users.FindManaged(current, vars["name"])
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, userInfo(user))
+}
+
+func (ur *usersRouter) update(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	var updates userdb.Args
+	if err := httputils.ReadJSON(r, &updates); err != nil {
+		return err
+	}
+
+	admin := httputils.UserFromContext(r.Context())
+	if err := ur.Authz.UpdateProfile(admin, vars["name"], updates); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (ur *usersRouter) delete(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	admin := httputils.UserFromContext(r.Context())
+	if _, err := ur.Users.FindManaged(admin, vars["name"]); err != nil {
+		return err
+	}
+	if err := ur.Users.Remove(vars["name"]); err != nil {
+		return err
+	}
+	if err := ur.Authz.RevokeSessions(vars["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (ur *usersRouter) enable(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return ur.setInactive(w, r, vars["name"], false)
+}
+
+func (ur *usersRouter) disable(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return ur.setInactive(w, r, vars["name"], true)
+}
+
+func (ur *usersRouter) setInactive(w http.ResponseWriter, r *http.Request, name string, inactive bool) error {
+	admin := httputils.UserFromContext(r.Context())
+	if _, err := ur.Users.FindManaged(admin, name); err != nil {
+		return err
+	}
+	if err := ur.Users.SetInactive(name, inactive); err != nil {
+		return err
+	}
+	if inactive {
+		if err := ur.Authz.RevokeSessions(name); err != nil {
+			return err
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// password changes the password of the current user, which requires the
+// old password, or resets the password of a user managed by the current
+// user. All login sessions of the user are revoked.
+func (ur *usersRouter) password(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	var req types.PasswordChange
+	if err := httputils.ReadJSON(r, &req); err != nil {
+		return err
+	}
+
+	var err error
+	current := httputils.UserFromContext(r.Context())
+	if current.Name == vars["name"] {
+		err = ur.Users.ChangePassword(current.Name, req.OldPassword, req.Password)
+	} else if _, err = ur.Users.FindManaged(current, vars["name"]); err == nil {
+		err = ur.Users.ResetPassword(vars["name"], req.Password)
+	}
+	if err == nil {
+		err = ur.Authz.RevokeSessions(vars["name"])
+	}
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// revokeSessions logs out the current user or a user managed by the
+// current user from all sessions. Access tokens already issued remain
+// valid until expired.
+func (ur *usersRouter) revokeSessions(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	current := httputils.UserFromContext(r.Context())
+	if current.Name != vars["name"] {
+		if _, err := ur.Users.FindManaged(current, vars["name"]); err != nil {
+			return err
+		}
+	}
+	if err := ur.Authz.RevokeSessions(vars["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// enrollTOTP starts a TOTP enrollment of the current user. Users can only
+// enroll themselves.
+func (ur *usersRouter) enrollTOTP(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	current := httputils.UserFromContext(r.Context())
+	if current.Name != vars["name"] {
+		return userdb.PermissionDeniedError(vars["name"])
+	}
+
+	enroll, err := ur.Users.EnrollTOTP(current.Name)
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, types.TOTPEnrollment{Secret: enroll.Secret, URI: enroll.URI})
+}
+
+// confirmTOTP enables the second factor of the current user with a code
+// of the enrollment, and returns the recovery codes.
+func (ur *usersRouter) confirmTOTP(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	var req types.TOTPConfirm
+	if err := httputils.ReadJSON(r, &req); err != nil {
+		return err
+	}
+
+	current := httputils.UserFromContext(r.Context())
+	if current.Name != vars["name"] {
+		return userdb.PermissionDeniedError(vars["name"])
+	}
+
+	codes, err := ur.Users.ConfirmTOTP(current.Name, req.Code)
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, types.RecoveryCodes{RecoveryCodes: codes})
+}
+
+// disableTOTP disables the second factor of the current user or a user
+// managed by the current user, such as a user who lost the authenticator.
+// Users disabling their own second factor must give a current code or a
+// recovery code, so that a stolen access token can't disable it.
+func (ur *usersRouter) disableTOTP(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	current := httputils.UserFromContext(r.Context())
+	if current.Name == vars["name"] {
+		var req types.TOTPConfirm
+		if err := httputils.ReadJSON(r, &req); err != nil {
+			return err
+		}
+		if err := ur.Users.VerifyTOTP(current.Name, req.Code); err != nil {
+			return err
+		}
+	} else {
+		if _, err := ur.Users.FindManaged(current, vars["name"]); err != nil {
+			return err
+		}
+	}
+	if err := ur.Users.DisableTOTP(vars["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Login events are returned at most defaultLoginLimit by default, and at
+// most maxLoginLimit if the "limit" parameter is given.
+const (
+	defaultLoginLimit = 100
+	maxLoginLimit     = 1000
+)
+
+// loginFilter parses the login event filter from request parameters. The
+// "since" parameter is a time in RFC 3339 format, or a duration before now.
+func loginFilter(r *http.Request) (*userdb.LoginFilter, error) {
+	filter := &userdb.LoginFilter{
+		User:   r.FormValue("user"),
+		Tenant: r.FormValue("tenant"),
+		IP:     r.FormValue("ip"),
+		Result: r.FormValue("result"),
+		Limit:  defaultLoginLimit,
+	}
+
+	if s := r.FormValue("since"); s != "" {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			filter.Since = t
+		} else if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+			filter.Since = time.Now().Add(-d)
+		} else {
+			return nil, userdb.InvalidArgumentError("Invalid since: " + s)
+		}
+	}
+
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, userdb.InvalidArgumentError("Invalid limit: " + s)
+		}
+		if n > maxLoginLimit {
+			n = maxLoginLimit
+		}
+		filter.Limit = n
+	}
+	return filter, nil
+}
+
+func loginInfo(events []*userdb.LoginEvent) []*types.LoginEvent {
+	result := make([]*types.LoginEvent, 0, len(events))
+	for _, e := range events {
+		result = append(result, &types.LoginEvent{
+			Time:    e.Time,
+			User:    e.User,
+			Tenant:  e.Tenant,
+			IP:      e.IP,
+			Channel: e.Channel,
+			Result:  e.Result,
+			Reason:  e.Reason,
+		})
+	}
+	return result
+}
+
+// logins returns login events of users of the tenant of the admin.
+func (ur *usersRouter) logins(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	filter, err := loginFilter(r)
+	if err != nil {
+		return err
+	}
+
+	admin := httputils.UserFromContext(r.Context())
+	events, err := ur.Users.LoginEvents(admin, filter)
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, loginInfo(events))
+}
+
+// userLogins returns login events of the current user or a user managed
+// by the current user.
+func (ur *usersRouter) userLogins(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	filter, err := loginFilter(r)
+	if err != nil {
+		return err
+	}
+
+	current := httputils.UserFromContext(r.Context())
+	if current.Name != vars["name"] {
+		if _, err := ur.Users.FindManaged(current, vars["name"]); err != nil {
+			return err
+		}
+	}
+
+	filter.User = vars["name"]
+	events, err := ur.Users.LoginEvents(current, filter)
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, loginInfo(events))
+}
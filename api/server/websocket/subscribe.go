@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/redhill42/iota/api/server/httputils"
 	"github.com/sirupsen/logrus"
 )
 
@@ -31,6 +32,13 @@ type Message interface {
 	Marshal() ([]byte, error)
 }
 
+// TenantMessage is a message that belongs to a tenant. It's only delivered
+// to subscribers of the tenant and system subscribers.
+type TenantMessage interface {
+	Message
+	GetTenant() string
+}
+
 type Hub struct {
 	// Registered subscribers
 	subscribers map[*subscriber]bool
@@ -51,6 +59,9 @@ type subscriber struct {
 	// The message identifier to subscribe, or "+" for all messages
 	id string
 
+	// The tenant of the subscriber, empty for system users
+	tenant string
+
 	// The websocket connection.
 	conn *websocket.Conn
 
@@ -169,7 +180,14 @@ func (h *Hub) Run() {
 			}
 
 			id := message.GetID()
+			tenant := ""
+			if tm, ok := message.(TenantMessage); ok {
+				tenant = tm.GetTenant()
+			}
 			for sub := range h.subscribers {
+				if sub.tenant != "" && sub.tenant != tenant {
+					continue
+				}
 				if sub.id == "+" || sub.id == id {
 					select {
 					case sub.send <- data:
@@ -188,13 +206,17 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
+// ServeWS subscribes to messages with the identifier, or all messages if
+// the identifier is "+". Users of a tenant only receive messages of the
+// tenant.
 func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request, id string) error {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return err
 	}
 
-	sub := &subscriber{hub: h, id: id, conn: conn, send: make(chan []byte, 256)}
+	tenant := httputils.TenantFromContext(r.Context())
+	sub := &subscriber{hub: h, id: id, tenant: tenant, conn: conn, send: make(chan []byte, 256)}
 	sub.hub.register <- sub
 
 	go sub.writePump()
@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 // Version information contains response of remote API:
 // GET "/version"
 type Version struct {
@@ -12,7 +14,142 @@ type Version struct {
 }
 
 // Token represents an access token signed by server to
-// identify a client entity.
+// identify a client entity. The refresh token is returned on user login
+// to obtain a new access token when the access token expires.
 type Token struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+	ExpiresIn    int64  `json:"expiresIn,omitempty"`
+
+	// Challenge is returned instead of tokens if the user must login
+	// with a second factor, and the enrollment is returned if the user
+	// must enroll at login.
+	Challenge string          `json:"challenge,omitempty"`
+	Enroll    *TOTPEnrollment `json:"enroll,omitempty"`
+
+	// RecoveryCodes are returned if the user enrolled at login.
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+// SecondFactorRequest contains request body of remote API:
+// POST "/auth/totp"
+type SecondFactorRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// TOTPEnrollment contains response of remote API:
+// POST "/users/{name}/totp"
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TOTPConfirm contains request of remote API:
+// POST "/users/{name}/totp/confirm"
+// DELETE "/users/{name}/totp"
+type TOTPConfirm struct {
+	Code string `json:"code"`
+}
+
+// RecoveryCodes contains response of remote API:
+// POST "/users/{name}/totp/confirm"
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// RefreshRequest contains request body of remote API:
+// POST "/auth/refresh" and POST "/auth/logout"
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+	All          bool   `json:"all,omitempty"`
+}
+
+// DeviceLogin contains response of remote API:
+// POST "/auth/oidc/device"
+type DeviceLogin struct {
+	DeviceCode              string `json:"deviceCode"`
+	UserCode                string `json:"userCode"`
+	VerificationURI         string `json:"verificationUri"`
+	VerificationURIComplete string `json:"verificationUriComplete,omitempty"`
+	ExpiresIn               int64  `json:"expiresIn"`
+	Interval                int64  `json:"interval"`
+}
+
+// DeviceTokenRequest contains request body of remote API:
+// POST "/auth/oidc/token"
+type DeviceTokenRequest struct {
+	DeviceCode string `json:"deviceCode"`
+}
+
+// Health contains response of remote API:
+// GET "/health"
+type Health struct {
+	Status string
+	MQTT   MQTTStatus
+}
+
+// MQTTStatus is the status of the connection to MQTT broker.
+type MQTTStatus struct {
+	Connected bool
+	Embedded  bool
+	Error     string `json:",omitempty"`
+	Since     time.Time
+}
+
+// User contains response of remote API:
+// GET "/users/{name}"
+type User struct {
+	Name     string   `json:"name"`
+	Roles    []string `json:"roles,omitempty"`
+	Tenant   string   `json:"tenant,omitempty"`
+	Inactive bool     `json:"inactive,omitempty"`
+}
+
+// UserCreate contains request of remote API:
+// POST "/users"
+type UserCreate struct {
+	User
+	Password string `json:"password"`
+}
+
+// PasswordChange contains request of remote API:
+// POST "/users/{name}/password"
+type PasswordChange struct {
+	OldPassword string `json:"oldPassword,omitempty"`
+	Password    string `json:"password"`
+}
+
+// APIKey contains response of remote API:
+// GET "/apikeys/{name}"
+type APIKey struct {
+	Name       string     `json:"name"`
+	Account    string     `json:"account,omitempty"`
+	Role       string     `json:"role,omitempty"`
+	Tenant     string     `json:"tenant,omitempty"`
+	AllowedIPs []string   `json:"allowedIPs,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"createdBy,omitempty"`
+}
+
+// APIKeyCreated contains response of remote API:
+// POST "/apikeys"
+// The key is only returned when created.
+type APIKeyCreated struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// LoginEvent contains response of remote API:
+// GET "/logins"
+// GET "/users/{name}/logins"
+type LoginEvent struct {
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Tenant  string    `json:"tenant,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Channel string    `json:"channel"`
+	Result  string    `json:"result"`
+	Reason  string    `json:"reason,omitempty"`
 }
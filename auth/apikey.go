@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhill42/iota/auth/userdb"
+)
+
+// Verified API keys are cached for a short time, so that the user database
+// is not queried for every request. Revoked keys may be used until the
+// cache entry expires on other servers.
+const (
+	_APIKEY_CACHE_TTL  = 30 * time.Second
+	_APIKEY_CACHE_SIZE = 1000
+)
+
+type apikeyCacheEntry struct {
+	key     *userdb.APIKey
+	expires time.Time
+}
+
+type apikeyCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]apikeyCacheEntry
+}
+
+func newAPIKeyCache() *apikeyCache {
+	return &apikeyCache{entries: make(map[[sha256.Size]byte]apikeyCacheEntry)}
+}
+
+func (c *apikeyCache) get(apikey string) *userdb.APIKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := sha256.Sum256([]byte(apikey))
+	if e, ok := c.entries[h]; ok && time.Now().Before(e.expires) {
+		return e.key
+	}
+	return nil
+}
+
+func (c *apikeyCache) put(apikey string, key *userdb.APIKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= _APIKEY_CACHE_SIZE {
+		c.entries = make(map[[sha256.Size]byte]apikeyCacheEntry)
+	}
+	c.entries[sha256.Sum256([]byte(apikey))] = apikeyCacheEntry{key, time.Now().Add(_APIKEY_CACHE_TTL)}
+}
+
+func (c *apikeyCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for h, e := range c.entries {
+		if e.key.Name == name {
+			delete(c.entries, h)
+		}
+	}
+}
+
+// apiKeyFromRequest returns the API key in the "X-API-Key" header, or the
+// bearer token if it's an API key.
+func apiKeyFromRequest(r *http.Request) string {
+	if apikey := r.Header.Get("X-API-Key"); apikey != "" {
+		return apikey
+	}
+	token := r.Header.Get("Authorization")
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") && strings.HasPrefix(token[7:], userdb.APIKeyPrefix) {
+		return token[7:]
+	}
+	return ""
+}
+
+// IsAPIKey returns true if the credential is an API key rather than an
+// access token.
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, userdb.APIKeyPrefix)
+}
+
+// VerifyAPIKey verifies an API key used from the IP address and returns
+// the service account of the key. Keys with an IP allowlist are rejected
+// if the address is empty.
+func (auth *Authenticator) VerifyAPIKey(apikey, addr string) (*userdb.BasicUser, error) {
+	key := auth.apikeys.get(apikey)
+	if key == nil {
+		var err error
+		if key, err = auth.db.VerifyAPIKey(apikey); err != nil {
+			return nil, err
+		}
+		auth.apikeys.put(apikey, key)
+	}
+
+	if key.Expired() {
+		return nil, userdb.InvalidAPIKeyError(key.Name + " expired")
+	}
+	if !key.AllowIP(addr) {
+		return nil, userdb.InvalidAPIKeyError(key.Name + " not allowed from " + addr)
+	}
+	return key.User(), nil
+}
+
+// RevokeAPIKey removes the API key managed by the admin.
+func (auth *Authenticator) RevokeAPIKey(admin *userdb.BasicUser, name string) error {
+	if _, err := auth.db.FindManagedAPIKey(admin, name); err != nil {
+		return err
+	}
+	if err := auth.db.RemoveAPIKey(name); err != nil {
+		return err
+	}
+	auth.apikeys.remove(name)
+	return nil
+}
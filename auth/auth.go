@@ -1,74 +1,360 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/dgrijalva/jwt-go/request"
+	"github.com/redhill42/iota/auth/jwks"
 	"github.com/redhill42/iota/auth/userdb"
+	"github.com/redhill42/iota/config"
 	"github.com/sirupsen/logrus"
 )
 
-const _TOKEN_EXPIRE_TIME = time.Hour * 24 * 30 // 30 days
+// Access tokens are short lived since they can't be revoked, and they are
+// refreshed with refresh tokens as long as the login session is active.
+const (
+	_TOKEN_EXPIRE_TIME   = 15 * time.Minute
+	_SESSION_EXPIRE_TIME = 30 * 24 * time.Hour // 30 days
+)
+
+// Claims are the claims of a user token. The roles and tenant of the user
+// are carried in the token so that permissions are checked without querying
+// the user database. Changes take effect when the token is refreshed.
+type Claims struct {
+	jwt.StandardClaims
+	Roles  []string `json:"roles,omitempty"`
+	Tenant string   `json:"tenant,omitempty"`
+}
+
+// Valid checks that the token is an unexpired user token.
+func (c *Claims) Valid() error {
+	if err := c.StandardClaims.Valid(); err != nil {
+		return err
+	}
+	return jwks.VerifyAudience(&c.StandardClaims, jwks.UserAudience)
+}
+
+// Token is the result of a successful login or refresh.
+type Token struct {
+	// AccessToken authorizes API requests until expired
+	AccessToken string
+
+	// RefreshToken obtains a new access token, it's replaced on every
+	// refresh
+	RefreshToken string
+
+	// ExpiresAt is the expiration time of the access token
+	ExpiresAt time.Time
+}
 
 // The authenticator authenticate user via http protocol
 type Authenticator struct {
-	db     *userdb.UserDatabase
-	secret []byte
+	db       *userdb.UserDatabase
+	keys     *jwks.KeySet
+	sessions SessionStore
+
+	tokenExpire   time.Duration
+	sessionExpire time.Duration
+	apikeys       *apikeyCache
+	stateKey      loginStateKey
+	challengeKey  loginStateKey
 }
 
 func NewAuthenticator(db *userdb.UserDatabase) (*Authenticator, error) {
-	secret, err := db.GetSecret("jwt")
+	sessions, err := NewSessionStore()
 	if err != nil {
 		return nil, err
 	}
-	return &Authenticator{db, secret}, nil
+	return NewAuthenticatorWithSessions(db, sessions)
+}
+
+// NewAuthenticatorWithSessions creates an authenticator that stores login
+// sessions in the given session store.
+func NewAuthenticatorWithSessions(db *userdb.UserDatabase, sessions SessionStore) (*Authenticator, error) {
+	keys, err := OpenKeys(db)
+	if err != nil {
+		return nil, err
+	}
+	return &Authenticator{
+		db:            db,
+		keys:          keys,
+		sessions:      sessions,
+		tokenExpire:   durationOption("auth.tokenExpire", _TOKEN_EXPIRE_TIME),
+		sessionExpire: durationOption("auth.sessionExpire", _SESSION_EXPIRE_TIME),
+		apikeys:       newAPIKeyCache(),
+	}, nil
+}
+
+// OpenKeys opens the key set that signs user tokens.
+func OpenKeys(db *userdb.UserDatabase) (*jwks.KeySet, error) {
+	return jwks.Open(db.Secrets(), "jwt.keys", "jwt")
+}
+
+// Keys returns the key set that signs user tokens.
+func (auth *Authenticator) Keys() *jwks.KeySet {
+	return auth.keys
+}
+
+func durationOption(key string, def time.Duration) time.Duration {
+	if s := config.Get(key); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			return d
+		}
+		logrus.Warnf("Invalid %s: %s", key, s)
+	}
+	return def
+}
+
+// Close the session store.
+func (auth *Authenticator) Close() {
+	auth.sessions.Close()
 }
 
-// Authenticate user with name and password. Returns the User object
-// and a token
-func (auth *Authenticator) Authenticate(username, password string) (*userdb.BasicUser, string, error) {
+// Authenticate user with name and password. Returns the User object and
+// the tokens of a new login session.
+func (auth *Authenticator) Authenticate(username, password string) (*userdb.BasicUser, *Token, error) {
+	return auth.AuthenticateFrom(username, password, "")
+}
+
+// AuthenticateFrom authenticates user with name and password from the
+// client address. The attempt is recorded in the login audit trail, and
+// refused with a LoginLockedError after too many failed attempts. A
+// ChallengeError is returned if the user must login with a second factor.
+func (auth *Authenticator) AuthenticateFrom(username, password, ip string) (*userdb.BasicUser, *Token, error) {
 	// Authenticate user by user database
-	user, err := auth.db.Authenticate(username, password)
+	user, err := auth.db.Login(username, password, ip, userdb.ChannelHTTP)
+	if required, ok := err.(*userdb.SecondFactorRequiredError); ok {
+		return nil, nil, auth.challenge(required)
+	}
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
 
-	// Create a new token object, specifying singing method and the claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{
-		ExpiresAt: time.Now().Add(_TOKEN_EXPIRE_TIME).Unix(),
-		Subject:   user.Name,
+	token, err := auth.login(user)
+	return user, token, err
+}
+
+// login creates a new login session of the authenticated user.
+func (auth *Authenticator) login(user *userdb.BasicUser) (*Token, error) {
+	id, secret, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	err = auth.sessions.Create(&Session{
+		ID:      id,
+		User:    user.Name,
+		Secret:  hashSecret(secret),
+		Created: now,
+		Expires: now.Add(auth.sessionExpire),
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	// Sign and get the complete encoded token as a string using the secret
 	logrus.Debugf("Authenticated user: %v", user.Name)
-	tokenString, err := token.SignedString(auth.secret)
-	return user, tokenString, err
+	return auth.newToken(user, id+"."+secret)
+}
+
+// Refresh issues a new access token and refresh token of the session
+// identified by the refresh token. The old refresh token is no longer
+// valid. The user is checked again, so that removed and disabled users
+// can't refresh their sessions, and role changes take effect.
+func (auth *Authenticator) Refresh(refreshToken string) (*Token, error) {
+	session, secret, err := auth.findSession(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var user userdb.BasicUser
+	if err = auth.db.Find(session.User, &user); err == nil && user.Inactive {
+		err = userdb.InactiveUserError(user.Name)
+	}
+	if err != nil {
+		auth.sessions.Remove(session.ID)
+		return nil, err
+	}
+
+	_, newSecret, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(auth.sessionExpire)
+	if err = auth.sessions.Refresh(session.ID, secret, hashSecret(newSecret), expires); err != nil {
+		return nil, err
+	}
+	return auth.newToken(&user, session.ID+"."+newSecret)
+}
+
+// Logout revokes the session identified by the refresh token, or all
+// sessions of the user if all is true.
+func (auth *Authenticator) Logout(refreshToken string, all bool) error {
+	session, _, err := auth.findSession(refreshToken)
+	if err != nil {
+		return err
+	}
+	if all {
+		return auth.sessions.RemoveUser(session.User)
+	}
+	return auth.sessions.Remove(session.ID)
+}
+
+// RevokeSessions revokes all sessions of the user. Access tokens issued
+// to the user remain valid until expired.
+func (auth *Authenticator) RevokeSessions(name string) error {
+	return auth.sessions.RemoveUser(name)
+}
+
+// UpdateProfile updates the profile of a user managed by the admin. All
+// sessions of the user are revoked if the user is disabled.
+func (auth *Authenticator) UpdateProfile(admin *userdb.BasicUser, name string, updates userdb.Args) error {
+	if err := auth.db.UpdateProfile(admin, name, updates); err != nil {
+		return err
+	}
+	var user userdb.BasicUser
+	if err := auth.db.Find(name, &user); err != nil || !user.Inactive {
+		return err
+	}
+	return auth.RevokeSessions(name)
+}
+
+// findSession finds the session of the refresh token and returns the
+// hashed secret. A session is revoked if an old refresh token is reused,
+// since the refresh token may be stolen.
+func (auth *Authenticator) findSession(refreshToken string) (*Session, []byte, error) {
+	sp := strings.SplitN(refreshToken, ".", 2)
+	if len(sp) != 2 {
+		return nil, nil, SessionError("malformed refresh token")
+	}
+	session, err := auth.sessions.Find(sp[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	secret := hashSecret(sp[1])
+	if subtle.ConstantTimeCompare(secret, session.Secret) != 1 {
+		logrus.Warnf("Refresh token reused, session of user %s revoked", session.User)
+		auth.sessions.Remove(session.ID)
+		return nil, nil, SessionError(session.ID)
+	}
+	return session, secret, nil
+}
+
+// newToken creates a new access token for the user.
+func (auth *Authenticator) newToken(user *userdb.BasicUser, refreshToken string) (*Token, error) {
+	expires := time.Now().Add(auth.tokenExpire)
+
+	// Sign the claims with the current signing key
+	tokenString, err := auth.keys.Sign(&Claims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    jwks.Issuer,
+			Audience:  jwks.UserAudience,
+			ExpiresAt: expires.Unix(),
+			Subject:   user.Name,
+		},
+		Roles:  user.Roles,
+		Tenant: user.Tenant,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Token{AccessToken: tokenString, RefreshToken: refreshToken, ExpiresAt: expires}, nil
+}
+
+// newRefreshToken generates a random session id and secret.
+func newRefreshToken() (id, secret string, err error) {
+	b := make([]byte, 48)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(b[:16]), base64.RawURLEncoding.EncodeToString(b[16:]), nil
 }
 
-// Verify the current http request is authorized.
+func hashSecret(secret string) []byte {
+	h := sha256.Sum256([]byte(secret))
+	return h[:]
+}
+
+// RemoteIP returns the IP address of the client of the http request. The
+// address is taken from the X-Forwarded-For header if the request comes
+// from one of the load balancers or proxies in "auth.trustedProxies", a
+// comma separated list of IP addresses or networks. The header is read
+// from right to left up to the first untrusted address, since clients can
+// send any addresses in the header.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	proxies := strings.Split(config.Get("auth.trustedProxies"), ",")
+	if !userdb.MatchIP(proxies, host) {
+		return host
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !userdb.MatchIP(proxies, host) {
+			break
+		}
+	}
+	return host
+}
+
+// Verify the current http request is authorized. The request is
+// authorized by an access token, or an API key in the "X-API-Key" header
+// or as a bearer token.
 func (auth *Authenticator) Verify(r *http.Request) (*userdb.BasicUser, error) {
-	var claims jwt.StandardClaims
+	if apikey := apiKeyFromRequest(r); apikey != "" {
+		return auth.VerifyAPIKey(apikey, RemoteIP(r))
+	}
+
+	var claims Claims
 
 	// Get token from request
 	_, err := request.ParseFromRequest(r, request.AuthorizationHeaderExtractor,
-		func(token *jwt.Token) (interface{}, error) {
-			return auth.secret, nil
-		}, request.WithClaims(&claims))
+		auth.keys.Keyfunc, request.WithClaims(&claims))
 
 	// If the token is missing or invalid, return error
 	if err != nil {
 		return nil, err
 	}
 
-	return &userdb.BasicUser{Name: claims.Subject}, nil
+	return &userdb.BasicUser{Name: claims.Subject, Roles: claims.Roles, Tenant: claims.Tenant}, nil
 }
 
+// VerifyToken verifies a user token and returns the user name.
 func (auth *Authenticator) VerifyToken(token string) (string, error) {
-	var claims jwt.StandardClaims
-	_, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
-		return auth.secret, nil
-	})
-	return claims.Subject, err
+	user, err := auth.VerifyUserToken(token)
+	if err != nil {
+		return "", err
+	}
+	return user.Name, nil
+}
+
+// VerifyUserToken verifies a user token and returns the user with the
+// roles in the token.
+func (auth *Authenticator) VerifyUserToken(token string) (*userdb.BasicUser, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, auth.keys.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	return &userdb.BasicUser{Name: claims.Subject, Roles: claims.Roles, Tenant: claims.Tenant}, nil
 }
@@ -1,14 +1,23 @@
 package auth_test
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
 	"net/http"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	"github.com/redhill42/iota/auth"
+	"github.com/redhill42/iota/auth/jwks"
+	"github.com/redhill42/iota/auth/oidc"
 	"github.com/redhill42/iota/auth/userdb"
 	_ "github.com/redhill42/iota/auth/userdb/mongodb"
 )
@@ -40,12 +49,14 @@ var _ = Describe("Authenticator", func() {
 		authz, err = auth.NewAuthenticator(db)
 		Expect(err).NotTo(HaveOccurred())
 
-		user := userdb.BasicUser{Name: TEST_USER}
+		user := userdb.BasicUser{Name: TEST_USER, Roles: []string{userdb.RoleAdmin}}
 		err = db.Create(&user, TEST_PASSWORD)
 		Expect(err).NotTo(HaveOccurred())
 	})
 
 	AfterEach(func() {
+		authz.RevokeSessions(TEST_USER)
+		authz.Close()
 		db.Remove(TEST_USER)
 		db.Close()
 	})
@@ -79,7 +90,7 @@ var _ = Describe("Authenticator", func() {
 			r, err := http.NewRequest("GET", "/", nil)
 			Expect(err).NotTo(HaveOccurred())
 
-			r.Header.Set("Authorization", "bearer "+token)
+			r.Header.Set("Authorization", "bearer "+token.AccessToken)
 			user, err := authz.Verify(r)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(user.Name).To(Equal(TEST_USER))
@@ -110,5 +121,340 @@ var _ = Describe("Authenticator", func() {
 			_, err = authz.Verify(r)
 			Expect(err).To(HaveOccurred())
 		})
+
+		It("should fail with tokens not issued for users", func() {
+			for _, aud := range []string{"", jwks.DeviceAudience} {
+				token, err := authz.Keys().Sign(&jwt.StandardClaims{
+					Issuer:    jwks.Issuer,
+					Audience:  aud,
+					ExpiresAt: time.Now().Add(time.Minute).Unix(),
+					Subject:   TEST_USER,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = authz.VerifyToken(token)
+				Expect(err).To(HaveOccurred())
+			}
+		})
+	})
+
+	Describe("Refresh", func() {
+		It("should issue new tokens with refresh token", func() {
+			_, token, err := authz.Authenticate(TEST_USER, TEST_PASSWORD)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(token.RefreshToken).NotTo(BeEmpty())
+
+			newToken, err := authz.Refresh(token.RefreshToken)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(newToken.RefreshToken).NotTo(Equal(token.RefreshToken))
+
+			user, err := authz.VerifyUserToken(newToken.AccessToken)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Name).To(Equal(TEST_USER))
+		})
+
+		It("should revoke session when refresh token is reused", func() {
+			_, token, err := authz.Authenticate(TEST_USER, TEST_PASSWORD)
+			Expect(err).NotTo(HaveOccurred())
+
+			newToken, err := authz.Refresh(token.RefreshToken)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = authz.Refresh(token.RefreshToken)
+			Expect(err).To(BeAssignableToTypeOf(auth.SessionError("")))
+			_, err = authz.Refresh(newToken.RefreshToken)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should fail with malformed refresh token", func() {
+			_, err := authz.Refresh("INVALID_TOKEN")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should fail for disabled user", func() {
+			_, token, err := authz.Authenticate(TEST_USER, TEST_PASSWORD)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(db.SetInactive(TEST_USER, true)).To(Succeed())
+			_, err = authz.Refresh(token.RefreshToken)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should revoke sessions of user disabled by profile update", func() {
+			_, token, err := authz.Authenticate(TEST_USER, TEST_PASSWORD)
+			Expect(err).NotTo(HaveOccurred())
+
+			admin := &userdb.BasicUser{Name: "admin", Roles: []string{userdb.RoleAdmin}}
+			Expect(authz.UpdateProfile(admin, TEST_USER, userdb.Args{"Inactive": true})).To(Succeed())
+			Expect(db.SetInactive(TEST_USER, false)).To(Succeed())
+			_, err = authz.Refresh(token.RefreshToken)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Logout", func() {
+		It("should revoke the session", func() {
+			_, token, err := authz.Authenticate(TEST_USER, TEST_PASSWORD)
+			Expect(err).NotTo(HaveOccurred())
+			_, other, err := authz.Authenticate(TEST_USER, TEST_PASSWORD)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(authz.Logout(token.RefreshToken, false)).To(Succeed())
+			_, err = authz.Refresh(token.RefreshToken)
+			Expect(err).To(HaveOccurred())
+			_, err = authz.Refresh(other.RefreshToken)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should revoke all sessions of the user", func() {
+			_, token, err := authz.Authenticate(TEST_USER, TEST_PASSWORD)
+			Expect(err).NotTo(HaveOccurred())
+			_, other, err := authz.Authenticate(TEST_USER, TEST_PASSWORD)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(authz.Logout(token.RefreshToken, true)).To(Succeed())
+			_, err = authz.Refresh(other.RefreshToken)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should revoke sessions of the user", func() {
+			_, token, err := authz.Authenticate(TEST_USER, TEST_PASSWORD)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(authz.RevokeSessions(TEST_USER)).To(Succeed())
+			_, err = authz.Refresh(token.RefreshToken)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("API keys", func() {
+		system := &userdb.BasicUser{Name: "system", Roles: []string{userdb.RoleAdmin}}
+
+		request := func(apikey string) *http.Request {
+			r, err := http.NewRequest("GET", "/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			r.RemoteAddr = "10.1.2.3:12345"
+			r.Header.Set("X-API-Key", apikey)
+			return r
+		}
+
+		AfterEach(func() {
+			db.RemoveAPIKey("ci")
+		})
+
+		It("should verify API key in X-API-Key header", func() {
+			apikey, err := db.CreateAPIKey(system, &userdb.APIKey{Name: "ci", Role: userdb.RoleViewer})
+			Expect(err).NotTo(HaveOccurred())
+
+			user, err := authz.Verify(request(apikey))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Name).To(Equal("service:ci"))
+			Expect(user.Roles).To(Equal([]string{userdb.RoleViewer}))
+		})
+
+		It("should verify API key as bearer token", func() {
+			apikey, err := db.CreateAPIKey(system, &userdb.APIKey{Name: "ci", Role: userdb.RoleViewer})
+			Expect(err).NotTo(HaveOccurred())
+
+			r := request("")
+			r.Header.Set("Authorization", "Bearer "+apikey)
+			user, err := authz.Verify(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Name).To(Equal("service:ci"))
+		})
+
+		It("should check IP allowlist", func() {
+			apikey, err := db.CreateAPIKey(system, &userdb.APIKey{Name: "ci", Role: userdb.RoleViewer, AllowedIPs: []string{"192.168.0.0/16"}})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = authz.Verify(request(apikey))
+			Expect(err).To(HaveOccurred())
+
+			r := request(apikey)
+			r.RemoteAddr = "192.168.1.1:12345"
+			_, err = authz.Verify(r)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should reject revoked API key", func() {
+			apikey, err := db.CreateAPIKey(system, &userdb.APIKey{Name: "ci", Role: userdb.RoleViewer})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = authz.Verify(request(apikey))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(authz.RevokeAPIKey(system, "ci")).To(Succeed())
+			_, err = authz.Verify(request(apikey))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Remote address", func() {
+		AfterEach(func() {
+			os.Unsetenv("IOTA_AUTH_TRUSTEDPROXIES")
+		})
+
+		remoteIP := func(remoteAddr string, forwardedFor ...string) string {
+			r, err := http.NewRequest("GET", "/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			r.RemoteAddr = remoteAddr
+			for _, v := range forwardedFor {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			return auth.RemoteIP(r)
+		}
+
+		It("should ignore forwarded addresses from untrusted clients", func() {
+			Expect(remoteIP("192.0.2.1:1234", "198.51.100.1")).To(Equal("192.0.2.1"))
+			os.Setenv("IOTA_AUTH_TRUSTEDPROXIES", "10.0.0.0/8")
+			Expect(remoteIP("192.0.2.1:1234", "198.51.100.1")).To(Equal("192.0.2.1"))
+		})
+
+		It("should take forwarded addresses from trusted proxies", func() {
+			os.Setenv("IOTA_AUTH_TRUSTEDPROXIES", "10.0.0.0/8, 192.0.2.1")
+			Expect(remoteIP("10.0.0.1:1234", "198.51.100.1")).To(Equal("198.51.100.1"))
+			Expect(remoteIP("10.0.0.1:1234", "203.0.113.9, 198.51.100.1, 192.0.2.1")).To(Equal("198.51.100.1"))
+			Expect(remoteIP("10.0.0.1:1234", "203.0.113.9", "198.51.100.1")).To(Equal("198.51.100.1"))
+			Expect(remoteIP("10.0.0.1:1234", "unknown")).To(Equal("10.0.0.1"))
+			Expect(remoteIP("10.0.0.1:1234")).To(Equal("10.0.0.1"))
+		})
+	})
+
+	Describe("Identity provider", func() {
+		const SSO_USER = "sso@example.com"
+
+		config := &oidc.Config{Issuer: "https://idp.example.com", AutoProvision: true}
+
+		AfterEach(func() {
+			authz.RevokeSessions(SSO_USER)
+			db.Remove(SSO_USER)
+		})
+
+		It("should verify login state", func() {
+			state, nonce, err := authz.NewLoginState()
+			Expect(err).NotTo(HaveOccurred())
+
+			got, err := authz.VerifyLoginState(state)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(nonce))
+
+			_, err = authz.VerifyLoginState(state + "x")
+			Expect(err).To(HaveOccurred())
+			_, err = authz.VerifyLoginState("x" + state)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should provision users", func() {
+			id := &oidc.Identity{Subject: "1234", Username: SSO_USER, Roles: []string{userdb.RoleViewer}}
+			user, token, err := authz.AuthenticateIdentity(id, config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Name).To(Equal(SSO_USER))
+			Expect(token.RefreshToken).NotTo(BeEmpty())
+
+			var found userdb.BasicUser
+			Expect(db.Find(SSO_USER, &found)).To(Succeed())
+			Expect(found.Roles).To(Equal([]string{userdb.RoleViewer}))
+		})
+
+		It("should update roles of existing users", func() {
+			id := &oidc.Identity{Subject: "1234", Username: SSO_USER, Roles: []string{userdb.RoleViewer}}
+			_, _, err := authz.AuthenticateIdentity(id, config)
+			Expect(err).NotTo(HaveOccurred())
+
+			id.Roles = []string{userdb.RoleOperator}
+			user, _, err := authz.AuthenticateIdentity(id, config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Roles).To(Equal([]string{userdb.RoleOperator}))
+
+			var found userdb.BasicUser
+			Expect(db.Find(SSO_USER, &found)).To(Succeed())
+			Expect(found.Roles).To(Equal([]string{userdb.RoleOperator}))
+		})
+
+		It("should not take over users of other identities", func() {
+			id := &oidc.Identity{Subject: "1234", Username: TEST_USER, Roles: []string{userdb.RoleAdmin}}
+			_, _, err := authz.AuthenticateIdentity(id, config)
+			Expect(err).To(BeAssignableToTypeOf(userdb.PermissionDeniedError("")))
+
+			var found userdb.BasicUser
+			Expect(db.Find(TEST_USER, &found)).To(Succeed())
+			Expect(found.Roles).To(Equal([]string{userdb.RoleAdmin}))
+
+			id = &oidc.Identity{Subject: "1234", Username: SSO_USER, Roles: []string{userdb.RoleViewer}}
+			_, _, err = authz.AuthenticateIdentity(id, config)
+			Expect(err).NotTo(HaveOccurred())
+
+			id.Subject = "5678"
+			_, _, err = authz.AuthenticateIdentity(id, config)
+			Expect(err).To(BeAssignableToTypeOf(userdb.PermissionDeniedError("")))
+			_, _, err = authz.AuthenticateIdentity(&oidc.Identity{Subject: "1234", Username: SSO_USER}, &oidc.Config{Issuer: "https://other.example.com"})
+			Expect(err).To(BeAssignableToTypeOf(userdb.PermissionDeniedError("")))
+		})
+
+		It("should not provision users if disabled", func() {
+			id := &oidc.Identity{Subject: "1234", Username: SSO_USER, Roles: []string{userdb.RoleViewer}}
+			_, _, err := authz.AuthenticateIdentity(id, &oidc.Config{})
+			Expect(err).To(MatchError(userdb.UserNotFoundError(SSO_USER)))
+		})
+
+		It("should reject inactive users", func() {
+			id := &oidc.Identity{Subject: "1234", Username: SSO_USER, Roles: []string{userdb.RoleViewer}}
+			_, _, err := authz.AuthenticateIdentity(id, config)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(db.SetInactive(SSO_USER, true)).To(Succeed())
+			_, _, err = authz.AuthenticateIdentity(id, config)
+			Expect(err).To(MatchError(userdb.InactiveUserError(SSO_USER)))
+		})
+	})
+
+	Describe("Second factor", func() {
+		BeforeEach(func() {
+			os.Setenv("IOTA_AUTH_TWOFACTORROLES", userdb.RoleAdmin)
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("IOTA_AUTH_TWOFACTORROLES")
+		})
+
+		It("should challenge users of required roles", func() {
+			_, _, err := authz.Authenticate(TEST_USER, TEST_PASSWORD)
+			Expect(err).To(BeAssignableToTypeOf(&auth.ChallengeError{}))
+			challenge := err.(*auth.ChallengeError)
+			Expect(challenge.Enroll).NotTo(BeNil())
+
+			_, _, _, err = authz.AuthenticateSecondFactor(challenge.Challenge+"x", "000000", "")
+			Expect(err).To(BeAssignableToTypeOf(auth.SessionError("")))
+
+			code := totpCode(challenge.Enroll.Secret, time.Now())
+			user, token, codes, err := authz.AuthenticateSecondFactor(challenge.Challenge, code, "10.1.2.3")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Name).To(Equal(TEST_USER))
+			Expect(token.AccessToken).NotTo(BeEmpty())
+			Expect(codes).To(HaveLen(10))
+
+			_, _, err = authz.Authenticate(TEST_USER, TEST_PASSWORD)
+			Expect(err).To(BeAssignableToTypeOf(&auth.ChallengeError{}))
+			challenge = err.(*auth.ChallengeError)
+			Expect(challenge.Enroll).To(BeNil())
+			_, _, _, err = authz.AuthenticateSecondFactor(challenge.Challenge, code, "10.1.2.3")
+			Expect(err).To(HaveOccurred())
+			_, _, _, err = authz.AuthenticateSecondFactor(challenge.Challenge, codes[0], "10.1.2.3")
+			Expect(err).NotTo(HaveOccurred())
+		})
 	})
 })
+
+// totpCode returns the TOTP code of the secret at the time, as specified
+// by RFC 6238.
+func totpCode(secret string, t time.Time) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(t.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+}
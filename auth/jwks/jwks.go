@@ -0,0 +1,465 @@
+// Package jwks manages the keys that sign and verify JWT tokens.
+//
+// A key set contains one or more asymmetric keys identified by the "kid"
+// header of tokens. The newest key signs new tokens, and all keys verify
+// tokens, so keys can be rotated without invalidating issued tokens. The
+// public keys are published as a JSON Web Key Set for external services
+// to verify tokens.
+package jwks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redhill42/iota/config"
+	"github.com/sirupsen/logrus"
+)
+
+// LegacyKeyID identifies the HMAC secret that signed tokens before key sets
+// were introduced. Tokens without "kid" header are verified by the legacy
+// key, which is never used to sign new tokens.
+const LegacyKeyID = "legacy"
+
+// Tokens are issued by "iota" for the audience of users or devices, so that
+// services verifying tokens with the published keys can tell user tokens
+// from device tokens.
+const (
+	Issuer         = "iota"
+	UserAudience   = "iota:user"
+	DeviceAudience = "iota:device"
+)
+
+// VerifyAudience checks the issuer and audience of the claims.
+func VerifyAudience(claims *jwt.StandardClaims, audience string) error {
+	if !claims.VerifyIssuer(Issuer, true) || !claims.VerifyAudience(audience, true) {
+		return jwt.NewValidationError("token is not issued for "+audience, jwt.ValidationErrorAudience)
+	}
+	return nil
+}
+
+// Key sets are reloaded periodically to pick up keys rotated by others.
+const (
+	_RELOAD_INTERVAL     = time.Minute
+	_MIN_RELOAD_INTERVAL = 5 * time.Second
+)
+
+// Key is a signing key in a key set.
+type Key struct {
+	ID        string    `json:"kid"`
+	Algorithm string    `json:"alg"`
+	Secret    []byte    `json:"key"` // PKCS#8 private key or HMAC secret
+	Created   time.Time `json:"created"`
+
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// Store stores key sets, which is implemented by user database and device
+// database.
+type Store interface {
+	// GetSecret returns a secret, the secret is generated and saved if it
+	// does not exist.
+	GetSecret(key string, gen func() ([]byte, error)) ([]byte, error)
+
+	// SetSecret replaces a secret.
+	SetSecret(key string, secret []byte) error
+}
+
+// KeySet is a set of signing keys.
+type KeySet struct {
+	store  Store
+	name   string
+	legacy string
+
+	mu     sync.RWMutex
+	keys   []*Key // newest key first
+	loaded time.Time
+	missed time.Time // last reload for an unknown key
+}
+
+// The KeyNotFoundError indicates that a key is not in the key set.
+type KeyNotFoundError string
+
+func (e KeyNotFoundError) Error() string {
+	return "Key not found: " + string(e)
+}
+
+func (e KeyNotFoundError) HTTPErrorStatusCode() int {
+	return http.StatusNotFound
+}
+
+var errNoLegacySecret = errors.New("no legacy secret")
+
+// Open the key set saved in the store with the name. If the key set does
+// not exist, a new key set is created with a key of the signing method
+// configured by "auth.signingMethod", and the legacy HMAC secret is added
+// to the key set if it exists.
+func Open(store Store, name, legacy string) (*KeySet, error) {
+	ks := &KeySet{store: store, name: name, legacy: legacy}
+	if err := ks.load(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (ks *KeySet) load() error {
+	data, err := ks.store.GetSecret(ks.name, ks.create)
+	if err != nil {
+		return err
+	}
+
+	var keys []*Key
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = key.init(); err != nil {
+			return fmt.Errorf("%s: %v", key.ID, err)
+		}
+	}
+	if len(keys) == 0 || keys[0].ID == LegacyKeyID {
+		return fmt.Errorf("No signing key in %s", ks.name)
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.loaded = time.Now()
+	ks.mu.Unlock()
+	return nil
+}
+
+// create generates data of a new key set.
+func (ks *KeySet) create() ([]byte, error) {
+	key, err := GenerateKey(config.GetOrDefault("auth.signingMethod", "RS256"))
+	if err != nil {
+		return nil, err
+	}
+	keys := []*Key{key}
+
+	secret, err := ks.store.GetSecret(ks.legacy, func() ([]byte, error) {
+		return nil, errNoLegacySecret
+	})
+	if err == nil && len(secret) != 0 {
+		keys = append(keys, &Key{ID: LegacyKeyID, Algorithm: "HS256", Secret: secret})
+	}
+	return json.Marshal(keys)
+}
+
+func (ks *KeySet) save(keys []*Key) error {
+	data, err := json.Marshal(keys)
+	if err == nil {
+		err = ks.store.SetSecret(ks.name, data)
+	}
+	if err == nil {
+		ks.mu.Lock()
+		ks.keys = keys
+		ks.loaded = time.Now()
+		ks.mu.Unlock()
+	}
+	return err
+}
+
+// reload the key set if it's loaded earlier than the given interval.
+func (ks *KeySet) reload(interval time.Duration) {
+	ks.mu.RLock()
+	stale := time.Since(ks.loaded) >= interval
+	ks.mu.RUnlock()
+
+	if stale {
+		if err := ks.load(); err != nil {
+			logrus.WithError(err).Errorf("Failed to reload %s", ks.name)
+		}
+	}
+}
+
+// missedKey returns true if the key set should be reloaded to find an
+// unknown key. Reloads are limited to prevent flooding the database with
+// forged tokens.
+func (ks *KeySet) missedKey() bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if time.Since(ks.missed) < _MIN_RELOAD_INTERVAL {
+		return false
+	}
+	ks.missed = time.Now()
+	return true
+}
+
+func (ks *KeySet) find(kid string) *Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	for _, key := range ks.keys {
+		if key.ID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// Sign the claims with the current signing key.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	ks.reload(_RELOAD_INTERVAL)
+
+	ks.mu.RLock()
+	key := ks.keys[0]
+	ks.mu.RUnlock()
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signKey)
+}
+
+// Keyfunc returns the key to verify the token. It's used as jwt.Keyfunc.
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = LegacyKeyID
+	}
+
+	ks.reload(_RELOAD_INTERVAL)
+	key := ks.find(kid)
+	if key == nil && ks.missedKey() {
+		// The key may be rotated recently
+		if err := ks.load(); err != nil {
+			logrus.WithError(err).Errorf("Failed to reload %s", ks.name)
+		}
+		key = ks.find(kid)
+	}
+	if key == nil {
+		return nil, KeyNotFoundError(kid)
+	}
+
+	// Prevent a public key from being used as HMAC secret
+	if token.Method.Alg() != key.Algorithm {
+		return nil, jwt.ErrInvalidKeyType
+	}
+	return key.verifyKey, nil
+}
+
+// Keys returns keys in the key set, the newest key first.
+func (ks *KeySet) Keys() []*Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return append([]*Key(nil), ks.keys...)
+}
+
+// Rotate adds a new key to sign tokens. Previous keys still verify tokens
+// until they are removed.
+func (ks *KeySet) Rotate(alg string) (*Key, error) {
+	key, err := GenerateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	if err = ks.load(); err != nil {
+		return nil, err
+	}
+	return key, ks.save(append([]*Key{key}, ks.Keys()...))
+}
+
+// Remove a key from the key set, tokens signed by the key are no longer
+// valid. The current signing key can't be removed.
+func (ks *KeySet) Remove(kid string) error {
+	if err := ks.load(); err != nil {
+		return err
+	}
+
+	keys := ks.Keys()
+	for i, key := range keys {
+		if key.ID == kid {
+			if i == 0 {
+				return errors.New("The current signing key can't be removed, rotate it first")
+			}
+			return ks.save(append(keys[:i], keys[i+1:]...))
+		}
+	}
+	return KeyNotFoundError(kid)
+}
+
+// GenerateKey generates a new key for the signing method, which is "RS256"
+// or "EdDSA".
+func GenerateKey(alg string) (*Key, error) {
+	var privateKey crypto.PrivateKey
+	var err error
+
+	switch alg {
+	case "RS256":
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("Unsupported signing method: %s", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	key := &Key{
+		ID:        hex.EncodeToString(id),
+		Algorithm: alg,
+		Secret:    secret,
+		Created:   time.Now().UTC().Truncate(time.Second),
+	}
+	return key, key.init()
+}
+
+// init parses the secret of the key.
+func (key *Key) init() error {
+	if key.method = jwt.GetSigningMethod(key.Algorithm); key.method == nil {
+		return fmt.Errorf("Unsupported signing method: %s", key.Algorithm)
+	}
+
+	if key.Algorithm == "HS256" {
+		key.signKey, key.verifyKey = key.Secret, key.Secret
+		return nil
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(key.Secret)
+	if err != nil {
+		return err
+	}
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		key.signKey, key.verifyKey = k, &k.PublicKey
+	case ed25519.PrivateKey:
+		key.signKey, key.verifyKey = k, k.Public()
+	}
+	if key.signKey == nil || !key.matches() {
+		return fmt.Errorf("Key type mismatch with signing method %s", key.Algorithm)
+	}
+	return nil
+}
+
+func (key *Key) matches() bool {
+	switch key.verifyKey.(type) {
+	case *rsa.PublicKey:
+		return key.Algorithm == "RS256"
+	case ed25519.PublicKey:
+		return key.Algorithm == "EdDSA"
+	}
+	return false
+}
+
+// JSONWebKey is a public key in JWK format (RFC 7517).
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is a set of public keys in JWKS format.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// PublicKeys returns the public keys of the key set. HMAC secrets are
+// never published.
+func (ks *KeySet) PublicKeys() []JSONWebKey {
+	ks.reload(_RELOAD_INTERVAL)
+
+	var result []JSONWebKey
+	for _, key := range ks.Keys() {
+		jwk := JSONWebKey{KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm}
+		switch k := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = encode(k.N.Bytes())
+			jwk.E = encode(big.NewInt(int64(k.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = encode(k)
+		default:
+			continue
+		}
+		result = append(result, jwk)
+	}
+	return result
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// PublicKey returns the public key that verifies tokens signed by the
+// JSON Web Key, which is *rsa.PublicKey, *ecdsa.PublicKey or
+// ed25519.PublicKey.
+func (jwk *JSONWebKey) PublicKey() (interface{}, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			break
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve: %s", jwk.Curve)
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err1 != nil || err2 != nil {
+			break
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			break
+		}
+		return key, nil
+
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, fmt.Errorf("Unsupported curve: %s", jwk.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			break
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported key type: %s", jwk.KeyType)
+	}
+	return nil, fmt.Errorf("Invalid %s key: %s", jwk.KeyType, jwk.KeyID)
+}
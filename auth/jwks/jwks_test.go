@@ -0,0 +1,278 @@
+package jwks_test
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/redhill42/iota/auth/jwks"
+)
+
+func TestKeySet(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Key Set Suite")
+}
+
+type memoryStore map[string][]byte
+
+func (m memoryStore) GetSecret(key string, gen func() ([]byte, error)) ([]byte, error) {
+	if secret, ok := m[key]; ok {
+		return secret, nil
+	}
+	secret, err := gen()
+	if err == nil {
+		m[key] = secret
+	}
+	return secret, err
+}
+
+func (m memoryStore) SetSecret(key string, secret []byte) error {
+	m[key] = secret
+	return nil
+}
+
+var _ = Describe("KeySet", func() {
+	var (
+		store memoryStore
+		ks    *jwks.KeySet
+	)
+
+	sign := func(subject string) string {
+		token, err := ks.Sign(&jwt.StandardClaims{Subject: subject})
+		Expect(err).NotTo(HaveOccurred())
+		return token
+	}
+
+	verify := func(ks *jwks.KeySet, token string) (string, error) {
+		var claims jwt.StandardClaims
+		_, err := jwt.ParseWithClaims(token, &claims, ks.Keyfunc)
+		return claims.Subject, err
+	}
+
+	verifyWith := func(pub interface{}, token string) (string, error) {
+		var claims jwt.StandardClaims
+		_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+			return pub, nil
+		})
+		return claims.Subject, err
+	}
+
+	BeforeEach(func() {
+		var err error
+		store = make(memoryStore)
+		ks, err = jwks.Open(store, "test.keys", "test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should create a key set with a signing key", func() {
+		keys := ks.Keys()
+		Expect(keys).To(HaveLen(1))
+		Expect(keys[0].Algorithm).To(Equal("RS256"))
+		Expect(store).To(HaveKey("test.keys"))
+		Expect(store).NotTo(HaveKey("test"))
+	})
+
+	It("should sign and verify tokens", func() {
+		token := sign("alice")
+		parsed, _, err := new(jwt.Parser).ParseUnverified(token, &jwt.StandardClaims{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed.Header["kid"]).To(Equal(ks.Keys()[0].ID))
+
+		subject, err := verify(ks, token)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(subject).To(Equal("alice"))
+	})
+
+	It("should reject tokens signed by unknown keys", func() {
+		other, err := jwks.Open(make(memoryStore), "test.keys", "test")
+		Expect(err).NotTo(HaveOccurred())
+		token, err := other.Sign(&jwt.StandardClaims{Subject: "alice"})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = verify(ks, token)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should sign tokens with EdDSA", func() {
+		key, err := ks.Rotate("EdDSA")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key.Algorithm).To(Equal("EdDSA"))
+
+		subject, err := verify(ks, sign("alice"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(subject).To(Equal("alice"))
+	})
+
+	It("should reject unsupported signing methods", func() {
+		_, err := ks.Rotate("HS256")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should verify the issuer and audience of tokens", func() {
+		claims := &jwt.StandardClaims{Issuer: jwks.Issuer, Audience: jwks.UserAudience}
+		Expect(jwks.VerifyAudience(claims, jwks.UserAudience)).To(Succeed())
+		Expect(jwks.VerifyAudience(claims, jwks.DeviceAudience)).NotTo(Succeed())
+
+		claims.Issuer = "other"
+		Expect(jwks.VerifyAudience(claims, jwks.UserAudience)).NotTo(Succeed())
+		Expect(jwks.VerifyAudience(&jwt.StandardClaims{}, jwks.UserAudience)).NotTo(Succeed())
+	})
+
+	Context("Legacy secret", func() {
+		var secret = []byte("legacy secret")
+
+		BeforeEach(func() {
+			var err error
+			store = memoryStore{"test": secret}
+			ks, err = jwks.Open(store, "test.keys", "test")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should verify tokens signed by the legacy secret", func() {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{Subject: "alice"}).SignedString(secret)
+			Expect(err).NotTo(HaveOccurred())
+
+			subject, err := verify(ks, token)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(subject).To(Equal("alice"))
+		})
+
+		It("should not sign tokens with the legacy secret", func() {
+			keys := ks.Keys()
+			Expect(keys).To(HaveLen(2))
+			Expect(keys[0].Algorithm).To(Equal("RS256"))
+			Expect(keys[1].ID).To(Equal(jwks.LegacyKeyID))
+		})
+
+		It("should not publish the legacy secret", func() {
+			keys := ks.PublicKeys()
+			Expect(keys).To(HaveLen(1))
+			Expect(keys[0].KeyType).To(Equal("RSA"))
+		})
+
+		It("should reject public key used as HMAC secret", func() {
+			var pub []byte
+			for _, jwk := range ks.PublicKeys() {
+				pub, _ = base64.RawURLEncoding.DecodeString(jwk.N)
+			}
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{Subject: "alice"})
+			token.Header["kid"] = ks.Keys()[0].ID
+			signed, err := token.SignedString(pub)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = verify(ks, signed)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should invalidate legacy tokens when the legacy secret is removed", func() {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{Subject: "alice"}).SignedString(secret)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ks.Remove(jwks.LegacyKeyID)).To(Succeed())
+			_, err = verify(ks, token)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Rotation", func() {
+		It("should verify tokens signed by previous keys", func() {
+			old := sign("alice")
+			oldKey := ks.Keys()[0]
+
+			key, err := ks.Rotate("RS256")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(key.ID).NotTo(Equal(oldKey.ID))
+			Expect(ks.Keys()[0].ID).To(Equal(key.ID))
+
+			_, err = verify(ks, old)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = verify(ks, sign("bob"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should invalidate tokens signed by removed keys", func() {
+			old := sign("alice")
+			oldKey := ks.Keys()[0]
+
+			_, err := ks.Rotate("RS256")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ks.Remove(oldKey.ID)).To(Succeed())
+
+			_, err = verify(ks, old)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should not remove the current signing key", func() {
+			Expect(ks.Remove(ks.Keys()[0].ID)).NotTo(Succeed())
+		})
+
+		It("should fail to remove unknown key", func() {
+			err := ks.Remove("unknown")
+			Expect(errors.As(err, new(jwks.KeyNotFoundError))).To(BeTrue())
+		})
+
+		It("should verify tokens signed by keys rotated by others", func() {
+			other, err := jwks.Open(store, "test.keys", "test")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = other.Rotate("EdDSA")
+			Expect(err).NotTo(HaveOccurred())
+
+			token, err := other.Sign(&jwt.StandardClaims{Subject: "alice"})
+			Expect(err).NotTo(HaveOccurred())
+			subject, err := verify(ks, token)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(subject).To(Equal("alice"))
+		})
+	})
+
+	It("should parse published public keys", func() {
+		_, err := ks.Rotate("EdDSA")
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, jwk := range ks.PublicKeys() {
+			pub, err := jwk.PublicKey()
+			Expect(err).NotTo(HaveOccurred())
+			subject, err := verifyWith(pub, sign("alice"))
+			if jwk.KeyID == ks.Keys()[0].ID {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(subject).To(Equal("alice"))
+			} else {
+				Expect(err).To(HaveOccurred())
+			}
+		}
+
+		_, err = (&jwks.JSONWebKey{KeyType: "oct"}).PublicKey()
+		Expect(err).To(HaveOccurred())
+		_, err = (&jwks.JSONWebKey{KeyType: "RSA", N: "!"}).PublicKey()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should publish public keys", func() {
+		token := sign("alice")
+		_, err := ks.Rotate("EdDSA")
+		Expect(err).NotTo(HaveOccurred())
+
+		keys := ks.PublicKeys()
+		Expect(keys).To(HaveLen(2))
+		Expect(keys[0].KeyType).To(Equal("OKP"))
+		Expect(keys[0].Curve).To(Equal("Ed25519"))
+		Expect(keys[0].Algorithm).To(Equal("EdDSA"))
+		Expect(keys[1].KeyType).To(Equal("RSA"))
+		Expect(keys[1].Algorithm).To(Equal("RS256"))
+
+		// External services verify tokens with the published keys
+		n, _ := base64.RawURLEncoding.DecodeString(keys[1].N)
+		e, _ := base64.RawURLEncoding.DecodeString(keys[1].E)
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		_, err = jwt.ParseWithClaims(token, &jwt.StandardClaims{}, func(*jwt.Token) (interface{}, error) {
+			return pub, nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,149 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redhill42/iota/auth/userdb"
+	"github.com/redhill42/iota/config"
+	"github.com/redhill42/iota/config/defaults"
+)
+
+// Config is the configuration of the identity provider.
+type Config struct {
+	// Issuer URL of the provider, the provider configuration is
+	// discovered from the issuer
+	Issuer string
+
+	// ClientID and ClientSecret registered in the provider
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL receives the authorization code from the provider
+	RedirectURL string
+
+	// Scopes requested from the provider
+	Scopes []string
+
+	// UsernameClaim is the claim of the user name. The "preferred_username",
+	// "email" and "sub" claims are tried in order if it's empty.
+	UsernameClaim string
+
+	// UsernamePrefix is prepended to user names, which keeps users of the
+	// provider apart from local users with the same name
+	UsernamePrefix string
+
+	// GroupsClaim is the claim of groups of the user
+	GroupsClaim string
+
+	// TenantClaim is the claim of the tenant of the user, users are
+	// system users if it's empty
+	TenantClaim string
+
+	// RoleMapping maps groups to roles
+	RoleMapping map[string][]string
+
+	// DefaultRoles are given to users without mapped roles
+	DefaultRoles []string
+
+	// AutoProvision creates users that are not in the user database
+	AutoProvision bool
+
+	// HTTPClient used to send requests to the provider
+	HTTPClient *http.Client
+}
+
+// Configure loads the configuration from the "oidc" configuration section.
+// Returns nil if the identity provider is not configured.
+func Configure() (*Config, error) {
+	issuer := config.Get("oidc.issuer")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	cfg := &Config{
+		Issuer:         issuer,
+		ClientID:       config.Get("oidc.clientId"),
+		ClientSecret:   config.Get("oidc.clientSecret"),
+		RedirectURL:    config.GetOrDefault("oidc.redirectUrl", defaults.ApiURL()+"/api/auth/oidc/callback"),
+		Scopes:         strings.Fields(config.GetOrDefault("oidc.scopes", "openid profile email")),
+		UsernameClaim:  config.Get("oidc.usernameClaim"),
+		UsernamePrefix: config.Get("oidc.usernamePrefix"),
+		GroupsClaim:    config.GetOrDefault("oidc.groupsClaim", "groups"),
+		TenantClaim:    config.Get("oidc.tenantClaim"),
+		DefaultRoles:   splitList(config.GetOrDefault("oidc.defaultRole", userdb.RoleViewer)),
+	}
+	if cfg.ClientID == "" {
+		return nil, fmt.Errorf("oidc: missing client id of %s", issuer)
+	}
+
+	var err error
+	if cfg.AutoProvision, err = strconv.ParseBool(config.GetOrDefault("oidc.autoProvision", "true")); err != nil {
+		return nil, fmt.Errorf("oidc: invalid autoProvision: %v", err)
+	}
+
+	if cfg.RoleMapping, err = userdb.ParseRoleMapping(config.Get("oidc.roleMapping")); err != nil {
+		return nil, err
+	}
+	if err = userdb.ValidateRoles(cfg.DefaultRoles); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// identity maps the claims of an ID token to an identity.
+func (cfg *Config) identity(claims jwt.MapClaims) (*Identity, error) {
+	id := &Identity{}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	if id.Subject == "" {
+		return nil, invalidToken("missing subject")
+	}
+
+	var username string
+	if cfg.UsernameClaim != "" {
+		username, _ = claims[cfg.UsernameClaim].(string)
+	} else {
+		for _, claim := range []string{"preferred_username", "email", "sub"} {
+			if username, _ = claims[claim].(string); username != "" {
+				break
+			}
+		}
+	}
+	if username == "" {
+		return nil, invalidToken("missing user name claim %s", cfg.UsernameClaim)
+	}
+	id.Username = cfg.UsernamePrefix + strings.ToLower(username)
+
+	// The groups claim is usually an array, but may be a single group
+	switch groups := claims[cfg.GroupsClaim].(type) {
+	case string:
+		id.Groups = []string{groups}
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	}
+
+	id.Roles = userdb.MapRoles(cfg.RoleMapping, id.Groups, cfg.DefaultRoles)
+
+	if cfg.TenantClaim != "" {
+		id.Tenant, _ = claims[cfg.TenantClaim].(string)
+	}
+	return id, nil
+}
@@ -0,0 +1,427 @@
+// Package oidc logs in users with an OpenID Connect identity provider.
+//
+// Users login in a browser with the authorization code flow, or on devices
+// without a browser, such as the command line interface, with the device
+// authorization flow (RFC 8628). The ID token issued by the provider is
+// verified with the public keys published by the provider, and the claims
+// of the ID token are mapped to the user name, roles and tenant of the
+// iota user.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redhill42/iota/auth/jwks"
+	"github.com/sirupsen/logrus"
+)
+
+// Error codes returned by the token endpoint while the user has not yet
+// approved a device login.
+const (
+	AuthorizationPending = "authorization_pending"
+	SlowDown             = "slow_down"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Public keys of the provider are reloaded periodically, and when a token
+// is signed by an unknown key.
+const (
+	_KEYS_RELOAD_INTERVAL     = time.Hour
+	_KEYS_MIN_RELOAD_INTERVAL = 5 * time.Second
+)
+
+// Error is an error response of the identity provider, or an error
+// verifying the ID token.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("oidc: %s: %s", e.Code, e.Description)
+	}
+	return "oidc: " + e.Code
+}
+
+func (e *Error) HTTPErrorStatusCode() int {
+	return http.StatusUnauthorized
+}
+
+// IsPending returns true if the error indicates that a device login is
+// not yet approved by the user.
+func IsPending(err error) bool {
+	e, ok := err.(*Error)
+	return ok && (e.Code == AuthorizationPending || e.Code == SlowDown)
+}
+
+func invalidToken(format string, args ...interface{}) error {
+	return &Error{Code: "invalid_token", Description: fmt.Sprintf(format, args...)}
+}
+
+// Identity is a user authenticated by the identity provider.
+type Identity struct {
+	// Subject is the unique identifier of the user in the provider
+	Subject string
+
+	// Username is the name of the iota user
+	Username string
+
+	// Email of the user, if provided
+	Email string
+
+	// Groups of the user in the provider
+	Groups []string
+
+	// Roles mapped from the groups
+	Roles []string
+
+	// Tenant of the user, empty if tenant claim is not configured
+	Tenant string
+}
+
+// DeviceAuth is the response of a device authorization request. The user
+// visits the verification URI and enters the user code to approve the
+// login, while the device polls the token endpoint with the device code.
+type DeviceAuth struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval,omitempty"`
+}
+
+// metadata is the provider configuration obtained by discovery.
+type metadata struct {
+	Issuer                      string `json:"issuer"`
+	AuthorizationEndpoint       string `json:"authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	JWKSURI                     string `json:"jwks_uri"`
+}
+
+// tokenResponse is the response of the token endpoint.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	Error
+}
+
+// Provider is an OpenID Connect identity provider. The provider is
+// discovered on first use, so that the API server can start while the
+// provider is unavailable.
+type Provider struct {
+	config *Config
+	client *http.Client
+
+	mu       sync.Mutex
+	meta     *metadata
+	keys     map[string]interface{}
+	loaded   time.Time
+	missed   time.Time
+	keysLock sync.RWMutex
+}
+
+// New creates a provider with the configuration.
+func New(config *Config) *Provider {
+	client := config.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Provider{config: config, client: client}
+}
+
+// Config returns the configuration of the provider.
+func (p *Provider) Config() *Config {
+	return p.config
+}
+
+// discover fetches the provider configuration from the well-known
+// location of the issuer.
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	issuer := strings.TrimSuffix(p.config.Issuer, "/")
+	var meta metadata
+	if err := p.get(ctx, issuer+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc: issuer mismatch, expected %s, got %s", issuer, meta.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: incomplete provider configuration of %s", issuer)
+	}
+	p.meta = &meta
+	return p.meta, nil
+}
+
+func (p *Provider) get(ctx context.Context, uri string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %s: %s", uri, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// post sends a form to an endpoint of the provider. Error responses are
+// decoded as *Error.
+func (p *Provider) post(ctx context.Context, uri string, form url.Values, v interface{}) error {
+	form.Set("client_id", p.config.ClientID)
+	req, err := http.NewRequestWithContext(ctx, "POST", uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e Error
+		if json.Unmarshal(body, &e) != nil || e.Code == "" {
+			return fmt.Errorf("oidc: %s: %s", uri, resp.Status)
+		}
+		return &e
+	}
+	return json.Unmarshal(body, v)
+}
+
+// AuthCodeURL returns the URL of the provider to login with the
+// authorization code flow. The provider redirects the browser to the
+// redirect URL with the authorization code and the state.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientID)
+	q.Set("redirect_uri", p.config.RedirectURL)
+	q.Set("scope", strings.Join(p.config.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange exchanges the authorization code for an ID token, and returns
+// the identity in the ID token. The nonce must match the nonce given to
+// AuthCodeURL.
+func (p *Provider) Exchange(ctx context.Context, code, nonce string) (*Identity, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.config.RedirectURL},
+	}
+	var resp tokenResponse
+	if err = p.post(ctx, meta.TokenEndpoint, form, &resp); err != nil {
+		return nil, err
+	}
+	return p.Verify(ctx, resp.IDToken, nonce)
+}
+
+// DeviceAuth starts a device login.
+func (p *Provider) DeviceAuth(ctx context.Context) (*DeviceAuth, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if meta.DeviceAuthorizationEndpoint == "" {
+		return nil, &Error{Code: "unsupported_grant_type", Description: "Device login is not supported by the identity provider"}
+	}
+
+	form := url.Values{"scope": {strings.Join(p.config.Scopes, " ")}}
+	var resp DeviceAuth
+	if err = p.post(ctx, meta.DeviceAuthorizationEndpoint, form, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Interval == 0 {
+		resp.Interval = 5
+	}
+	if resp.ExpiresIn == 0 {
+		resp.ExpiresIn = 300
+	}
+	return &resp, nil
+}
+
+// DeviceToken polls the token endpoint for the device login. An error
+// satisfying IsPending is returned until the user approves the login.
+func (p *Provider) DeviceToken(ctx context.Context, deviceCode string) (*Identity, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":  {deviceCodeGrantType},
+		"device_code": {deviceCode},
+	}
+	var resp tokenResponse
+	if err = p.post(ctx, meta.TokenEndpoint, form, &resp); err != nil {
+		return nil, err
+	}
+	return p.Verify(ctx, resp.IDToken, "")
+}
+
+// Verify the ID token issued by the provider and returns the identity in
+// the token. The nonce is checked if not empty.
+func (p *Provider) Verify(ctx context.Context, idToken, nonce string) (*Identity, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if idToken == "" {
+		return nil, invalidToken("missing ID token")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			return nil, jwt.ErrInvalidKeyType
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(ctx, meta, kid)
+	})
+	if err != nil {
+		return nil, invalidToken("%v", err)
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != strings.TrimSuffix(meta.Issuer, "/") {
+		return nil, invalidToken("issuer mismatch: %s", iss)
+	}
+	if !hasAudience(claims["aud"], p.config.ClientID) {
+		return nil, invalidToken("audience mismatch")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, invalidToken("missing expiration time")
+	}
+	if got, _ := claims["nonce"].(string); nonce != "" && got != nonce {
+		return nil, invalidToken("nonce mismatch")
+	}
+	return p.config.identity(claims)
+}
+
+func hasAudience(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// publicKey returns the public key of the provider identified by kid. The
+// keys are reloaded if the key is unknown, since the provider may rotate
+// keys at any time.
+func (p *Provider) publicKey(ctx context.Context, meta *metadata, kid string) (interface{}, error) {
+	p.keysLock.RLock()
+	key, ok := p.keys[kid]
+	stale := time.Since(p.loaded) >= _KEYS_RELOAD_INTERVAL
+	p.keysLock.RUnlock()
+	if ok && !stale {
+		return key, nil
+	}
+
+	if stale || p.missedKey() {
+		if err := p.loadKeys(ctx, meta); err != nil {
+			logrus.WithError(err).Error("oidc: Failed to load provider keys")
+		}
+		p.keysLock.RLock()
+		key, ok = p.keys[kid]
+		p.keysLock.RUnlock()
+	}
+	if !ok {
+		return nil, jwks.KeyNotFoundError(kid)
+	}
+	return key, nil
+}
+
+// missedKey limits reloads for unknown keys, so that forged tokens don't
+// flood the provider.
+func (p *Provider) missedKey() bool {
+	p.keysLock.Lock()
+	defer p.keysLock.Unlock()
+	if time.Since(p.missed) < _KEYS_MIN_RELOAD_INTERVAL {
+		return false
+	}
+	p.missed = time.Now()
+	return true
+}
+
+func (p *Provider) loadKeys(ctx context.Context, meta *metadata) error {
+	var set jwks.JSONWebKeySet
+	if err := p.get(ctx, meta.JWKSURI, &set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			logrus.WithError(err).Debugf("oidc: Ignore provider key %s", jwk.KeyID)
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+
+	p.keysLock.Lock()
+	p.keys = keys
+	p.loaded = time.Now()
+	p.keysLock.Unlock()
+	return nil
+}
@@ -0,0 +1,422 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/redhill42/iota/auth/jwks"
+	"github.com/redhill42/iota/auth/oidc"
+	"github.com/redhill42/iota/auth/userdb"
+)
+
+func TestOIDC(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "OIDC Suite")
+}
+
+const (
+	clientID     = "iota"
+	clientSecret = "secret"
+	redirectURL  = "http://iota.local/api/auth/oidc/callback"
+)
+
+// mockProvider is a minimal OpenID Connect provider. Users are logged in
+// without interaction, and device logins are approved by the test.
+type mockProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+	device bool
+
+	mu       sync.Mutex
+	claims   jwt.MapClaims     // claims of the logged in user
+	codes    map[string]string // authorization code to nonce
+	approved bool
+}
+
+func newMockProvider() *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+
+	m := &mockProvider{key: key, kid: "k1", device: true, codes: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/other/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/jwks", m.jwks)
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	mux.HandleFunc("/device", m.deviceAuth)
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	meta := map[string]string{
+		"issuer":                 m.URL,
+		"authorization_endpoint": m.URL + "/authorize",
+		"token_endpoint":         m.URL + "/token",
+		"jwks_uri":               m.URL + "/jwks",
+	}
+	if m.device {
+		meta["device_authorization_endpoint"] = m.URL + "/device"
+	}
+	json.NewEncoder(w).Encode(meta)
+}
+
+func (m *mockProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := m.key.PublicKey
+	json.NewEncoder(w).Encode(jwks.JSONWebKeySet{Keys: []jwks.JSONWebKey{{
+		KeyType:   "RSA",
+		KeyID:     m.kid,
+		Use:       "sig",
+		Algorithm: "RS256",
+		N:         base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}})
+}
+
+func (m *mockProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != clientID || q.Get("response_type") != "code" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	code := "code" + q.Get("state")
+	m.codes[code] = q.Get("nonce")
+	m.mu.Unlock()
+
+	u, _ := url.Parse(q.Get("redirect_uri"))
+	u.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func (m *mockProvider) deviceAuth(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(oidc.DeviceAuth{
+		DeviceCode:      "device-code",
+		UserCode:        "ABCD-EFGH",
+		VerificationURI: m.URL + "/activate",
+		ExpiresIn:       60,
+		Interval:        1,
+	})
+}
+
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	if id, secret, ok := r.BasicAuth(); !ok || id != clientID || secret != clientSecret {
+		m.fail(w, "invalid_client")
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var nonce string
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		var ok bool
+		if nonce, ok = m.codes[r.FormValue("code")]; !ok || r.FormValue("redirect_uri") != redirectURL {
+			m.fail(w, "invalid_grant")
+			return
+		}
+		delete(m.codes, r.FormValue("code"))
+	case "urn:ietf:params:oauth:grant-type:device_code":
+		if r.FormValue("device_code") != "device-code" {
+			m.fail(w, "invalid_grant")
+			return
+		}
+		if !m.approved {
+			m.fail(w, oidc.AuthorizationPending)
+			return
+		}
+	default:
+		m.fail(w, "unsupported_grant_type")
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss": m.URL,
+		"aud": clientID,
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"id_token":     m.sign(claims),
+	})
+}
+
+func (m *mockProvider) fail(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func (m *mockProvider) sign(claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = m.kid
+	signed, err := token.SignedString(m.key)
+	Expect(err).NotTo(HaveOccurred())
+	return signed
+}
+
+var _ = Describe("Provider", func() {
+	var (
+		mock     *mockProvider
+		config   *oidc.Config
+		provider *oidc.Provider
+		ctx      = context.Background()
+	)
+
+	BeforeEach(func() {
+		mock = newMockProvider()
+		mock.claims = jwt.MapClaims{
+			"sub":                "1234",
+			"preferred_username": "Alice",
+			"email":              "alice@example.com",
+			"groups":             []string{"iota-admins", "staff"},
+		}
+		config = &oidc.Config{
+			Issuer:       mock.URL,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{"openid", "profile", "email"},
+			GroupsClaim:  "groups",
+			RoleMapping: map[string][]string{
+				"iota-admins": {userdb.RoleAdmin},
+				"iota-ops":    {userdb.RoleOperator},
+			},
+			DefaultRoles:  []string{userdb.RoleViewer},
+			AutoProvision: true,
+		}
+		provider = oidc.New(config)
+	})
+
+	AfterEach(func() {
+		mock.Close()
+	})
+
+	// login follows the authorization URL and returns the authorization
+	// code redirected back from the provider.
+	login := func(state, nonce string) string {
+		uri, err := provider.AuthCodeURL(ctx, state, nonce)
+		Expect(err).NotTo(HaveOccurred())
+
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+		resp, err := client.Get(uri)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusFound))
+
+		u, err := url.Parse(resp.Header.Get("Location"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u.Query().Get("state")).To(Equal(state))
+		return u.Query().Get("code")
+	}
+
+	Describe("Authorization code flow", func() {
+		It("should login with authorization code", func() {
+			code := login("state", "nonce")
+			id, err := provider.Exchange(ctx, code, "nonce")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id.Subject).To(Equal("1234"))
+			Expect(id.Username).To(Equal("alice"))
+			Expect(id.Email).To(Equal("alice@example.com"))
+			Expect(id.Groups).To(Equal([]string{"iota-admins", "staff"}))
+			Expect(id.Roles).To(Equal([]string{userdb.RoleAdmin}))
+		})
+
+		It("should reject nonce mismatch", func() {
+			code := login("state", "nonce")
+			_, err := provider.Exchange(ctx, code, "other")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject invalid authorization code", func() {
+			_, err := provider.Exchange(ctx, "invalid", "nonce")
+			Expect(err).To(BeAssignableToTypeOf(&oidc.Error{}))
+			Expect(err.(*oidc.Error).Code).To(Equal("invalid_grant"))
+		})
+
+		It("should reject invalid client secret", func() {
+			config.ClientSecret = "wrong"
+			_, err := provider.Exchange(ctx, login("state", "nonce"), "nonce")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should fail if the issuer mismatches", func() {
+			config.Issuer = mock.URL + "/other"
+			_, err := provider.AuthCodeURL(ctx, "state", "nonce")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Device flow", func() {
+		It("should login after the user approved", func() {
+			da, err := provider.DeviceAuth(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(da.UserCode).To(Equal("ABCD-EFGH"))
+
+			_, err = provider.DeviceToken(ctx, da.DeviceCode)
+			Expect(oidc.IsPending(err)).To(BeTrue())
+
+			mock.mu.Lock()
+			mock.approved = true
+			mock.mu.Unlock()
+
+			id, err := provider.DeviceToken(ctx, da.DeviceCode)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id.Username).To(Equal("alice"))
+		})
+
+		It("should reject invalid device code", func() {
+			_, err := provider.DeviceToken(ctx, "invalid")
+			Expect(err).To(HaveOccurred())
+			Expect(oidc.IsPending(err)).To(BeFalse())
+		})
+
+		It("should fail if the provider doesn't support device login", func() {
+			mock.device = false
+			_, err := provider.DeviceAuth(ctx)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ID token", func() {
+		claims := func() jwt.MapClaims {
+			return jwt.MapClaims{
+				"iss": mock.URL,
+				"aud": []string{"other", clientID},
+				"sub": "1234",
+				"exp": time.Now().Add(time.Minute).Unix(),
+			}
+		}
+
+		It("should verify ID token with multiple audiences", func() {
+			id, err := provider.Verify(ctx, mock.sign(claims()), "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id.Username).To(Equal("1234"))
+		})
+
+		It("should reject expired ID token", func() {
+			c := claims()
+			c["exp"] = time.Now().Add(-time.Minute).Unix()
+			_, err := provider.Verify(ctx, mock.sign(c), "")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject ID token without expiration time", func() {
+			c := claims()
+			delete(c, "exp")
+			_, err := provider.Verify(ctx, mock.sign(c), "")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject ID token of other clients", func() {
+			c := claims()
+			c["aud"] = "other"
+			_, err := provider.Verify(ctx, mock.sign(c), "")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject ID token of other issuers", func() {
+			c := claims()
+			c["iss"] = "https://evil.example.com"
+			_, err := provider.Verify(ctx, mock.sign(c), "")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject ID token signed by unknown keys", func() {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).NotTo(HaveOccurred())
+			signed, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims()).SignedString(key)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = provider.Verify(ctx, signed, "")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject ID token signed with HMAC", func() {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+			token.Header["kid"] = mock.kid
+			signed, err := token.SignedString([]byte(clientSecret))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = provider.Verify(ctx, signed, "")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should verify ID token signed by rotated keys", func() {
+			_, err := provider.Verify(ctx, mock.sign(claims()), "")
+			Expect(err).NotTo(HaveOccurred())
+
+			mock.key, err = rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).NotTo(HaveOccurred())
+			mock.kid = "k2"
+			_, err = provider.Verify(ctx, mock.sign(claims()), "")
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("Claims mapping", func() {
+		verify := func(c jwt.MapClaims) *oidc.Identity {
+			c["iss"] = mock.URL
+			c["aud"] = clientID
+			c["exp"] = time.Now().Add(time.Minute).Unix()
+			id, err := provider.Verify(ctx, mock.sign(c), "")
+			Expect(err).NotTo(HaveOccurred())
+			return id
+		}
+
+		It("should give default roles without mapped groups", func() {
+			id := verify(jwt.MapClaims{"sub": "1234", "groups": "staff"})
+			Expect(id.Groups).To(Equal([]string{"staff"}))
+			Expect(id.Roles).To(Equal([]string{userdb.RoleViewer}))
+		})
+
+		It("should merge roles of groups", func() {
+			id := verify(jwt.MapClaims{"sub": "1234", "groups": []string{"iota-ops", "iota-admins", "iota-ops"}})
+			Expect(id.Roles).To(ConsistOf(userdb.RoleOperator, userdb.RoleAdmin))
+		})
+
+		It("should map user name and tenant with configured claims", func() {
+			config.UsernameClaim = "email"
+			config.UsernamePrefix = "sso:"
+			config.TenantClaim = "org"
+			id := verify(jwt.MapClaims{"sub": "1234", "email": "Bob@example.com", "org": "acme"})
+			Expect(id.Username).To(Equal("sso:bob@example.com"))
+			Expect(id.Tenant).To(Equal("acme"))
+		})
+
+		It("should reject ID token without user name claim", func() {
+			config.UsernameClaim = "email"
+			c := jwt.MapClaims{"sub": "1234", "iss": mock.URL, "aud": clientID, "exp": time.Now().Add(time.Minute).Unix()}
+			_, err := provider.Verify(ctx, mock.sign(c), "")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/redhill42/iota/config"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Session is a login session of a user. The session is refreshed by a
+// refresh token, only the hash of which is stored.
+type Session struct {
+	ID      string    `bson:"_id"`
+	User    string    `bson:"user"`
+	Secret  []byte    `bson:"secret"`
+	Created time.Time `bson:"created"`
+	Expires time.Time `bson:"expires"`
+}
+
+// SessionStore stores login sessions. Sessions must be shared by all API
+// servers in a cluster.
+type SessionStore interface {
+	// Create a new session.
+	Create(s *Session) error
+
+	// Find a session by id. Returns SessionError if the session doesn't
+	// exist or expired.
+	Find(id string) (*Session, error)
+
+	// Refresh replaces the secret and expiration time of the session if
+	// the secret is not changed by others.
+	Refresh(id string, oldSecret, newSecret []byte, expires time.Time) error
+
+	// Remove a session.
+	Remove(id string) error
+
+	// RemoveUser removes all sessions of a user.
+	RemoveUser(user string) error
+
+	// Close the session store.
+	Close()
+}
+
+// The SessionError indicates that a session is invalid, expired or revoked.
+type SessionError string
+
+func (e SessionError) Error() string {
+	return "Invalid session: " + string(e)
+}
+
+func (e SessionError) HTTPErrorStatusCode() int {
+	return http.StatusUnauthorized
+}
+
+// NewSessionStore opens the session store configured by "sessiondb.url",
+// which defaults to the user database URL. Sessions are stored in MongoDB
+// if configured, otherwise they are kept in memory and lost on restart.
+func NewSessionStore() (SessionStore, error) {
+	dburl := config.Get("sessiondb.url")
+	if dburl == "" {
+		dburl = config.Get("userdb.url")
+	}
+	if u, err := url.Parse(dburl); err == nil && u.Scheme == "mongodb" {
+		return openMongoSessions(dburl)
+	}
+	logrus.Warn("Login sessions are kept in memory, configure sessiondb.url to share sessions in a cluster")
+	return NewMemorySessions(), nil
+}
+
+type mongoSessions struct {
+	session *mgo.Session
+}
+
+func openMongoSessions(dburl string) (SessionStore, error) {
+	session, err := mgo.Dial(dburl)
+	if err != nil {
+		return nil, err
+	}
+
+	// Expired sessions are removed by MongoDB
+	sessions := session.DB("").C("sessions")
+	err = sessions.EnsureIndex(mgo.Index{
+		Key:         []string{"expires"},
+		ExpireAfter: time.Second,
+	})
+	if err == nil {
+		err = sessions.EnsureIndexKey("user")
+	}
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return &mongoSessions{session}, nil
+}
+
+func (db *mongoSessions) do(f func(c *mgo.Collection) error) error {
+	session := db.session.Copy()
+	err := f(session.DB("").C("sessions"))
+	session.Close()
+	return err
+}
+
+func (db *mongoSessions) Create(s *Session) error {
+	return db.do(func(c *mgo.Collection) error {
+		return c.Insert(s)
+	})
+}
+
+func (db *mongoSessions) Find(id string) (*Session, error) {
+	var s Session
+	err := db.do(func(c *mgo.Collection) error {
+		return c.FindId(id).One(&s)
+	})
+	if err == mgo.ErrNotFound || err == nil && s.Expires.Before(time.Now()) {
+		return nil, SessionError(id)
+	}
+	return &s, err
+}
+
+func (db *mongoSessions) Refresh(id string, oldSecret, newSecret []byte, expires time.Time) error {
+	return db.do(func(c *mgo.Collection) error {
+		err := c.Update(
+			bson.M{"_id": id, "secret": oldSecret},
+			bson.M{"$set": bson.M{"secret": newSecret, "expires": expires}})
+		if err == mgo.ErrNotFound {
+			err = SessionError(id)
+		}
+		return err
+	})
+}
+
+func (db *mongoSessions) Remove(id string) error {
+	return db.do(func(c *mgo.Collection) error {
+		err := c.RemoveId(id)
+		if err == mgo.ErrNotFound {
+			err = nil
+		}
+		return err
+	})
+}
+
+func (db *mongoSessions) RemoveUser(user string) error {
+	return db.do(func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{"user": user})
+		return err
+	})
+}
+
+func (db *mongoSessions) Close() {
+	db.session.Close()
+}
+
+type memorySessions struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+// NewMemorySessions creates a session store that keeps sessions in memory.
+func NewMemorySessions() SessionStore {
+	return &memorySessions{sessions: make(map[string]Session)}
+}
+
+func (m *memorySessions) Create(s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Remove expired sessions
+	now := time.Now()
+	for id, s := range m.sessions {
+		if s.Expires.Before(now) {
+			delete(m.sessions, id)
+		}
+	}
+
+	m.sessions[s.ID] = *s
+	return nil
+}
+
+func (m *memorySessions) Find(id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || s.Expires.Before(time.Now()) {
+		return nil, SessionError(id)
+	}
+	return &s, nil
+}
+
+func (m *memorySessions) Refresh(id string, oldSecret, newSecret []byte, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || string(s.Secret) != string(oldSecret) {
+		return SessionError(id)
+	}
+	s.Secret, s.Expires = newSecret, expires
+	m.sessions[id] = s
+	return nil
+}
+
+func (m *memorySessions) Remove(id string) error {
+	m.mu.Lock()
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memorySessions) RemoveUser(user string) error {
+	m.mu.Lock()
+	for id, s := range m.sessions {
+		if s.User == user {
+			delete(m.sessions, id)
+		}
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memorySessions) Close() {
+}
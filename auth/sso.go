@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhill42/iota/auth/oidc"
+	"github.com/redhill42/iota/auth/userdb"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The user must complete the login with the identity provider before the
+// login state expires.
+const _LOGIN_STATE_EXPIRE = 10 * time.Minute
+
+// loginStateKey signs login states, so that any API server in a cluster
+// can verify the state returned by the identity provider.
+type loginStateKey struct {
+	mu     sync.Mutex
+	secret []byte
+}
+
+// get returns the secret of the key saved in the user database, which is
+// generated on first use.
+func (k *loginStateKey) get(db *userdb.UserDatabase, name string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.secret == nil {
+		secret, err := db.Secrets().GetSecret(name, func() ([]byte, error) {
+			b := make([]byte, 32)
+			_, err := rand.Read(b)
+			return b, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		k.secret = secret
+	}
+	return k.secret, nil
+}
+
+func (auth *Authenticator) loginStateSecret() ([]byte, error) {
+	return auth.stateKey.get(auth.db, "oidc.state")
+}
+
+func signLoginState(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewLoginState returns the state and nonce of a login with the identity
+// provider. The state is verified when the provider redirects back, and
+// the nonce must be in the ID token issued by the provider.
+func (auth *Authenticator) NewLoginState() (state, nonce string, err error) {
+	secret, err := auth.loginStateSecret()
+	if err != nil {
+		return "", "", err
+	}
+
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", err
+	}
+	nonce = base64.RawURLEncoding.EncodeToString(b)
+	payload := nonce + "." + strconv.FormatInt(time.Now().Add(_LOGIN_STATE_EXPIRE).Unix(), 10)
+	return payload + "." + signLoginState(secret, payload), nonce, nil
+}
+
+// VerifyLoginState verifies the state returned by the identity provider
+// and returns the nonce of the login.
+func (auth *Authenticator) VerifyLoginState(state string) (string, error) {
+	secret, err := auth.loginStateSecret()
+	if err != nil {
+		return "", err
+	}
+
+	sp := strings.Split(state, ".")
+	if len(sp) != 3 {
+		return "", SessionError("malformed login state")
+	}
+	payload := sp[0] + "." + sp[1]
+	if !hmac.Equal([]byte(sp[2]), []byte(signLoginState(secret, payload))) {
+		return "", SessionError("invalid login state")
+	}
+	expires, err := strconv.ParseInt(sp[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", SessionError("login state expired")
+	}
+	return sp[0], nil
+}
+
+// ssoUser is a user provisioned from an identity provider. The user is
+// linked to the identity by the issuer and subject, so that identities
+// can't take over local users or users of other identities with the same
+// name.
+type ssoUser struct {
+	userdb.BasicUser `bson:",inline"`
+	Identity         string `bson:"identity,omitempty" json:"identity,omitempty"`
+}
+
+// AuthenticateIdentity logs in the user authenticated by the identity
+// provider. The user is created if not exists and auto provisioning is
+// enabled, and existing users must have been provisioned from the same
+// identity. The roles, and the tenant if the tenant claim is configured,
+// are updated from the identity on every login.
+func (auth *Authenticator) AuthenticateIdentity(id *oidc.Identity, cfg *oidc.Config) (*userdb.BasicUser, *Token, error) {
+	var user ssoUser
+	link := cfg.Issuer + " " + id.Subject
+	err := auth.db.Find(id.Username, &user)
+
+	if _, ok := err.(userdb.UserNotFoundError); ok && cfg.AutoProvision {
+		// The password is never used, users login with the provider. It's
+		// hashed here so that it's not subject to the password policy.
+		b := make([]byte, 32)
+		if _, err = rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		var hash []byte
+		if hash, err = bcrypt.GenerateFromPassword(b, bcrypt.DefaultCost); err != nil {
+			return nil, nil, err
+		}
+		user = ssoUser{
+			BasicUser: userdb.BasicUser{Name: id.Username, Roles: id.Roles, Tenant: id.Tenant},
+			Identity:  link,
+		}
+		if err = auth.db.Create(&user, string(hash)); err != nil {
+			return nil, nil, err
+		}
+		logrus.Infof("User %s provisioned from identity provider", user.Name)
+	} else if err != nil {
+		return nil, nil, err
+	} else {
+		if user.Identity != link {
+			logrus.Warnf("Identity %s of provider %s refused to login as user %s", id.Subject, cfg.Issuer, user.Name)
+			return nil, nil, userdb.PermissionDeniedError("user " + user.Name + " is not linked to the identity")
+		}
+		if user.Inactive {
+			return nil, nil, userdb.InactiveUserError(user.Name)
+		}
+
+		fields := userdb.Args{}
+		if !equalStrings(user.Roles, id.Roles) {
+			fields["roles"] = id.Roles
+			user.Roles = id.Roles
+		}
+		if cfg.TenantClaim != "" && user.Tenant != id.Tenant {
+			if err = userdb.ValidateTenant(id.Tenant); err != nil {
+				return nil, nil, err
+			}
+			fields["tenant"] = id.Tenant
+			user.Tenant = id.Tenant
+		}
+		if len(fields) != 0 {
+			if err = auth.db.Update(user.Name, fields); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	token, err := auth.login(&user.BasicUser)
+	return &user.BasicUser, token, err
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
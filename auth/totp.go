@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redhill42/iota/auth/userdb"
+)
+
+// The user must enter the code of the second factor before the login
+// challenge expires.
+const _CHALLENGE_EXPIRE = 5 * time.Minute
+
+// The ChallengeError is returned from AuthenticateFrom if the password is
+// correct but the user must login with a second factor. The login is
+// completed by AuthenticateSecondFactor with the challenge. Users who are
+// required to use a second factor but not enrolled are given the TOTP
+// enrollment, which is confirmed by the code.
+type ChallengeError struct {
+	Challenge string
+	Enroll    *userdb.TOTPEnrollment
+}
+
+func (e *ChallengeError) Error() string {
+	return "Two-factor authentication required"
+}
+
+// newChallenge returns a challenge of the user whose password was verified.
+// The challenge is signed so that any API server in a cluster can verify it.
+func (auth *Authenticator) newChallenge(username string) (string, error) {
+	secret, err := auth.challengeKey.get(auth.db, "auth.challenge")
+	if err != nil {
+		return "", err
+	}
+	name := base64.RawURLEncoding.EncodeToString([]byte(username))
+	payload := name + "." + strconv.FormatInt(time.Now().Add(_CHALLENGE_EXPIRE).Unix(), 10)
+	return payload + "." + signLoginState(secret, payload), nil
+}
+
+// verifyChallenge verifies the challenge and returns the user name.
+func (auth *Authenticator) verifyChallenge(challenge string) (string, error) {
+	secret, err := auth.challengeKey.get(auth.db, "auth.challenge")
+	if err != nil {
+		return "", err
+	}
+
+	sp := strings.Split(challenge, ".")
+	if len(sp) != 3 {
+		return "", SessionError("malformed login challenge")
+	}
+	payload := sp[0] + "." + sp[1]
+	if !hmac.Equal([]byte(sp[2]), []byte(signLoginState(secret, payload))) {
+		return "", SessionError("invalid login challenge")
+	}
+	expires, err := strconv.ParseInt(sp[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", SessionError("login challenge expired")
+	}
+	name, err := base64.RawURLEncoding.DecodeString(sp[0])
+	if err != nil {
+		return "", SessionError("malformed login challenge")
+	}
+	return string(name), nil
+}
+
+// challenge converts the second factor requirement of the user database
+// to a login challenge.
+func (auth *Authenticator) challenge(required *userdb.SecondFactorRequiredError) error {
+	challenge, err := auth.newChallenge(required.User)
+	if err != nil {
+		return err
+	}
+	e := &ChallengeError{Challenge: challenge}
+	if required.Enroll {
+		if e.Enroll, err = auth.db.EnrollTOTP(required.User); err != nil {
+			return err
+		}
+	}
+	return e
+}
+
+// AuthenticateSecondFactor completes the login of the challenge with the
+// TOTP code or a recovery code from the client address. Returns the User
+// object and the tokens of a new login session, and the recovery codes if
+// the user enrolled at login.
+func (auth *Authenticator) AuthenticateSecondFactor(challenge, code, ip string) (*userdb.BasicUser, *Token, []string, error) {
+	username, err := auth.verifyChallenge(challenge)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	user, recoveryCodes, err := auth.db.LoginSecondFactor(username, code, ip, userdb.ChannelHTTP)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	token, err := auth.login(user)
+	return user, token, recoveryCodes, err
+}
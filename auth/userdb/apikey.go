@@ -0,0 +1,269 @@
+package userdb
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix is the prefix of API keys, which distinguishes API keys
+// from access tokens.
+const APIKeyPrefix = "iota_"
+
+// ServiceAccountPrefix is the prefix of the user name of service accounts
+// authenticated by API keys. User names with the prefix are reserved.
+const ServiceAccountPrefix = "service:"
+
+// APIKey is a key that authenticates a service account. The key is only
+// shown when created, and only the hash of the key secret is stored.
+type APIKey struct {
+	ID         string    `bson:"_id" json:"id"`
+	Name       string    `bson:"name" json:"name"`
+	Account    string    `bson:"account" json:"account"`
+	Role       string    `bson:"role,omitempty" json:"role,omitempty"`
+	Tenant     string    `bson:"tenant,omitempty" json:"tenant,omitempty"`
+	AllowedIPs []string  `bson:"allowedIPs,omitempty" json:"allowedIPs,omitempty"`
+	Expires    time.Time `bson:"expires,omitempty" json:"expires,omitempty"`
+	Created    time.Time `bson:"created" json:"created"`
+	CreatedBy  string    `bson:"createdBy" json:"createdBy"`
+	Hash       []byte    `bson:"hash" json:"hash"`
+}
+
+// APIKeyStore is implemented by user database plugins that store API keys.
+type APIKeyStore interface {
+	// CreateAPIKey saves a new API key, the key name must be unique.
+	CreateAPIKey(key *APIKey) error
+
+	// FindAPIKey finds an API key by id.
+	FindAPIKey(id string) (*APIKey, error)
+
+	// FindAPIKeyByName finds an API key by name.
+	FindAPIKeyByName(name string) (*APIKey, error)
+
+	// ListAPIKeys returns API keys of the tenant, or all API keys if the
+	// tenant is empty.
+	ListAPIKeys(tenant string) ([]*APIKey, error)
+
+	// RemoveAPIKey removes an API key by name.
+	RemoveAPIKey(name string) error
+}
+
+// The APIKeyNotFoundError indicates that an API key is not found.
+type APIKeyNotFoundError string
+
+func (e APIKeyNotFoundError) Error() string {
+	return fmt.Sprintf("API key not found: %s", string(e))
+}
+
+func (e APIKeyNotFoundError) HTTPErrorStatusCode() int {
+	return http.StatusNotFound
+}
+
+// The DuplicateAPIKeyError indicates that an API key with the same name
+// already exists.
+type DuplicateAPIKeyError string
+
+func (e DuplicateAPIKeyError) Error() string {
+	return fmt.Sprintf("API key already exists: %s", string(e))
+}
+
+func (e DuplicateAPIKeyError) HTTPErrorStatusCode() int {
+	return http.StatusConflict
+}
+
+// The InvalidAPIKeyError indicates that an API key is invalid, expired,
+// revoked or used from a disallowed address.
+type InvalidAPIKeyError string
+
+func (e InvalidAPIKeyError) Error() string {
+	return "Invalid API key: " + string(e)
+}
+
+func (e InvalidAPIKeyError) HTTPErrorStatusCode() int {
+	return http.StatusUnauthorized
+}
+
+var validKeyNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+$`)
+
+// User returns the service account authenticated by the API key.
+func (key *APIKey) User() *BasicUser {
+	user := &BasicUser{Name: ServiceAccountPrefix + key.Account, Tenant: key.Tenant}
+	if key.Role != "" {
+		user.Roles = []string{key.Role}
+	}
+	return user
+}
+
+// Expired returns true if the API key is expired.
+func (key *APIKey) Expired() bool {
+	return !key.Expires.IsZero() && time.Now().After(key.Expires)
+}
+
+// AllowIP returns true if the API key can be used from the IP address.
+// Keys with an IP allowlist are not allowed if the address is unknown.
+func (key *APIKey) AllowIP(addr string) bool {
+	return len(key.AllowedIPs) == 0 || MatchIP(key.AllowedIPs, addr)
+}
+
+// MatchIP returns true if the IP address is one of the IP addresses or
+// in one of the networks in CIDR notation.
+func MatchIP(list []string, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, allowed := range list {
+		allowed = strings.TrimSpace(allowed)
+		if _, cidr, err := net.ParseCIDR(allowed); err == nil {
+			if cidr.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *UserDatabase) apiKeys() (APIKeyStore, error) {
+	if store, ok := db.plugin.(APIKeyStore); ok {
+		return store, nil
+	}
+	return nil, Unsupported{}
+}
+
+// CreateAPIKey creates an API key on behalf of the admin, and returns the
+// key that must be given to the service. Keys of a tenant admin are
+// created in the tenant, and the role must be granted by the admin.
+func (db *UserDatabase) CreateAPIKey(admin *BasicUser, key *APIKey) (string, error) {
+	store, err := db.apiKeys()
+	if err != nil {
+		return "", err
+	}
+
+	if !admin.HasPermission(UserManage) {
+		return "", PermissionDeniedError(UserManage)
+	}
+	if admin.Tenant != "" {
+		key.Tenant = admin.Tenant
+	}
+	if key.Account == "" {
+		key.Account = key.Name
+	}
+	if !validKeyNamePattern.MatchString(key.Name) || !validKeyNamePattern.MatchString(key.Account) {
+		return "", InvalidArgumentError("Invalid API key name or service account")
+	}
+	if err = ValidateTenant(key.Tenant); err != nil {
+		return "", err
+	}
+
+	if key.Role == "" {
+		return "", InvalidArgumentError("missing role")
+	}
+	roles := []string{key.Role}
+	if err = ValidateRoles(roles); err != nil {
+		return "", err
+	}
+	if !admin.CanGrant(roles) {
+		return "", PermissionDeniedError(key.Role)
+	}
+
+	for _, allowed := range key.AllowedIPs {
+		if _, _, err := net.ParseCIDR(allowed); err != nil && net.ParseIP(allowed) == nil {
+			return "", InvalidArgumentError("Invalid IP address: " + allowed)
+		}
+	}
+
+	b := make([]byte, 40)
+	if _, err = rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b[8:])
+	key.ID = hex.EncodeToString(b[:8])
+	key.Hash = hashAPIKeySecret(secret)
+	key.Created = time.Now().UTC().Truncate(time.Second)
+	key.CreatedBy = admin.Name
+
+	if err = store.CreateAPIKey(key); err != nil {
+		return "", err
+	}
+	return APIKeyPrefix + key.ID + "_" + secret, nil
+}
+
+// VerifyAPIKey finds the API key and checks the key secret. Expiration
+// and IP allowlist are not checked.
+func (db *UserDatabase) VerifyAPIKey(apikey string) (*APIKey, error) {
+	store, err := db.apiKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	sp := strings.SplitN(strings.TrimPrefix(apikey, APIKeyPrefix), "_", 2)
+	if !strings.HasPrefix(apikey, APIKeyPrefix) || len(sp) != 2 {
+		return nil, InvalidAPIKeyError("malformed key")
+	}
+
+	key, err := store.FindAPIKey(sp[0])
+	if err != nil {
+		if _, ok := err.(APIKeyNotFoundError); ok {
+			err = InvalidAPIKeyError(sp[0])
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(hashAPIKeySecret(sp[1]), key.Hash) != 1 {
+		return nil, InvalidAPIKeyError(sp[0])
+	}
+	return key, nil
+}
+
+// FindManagedAPIKey finds an API key managed by the admin. Keys of other
+// tenants are reported as not found.
+func (db *UserDatabase) FindManagedAPIKey(admin *BasicUser, name string) (*APIKey, error) {
+	store, err := db.apiKeys()
+	if err != nil {
+		return nil, err
+	}
+	if !admin.HasPermission(UserManage) {
+		return nil, PermissionDeniedError(UserManage)
+	}
+	key, err := store.FindAPIKeyByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if admin.Tenant != "" && admin.Tenant != key.Tenant {
+		return nil, APIKeyNotFoundError(name)
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns API keys of the tenant, or all API keys if the
+// tenant is empty.
+func (db *UserDatabase) ListAPIKeys(tenant string) ([]*APIKey, error) {
+	store, err := db.apiKeys()
+	if err != nil {
+		return nil, err
+	}
+	return store.ListAPIKeys(tenant)
+}
+
+// RemoveAPIKey revokes an API key.
+func (db *UserDatabase) RemoveAPIKey(name string) error {
+	store, err := db.apiKeys()
+	if err != nil {
+		return err
+	}
+	return store.RemoveAPIKey(name)
+}
+
+func hashAPIKeySecret(secret string) []byte {
+	h := sha256.Sum256([]byte(secret))
+	return h[:]
+}
@@ -0,0 +1,303 @@
+package userdb
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Channels of login events.
+const (
+	ChannelHTTP = "http"
+	ChannelMQTT = "mqtt"
+)
+
+// Results of login events.
+const (
+	LoginSuccess = "success"
+	LoginFailure = "failure"
+	LoginLocked  = "locked"
+)
+
+// LoginEvent records a login attempt of a user.
+type LoginEvent struct {
+	Time    time.Time `bson:"time" json:"time"`
+	User    string    `bson:"user" json:"user"`
+	Tenant  string    `bson:"tenant,omitempty" json:"tenant,omitempty"`
+	IP      string    `bson:"ip,omitempty" json:"ip,omitempty"`
+	Channel string    `bson:"channel" json:"channel"`
+	Result  string    `bson:"result" json:"result"`
+	Reason  string    `bson:"reason,omitempty" json:"reason,omitempty"`
+}
+
+// LoginFilter selects login events. Empty fields match all events.
+type LoginFilter struct {
+	User   string
+	Tenant string
+	IP     string
+	Result string
+	Since  time.Time
+	Limit  int
+}
+
+// Match returns true if the login event is selected by the filter,
+// regardless of the limit.
+func (f *LoginFilter) Match(e *LoginEvent) bool {
+	return (f.User == "" || f.User == e.User) &&
+		(f.Tenant == "" || f.Tenant == e.Tenant) &&
+		(f.IP == "" || f.IP == e.IP) &&
+		(f.Result == "" || f.Result == e.Result) &&
+		!e.Time.Before(f.Since)
+}
+
+// LoginAuditStore is implemented by user database plugins that store
+// login events.
+type LoginAuditStore interface {
+	// AddLoginEvent saves a login event.
+	AddLoginEvent(event *LoginEvent) error
+
+	// FindLoginEvents returns login events matching the filter, latest
+	// first.
+	FindLoginEvents(filter *LoginFilter) ([]*LoginEvent, error)
+
+	// RemoveLoginEvents removes login events earlier than the time.
+	RemoveLoginEvents(before time.Time) error
+}
+
+// The LoginLockedError indicates that login is refused until the time
+// after too many failed login attempts.
+type LoginLockedError struct {
+	Until time.Time
+}
+
+func (e *LoginLockedError) Error() string {
+	return "Too many failed login attempts, try again later"
+}
+
+func (e *LoginLockedError) HTTPErrorStatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+// RetryAfter returns the value of the Retry-After header in seconds.
+func (e *LoginLockedError) RetryAfter() string {
+	secs := int64(time.Until(e.Until)/time.Second) + 1
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.FormatInt(secs, 10)
+}
+
+// Lockout options in the "auth" configuration section.
+const (
+	defaultMaxLoginFailures    = 10
+	defaultMaxIPLoginFailures  = 50
+	defaultLoginDelay          = time.Second
+	defaultLockoutDuration     = 15 * time.Minute
+	defaultLoginAuditRetention = 90 * 24 * time.Hour
+	loginAuditPurgeInterval    = time.Hour
+)
+
+// Login authenticates a user with name and password from the client
+// address over the channel, and records the attempt in the login audit
+// trail. Failed attempts of a user or from an address delay further
+// attempts, and too many failures lock them out for a while:
+//
+//	auth.maxLoginFailures     failures of a user since the last successful
+//	                          login before the user is locked out
+//	auth.maxIPLoginFailures   failures from an address before the address
+//	                          is locked out
+//	auth.loginDelay           delay after half of the allowed failures,
+//	                          doubled by every further failure
+//	auth.lockoutDuration      the lockout duration, failures earlier than
+//	                          the duration are forgotten
+//	auth.loginAuditRetention  the retention of login events
+//
+// Users of a second factor get a SecondFactorRequiredError if the password
+// is correct, and the login is completed by LoginSecondFactor. Users are
+// authenticated without lockout and audit if the plugin doesn't store
+// login events.
+func (db *UserDatabase) Login(name, password, ip, channel string) (*BasicUser, error) {
+	return db.audited(name, ip, channel, func() (*BasicUser, error) {
+		user, err := db.Authenticate(name, password)
+		if err == nil {
+			err = db.checkSecondFactor(name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	})
+}
+
+// audited calls the authenticate function unless the user or the client
+// address is locked out, and records the result in the login audit trail.
+// A login waiting for the second factor is not recorded, so that failures
+// of the second factor are not reset.
+func (db *UserDatabase) audited(name, ip, channel string, authenticate func() (*BasicUser, error)) (*BasicUser, error) {
+	store, ok := db.plugin.(LoginAuditStore)
+	if !ok {
+		return authenticate()
+	}
+
+	now := time.Now()
+	db.purgeLoginEvents(store, now)
+
+	event := &LoginEvent{Time: now, User: name, IP: ip, Channel: channel}
+	if err := checkLockout(store, event); err != nil {
+		if _, ok := err.(Unsupported); ok {
+			return authenticate()
+		}
+		if _, ok := err.(*LoginLockedError); ok {
+			event.Result = LoginLocked
+			db.addLoginEvent(store, event)
+		}
+		return nil, err
+	}
+
+	user, err := authenticate()
+	if _, ok := err.(*SecondFactorRequiredError); ok {
+		return nil, err
+	}
+	if err == nil {
+		event.Result = LoginSuccess
+		event.Tenant = user.Tenant
+	} else {
+		event.Result = LoginFailure
+		switch err.(type) {
+		case UserNotFoundError:
+			event.Reason = "unknown user"
+		case InactiveUserError:
+			event.Reason = "inactive"
+		case SecondFactorError:
+			event.Reason = "second factor"
+		default:
+			event.Reason = "password"
+		}
+		var found BasicUser
+		if db.plugin.Find(name, &found) == nil {
+			event.Tenant = found.Tenant
+		}
+	}
+	db.addLoginEvent(store, event)
+	return user, err
+}
+
+// checkLockout returns a LoginLockedError if the user or the client
+// address is locked out or delayed. A successful login of the user resets
+// the failures of the user, but not the failures from the address, which
+// may be shared by attackers guessing passwords of many users.
+func checkLockout(store LoginAuditStore, event *LoginEvent) error {
+	duration := durationOption("auth.lockoutDuration", defaultLockoutDuration)
+	since := event.Time.Add(-duration)
+
+	max := intOption("auth.maxLoginFailures", defaultMaxLoginFailures)
+	if max > 0 {
+		last, err := store.FindLoginEvents(&LoginFilter{User: event.User, Result: LoginSuccess, Since: since, Limit: 1})
+		if err != nil {
+			return err
+		}
+		userSince := since
+		if len(last) != 0 {
+			userSince = last[0].Time
+		}
+		filter := &LoginFilter{User: event.User, Result: LoginFailure, Since: userSince, Limit: max}
+		if err = checkFailures(store, filter, max, duration, event.Time); err != nil {
+			return err
+		}
+	}
+
+	max = intOption("auth.maxIPLoginFailures", defaultMaxIPLoginFailures)
+	if max > 0 && event.IP != "" {
+		filter := &LoginFilter{IP: event.IP, Result: LoginFailure, Since: since, Limit: max}
+		if err := checkFailures(store, filter, max, duration, event.Time); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFailures counts the failures selected by the filter. Attempts are
+// locked out for the duration after the last failure if there are max
+// failures, or delayed if there are more than half of max failures.
+func checkFailures(store LoginAuditStore, filter *LoginFilter, max int, duration time.Duration, now time.Time) error {
+	failures, err := store.FindLoginEvents(filter)
+	if err != nil {
+		return err
+	}
+
+	n := len(failures)
+	if n == 0 || n <= max/2 {
+		return nil
+	}
+
+	delay := duration
+	if n < max {
+		delay = durationOption("auth.loginDelay", defaultLoginDelay)
+		for i := max/2 + 1; i < n && delay < duration; i++ {
+			delay *= 2
+		}
+		if delay > duration {
+			delay = duration
+		}
+	}
+
+	until := failures[0].Time.Add(delay)
+	if now.Before(until) {
+		return &LoginLockedError{Until: until}
+	}
+	return nil
+}
+
+func (db *UserDatabase) addLoginEvent(store LoginAuditStore, event *LoginEvent) {
+	if err := store.AddLoginEvent(event); err != nil {
+		logrus.WithError(err).Warn("Failed to save login event")
+	}
+}
+
+// purgeLoginEvents removes login events older than the retention, at
+// most once in the purge interval.
+func (db *UserDatabase) purgeLoginEvents(store LoginAuditStore, now time.Time) {
+	last := atomic.LoadInt64(&db.purged)
+	if now.UnixNano()-last < int64(loginAuditPurgeInterval) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&db.purged, last, now.UnixNano()) {
+		return
+	}
+
+	retention := durationOption("auth.loginAuditRetention", defaultLoginAuditRetention)
+	if retention == 0 {
+		return
+	}
+	if err := store.RemoveLoginEvents(now.Add(-retention)); err != nil {
+		logrus.WithError(err).Warn("Failed to remove login events")
+	}
+}
+
+// LoginEvents returns login events selected by the filter on behalf of
+// the admin, latest first. Users of a tenant can only see login events of
+// the tenant. Every user can see their own login events.
+func (db *UserDatabase) LoginEvents(admin *BasicUser, filter *LoginFilter) ([]*LoginEvent, error) {
+	store, ok := db.plugin.(LoginAuditStore)
+	if !ok {
+		return nil, Unsupported{}
+	}
+
+	if filter.User != admin.Name {
+		if !admin.HasPermission(UserManage) {
+			return nil, PermissionDeniedError(UserManage)
+		}
+		if admin.Tenant != "" {
+			filter.Tenant = admin.Tenant
+		}
+	}
+
+	events, err := store.FindLoginEvents(filter)
+	if events == nil && err == nil {
+		events = []*LoginEvent{}
+	}
+	return events, err
+}
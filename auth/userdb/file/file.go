@@ -1,19 +1,72 @@
+// Package file implements a user database backed by a JSON file.
+//
+// The file is shared by processes on the same host, such as the API server
+// and the mosquitto plugin. Every operation holds a lock on a companion
+// ".lock" file, reloads the database if the file was changed by another
+// process or edited by hand, and writes changes atomically by replacing
+// the file. Files of the legacy INI format are converted on first write.
 package file
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/redhill42/iota/auth/userdb"
 	"github.com/redhill42/iota/config"
 )
 
+// record is a user saved in the file. Extra fields of concrete User types
+// are keyed by lower case field names.
+type record struct {
+	Password string                     `json:"password"`
+	Inactive bool                       `json:"inactive,omitempty"`
+	Roles    []string                   `json:"roles,omitempty"`
+	Tenant   string                     `json:"tenant,omitempty"`
+	Extra    map[string]json.RawMessage `json:"extra,omitempty"`
+}
+
+// maxLoginEvents is the maximum number of login events kept in the file,
+// earlier events are discarded.
+const maxLoginEvents = 1000
+
+// content is the content of the database file. Login events are kept in
+// chronological order.
+type content struct {
+	Users   map[string]*record        `json:"users"`
+	Secrets map[string][]byte         `json:"secrets,omitempty"`
+	APIKeys map[string]*userdb.APIKey `json:"apikeys,omitempty"`
+	Logins  []*userdb.LoginEvent      `json:"logins,omitempty"`
+}
+
+func newContent() *content {
+	return &content{
+		Users:   make(map[string]*record),
+		Secrets: make(map[string][]byte),
+		APIKeys: make(map[string]*userdb.APIKey),
+	}
+}
+
 // User database backed by file.
 type fileDB struct {
-	*config.Config
+	filename string
+	lock     *os.File
+
+	mu   sync.Mutex
+	data *content
+	stat os.FileInfo // stat of the file when loaded
 }
 
 func filePlugin(dburl string) (userdb.Plugin, error) {
@@ -31,75 +84,533 @@ func filePlugin(dburl string) (userdb.Plugin, error) {
 		return nil, errors.New("User database file not configured")
 	}
 
-	conf, err := config.Open(filename)
-	if err != nil && !os.IsNotExist(err) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0750); err != nil {
 		return nil, err
 	}
-	return &fileDB{conf}, nil
+	lock, err := os.OpenFile(filename+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &fileDB{filename: filename, lock: lock}
+	if err = db.read(func(*content) error { return nil }); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return db, nil
 }
 
 func init() {
 	userdb.RegisterPlugin("file", filePlugin)
 }
 
+// read calls f with the database content under a shared lock.
+func (db *fileDB) read(f func(data *content) error) error {
+	return db.do(false, f)
+}
+
+// write calls f with the database content under an exclusive lock, and
+// saves the content if f succeeds.
+func (db *fileDB) write(f func(data *content) error) error {
+	return db.do(true, f)
+}
+
+func (db *fileDB) do(exclusive bool, f func(data *content) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := lockFile(db.lock, exclusive); err != nil {
+		return err
+	}
+	defer unlockFile(db.lock)
+
+	if err := db.reload(); err != nil {
+		return err
+	}
+	if err := f(db.data); err != nil {
+		if exclusive {
+			db.data = nil // discard partial changes
+		}
+		return err
+	}
+	if exclusive {
+		return db.save()
+	}
+	return nil
+}
+
+// reload loads the file if it's changed since last loaded.
+func (db *fileDB) reload() error {
+	stat, err := os.Stat(db.filename)
+	if os.IsNotExist(err) {
+		if db.data == nil || db.stat != nil {
+			db.data, db.stat = newContent(), nil
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if db.data != nil && db.stat != nil && os.SameFile(stat, db.stat) &&
+		stat.ModTime().Equal(db.stat.ModTime()) && stat.Size() == db.stat.Size() {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(db.filename)
+	if err != nil {
+		return err
+	}
+	data := newContent()
+	if b = bytes.TrimSpace(b); len(b) != 0 {
+		if b[0] == '{' {
+			err = json.Unmarshal(b, data)
+		} else {
+			err = loadLegacy(db.filename, data)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", db.filename, err)
+		}
+	}
+	if data.Users == nil {
+		data.Users = make(map[string]*record)
+	}
+	if data.Secrets == nil {
+		data.Secrets = make(map[string][]byte)
+	}
+	if data.APIKeys == nil {
+		data.APIKeys = make(map[string]*userdb.APIKey)
+	}
+	db.data, db.stat = data, stat
+	return nil
+}
+
+// loadLegacy loads the INI format used by earlier versions, which keeps
+// password hashes, roles, tenants, secrets and API keys in sections.
+func loadLegacy(filename string, data *content) error {
+	conf, err := config.Open(filename)
+	if err != nil {
+		return err
+	}
+	for name, password := range conf.GetSection("users") {
+		r := &record{Password: password, Tenant: conf.GetOption("tenants", name)}
+		if roles := conf.GetOption("roles", name); roles != "" {
+			r.Roles = strings.Split(roles, ",")
+		}
+		data.Users[name] = r
+	}
+	for key, value := range conf.GetSection("secrets") {
+		if data.Secrets[key], err = base64.StdEncoding.DecodeString(value); err != nil {
+			return err
+		}
+	}
+	for name, value := range conf.GetSection("apikeys") {
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return err
+		}
+		var key userdb.APIKey
+		if err = json.Unmarshal(b, &key); err != nil {
+			return err
+		}
+		data.APIKeys[name] = &key
+	}
+	return nil
+}
+
+// save writes the content to a temporary file and renames it to the
+// database file, so readers never see a partially written file.
+func (db *fileDB) save() error {
+	b, err := json.MarshalIndent(db.data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(db.filename), filepath.Base(db.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(b, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), db.filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		db.data = nil
+		return err
+	}
+
+	db.stat, err = os.Stat(db.filename)
+	return err
+}
+
 func (db *fileDB) Create(user userdb.User) error {
 	basic := user.Basic()
-	if db.GetOption("users", basic.Name) != "" {
-		return userdb.DuplicateUserError(basic.Name)
+	extra, err := userdb.ExtraFields(user)
+	if err != nil {
+		return err
 	}
-	db.AddOption("users", basic.Name, string(basic.Password))
-	return db.Save()
+	if len(extra) == 0 {
+		extra = nil
+	}
+
+	return db.write(func(data *content) error {
+		if data.Users[basic.Name] != nil {
+			return userdb.DuplicateUserError(basic.Name)
+		}
+		data.Users[basic.Name] = &record{
+			Password: string(basic.Password),
+			Inactive: basic.Inactive,
+			Roles:    basic.Roles,
+			Tenant:   basic.Tenant,
+			Extra:    extra,
+		}
+		return nil
+	})
+}
+
+// fill copies the record to the user.
+func (r *record) fill(name string, result userdb.User) error {
+	var extra []byte
+	if len(r.Extra) != 0 {
+		var err error
+		if extra, err = json.Marshal(r.Extra); err != nil {
+			return err
+		}
+	}
+	basic := userdb.BasicUser{Name: name, Password: []byte(r.Password), Inactive: r.Inactive, Roles: r.Roles, Tenant: r.Tenant}
+	return userdb.FillUser(result, basic, extra)
 }
 
 func (db *fileDB) Find(name string, result userdb.User) error {
-	password := db.GetOption("users", name)
-	if password == "" {
-		return userdb.UserNotFoundError(name)
+	return db.read(func(data *content) error {
+		r := data.Users[name]
+		if r == nil {
+			return userdb.UserNotFoundError(name)
+		}
+		return r.fill(name, result)
+	})
+}
+
+// compileFilter compiles the search filter. The name is matched as a
+// pattern of path.Match, such as "*@example.com".
+func compileFilter(filter interface{}) (*userdb.UserFilter, error) {
+	f, err := userdb.CompileFilter(filter)
+	if err != nil {
+		return nil, err
 	}
-	basic := result.Basic()
-	basic.Name = name
-	basic.Password = []byte(password)
-	return nil
+	if f.Name != nil {
+		if _, err := path.Match(*f.Name, ""); err != nil {
+			return nil, userdb.InvalidArgumentError("Invalid filter of name")
+		}
+	}
+	return f, nil
 }
 
+func match(f *userdb.UserFilter, name string, r *record) bool {
+	if f.Name != nil && *f.Name != "" {
+		if ok, _ := path.Match(*f.Name, name); !ok {
+			return false
+		}
+	}
+	if f.Tenant != nil && *f.Tenant != r.Tenant {
+		return false
+	}
+	if f.Inactive != nil && *f.Inactive != r.Inactive {
+		return false
+	}
+	return f.MatchRoles(r.Roles) && f.MatchExtra(r.Extra)
+}
+
+// Search users by the filter, which is an Args of field names and values.
+// The result is a pointer to a slice of users sorted by name, or a user to
+// find the first match.
 func (db *fileDB) Search(filter interface{}, result interface{}) error {
-	return userdb.Unsupported{}
+	f, err := compileFilter(filter)
+	if err != nil {
+		return err
+	}
+
+	resultv := reflect.ValueOf(result)
+	isSlice := resultv.Kind() == reflect.Ptr && resultv.Elem().Kind() == reflect.Slice
+	user, _ := result.(userdb.User)
+	if !isSlice && user == nil {
+		return userdb.Unsupported{}
+	}
+
+	return db.read(func(data *content) error {
+		names := make([]string, 0, len(data.Users))
+		for name, r := range data.Users {
+			if match(f, name, r) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		if !isSlice {
+			if len(names) == 0 {
+				return userdb.UserNotFoundError(fmt.Sprintf("%v", filter))
+			}
+			return data.Users[names[0]].fill(names[0], user)
+		}
+
+		users := reflect.MakeSlice(resultv.Elem().Type(), 0, len(names))
+		for _, name := range names {
+			v := userdb.NewUserElem(users.Type().Elem())
+			user := userdb.UserOf(v)
+			if user == nil {
+				return userdb.Unsupported{}
+			}
+			if err := data.Users[name].fill(name, user); err != nil {
+				return err
+			}
+			users = reflect.Append(users, v)
+		}
+		resultv.Elem().Set(users)
+		return nil
+	})
 }
 
 func (db *fileDB) Remove(name string) error {
-	if db.GetOption("users", name) == "" {
-		return userdb.UserNotFoundError(name)
-	}
-	db.RemoveOption("users", name)
-	return db.Save()
+	return db.write(func(data *content) error {
+		if data.Users[name] == nil {
+			return userdb.UserNotFoundError(name)
+		}
+		delete(data.Users, name)
+		return nil
+	})
 }
 
+// Update the user with fields of an Args. Fields other than the fields
+// of BasicUser are saved as extra fields.
 func (db *fileDB) Update(name string, fields interface{}) error {
-	if db.GetOption("users", name) == "" {
-		return userdb.UserNotFoundError(name)
+	args, ok := fields.(userdb.Args)
+	if !ok {
+		return userdb.Unsupported{}
 	}
-	if args, ok := fields.(userdb.Args); ok {
-		if passwd, ok := args["password"]; ok {
-			db.AddOption("users", name, string(passwd.([]byte)))
-			return db.Save()
+
+	return db.write(func(data *content) error {
+		old := data.Users[name]
+		if old == nil {
+			return userdb.UserNotFoundError(name)
 		}
-	}
-	return userdb.Unsupported{}
+
+		// Update a copy, so the user is not changed by invalid fields
+		r := *old
+		r.Extra = make(map[string]json.RawMessage)
+		for key, value := range old.Extra {
+			r.Extra[key] = value
+		}
+		newName := name
+
+		for key, value := range args {
+			invalid := userdb.InvalidArgumentError("Invalid " + key)
+			switch key = strings.ToLower(key); key {
+			case "name":
+				s, ok := value.(string)
+				if !ok || s == "" {
+					return invalid
+				}
+				newName = s
+
+			case "password":
+				b, ok := value.([]byte)
+				if !ok {
+					return invalid
+				}
+				r.Password = string(b)
+
+			case "inactive":
+				b, ok := value.(bool)
+				if !ok {
+					return invalid
+				}
+				r.Inactive = b
+
+			case "roles":
+				roles, ok := value.([]string)
+				if !ok && value != nil {
+					return invalid
+				}
+				r.Roles = roles
+				if len(roles) == 0 {
+					r.Roles = nil
+				}
+
+			case "tenant":
+				s, ok := value.(string)
+				if !ok {
+					return invalid
+				}
+				r.Tenant = s
+
+			default:
+				b, err := json.Marshal(value)
+				if err != nil {
+					return invalid
+				}
+				r.Extra[key] = b
+			}
+		}
+
+		if len(r.Extra) == 0 {
+			r.Extra = nil
+		}
+		if newName != name {
+			if data.Users[newName] != nil {
+				return userdb.DuplicateUserError(newName)
+			}
+			delete(data.Users, name)
+		}
+		data.Users[newName] = &r
+		return nil
+	})
 }
 
 func (db *fileDB) GetSecret(key string, gen func() ([]byte, error)) ([]byte, error) {
-	secret := db.GetOption("secrets", key)
-	if secret != "" {
-		return base64.StdEncoding.DecodeString(secret)
+	var secret []byte
+	err := db.read(func(data *content) error {
+		secret = data.Secrets[key]
+		return nil
+	})
+	if err != nil || secret != nil {
+		return secret, err
 	}
 
-	newSecret, err := gen()
-	if err == nil {
-		db.AddOption("secrets", key, base64.StdEncoding.EncodeToString(newSecret))
-		err = db.Save()
-	}
-	return newSecret, err
+	// Another process may have saved the secret after the read
+	err = db.write(func(data *content) error {
+		if secret = data.Secrets[key]; secret != nil {
+			return nil
+		}
+		newSecret, err := gen()
+		if err != nil {
+			return err
+		}
+		data.Secrets[key], secret = newSecret, newSecret
+		return nil
+	})
+	return secret, err
+}
+
+func (db *fileDB) SetSecret(key string, secret []byte) error {
+	return db.write(func(data *content) error {
+		data.Secrets[key] = secret
+		return nil
+	})
+}
+
+func (db *fileDB) CreateAPIKey(key *userdb.APIKey) error {
+	return db.write(func(data *content) error {
+		if data.APIKeys[key.Name] != nil {
+			return userdb.DuplicateAPIKeyError(key.Name)
+		}
+		k := *key
+		data.APIKeys[key.Name] = &k
+		return nil
+	})
+}
+
+func (db *fileDB) FindAPIKey(id string) (*userdb.APIKey, error) {
+	var found *userdb.APIKey
+	err := db.read(func(data *content) error {
+		for _, key := range data.APIKeys {
+			if key.ID == id {
+				k := *key
+				found = &k
+				return nil
+			}
+		}
+		return userdb.APIKeyNotFoundError(id)
+	})
+	return found, err
+}
+
+func (db *fileDB) FindAPIKeyByName(name string) (*userdb.APIKey, error) {
+	var found *userdb.APIKey
+	err := db.read(func(data *content) error {
+		key := data.APIKeys[name]
+		if key == nil {
+			return userdb.APIKeyNotFoundError(name)
+		}
+		k := *key
+		found = &k
+		return nil
+	})
+	return found, err
+}
+
+func (db *fileDB) ListAPIKeys(tenant string) ([]*userdb.APIKey, error) {
+	keys := make([]*userdb.APIKey, 0)
+	err := db.read(func(data *content) error {
+		for _, key := range data.APIKeys {
+			if tenant == "" || key.Tenant == tenant {
+				k := *key
+				keys = append(keys, &k)
+			}
+		}
+		return nil
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+	return keys, err
+}
+
+func (db *fileDB) RemoveAPIKey(name string) error {
+	return db.write(func(data *content) error {
+		if data.APIKeys[name] == nil {
+			return userdb.APIKeyNotFoundError(name)
+		}
+		delete(data.APIKeys, name)
+		return nil
+	})
+}
+
+func (db *fileDB) AddLoginEvent(event *userdb.LoginEvent) error {
+	return db.write(func(data *content) error {
+		e := *event
+		data.Logins = append(data.Logins, &e)
+		if n := len(data.Logins) - maxLoginEvents; n > 0 {
+			data.Logins = append([]*userdb.LoginEvent(nil), data.Logins[n:]...)
+		}
+		return nil
+	})
+}
+
+func (db *fileDB) FindLoginEvents(filter *userdb.LoginFilter) ([]*userdb.LoginEvent, error) {
+	events := make([]*userdb.LoginEvent, 0)
+	err := db.read(func(data *content) error {
+		for i := len(data.Logins) - 1; i >= 0; i-- {
+			if filter.Limit > 0 && len(events) == filter.Limit {
+				break
+			}
+			if e := data.Logins[i]; filter.Match(e) {
+				ev := *e
+				events = append(events, &ev)
+			}
+		}
+		return nil
+	})
+	return events, err
+}
+
+func (db *fileDB) RemoveLoginEvents(before time.Time) error {
+	return db.write(func(data *content) error {
+		i := sort.Search(len(data.Logins), func(i int) bool {
+			return !data.Logins[i].Time.Before(before)
+		})
+		if i > 0 {
+			data.Logins = append([]*userdb.LoginEvent(nil), data.Logins[i:]...)
+		}
+		return nil
+	})
 }
 
 func (db *fileDB) Close() {
+	db.lock.Close()
 }
@@ -0,0 +1,212 @@
+package file_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/redhill42/iota/auth/userdb"
+	_ "github.com/redhill42/iota/auth/userdb/file"
+)
+
+func TestFile(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "File UserDB Suite")
+}
+
+var _ = Describe("File", func() {
+	var (
+		tmp      string
+		filename string
+		db       *userdb.UserDatabase
+	)
+
+	open := func() *userdb.UserDatabase {
+		os.Setenv("IOTA_USERDB_URL", "file://"+filename)
+		defer os.Unsetenv("IOTA_USERDB_URL")
+		db, err := userdb.Open()
+		ExpectWithOffset(1, err).NotTo(HaveOccurred())
+		return db
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "userdb_test")
+		Expect(err).NotTo(HaveOccurred())
+		filename = filepath.Join(tmp, "userdb")
+	})
+
+	AfterEach(func() {
+		if db != nil {
+			db.Close()
+			db = nil
+		}
+		os.RemoveAll(tmp)
+	})
+
+	It("should convert legacy file", func() {
+		legacy := "[users]\n" +
+			"alice = $2a$10$R3ATOzHCdIQEGYp/6XwWOugwsY2VtLqVZR1.ut14Hgnx0/T0KiMxi\n" +
+			"[roles]\n" +
+			"alice = viewer,operator\n" +
+			"[tenants]\n" +
+			"alice = acme\n" +
+			"[secrets]\n" +
+			"user = c2VjcmV0\n"
+		Expect(ioutil.WriteFile(filename, []byte(legacy), 0600)).To(Succeed())
+
+		db = open()
+		var user userdb.BasicUser
+		Expect(db.Find("alice", &user)).To(Succeed())
+		Expect(user.Roles).To(Equal([]string{userdb.RoleViewer, userdb.RoleOperator}))
+		Expect(user.Tenant).To(Equal("acme"))
+		Expect(string(user.Password)).To(HavePrefix("$2a$"))
+
+		secret, err := db.Secrets().GetSecret("user", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secret).To(Equal([]byte("secret")))
+
+		Expect(db.SetInactive("alice", true)).To(Succeed())
+		data, err := ioutil.ReadFile(filename)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(HavePrefix("{"))
+		Expect(db.Find("alice", &user)).To(Succeed())
+		Expect(user.Inactive).To(BeTrue())
+		Expect(user.Tenant).To(Equal("acme"))
+	})
+
+	It("should give the admin role to users created before roles", func() {
+		legacy := `{"users": {"bob": {"password": "$2a$10$R3ATOzHCdIQEGYp/6XwWOugwsY2VtLqVZR1.ut14Hgnx0/T0KiMxi"}}}`
+		Expect(ioutil.WriteFile(filename, []byte(legacy), 0600)).To(Succeed())
+
+		db = open()
+		var user userdb.BasicUser
+		Expect(db.Find("bob", &user)).To(Succeed())
+		Expect(user.Roles).To(Equal([]string{userdb.RoleAdmin}))
+
+		// The migration runs only once
+		Expect(db.SetRoles("bob", nil)).To(Succeed())
+		db.Close()
+		db = open()
+		Expect(db.Find("bob", &user)).To(Succeed())
+		Expect(user.Roles).To(BeEmpty())
+		Expect(user.HasPermission(userdb.DeviceDelete)).To(BeFalse())
+	})
+
+	It("should pick up external edits", func() {
+		db = open()
+		Expect(db.Create(&userdb.BasicUser{Name: "alice", Roles: []string{userdb.RoleViewer}}, "alice")).To(Succeed())
+
+		data, err := ioutil.ReadFile(filename)
+		Expect(err).NotTo(HaveOccurred())
+		var user userdb.BasicUser
+		Expect(db.Find("alice", &user)).To(Succeed())
+
+		edited := fmt.Sprintf(`{"users": {"bob": {"password": %q, "tenant": "acme"}}}`, user.Password)
+		Expect(ioutil.WriteFile(filename, []byte(edited), 0600)).To(Succeed())
+		later := time.Now().Add(time.Second)
+		Expect(os.Chtimes(filename, later, later)).To(Succeed())
+
+		Expect(db.Find("alice", &user)).To(MatchError(userdb.UserNotFoundError("alice")))
+		found, err := db.Authenticate("bob", "alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found.Tenant).To(Equal("acme"))
+
+		Expect(ioutil.WriteFile(filename, data, 0600)).To(Succeed())
+		Expect(os.Chtimes(filename, later.Add(time.Second), later.Add(time.Second))).To(Succeed())
+		Expect(db.Find("alice", &user)).To(Succeed())
+	})
+
+	It("should share the file between databases", func() {
+		db = open()
+		other := open()
+		defer other.Close()
+
+		Expect(db.Create(&userdb.BasicUser{Name: "alice", Roles: []string{userdb.RoleViewer}}, "alice")).To(Succeed())
+		var user userdb.BasicUser
+		Expect(other.Find("alice", &user)).To(Succeed())
+		Expect(other.Create(&userdb.BasicUser{Name: "alice", Roles: []string{userdb.RoleViewer}}, "alice")).To(MatchError(userdb.DuplicateUserError("alice")))
+
+		Expect(other.SetRoles("alice", []string{userdb.RoleViewer})).To(Succeed())
+		Expect(db.Find("alice", &user)).To(Succeed())
+		Expect(user.Roles).To(Equal([]string{userdb.RoleViewer}))
+
+		s1, err := db.GetSecret("user")
+		Expect(err).NotTo(HaveOccurred())
+		s2, err := other.GetSecret("user")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s2).To(Equal(s1))
+	})
+
+	It("should not lose concurrent writes", func() {
+		db = open()
+		other := open()
+		defer other.Close()
+
+		// Use a hashed password to create users quickly
+		hash, err := bcrypt.GenerateFromPassword([]byte("test"), bcrypt.MinCost)
+		Expect(err).NotTo(HaveOccurred())
+
+		var wg sync.WaitGroup
+		for i, d := range []*userdb.UserDatabase{db, other} {
+			wg.Add(1)
+			go func(i int, d *userdb.UserDatabase) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					user := &userdb.BasicUser{Name: fmt.Sprintf("user%d-%d", i, j), Roles: []string{userdb.RoleViewer}}
+					Expect(d.Create(user, string(hash))).To(Succeed())
+				}
+			}(i, d)
+		}
+		wg.Wait()
+
+		users, err := db.List("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(users).To(HaveLen(20))
+	})
+
+	Describe("Search", func() {
+		BeforeEach(func() {
+			db = open()
+			Expect(db.Create(&userdb.BasicUser{Name: "alice@example.com", Roles: []string{userdb.RoleOperator}, Tenant: "acme"}, "alice")).To(Succeed())
+			Expect(db.Create(&userdb.BasicUser{Name: "bob@example.com", Roles: []string{userdb.RoleViewer}}, "bob")).To(Succeed())
+			Expect(db.Create(&userdb.BasicUser{Name: "carol@example.org", Roles: []string{userdb.RoleOperator}, Tenant: "acme"}, "carol")).To(Succeed())
+		})
+
+		search := func(filter userdb.Args) []string {
+			var users []userdb.BasicUser
+			ExpectWithOffset(1, db.Search(filter, &users)).To(Succeed())
+			names := make([]string, len(users))
+			for i, user := range users {
+				names[i] = user.Name
+			}
+			return names
+		}
+
+		It("should match name pattern", func() {
+			Expect(search(userdb.Args{"name": "*@example.com"})).To(Equal([]string{"alice@example.com", "bob@example.com"}))
+			Expect(search(userdb.Args{"name": "?o*"})).To(Equal([]string{"bob@example.com"}))
+			Expect(search(userdb.Args{"name": "carol@example.org"})).To(Equal([]string{"carol@example.org"}))
+			Expect(db.Search(userdb.Args{"name": "["}, &[]userdb.BasicUser{})).NotTo(Succeed())
+		})
+
+		It("should match fields", func() {
+			Expect(search(userdb.Args{"tenant": "acme"})).To(Equal([]string{"alice@example.com", "carol@example.org"}))
+			Expect(search(userdb.Args{"tenant": "acme", "name": "c*"})).To(Equal([]string{"carol@example.org"}))
+			Expect(search(userdb.Args{"roles": userdb.RoleViewer})).To(Equal([]string{"bob@example.com"}))
+
+			Expect(db.SetInactive("bob@example.com", true)).To(Succeed())
+			Expect(search(userdb.Args{"inactive": true})).To(Equal([]string{"bob@example.com"}))
+			Expect(db.Search(userdb.Args{"tenant": 42}, &[]userdb.BasicUser{})).NotTo(Succeed())
+		})
+	})
+})
@@ -0,0 +1,26 @@
+// +build !windows
+
+package file
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes a shared or exclusive advisory lock of the file, waiting
+// until the lock is released by other processes.
+func lockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		if err := syscall.Flock(int(f.Fd()), how); err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,634 @@
+// Package ldap implements a user database backed by an LDAP directory.
+//
+// Users are found in the directory and authenticated by binding with the
+// password, and the groups of users are mapped to roles. The directory is
+// never modified, local users, secrets and API keys are kept in a
+// secondary user database, as are fields of directory users other than
+// the fields of BasicUser, such as the second factor.
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/redhill42/iota/auth/userdb"
+	"github.com/redhill42/iota/config"
+)
+
+// User database backed by LDAP directory.
+type ldapDB struct {
+	url       string
+	tlsConfig *tls.Config
+	startTLS  bool
+	timeout   time.Duration
+
+	bindDN       string
+	bindPassword string
+
+	userBase   string
+	userFilter string
+	userAttr   string
+	tenantAttr string
+
+	groupBase   string
+	groupFilter string
+	groupAttr   string
+
+	roleMapping  map[string][]string
+	defaultRoles []string
+
+	secondary userdb.Plugin
+}
+
+// ldapPlugin creates a user database of the LDAP URL. The path of the URL
+// is the base DN of users and groups. The following options are used:
+//
+//	ldap.bindDN        DN to search the directory, anonymous if not set
+//	ldap.bindPassword  password of the bind DN
+//	ldap.userBase      base DN of users
+//	ldap.userFilter    filter of user entries, "(objectClass=person)"
+//	ldap.userAttr      attribute of user name, "uid"
+//	ldap.tenantAttr    attribute of user tenant, system users if not set
+//	ldap.groupBase     base DN of groups
+//	ldap.groupFilter   filter of groups of a user, {dn} and {name} are
+//	                   replaced by the DN and name of the user
+//	ldap.groupAttr     attribute of group name, "cn"
+//	ldap.roleMapping   comma separated list of group=role pairs
+//	ldap.defaultRole   roles of users without mapped groups, "viewer"
+//	ldap.startTLS      upgrade ldap:// connections with StartTLS
+//	ldap.ca            file of PEM encoded CA certificates of the server
+//	ldap.timeout       timeout of LDAP requests, "10s"
+//	ldap.secondary     URL of the user database of local users, secrets
+//	                   and API keys
+func ldapPlugin(dburl string) (userdb.Plugin, error) {
+	u, err := url.Parse(dburl)
+	if err != nil {
+		return nil, err
+	}
+	base := strings.TrimPrefix(u.Path, "/")
+
+	db := &ldapDB{
+		url:          (&url.URL{Scheme: u.Scheme, Host: u.Host}).String(),
+		bindDN:       config.Get("ldap.bindDN"),
+		bindPassword: config.Get("ldap.bindPassword"),
+		userBase:     config.GetOrDefault("ldap.userBase", base),
+		userFilter:   config.GetOrDefault("ldap.userFilter", "(objectClass=person)"),
+		userAttr:     config.GetOrDefault("ldap.userAttr", "uid"),
+		tenantAttr:   config.Get("ldap.tenantAttr"),
+		groupBase:    config.GetOrDefault("ldap.groupBase", base),
+		groupFilter:  config.GetOrDefault("ldap.groupFilter", "(|(member={dn})(uniqueMember={dn})(memberUid={name}))"),
+		groupAttr:    config.GetOrDefault("ldap.groupAttr", "cn"),
+	}
+	if db.userBase == "" {
+		return nil, errors.New("ldap: base DN of users not configured")
+	}
+
+	if db.roleMapping, err = userdb.ParseRoleMapping(config.Get("ldap.roleMapping")); err != nil {
+		return nil, err
+	}
+	for _, role := range strings.Split(config.GetOrDefault("ldap.defaultRole", userdb.RoleViewer), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			db.defaultRoles = append(db.defaultRoles, role)
+		}
+	}
+	if err = userdb.ValidateRoles(db.defaultRoles); err != nil {
+		return nil, err
+	}
+
+	if db.timeout, err = time.ParseDuration(config.GetOrDefault("ldap.timeout", "10s")); err != nil {
+		return nil, fmt.Errorf("ldap: invalid timeout: %v", err)
+	}
+	db.startTLS, _ = strconv.ParseBool(config.GetOrDefault("ldap.startTLS", "false"))
+	if db.tlsConfig, err = configureTLS(u.Hostname()); err != nil {
+		return nil, err
+	}
+
+	// Verify the directory is accessible
+	conn, err := db.dial()
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+
+	secondary := config.Get("ldap.secondary")
+	if secondary == "" {
+		return nil, errors.New("ldap: secondary user database not configured")
+	}
+	if db.secondary, err = userdb.NewPluginURL(secondary); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func init() {
+	userdb.RegisterPlugin("ldap", ldapPlugin)
+	userdb.RegisterPlugin("ldaps", ldapPlugin)
+}
+
+func configureTLS(serverName string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if ca := config.Get("ldap.ca"); ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("ldap: no CA certificates found in " + ca)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// dial connects to the directory and binds with the bind DN.
+func (db *ldapDB) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(db.url, ldap.DialWithTLSConfig(db.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(db.timeout)
+
+	if db.startTLS {
+		if err = conn.StartTLS(db.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if db.bindDN != "" {
+		err = conn.Bind(db.bindDN, db.bindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (db *ldapDB) do(f func(conn *ldap.Conn) error) error {
+	conn, err := db.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return f(conn)
+}
+
+// search finds user entries matching the filter.
+func (db *ldapDB) search(conn *ldap.Conn, filter string) ([]*ldap.Entry, error) {
+	attrs := []string{db.userAttr}
+	if db.tenantAttr != "" {
+		attrs = append(attrs, db.tenantAttr)
+	}
+	req := ldap.NewSearchRequest(
+		db.userBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(&"+db.userFilter+filter+")", attrs, nil)
+	resp, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Entries, nil
+}
+
+// findEntry finds the entry of a user. Returns nil if the user is not in
+// the directory.
+func (db *ldapDB) findEntry(conn *ldap.Conn, name string) (*ldap.Entry, error) {
+	entries, err := db.search(conn, "("+db.userAttr+"="+ldap.EscapeFilter(name)+")")
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	if len(entries) > 1 {
+		return nil, fmt.Errorf("ldap: multiple entries found for user %s", name)
+	}
+	return entries[0], nil
+}
+
+// groups returns names of groups of the user.
+func (db *ldapDB) groups(conn *ldap.Conn, entry *ldap.Entry) ([]string, error) {
+	if len(db.roleMapping) == 0 {
+		return nil, nil
+	}
+	filter := strings.NewReplacer(
+		"{dn}", ldap.EscapeFilter(entry.DN),
+		"{name}", ldap.EscapeFilter(entry.GetAttributeValue(db.userAttr)),
+	).Replace(db.groupFilter)
+	req := ldap.NewSearchRequest(
+		db.groupBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter, []string{db.groupAttr}, nil)
+	resp, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, group := range resp.Entries {
+		groups = append(groups, group.GetAttributeValues(db.groupAttr)...)
+	}
+	return groups, nil
+}
+
+// fill fills the user with the directory entry and its local fields.
+func (db *ldapDB) fill(conn *ldap.Conn, entry *ldap.Entry, result userdb.User) error {
+	groups, err := db.groups(conn, entry)
+	if err != nil {
+		return err
+	}
+	user := userdb.BasicUser{
+		Name:  entry.GetAttributeValue(db.userAttr),
+		Roles: userdb.MapRoles(db.roleMapping, groups, db.defaultRoles),
+	}
+	if db.tenantAttr != "" {
+		user.Tenant = entry.GetAttributeValue(db.tenantAttr)
+	}
+
+	var extra []byte
+	if _, ok := result.(*userdb.BasicUser); !ok {
+		fields, err := db.localFields(user.Name)
+		if err != nil {
+			return err
+		}
+		if len(fields) != 0 {
+			if extra, err = json.Marshal(fields); err != nil {
+				return err
+			}
+		}
+	}
+	return userdb.FillUser(result, user, extra)
+}
+
+// localKey is the key of the secret that keeps local fields of a directory
+// user in the secondary user database.
+func localKey(name string) string {
+	return "ldap.user." + name
+}
+
+var errNoLocalFields = errors.New("ldap: no local fields")
+
+// localFields returns the JSON encoded local fields of a directory user,
+// keyed by lower case field names.
+func (db *ldapDB) localFields(name string) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	data, err := db.secondary.GetSecret(localKey(name), func() ([]byte, error) {
+		return nil, errNoLocalFields
+	})
+	if err == errNoLocalFields {
+		return fields, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &fields)
+	}
+	return fields, err
+}
+
+// Authenticate the user by binding with the password. Users not in the
+// directory are authenticated by the secondary user database.
+func (db *ldapDB) Authenticate(name, password string, result userdb.User) error {
+	// An empty password is an unauthenticated bind that always succeeds
+	if password == "" {
+		return userdb.InvalidArgumentError("missing required parameters")
+	}
+
+	return db.do(func(conn *ldap.Conn) error {
+		entry, err := db.findEntry(conn, name)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			if err = db.secondary.Find(name, result); err == nil {
+				err = userdb.VerifyPassword(result.Basic(), password)
+			}
+			return err
+		}
+
+		if err = conn.Bind(entry.DN, password); err != nil {
+			return err
+		}
+		// Rebind to search groups with the permissions of the bind DN
+		if db.bindDN != "" {
+			err = conn.Bind(db.bindDN, db.bindPassword)
+		} else {
+			err = conn.UnauthenticatedBind("")
+		}
+		if err != nil {
+			return err
+		}
+		return db.fill(conn, entry, result)
+	})
+}
+
+// Create a local user in the secondary user database. Users in the
+// directory can't be created.
+func (db *ldapDB) Create(user userdb.User) error {
+	name := user.Basic().Name
+	err := db.do(func(conn *ldap.Conn) error {
+		entry, err := db.findEntry(conn, name)
+		if err == nil && entry != nil {
+			err = userdb.DuplicateUserError(name)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return db.secondary.Create(user)
+}
+
+// Find the user in the directory, or in the secondary user database.
+func (db *ldapDB) Find(name string, result userdb.User) error {
+	var found bool
+	err := db.do(func(conn *ldap.Conn) error {
+		entry, err := db.findEntry(conn, name)
+		if err != nil || entry == nil {
+			return err
+		}
+		found = true
+		return db.fill(conn, entry, result)
+	})
+	if err != nil || found {
+		return err
+	}
+	return db.secondary.Find(name, result)
+}
+
+// Search users in the directory and the secondary user database. The
+// filter is userdb.Args with "name" and "tenant" keys, and the result is
+// a pointer to a slice of users, or a user to find the first match.
+func (db *ldapDB) Search(filter interface{}, result interface{}) error {
+	ldapFilter, err := db.compileFilter(filter)
+	if err != nil {
+		return err
+	}
+
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() == reflect.Ptr && resultv.Elem().Kind() == reflect.Slice {
+		return db.searchAll(filter, ldapFilter, resultv.Elem())
+	}
+
+	user, ok := result.(userdb.User)
+	if !ok {
+		return userdb.Unsupported{}
+	}
+	var found bool
+	err = db.do(func(conn *ldap.Conn) error {
+		entries, err := db.search(conn, ldapFilter)
+		if err != nil || len(entries) == 0 {
+			return err
+		}
+		found = true
+		return db.fill(conn, entries[0], user)
+	})
+	if err != nil || found {
+		return err
+	}
+	err = db.secondary.Search(filter, result)
+	if _, ok := err.(userdb.Unsupported); ok {
+		err = userdb.UserNotFoundError(fmt.Sprintf("%v", filter))
+	}
+	return err
+}
+
+func (db *ldapDB) searchAll(filter interface{}, ldapFilter string, slice reflect.Value) error {
+	elemType := slice.Type().Elem()
+	if userdb.UserOf(userdb.NewUserElem(elemType)) == nil {
+		return userdb.Unsupported{}
+	}
+
+	// Directory users shadow local users with the same name
+	local := reflect.New(slice.Type())
+	err := db.secondary.Search(filter, local.Interface())
+	if _, ok := err.(userdb.Unsupported); ok {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return db.do(func(conn *ldap.Conn) error {
+		entries, err := db.search(conn, ldapFilter)
+		if err != nil {
+			return err
+		}
+
+		users := reflect.MakeSlice(slice.Type(), 0, len(entries)+local.Elem().Len())
+		names := make(map[string]bool)
+		for _, entry := range entries {
+			v := userdb.NewUserElem(elemType)
+			user := userdb.UserOf(v)
+			if err = db.fill(conn, entry, user); err != nil {
+				return err
+			}
+			names[user.Basic().Name] = true
+			users = reflect.Append(users, v)
+		}
+		for i := 0; i < local.Elem().Len(); i++ {
+			v := local.Elem().Index(i)
+			if user := userdb.UserOf(v); user == nil || !names[user.Basic().Name] {
+				users = reflect.Append(users, v)
+			}
+		}
+		slice.Set(users)
+		return nil
+	})
+}
+
+// compileFilter translates the search filter to an LDAP filter.
+func (db *ldapDB) compileFilter(filter interface{}) (string, error) {
+	args, err := userdb.FilterArgs(filter)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for key, value := range args {
+		s, ok := value.(string)
+		if !ok {
+			return "", userdb.InvalidArgumentError(fmt.Sprintf("Invalid filter of %s", key))
+		}
+		switch key {
+		case "name":
+			sb.WriteString("(" + db.userAttr + "=" + ldap.EscapeFilter(s) + ")")
+		case "tenant":
+			if db.tenantAttr == "" {
+				if s != "" {
+					sb.WriteString("(!(objectClass=*))") // matches nothing
+				}
+			} else if s == "" {
+				sb.WriteString("(!(" + db.tenantAttr + "=*))")
+			} else {
+				sb.WriteString("(" + db.tenantAttr + "=" + ldap.EscapeFilter(s) + ")")
+			}
+		default:
+			return "", userdb.InvalidArgumentError("Unsupported filter: " + key)
+		}
+	}
+	return sb.String(), nil
+}
+
+// directoryName returns the name of the user in the directory, or an empty
+// string if the user is not in the directory.
+func (db *ldapDB) directoryName(name string) (string, error) {
+	var dirName string
+	err := db.do(func(conn *ldap.Conn) error {
+		entry, err := db.findEntry(conn, name)
+		if err == nil && entry != nil {
+			dirName = entry.GetAttributeValue(db.userAttr)
+		}
+		return err
+	})
+	return dirName, err
+}
+
+func managedError(name string) error {
+	return userdb.InvalidArgumentError("User is managed by the directory: " + name)
+}
+
+// Remove a local user. Users in the directory can't be removed.
+func (db *ldapDB) Remove(name string) error {
+	dirName, err := db.directoryName(name)
+	if err != nil {
+		return err
+	}
+	if dirName != "" {
+		return managedError(name)
+	}
+	return db.secondary.Remove(name)
+}
+
+// Update a local user. Only local fields of users in the directory, which
+// are not fields of BasicUser, can be updated.
+func (db *ldapDB) Update(name string, fields interface{}) error {
+	dirName, err := db.directoryName(name)
+	if err != nil {
+		return err
+	}
+	if dirName == "" {
+		return db.secondary.Update(name, fields)
+	}
+
+	args, ok := fields.(userdb.Args)
+	if !ok {
+		return userdb.Unsupported{}
+	}
+	for key := range args {
+		if userdb.IsBasicField(key) {
+			return managedError(name)
+		}
+	}
+
+	local, err := db.localFields(dirName)
+	if err != nil {
+		return err
+	}
+	for key, value := range args {
+		if local[strings.ToLower(key)], err = json.Marshal(value); err != nil {
+			return userdb.InvalidArgumentError("Invalid " + key)
+		}
+	}
+	data, err := json.Marshal(local)
+	if err != nil {
+		return err
+	}
+	return db.secondary.SetSecret(localKey(dirName), data)
+}
+
+func (db *ldapDB) GetSecret(key string, gen func() ([]byte, error)) ([]byte, error) {
+	return db.secondary.GetSecret(key, gen)
+}
+
+func (db *ldapDB) SetSecret(key string, secret []byte) error {
+	return db.secondary.SetSecret(key, secret)
+}
+
+func (db *ldapDB) apiKeys() (userdb.APIKeyStore, error) {
+	if store, ok := db.secondary.(userdb.APIKeyStore); ok {
+		return store, nil
+	}
+	return nil, userdb.Unsupported{}
+}
+
+func (db *ldapDB) CreateAPIKey(key *userdb.APIKey) error {
+	store, err := db.apiKeys()
+	if err != nil {
+		return err
+	}
+	return store.CreateAPIKey(key)
+}
+
+func (db *ldapDB) FindAPIKey(id string) (*userdb.APIKey, error) {
+	store, err := db.apiKeys()
+	if err != nil {
+		return nil, err
+	}
+	return store.FindAPIKey(id)
+}
+
+func (db *ldapDB) FindAPIKeyByName(name string) (*userdb.APIKey, error) {
+	store, err := db.apiKeys()
+	if err != nil {
+		return nil, err
+	}
+	return store.FindAPIKeyByName(name)
+}
+
+func (db *ldapDB) ListAPIKeys(tenant string) ([]*userdb.APIKey, error) {
+	store, err := db.apiKeys()
+	if err != nil {
+		return nil, err
+	}
+	return store.ListAPIKeys(tenant)
+}
+
+func (db *ldapDB) RemoveAPIKey(name string) error {
+	store, err := db.apiKeys()
+	if err != nil {
+		return err
+	}
+	return store.RemoveAPIKey(name)
+}
+
+func (db *ldapDB) logins() (userdb.LoginAuditStore, error) {
+	if store, ok := db.secondary.(userdb.LoginAuditStore); ok {
+		return store, nil
+	}
+	return nil, userdb.Unsupported{}
+}
+
+func (db *ldapDB) AddLoginEvent(event *userdb.LoginEvent) error {
+	store, err := db.logins()
+	if err != nil {
+		return err
+	}
+	return store.AddLoginEvent(event)
+}
+
+func (db *ldapDB) FindLoginEvents(filter *userdb.LoginFilter) ([]*userdb.LoginEvent, error) {
+	store, err := db.logins()
+	if err != nil {
+		return nil, err
+	}
+	return store.FindLoginEvents(filter)
+}
+
+func (db *ldapDB) RemoveLoginEvents(before time.Time) error {
+	store, err := db.logins()
+	if err != nil {
+		return err
+	}
+	return store.RemoveLoginEvents(before)
+}
+
+func (db *ldapDB) Close() {
+	db.secondary.Close()
+}
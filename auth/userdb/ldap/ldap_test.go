@@ -0,0 +1,480 @@
+package ldap_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/redhill42/iota/auth/userdb"
+	_ "github.com/redhill42/iota/auth/userdb/file"
+	_ "github.com/redhill42/iota/auth/userdb/ldap"
+)
+
+func TestLDAP(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "LDAP UserDB Suite")
+}
+
+const (
+	baseDN       = "dc=example,dc=com"
+	adminDN      = "cn=admin,dc=example,dc=com"
+	adminPasswd  = "secret"
+	aliceDN      = "uid=alice,ou=people,dc=example,dc=com"
+	bobDN        = "uid=bob,ou=people,dc=example,dc=com"
+	adminsDN     = "cn=iota-admins,ou=groups,dc=example,dc=com"
+	staffGroupDN = "cn=staff,ou=groups,dc=example,dc=com"
+)
+
+type entry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// mockDirectory is a minimal LDAP server that supports simple bind and
+// search with and, or, not, equality, presence and substrings filters.
+type mockDirectory struct {
+	listener net.Listener
+	entries  []entry
+	wg       sync.WaitGroup
+}
+
+func newMockDirectory() *mockDirectory {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+
+	d := &mockDirectory{listener: l, entries: []entry{
+		{dn: adminDN, password: adminPasswd, attrs: map[string][]string{"objectClass": {"organizationalRole"}}},
+		{dn: aliceDN, password: "alice", attrs: map[string][]string{
+			"objectClass": {"person"}, "uid": {"alice"}, "o": {"acme"},
+		}},
+		{dn: bobDN, password: "bob", attrs: map[string][]string{
+			"objectClass": {"person"}, "uid": {"bob"},
+		}},
+		{dn: adminsDN, attrs: map[string][]string{
+			"objectClass": {"groupOfNames"}, "cn": {"iota-admins"}, "member": {aliceDN},
+		}},
+		{dn: staffGroupDN, attrs: map[string][]string{
+			"objectClass": {"groupOfNames"}, "cn": {"staff"}, "member": {aliceDN, bobDN},
+		}},
+	}}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+func (d *mockDirectory) Close() {
+	d.listener.Close()
+	d.wg.Wait()
+}
+
+func (d *mockDirectory) URL() string {
+	return "ldap://" + d.listener.Addr().String() + "/" + baseDN
+}
+
+func (d *mockDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+			if dn == "" && password == "" {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, e := range d.entries {
+				if e.dn == dn && e.password != "" && e.password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			conn.Write(envelope(id, result(ldap.ApplicationBindResponse, code)).Bytes())
+
+		case ldap.ApplicationSearchRequest:
+			base := op.Children[0].Data.String()
+			filter := op.Children[6]
+			for _, e := range d.entries {
+				if strings.HasSuffix(e.dn, base) && match(filter, e) {
+					conn.Write(envelope(id, searchEntry(e)).Bytes())
+				}
+			}
+			conn.Write(envelope(id, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)).Bytes())
+
+		case ldap.ApplicationUnbindRequest:
+			return
+
+		default:
+			return
+		}
+	}
+}
+
+func envelope(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	return p
+}
+
+func result(tag ber.Tag, code int) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return p
+}
+
+func searchEntry(e entry) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+	attrs := ber.NewSequence("")
+	for name, values := range e.attrs {
+		attr := ber.NewSequence("")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	p.AppendChild(attrs)
+	return p
+}
+
+func values(e entry, attr string) []string {
+	for name, values := range e.attrs {
+		if strings.EqualFold(name, attr) {
+			return values
+		}
+	}
+	return nil
+}
+
+func match(filter *ber.Packet, e entry) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !match(child, e) {
+				return false
+			}
+		}
+		return true
+
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if match(child, e) {
+				return true
+			}
+		}
+		return false
+
+	case ldap.FilterNot:
+		return !match(filter.Children[0], e)
+
+	case ldap.FilterPresent:
+		return len(values(e, filter.Data.String())) != 0
+
+	case ldap.FilterEqualityMatch:
+		want := filter.Children[1].Data.String()
+		for _, v := range values(e, filter.Children[0].Data.String()) {
+			if strings.EqualFold(v, want) {
+				return true
+			}
+		}
+		return false
+
+	case ldap.FilterSubstrings:
+		for _, v := range values(e, filter.Children[0].Data.String()) {
+			ok := true
+			for _, sub := range filter.Children[1].Children {
+				s := sub.Data.String()
+				switch sub.Tag {
+				case ldap.FilterSubstringsInitial:
+					ok = ok && strings.HasPrefix(v, s)
+				case ldap.FilterSubstringsAny:
+					ok = ok && strings.Contains(v, s)
+				case ldap.FilterSubstringsFinal:
+					ok = ok && strings.HasSuffix(v, s)
+				}
+			}
+			if ok {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+var _ = Describe("LDAP", func() {
+	var (
+		dir *mockDirectory
+		tmp string
+		db  *userdb.UserDatabase
+	)
+
+	env := map[string]string{
+		"IOTA_LDAP_BINDDN":       adminDN,
+		"IOTA_LDAP_BINDPASSWORD": adminPasswd,
+		"IOTA_LDAP_TENANTATTR":   "o",
+		"IOTA_LDAP_ROLEMAPPING":  "iota-admins=admin, staff=operator",
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir = newMockDirectory()
+		tmp, err = ioutil.TempDir("", "ldap_test")
+		Expect(err).NotTo(HaveOccurred())
+
+		for key, value := range env {
+			os.Setenv(key, value)
+		}
+		os.Setenv("IOTA_USERDB_URL", dir.URL())
+		os.Setenv("IOTA_LDAP_SECONDARY", "file://"+filepath.Join(tmp, "userdb"))
+
+		db, err = userdb.Open()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		db.Close()
+		dir.Close()
+		os.RemoveAll(tmp)
+		for key := range env {
+			os.Unsetenv(key)
+		}
+		os.Unsetenv("IOTA_USERDB_URL")
+		os.Unsetenv("IOTA_LDAP_SECONDARY")
+	})
+
+	Describe("Authenticate", func() {
+		It("should authenticate by bind", func() {
+			user, err := db.Authenticate("alice", "alice")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Name).To(Equal("alice"))
+			Expect(user.Roles).To(ConsistOf(userdb.RoleAdmin, userdb.RoleOperator))
+			Expect(user.Tenant).To(Equal("acme"))
+		})
+
+		It("should fail with incorrect password", func() {
+			_, err := db.Authenticate("alice", "bob")
+			Expect(err).To(HaveOccurred())
+			_, err = db.Authenticate("alice", "")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should fail for unknown user", func() {
+			_, err := db.Authenticate("nobody", "nobody")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should not match users by filter injection", func() {
+			_, err := db.Authenticate("*", "alice")
+			Expect(err).To(HaveOccurred())
+			_, err = db.Authenticate("alice)(uid=*", "alice")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Find", func() {
+		It("should map groups to roles", func() {
+			var user userdb.BasicUser
+			Expect(db.Find("bob", &user)).To(Succeed())
+			Expect(user.Roles).To(Equal([]string{userdb.RoleOperator}))
+			Expect(user.Tenant).To(BeEmpty())
+		})
+
+		It("should give default roles without mapped groups", func() {
+			os.Setenv("IOTA_LDAP_ROLEMAPPING", "iota-admins=admin")
+			other, err := userdb.Open()
+			Expect(err).NotTo(HaveOccurred())
+			defer other.Close()
+
+			var user userdb.BasicUser
+			Expect(other.Find("bob", &user)).To(Succeed())
+			Expect(user.Roles).To(Equal([]string{userdb.RoleViewer}))
+		})
+
+		It("should fail for unknown user", func() {
+			var user userdb.BasicUser
+			Expect(db.Find("nobody", &user)).To(MatchError(userdb.UserNotFoundError("nobody")))
+		})
+	})
+
+	Describe("Search", func() {
+		It("should list users of the directory", func() {
+			users, err := db.List("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(users).To(HaveLen(2))
+		})
+
+		It("should list users of a tenant", func() {
+			users, err := db.List("acme")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(users).To(HaveLen(1))
+			Expect(users[0].Name).To(Equal("alice"))
+		})
+
+		It("should find user by name", func() {
+			var user userdb.BasicUser
+			Expect(db.Search(userdb.Args{"name": "bob"}, &user)).To(Succeed())
+			Expect(user.Name).To(Equal("bob"))
+		})
+
+		It("should reject unsupported filters", func() {
+			var users []*userdb.BasicUser
+			Expect(db.Search(userdb.Args{"email": "bob@example.com"}, &users)).NotTo(Succeed())
+		})
+	})
+
+	Describe("Local users", func() {
+		It("should create local users in the secondary database", func() {
+			Expect(db.Create(&userdb.BasicUser{Name: "carol", Roles: []string{userdb.RoleViewer}}, "carol")).To(Succeed())
+
+			user, err := db.Authenticate("carol", "carol")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Name).To(Equal("carol"))
+
+			_, err = db.Authenticate("carol", "alice")
+			Expect(err).To(HaveOccurred())
+
+			Expect(db.ChangePassword("carol", "carol", "new")).To(Succeed())
+			_, err = db.Authenticate("carol", "new")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(db.Remove("carol")).To(Succeed())
+		})
+
+		It("should not create users in the directory", func() {
+			err := db.Create(&userdb.BasicUser{Name: "alice", Roles: []string{userdb.RoleViewer}}, "alice")
+			Expect(err).To(MatchError(userdb.DuplicateUserError("alice")))
+		})
+
+		It("should not modify users in the directory", func() {
+			Expect(db.SetInactive("alice", true)).NotTo(Succeed())
+			Expect(db.Remove("alice")).NotTo(Succeed())
+			Expect(db.ChangePassword("alice", "alice", "new")).NotTo(Succeed())
+			Expect(db.ChangePassword("alice", "wrong", "new")).To(MatchError(userdb.PermissionDeniedError("incorrect password")))
+		})
+	})
+
+	Describe("Two-factor authentication", func() {
+		AfterEach(func() {
+			os.Unsetenv("IOTA_AUTH_TWOFACTORROLES")
+		})
+
+		login := func(name, password string) error {
+			_, err := db.Login(name, password, "", userdb.ChannelHTTP)
+			return err
+		}
+
+		It("should enroll users of the directory", func() {
+			os.Setenv("IOTA_AUTH_TWOFACTORROLES", userdb.RoleAdmin)
+			Expect(login("bob", "bob")).To(Succeed())
+			Expect(login("alice", "alice")).To(Equal(&userdb.SecondFactorRequiredError{User: "alice", Enroll: true}))
+
+			enroll, err := db.EnrollTOTP("alice")
+			Expect(err).NotTo(HaveOccurred())
+			user, codes, err := db.LoginSecondFactor("alice", totpCode(enroll.Secret, time.Now()), "", userdb.ChannelHTTP)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Roles).To(ConsistOf(userdb.RoleAdmin, userdb.RoleOperator))
+			Expect(codes).To(HaveLen(10))
+
+			Expect(login("alice", "alice")).To(Equal(&userdb.SecondFactorRequiredError{User: "alice"}))
+			_, _, err = db.LoginSecondFactor("alice", codes[0], "", userdb.ChannelHTTP)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, err = db.LoginSecondFactor("alice", codes[0], "", userdb.ChannelHTTP)
+			Expect(err).To(BeAssignableToTypeOf(userdb.SecondFactorError("")))
+
+			Expect(db.DisableTOTP("alice")).To(Succeed())
+			Expect(login("alice", "alice")).To(Equal(&userdb.SecondFactorRequiredError{User: "alice", Enroll: true}))
+		})
+
+		It("should not create local users for users of the directory", func() {
+			_, err := db.EnrollTOTP("alice")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(db.Update("alice", userdb.Args{"TOTPPending": nil, "Inactive": true})).NotTo(Succeed())
+
+			secondary, err := userdb.NewPluginURL("file://" + filepath.Join(tmp, "userdb"))
+			Expect(err).NotTo(HaveOccurred())
+			defer secondary.Close()
+			var user userdb.BasicUser
+			Expect(secondary.Find("alice", &user)).To(MatchError(userdb.UserNotFoundError("alice")))
+
+			users, err := db.List("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(users).To(HaveLen(2))
+		})
+	})
+
+	It("should keep secrets in the secondary database", func() {
+		secret, err := db.Secrets().GetSecret("test", func() ([]byte, error) {
+			return []byte("secret"), nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secret).To(Equal([]byte("secret")))
+
+		Expect(db.Secrets().SetSecret("test", []byte("rotated"))).To(Succeed())
+		secret, err = db.Secrets().GetSecret("test", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secret).To(Equal([]byte("rotated")))
+	})
+
+	It("should keep API keys in the secondary database", func() {
+		system := &userdb.BasicUser{Name: "system", Roles: []string{userdb.RoleAdmin}}
+		apikey, err := db.CreateAPIKey(system, &userdb.APIKey{Name: "ci", Role: userdb.RoleViewer})
+		Expect(err).NotTo(HaveOccurred())
+		key, err := db.VerifyAPIKey(apikey)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key.Name).To(Equal("ci"))
+	})
+})
+
+// totpCode returns the TOTP code of the secret at the time, as specified
+// by RFC 6238.
+func totpCode(secret string, t time.Time) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(t.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+}
@@ -3,6 +3,7 @@ package mongodb
 import (
 	"fmt"
 	"reflect"
+	"time"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -27,6 +28,20 @@ func mongodbPlugin(dburl string) (userdb.Plugin, error) {
 		Key:    []string{"name"},
 		Unique: true,
 	})
+	if err == nil {
+		err = session.DB("").C("apikeys").EnsureIndex(mgo.Index{
+			Key:    []string{"name"},
+			Unique: true,
+		})
+	}
+	if err == nil {
+		logins := session.DB("").C("logins")
+		for _, key := range [][]string{{"user", "-time"}, {"ip", "-time"}, {"tenant", "-time"}, {"time"}} {
+			if err = logins.EnsureIndexKey(key...); err != nil {
+				break
+			}
+		}
+	}
 	if err != nil {
 		session.Close()
 		return nil, err
@@ -121,6 +136,123 @@ func (db *mongodb) GetSecret(key string, gen func() ([]byte, error)) ([]byte, er
 	return record.Secret, err
 }
 
+func (db *mongodb) SetSecret(key string, secret []byte) error {
+	session := db.session.Copy()
+	c := session.DB("").C("secret")
+	defer session.Close()
+
+	_, err := c.UpsertId(key, bson.M{"$set": bson.M{"secret": secret}})
+	return err
+}
+
+func (db *mongodb) doKeys(f func(c *mgo.Collection) error) error {
+	session := db.session.Copy()
+	err := f(session.DB("").C("apikeys"))
+	session.Close()
+	return err
+}
+
+func (db *mongodb) CreateAPIKey(key *userdb.APIKey) error {
+	return db.doKeys(func(c *mgo.Collection) error {
+		err := c.Insert(key)
+		if mgo.IsDup(err) {
+			err = userdb.DuplicateAPIKeyError(key.Name)
+		}
+		return err
+	})
+}
+
+func (db *mongodb) FindAPIKey(id string) (*userdb.APIKey, error) {
+	var key userdb.APIKey
+	err := db.doKeys(func(c *mgo.Collection) error {
+		err := c.FindId(id).One(&key)
+		if err == mgo.ErrNotFound {
+			err = userdb.APIKeyNotFoundError(id)
+		}
+		return err
+	})
+	return &key, err
+}
+
+func (db *mongodb) FindAPIKeyByName(name string) (*userdb.APIKey, error) {
+	var key userdb.APIKey
+	err := db.doKeys(func(c *mgo.Collection) error {
+		err := c.Find(bson.M{"name": name}).One(&key)
+		if err == mgo.ErrNotFound {
+			err = userdb.APIKeyNotFoundError(name)
+		}
+		return err
+	})
+	return &key, err
+}
+
+func (db *mongodb) ListAPIKeys(tenant string) ([]*userdb.APIKey, error) {
+	filter := bson.M{}
+	if tenant != "" {
+		filter["tenant"] = tenant
+	}
+	keys := make([]*userdb.APIKey, 0)
+	err := db.doKeys(func(c *mgo.Collection) error {
+		return c.Find(filter).Sort("name").All(&keys)
+	})
+	return keys, err
+}
+
+func (db *mongodb) RemoveAPIKey(name string) error {
+	return db.doKeys(func(c *mgo.Collection) error {
+		err := c.Remove(bson.M{"name": name})
+		if err == mgo.ErrNotFound {
+			err = userdb.APIKeyNotFoundError(name)
+		}
+		return err
+	})
+}
+
+func (db *mongodb) doLogins(f func(c *mgo.Collection) error) error {
+	session := db.session.Copy()
+	err := f(session.DB("").C("logins"))
+	session.Close()
+	return err
+}
+
+func (db *mongodb) AddLoginEvent(event *userdb.LoginEvent) error {
+	return db.doLogins(func(c *mgo.Collection) error {
+		return c.Insert(event)
+	})
+}
+
+func (db *mongodb) FindLoginEvents(filter *userdb.LoginFilter) ([]*userdb.LoginEvent, error) {
+	query := bson.M{}
+	if filter.User != "" {
+		query["user"] = filter.User
+	}
+	if filter.Tenant != "" {
+		query["tenant"] = filter.Tenant
+	}
+	if filter.IP != "" {
+		query["ip"] = filter.IP
+	}
+	if filter.Result != "" {
+		query["result"] = filter.Result
+	}
+	if !filter.Since.IsZero() {
+		query["time"] = bson.M{"$gte": filter.Since}
+	}
+
+	events := make([]*userdb.LoginEvent, 0)
+	err := db.doLogins(func(c *mgo.Collection) error {
+		return c.Find(query).Sort("-time").Limit(filter.Limit).All(&events)
+	})
+	return events, err
+}
+
+func (db *mongodb) RemoveLoginEvents(before time.Time) error {
+	return db.doLogins(func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{"time": bson.M{"$lt": before}})
+		return err
+	})
+}
+
 func (db *mongodb) Close() {
 	db.session.Close()
 }
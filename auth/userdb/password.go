@@ -0,0 +1,148 @@
+package userdb
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/redhill42/iota/config"
+)
+
+// The PasswordPolicyError indicates that a password doesn't satisfy the
+// password policy.
+type PasswordPolicyError string
+
+func (e PasswordPolicyError) Error() string {
+	return string(e)
+}
+
+func (e PasswordPolicyError) HTTPErrorStatusCode() int {
+	return http.StatusBadRequest
+}
+
+// passwordHistoryField is the field of previous password hashes of a user,
+// which is saved as an extra field.
+const passwordHistoryField = "passwordhistory"
+
+// historyUser is a user with previous password hashes.
+type historyUser struct {
+	BasicUser       `bson:",inline"`
+	PasswordHistory [][]byte `bson:"passwordhistory,omitempty" json:"passwordhistory,omitempty"`
+}
+
+// CheckPasswordPolicy checks a new password against the password policy
+// in the "password" configuration section:
+//
+//	password.minLength   minimum number of characters
+//	password.minClasses  minimum number of character classes, which are
+//	                     lower case and upper case letters, digits and
+//	                     other characters
+//
+// Any non-empty password is accepted if the policy is not configured.
+func CheckPasswordPolicy(password string) error {
+	if len(password) == 0 {
+		return InvalidArgumentError("missing required parameters")
+	}
+
+	if n := intOption("password.minLength", 0); utf8.RuneCountInString(password) < n {
+		return PasswordPolicyError(fmt.Sprintf("Password must have at least %d characters", n))
+	}
+
+	if n := intOption("password.minClasses", 0); n > 0 {
+		var lower, upper, digit, other int
+		for _, c := range password {
+			switch {
+			case unicode.IsLower(c):
+				lower = 1
+			case unicode.IsUpper(c):
+				upper = 1
+			case unicode.IsDigit(c):
+				digit = 1
+			default:
+				other = 1
+			}
+		}
+		if lower+upper+digit+other < n {
+			return PasswordPolicyError(fmt.Sprintf(
+				"Password must have at least %d of lower case letters, upper case letters, digits and symbols", n))
+		}
+	}
+	return nil
+}
+
+// setPassword replaces the password of a user. The password must satisfy
+// the password policy, and must not be one of the last "password.history"
+// passwords of the user.
+func (db *UserDatabase) setPassword(name string, password string) error {
+	if err := CheckPasswordPolicy(password); err != nil {
+		return err
+	}
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	n := intOption("password.history", 0)
+	if n <= 0 {
+		return db.plugin.Update(name, Args{"password": hashedPassword})
+	}
+
+	var user historyUser
+	if err = db.plugin.Find(name, &user); err != nil {
+		return err
+	}
+	previous := append([][]byte{user.Password}, user.PasswordHistory...)
+	if len(previous) > n {
+		previous = previous[:n]
+	}
+	for _, hash := range previous {
+		if bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil {
+			return PasswordPolicyError(fmt.Sprintf("Password must not be one of the last %d passwords", n))
+		}
+	}
+
+	// The new password and the saved passwords are the last n passwords
+	if len(previous) > n-1 {
+		previous = previous[:n-1]
+	}
+	return db.plugin.Update(name, Args{
+		"password":           hashedPassword,
+		passwordHistoryField: previous,
+	})
+}
+
+// isHashedPassword returns true if the password is already hashed by bcrypt.
+func isHashedPassword(password string) bool {
+	if strings.HasPrefix(password, "$2a$") {
+		_, err := bcrypt.Cost([]byte(password))
+		return err == nil
+	}
+	return false
+}
+
+func intOption(key string, def int) int {
+	if s := config.Get(key); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			return n
+		}
+		logrus.Warnf("Invalid %s: %s", key, s)
+	}
+	return def
+}
+
+func durationOption(key string, def time.Duration) time.Duration {
+	if s := config.Get(key); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+			return d
+		}
+		logrus.Warnf("Invalid %s: %s", key, s)
+	}
+	return def
+}
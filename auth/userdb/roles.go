@@ -0,0 +1,198 @@
+package userdb
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/redhill42/iota/config"
+)
+
+// Permissions checked by the API server and MQTT broker.
+const (
+	// Read devices and claims, subscribe to device topics
+	DeviceRead = "device:read"
+
+	// Create and update devices, send RPC requests, publish to device
+	// topics
+	DeviceWrite = "device:write"
+
+	// Remove devices
+	DeviceDelete = "device:delete"
+
+	// Approve or reject device claims
+	DeviceApprove = "device:approve"
+
+	// Read alarms
+	AlarmRead = "alarm:read"
+
+	// Raise, clear and remove alarms
+	AlarmWrite = "alarm:write"
+
+	// Create, update and remove users of the same tenant, or users of all
+	// tenants for system users
+	UserManage = "user:manage"
+
+	// Read runtime metrics of the server, for system users only
+	SystemRead = "system:read"
+
+	// AllPermissions grants all permissions
+	AllPermissions = "*"
+)
+
+// Built-in roles
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var builtinRoles = map[string][]string{
+	RoleViewer:   {DeviceRead, AlarmRead},
+	RoleOperator: {DeviceRead, DeviceWrite, AlarmRead, AlarmWrite},
+	RoleAdmin:    {AllPermissions},
+}
+
+// RolePermissions returns the permissions granted to a role. Roles are
+// defined in the "roles" configuration section as comma separated lists
+// of permissions, which override the built-in roles. Returns false if the
+// role is not defined.
+func RolePermissions(role string) ([]string, bool) {
+	if perms := config.Get("roles." + role); perms != "" {
+		var result []string
+		for _, p := range strings.Split(perms, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				result = append(result, p)
+			}
+		}
+		return result, true
+	}
+	perms, ok := builtinRoles[role]
+	return perms, ok
+}
+
+// ParseRoleMapping parses a comma separated list of group=role pairs that
+// map groups of an external identity service to roles. A group may be
+// mapped to multiple roles, and all roles must be defined.
+func ParseRoleMapping(s string) (map[string][]string, error) {
+	mapping := make(map[string][]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, InvalidArgumentError("Invalid role mapping: " + pair)
+		}
+		group, role := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		if err := ValidateRoles([]string{role}); err != nil {
+			return nil, err
+		}
+		mapping[group] = append(mapping[group], role)
+	}
+	return mapping, nil
+}
+
+// MapRoles returns the roles mapped from groups, or the default roles if
+// no group is mapped.
+func MapRoles(mapping map[string][]string, groups []string, defaultRoles []string) []string {
+	var roles []string
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		for _, role := range mapping[group] {
+			if !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+	if len(roles) == 0 {
+		roles = append([]string{}, defaultRoles...)
+	}
+	return roles
+}
+
+// ValidateRoles returns an error if any of the roles is not defined.
+func ValidateRoles(roles []string) error {
+	for _, role := range roles {
+		if _, ok := RolePermissions(role); !ok {
+			return InvalidArgumentError("Unknown role: " + role)
+		}
+	}
+	return nil
+}
+
+// DefaultRoles returns the roles of users that have no role assigned, as
+// configured by "auth.defaultRole", "viewer" by default.
+func DefaultRoles() []string {
+	return strings.Split(config.GetOrDefault("auth.defaultRole", RoleViewer), ",")
+}
+
+// HasPermission returns true if any of the roles grants the permission.
+// The default roles are checked if no role is given.
+func HasPermission(roles []string, perm string) bool {
+	if len(roles) == 0 {
+		roles = DefaultRoles()
+	}
+	for _, role := range roles {
+		perms, _ := RolePermissions(strings.TrimSpace(role))
+		for _, p := range perms {
+			if p == perm || p == AllPermissions {
+				return true
+			}
+			// "device:*" grants all permissions on devices
+			if strings.HasSuffix(p, ":*") && strings.HasPrefix(perm, p[:len(p)-1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HasPermission returns true if the user has the permission.
+func (user *BasicUser) HasPermission(perm string) bool {
+	return HasPermission(user.Roles, perm)
+}
+
+// CanManage returns true if the user is permitted to manage the other user.
+// System users manage users of all tenants, while users of a tenant only
+// manage users of the tenant. Users with more permissions than the user
+// can't be managed by the user.
+func (user *BasicUser) CanManage(other *BasicUser) bool {
+	return user.HasPermission(UserManage) &&
+		(user.Tenant == "" || user.Tenant == other.Tenant) &&
+		user.CanGrant(other.Roles)
+}
+
+// CanGrant returns true if the user has all permissions of the roles, so
+// that users can't escalate privileges by assigning roles. The default
+// roles are checked if no role is given.
+func (user *BasicUser) CanGrant(roles []string) bool {
+	if len(roles) == 0 {
+		roles = DefaultRoles()
+	}
+	for _, role := range roles {
+		perms, ok := RolePermissions(strings.TrimSpace(role))
+		if !ok {
+			return false
+		}
+		for _, p := range perms {
+			if !user.HasPermission(p) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// The PermissionDeniedError indicates that a user doesn't have the
+// permission to perform an operation.
+type PermissionDeniedError string
+
+func (e PermissionDeniedError) Error() string {
+	return fmt.Sprintf("Permission denied: %s", string(e))
+}
+
+func (e PermissionDeniedError) HTTPErrorStatusCode() int {
+	return http.StatusForbidden
+}
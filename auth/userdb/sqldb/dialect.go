@@ -0,0 +1,80 @@
+package sqldb
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/redhill42/iota/auth/userdb"
+)
+
+// dialect hides differences between SQL databases.
+type dialect struct {
+	// driver is the name of the database/sql driver
+	driver string
+
+	// blob is the column type of binary data
+	blob string
+
+	// lock serializes schema migrations between servers
+	lock string
+
+	// numbered placeholders are used instead of '?'
+	numbered bool
+
+	// dsn returns the data source name of the database URL
+	dsn func(u *url.URL) (string, error)
+
+	// isDup returns true if the error is a unique constraint violation
+	isDup func(err error) bool
+}
+
+var postgres = &dialect{
+	driver:   "postgres",
+	blob:     "BYTEA",
+	lock:     "LOCK TABLE schema_version IN EXCLUSIVE MODE",
+	numbered: true,
+	dsn: func(u *url.URL) (string, error) {
+		return u.String(), nil
+	},
+	isDup: func(err error) bool {
+		e, ok := err.(*pq.Error)
+		return ok && e.Code == "23505"
+	},
+}
+
+// dialects are the SQL databases by URL scheme.
+var dialects = make(map[string]*dialect)
+
+// registerDialect registers the dialect and the user database plugin for
+// the URL schemes.
+func registerDialect(d *dialect, schemes ...string) {
+	for _, scheme := range schemes {
+		dialects[scheme] = d
+		userdb.RegisterPlugin(scheme, sqlPlugin)
+	}
+}
+
+func init() {
+	registerDialect(postgres, "postgres", "postgresql")
+}
+
+// rebind replaces '?' placeholders of the query with the placeholders of
+// the dialect.
+func (d *dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var sb strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+		} else {
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,46 @@
+// +build cgo
+
+package sqldb
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var sqlite = &dialect{
+	driver: "sqlite3",
+	blob:   "BLOB",
+	dsn:    sqliteDSN,
+	isDup: func(err error) bool {
+		e, ok := err.(sqlite3.Error)
+		return ok && e.Code == sqlite3.ErrConstraint
+	},
+}
+
+func init() {
+	registerDialect(sqlite, "sqlite", "sqlite3")
+}
+
+// sqliteDSN returns the database file of sqlite:///path/to/file URLs, or
+// sqlite://path/to/file for relative paths. Transactions take the write
+// lock immediately and wait for other servers sharing the file.
+func sqliteDSN(u *url.URL) (string, error) {
+	filename := u.Host + u.Path
+	if u.Opaque != "" {
+		filename = u.Opaque
+	}
+	if filename == "" {
+		return "", errors.New("User database file not configured")
+	}
+
+	query := u.Query()
+	if query.Get("_busy_timeout") == "" {
+		query.Set("_busy_timeout", "5000")
+	}
+	if query.Get("_txlock") == "" {
+		query.Set("_txlock", "immediate")
+	}
+	return "file:" + filename + "?" + query.Encode(), nil
+}
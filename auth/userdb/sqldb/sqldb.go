@@ -0,0 +1,577 @@
+// Package sqldb implements a user database backed by PostgreSQL or SQLite.
+// SQLite is only supported in builds with cgo enabled.
+//
+// The fields of BasicUser are kept in columns of the users table, and
+// extra fields of concrete User types are kept in a JSON column, keyed by
+// lower case field names as they are in MongoDB. The schema is created
+// and upgraded when the database is opened.
+package sqldb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/redhill42/iota/auth/userdb"
+)
+
+// User database backed by SQL database.
+type sqlDB struct {
+	db      *sql.DB
+	dialect *dialect
+}
+
+func sqlPlugin(dburl string) (userdb.Plugin, error) {
+	u, err := url.Parse(dburl)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := dialects[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported user database scheme: %s", u.Scheme)
+	}
+	dsn, err := d.dsn(u)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlDB{db, d}
+	if err = s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrations create and upgrade the schema. Each migration is applied
+// once in a transaction, and the number of applied migrations is kept
+// in the schema_version table. New migrations must be appended.
+var migrations = [][]string{
+	{
+		`CREATE TABLE users (
+			name     TEXT PRIMARY KEY,
+			password BLOB NOT NULL,
+			inactive BOOLEAN NOT NULL DEFAULT FALSE,
+			roles    TEXT NOT NULL DEFAULT '',
+			tenant   TEXT NOT NULL DEFAULT '',
+			extra    TEXT NOT NULL DEFAULT '{}'
+		)`,
+		`CREATE INDEX users_tenant ON users (tenant)`,
+		`CREATE TABLE secrets (
+			name   TEXT PRIMARY KEY,
+			secret BLOB NOT NULL
+		)`,
+		`CREATE TABLE apikeys (
+			id     TEXT PRIMARY KEY,
+			name   TEXT NOT NULL UNIQUE,
+			tenant TEXT NOT NULL DEFAULT '',
+			data   TEXT NOT NULL
+		)`,
+	},
+	{
+		`CREATE TABLE logins (
+			ts       BIGINT NOT NULL,
+			username TEXT NOT NULL,
+			tenant   TEXT NOT NULL DEFAULT '',
+			ip       TEXT NOT NULL DEFAULT '',
+			channel  TEXT NOT NULL,
+			result   TEXT NOT NULL,
+			reason   TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX logins_username ON logins (username, ts)`,
+		`CREATE INDEX logins_ip ON logins (ip, ts)`,
+		`CREATE INDEX logins_tenant ON logins (tenant, ts)`,
+		`CREATE INDEX logins_ts ON logins (ts)`,
+	},
+}
+
+func (db *sqlDB) migrate() error {
+	_, err := db.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	return db.tx(func(tx *sql.Tx) error {
+		if db.dialect.lock != "" {
+			if _, err := tx.Exec(db.dialect.lock); err != nil {
+				return err
+			}
+		}
+
+		var version int
+		err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+		if err != nil {
+			return err
+		}
+		if version > len(migrations) {
+			return fmt.Errorf("User database schema version %d is newer than supported", version)
+		}
+
+		for ; version < len(migrations); version++ {
+			for _, stmt := range migrations[version] {
+				stmt = strings.Replace(stmt, "BLOB", db.dialect.blob, -1)
+				if _, err = tx.Exec(stmt); err != nil {
+					return fmt.Errorf("User database migration %d: %v", version+1, err)
+				}
+			}
+			_, err = tx.Exec(db.rebind(`INSERT INTO schema_version (version) VALUES (?)`), version+1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *sqlDB) rebind(query string) string {
+	return db.dialect.rebind(query)
+}
+
+func (db *sqlDB) tx(f func(tx *sql.Tx) error) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+const userColumns = "name, password, inactive, roles, tenant, extra"
+
+// record is a row of the users table.
+type record struct {
+	name     string
+	password []byte
+	inactive bool
+	roles    string
+	tenant   string
+	extra    string
+}
+
+func (r *record) scan(row interface{ Scan(...interface{}) error }) error {
+	return row.Scan(&r.name, &r.password, &r.inactive, &r.roles, &r.tenant, &r.extra)
+}
+
+// fill copies the record to the user.
+func (r *record) fill(result userdb.User) error {
+	basic := userdb.BasicUser{Name: r.name, Password: r.password, Inactive: r.inactive, Tenant: r.tenant}
+	if r.roles != "" {
+		basic.Roles = strings.Split(r.roles, ",")
+	}
+	return userdb.FillUser(result, basic, []byte(r.extra))
+}
+
+func (db *sqlDB) Create(user userdb.User) error {
+	basic := user.Basic()
+	extra, err := userdb.ExtraFields(user)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(extra)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.db.Exec(db.rebind(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?)`),
+		basic.Name, basic.Password, basic.Inactive, strings.Join(basic.Roles, ","), basic.Tenant, string(data))
+	if db.dialect.isDup(err) {
+		err = userdb.DuplicateUserError(basic.Name)
+	}
+	return err
+}
+
+func (db *sqlDB) Find(name string, result userdb.User) error {
+	var r record
+	err := r.scan(db.db.QueryRow(db.rebind(`SELECT `+userColumns+` FROM users WHERE name = ?`), name))
+	if err == sql.ErrNoRows {
+		return userdb.UserNotFoundError(name)
+	} else if err != nil {
+		return err
+	}
+	return r.fill(result)
+}
+
+// where returns the conditions of the name, tenant and inactive fields of
+// the filter, which are matched by the database. Roles and extra fields are
+// matched on the loaded records.
+func where(f *userdb.UserFilter) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if f.Name != nil {
+		conds = append(conds, "name = ?")
+		args = append(args, *f.Name)
+	}
+	if f.Tenant != nil {
+		conds = append(conds, "tenant = ?")
+		args = append(args, *f.Tenant)
+	}
+	if f.Inactive != nil {
+		conds = append(conds, "inactive = ?")
+		args = append(args, *f.Inactive)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func match(f *userdb.UserFilter, r *record) (bool, error) {
+	if !f.MatchRoles(strings.Split(r.roles, ",")) {
+		return false, nil
+	}
+	if len(f.Extra) == 0 {
+		return true, nil
+	}
+	var extra map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(r.extra), &extra); err != nil {
+		return false, err
+	}
+	return f.MatchExtra(extra), nil
+}
+
+// Search users by the filter, which is an Args of field names and values.
+// The result is a pointer to a slice of users, or a user to find the first
+// match.
+func (db *sqlDB) Search(filter interface{}, result interface{}) error {
+	f, err := userdb.CompileFilter(filter)
+	if err != nil {
+		return err
+	}
+
+	resultv := reflect.ValueOf(result)
+	isSlice := resultv.Kind() == reflect.Ptr && resultv.Elem().Kind() == reflect.Slice
+	user, _ := result.(userdb.User)
+	if !isSlice && user == nil {
+		return userdb.Unsupported{}
+	}
+
+	cond, args := where(f)
+	rows, err := db.db.Query(db.rebind(`SELECT `+userColumns+` FROM users`+cond+` ORDER BY name`), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var users reflect.Value
+	if isSlice {
+		users = reflect.MakeSlice(resultv.Elem().Type(), 0, 0)
+	}
+	for rows.Next() {
+		var r record
+		if err = r.scan(rows); err != nil {
+			return err
+		}
+		if ok, err := match(f, &r); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+
+		if !isSlice {
+			return r.fill(user)
+		}
+		v := userdb.NewUserElem(users.Type().Elem())
+		if user = userdb.UserOf(v); user == nil {
+			return userdb.Unsupported{}
+		}
+		if err = r.fill(user); err != nil {
+			return err
+		}
+		users = reflect.Append(users, v)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if !isSlice {
+		return userdb.UserNotFoundError(fmt.Sprintf("%v", filter))
+	}
+	resultv.Elem().Set(users)
+	return nil
+}
+
+func (db *sqlDB) Remove(name string) error {
+	res, err := db.db.Exec(db.rebind(`DELETE FROM users WHERE name = ?`), name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return userdb.UserNotFoundError(name)
+	}
+	return nil
+}
+
+// Update the user with fields of an Args. Fields other than the fields
+// of BasicUser are saved as extra fields.
+func (db *sqlDB) Update(name string, fields interface{}) error {
+	args, ok := fields.(userdb.Args)
+	if !ok {
+		return userdb.Unsupported{}
+	}
+
+	return db.tx(func(tx *sql.Tx) error {
+		var data string
+		err := tx.QueryRow(db.rebind(`SELECT extra FROM users WHERE name = ?`), name).Scan(&data)
+		if err == sql.ErrNoRows {
+			return userdb.UserNotFoundError(name)
+		} else if err != nil {
+			return err
+		}
+
+		var sets []string
+		var values []interface{}
+		var extra map[string]json.RawMessage
+		newName := name
+
+		for key, value := range args {
+			invalid := userdb.InvalidArgumentError("Invalid " + key)
+			switch key = strings.ToLower(key); key {
+			case "name", "tenant":
+				s, ok := value.(string)
+				if !ok {
+					return invalid
+				}
+				if key == "name" {
+					newName = s
+				}
+				sets = append(sets, key+" = ?")
+				values = append(values, s)
+
+			case "password":
+				b, ok := value.([]byte)
+				if !ok {
+					return invalid
+				}
+				sets = append(sets, "password = ?")
+				values = append(values, b)
+
+			case "inactive":
+				b, ok := value.(bool)
+				if !ok {
+					return invalid
+				}
+				sets = append(sets, "inactive = ?")
+				values = append(values, b)
+
+			case "roles":
+				roles, ok := value.([]string)
+				if !ok && value != nil {
+					return invalid
+				}
+				sets = append(sets, "roles = ?")
+				values = append(values, strings.Join(roles, ","))
+
+			default:
+				if extra == nil {
+					if err = json.Unmarshal([]byte(data), &extra); err != nil {
+						return err
+					}
+				}
+				if extra[key], err = json.Marshal(value); err != nil {
+					return invalid
+				}
+			}
+		}
+
+		if extra != nil {
+			b, err := json.Marshal(extra)
+			if err != nil {
+				return err
+			}
+			sets = append(sets, "extra = ?")
+			values = append(values, string(b))
+		}
+		if len(sets) == 0 {
+			return nil
+		}
+
+		values = append(values, name)
+		_, err = tx.Exec(db.rebind(`UPDATE users SET `+strings.Join(sets, ", ")+` WHERE name = ?`), values...)
+		if db.dialect.isDup(err) {
+			err = userdb.DuplicateUserError(newName)
+		}
+		return err
+	})
+}
+
+func (db *sqlDB) GetSecret(key string, gen func() ([]byte, error)) ([]byte, error) {
+	var secret []byte
+	query := db.rebind(`SELECT secret FROM secrets WHERE name = ?`)
+	err := db.db.QueryRow(query, key).Scan(&secret)
+	if err != sql.ErrNoRows {
+		return secret, err
+	}
+
+	if secret, err = gen(); err != nil {
+		return nil, err
+	}
+
+	// The secret generated by another server wins if they race
+	_, err = db.db.Exec(db.rebind(`INSERT INTO secrets (name, secret) VALUES (?, ?) ON CONFLICT (name) DO NOTHING`), key, secret)
+	if err == nil {
+		err = db.db.QueryRow(query, key).Scan(&secret)
+	}
+	return secret, err
+}
+
+func (db *sqlDB) SetSecret(key string, secret []byte) error {
+	_, err := db.db.Exec(db.rebind(`INSERT INTO secrets (name, secret) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET secret = excluded.secret`), key, secret)
+	return err
+}
+
+// API keys are saved as JSON objects, the id, name and tenant are kept in
+// columns for lookup.
+
+func (db *sqlDB) CreateAPIKey(key *userdb.APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec(db.rebind(`INSERT INTO apikeys (id, name, tenant, data) VALUES (?, ?, ?, ?)`),
+		key.ID, key.Name, key.Tenant, string(data))
+	if db.dialect.isDup(err) {
+		err = userdb.DuplicateAPIKeyError(key.Name)
+	}
+	return err
+}
+
+func (db *sqlDB) findAPIKey(column, value string) (*userdb.APIKey, error) {
+	var data string
+	err := db.db.QueryRow(db.rebind(`SELECT data FROM apikeys WHERE `+column+` = ?`), value).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, userdb.APIKeyNotFoundError(value)
+	} else if err != nil {
+		return nil, err
+	}
+	var key userdb.APIKey
+	return &key, json.Unmarshal([]byte(data), &key)
+}
+
+func (db *sqlDB) FindAPIKey(id string) (*userdb.APIKey, error) {
+	return db.findAPIKey("id", id)
+}
+
+func (db *sqlDB) FindAPIKeyByName(name string) (*userdb.APIKey, error) {
+	return db.findAPIKey("name", name)
+}
+
+func (db *sqlDB) ListAPIKeys(tenant string) ([]*userdb.APIKey, error) {
+	query, args := `SELECT data FROM apikeys`, []interface{}{}
+	if tenant != "" {
+		query += ` WHERE tenant = ?`
+		args = append(args, tenant)
+	}
+	rows, err := db.db.Query(db.rebind(query+` ORDER BY name`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]*userdb.APIKey, 0)
+	for rows.Next() {
+		var data string
+		if err = rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var key userdb.APIKey
+		if err = json.Unmarshal([]byte(data), &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	return keys, rows.Err()
+}
+
+func (db *sqlDB) RemoveAPIKey(name string) error {
+	res, err := db.db.Exec(db.rebind(`DELETE FROM apikeys WHERE name = ?`), name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return userdb.APIKeyNotFoundError(name)
+	}
+	return nil
+}
+
+// Login events are kept in the logins table, the time is kept as Unix
+// time in nanoseconds.
+
+func (db *sqlDB) AddLoginEvent(e *userdb.LoginEvent) error {
+	_, err := db.db.Exec(db.rebind(`INSERT INTO logins (ts, username, tenant, ip, channel, result, reason)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		e.Time.UnixNano(), e.User, e.Tenant, e.IP, e.Channel, e.Result, e.Reason)
+	return err
+}
+
+func (db *sqlDB) FindLoginEvents(filter *userdb.LoginFilter) ([]*userdb.LoginEvent, error) {
+	var where []string
+	var args []interface{}
+	for _, c := range []struct{ column, value string }{
+		{"username", filter.User},
+		{"tenant", filter.Tenant},
+		{"ip", filter.IP},
+		{"result", filter.Result},
+	} {
+		if c.value != "" {
+			where = append(where, c.column+" = ?")
+			args = append(args, c.value)
+		}
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "ts >= ?")
+		args = append(args, filter.Since.UnixNano())
+	}
+
+	query := `SELECT ts, username, tenant, ip, channel, result, reason FROM logins`
+	if len(where) != 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY ts DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.db.Query(db.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*userdb.LoginEvent, 0)
+	for rows.Next() {
+		var e userdb.LoginEvent
+		var ts int64
+		if err = rows.Scan(&ts, &e.User, &e.Tenant, &e.IP, &e.Channel, &e.Result, &e.Reason); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(0, ts)
+		events = append(events, &e)
+	}
+	return events, rows.Err()
+}
+
+func (db *sqlDB) RemoveLoginEvents(before time.Time) error {
+	_, err := db.db.Exec(db.rebind(`DELETE FROM logins WHERE ts < ?`), before.UnixNano())
+	return err
+}
+
+func (db *sqlDB) Close() {
+	db.db.Close()
+}
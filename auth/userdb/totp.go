@@ -0,0 +1,331 @@
+package userdb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/redhill42/iota/config"
+)
+
+// Fields of the second factor, which are saved as extra fields of users.
+const (
+	totpSecretField    = "totpsecret"
+	totpPendingField   = "totppending"
+	totpStepField      = "totpstep"
+	recoveryCodesField = "recoverycodes"
+)
+
+// TOTP parameters of RFC 6238, which are the defaults of authenticator apps.
+const (
+	totpPeriod     = 30
+	totpDigits     = 6
+	totpSkew       = 1 // steps of clock drift allowed
+	totpSecretSize = 20
+
+	recoveryCodeCount = 10
+)
+
+// totpUser is a user with the second factor.
+type totpUser struct {
+	BasicUser     `bson:",inline"`
+	TOTPSecret    []byte   `bson:"totpsecret,omitempty" json:"totpsecret,omitempty"`
+	TOTPPending   []byte   `bson:"totppending,omitempty" json:"totppending,omitempty"`
+	TOTPStep      int64    `bson:"totpstep,omitempty" json:"totpstep,omitempty"`
+	RecoveryCodes [][]byte `bson:"recoverycodes,omitempty" json:"recoverycodes,omitempty"`
+}
+
+// TOTPEnrollment is the secret of a TOTP enrollment. The provisioning URI
+// is shown as a QR code to be scanned by authenticator apps.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// The SecondFactorRequiredError indicates that the password of the user
+// is correct, but the user must login with a second factor. Users who are
+// required to use a second factor but not enrolled must enroll at login.
+type SecondFactorRequiredError struct {
+	User   string
+	Enroll bool
+}
+
+func (e *SecondFactorRequiredError) Error() string {
+	return "Two-factor authentication required: " + e.User
+}
+
+func (e *SecondFactorRequiredError) HTTPErrorStatusCode() int {
+	return http.StatusUnauthorized
+}
+
+// The SecondFactorError indicates that a verification code is incorrect.
+type SecondFactorError string
+
+func (e SecondFactorError) Error() string {
+	return "Invalid verification code: " + string(e)
+}
+
+func (e SecondFactorError) HTTPErrorStatusCode() int {
+	return http.StatusUnauthorized
+}
+
+// RequiresSecondFactor returns true if any of the roles requires a second
+// factor, as configured by "auth.twoFactorRoles". The default roles are
+// checked if no role is given.
+func RequiresSecondFactor(roles []string) bool {
+	required := config.Get("auth.twoFactorRoles")
+	if required == "" {
+		return false
+	}
+	if len(roles) == 0 {
+		roles = DefaultRoles()
+	}
+	for _, r := range strings.Split(required, ",") {
+		if contains(roles, strings.TrimSpace(r)) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if strings.TrimSpace(x) == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSecondFactor returns a SecondFactorRequiredError if the user has
+// enabled the second factor or is required to use it.
+func (db *UserDatabase) checkSecondFactor(name string) error {
+	var user totpUser
+	if err := db.plugin.Find(name, &user); err != nil {
+		return err
+	}
+	if len(user.TOTPSecret) != 0 {
+		return &SecondFactorRequiredError{User: name}
+	}
+	if RequiresSecondFactor(user.Roles) {
+		return &SecondFactorRequiredError{User: name, Enroll: true}
+	}
+	return nil
+}
+
+// EnrollTOTP starts a TOTP enrollment of the user. The second factor is
+// enabled when confirmed by a code generated with the secret, and the
+// current second factor remains in effect until then.
+func (db *UserDatabase) EnrollTOTP(name string) (*TOTPEnrollment, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := db.plugin.Update(name, Args{totpPendingField: secret}); err != nil {
+		return nil, err
+	}
+
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	issuer := config.GetOrDefault("auth.totpIssuer", "iota")
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + name,
+		RawQuery: url.Values{
+			"secret":    {encoded},
+			"issuer":    {issuer},
+			"algorithm": {"SHA1"},
+			"digits":    {fmt.Sprint(totpDigits)},
+			"period":    {fmt.Sprint(totpPeriod)},
+		}.Encode(),
+	}
+	return &TOTPEnrollment{Secret: encoded, URI: uri.String()}, nil
+}
+
+// ConfirmTOTP enables the second factor of the pending enrollment if the
+// code is correct, and returns new recovery codes of the user, which are
+// only shown once.
+func (db *UserDatabase) ConfirmTOTP(name, code string) ([]string, error) {
+	var user totpUser
+	if err := db.plugin.Find(name, &user); err != nil {
+		return nil, err
+	}
+	return db.confirmTOTP(&user, code)
+}
+
+func (db *UserDatabase) confirmTOTP(user *totpUser, code string) ([]string, error) {
+	if len(user.TOTPPending) == 0 {
+		return nil, InvalidArgumentError("TOTP enrollment not started")
+	}
+	step, ok := matchTOTP(user.TOTPPending, code, 0, time.Now())
+	if !ok {
+		return nil, SecondFactorError(user.Name)
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = db.plugin.Update(user.Name, Args{
+		totpSecretField:    user.TOTPPending,
+		totpPendingField:   nil,
+		totpStepField:      step,
+		recoveryCodesField: hashes,
+	})
+	return codes, err
+}
+
+// DisableTOTP disables the second factor of the user, and removes the
+// pending enrollment and recovery codes.
+func (db *UserDatabase) DisableTOTP(name string) error {
+	return db.plugin.Update(name, Args{
+		totpSecretField:    nil,
+		totpPendingField:   nil,
+		totpStepField:      0,
+		recoveryCodesField: nil,
+	})
+}
+
+// LoginSecondFactor completes the login of a user whose password was
+// verified with the TOTP code or a recovery code, which can only be used
+// once. The attempt is recorded in the login audit trail like passwords.
+// Users enrolling at login confirm the enrollment with the code, and new
+// recovery codes are returned.
+func (db *UserDatabase) LoginSecondFactor(name, code, ip, channel string) (user *BasicUser, recoveryCodes []string, err error) {
+	user, err = db.audited(name, ip, channel, func() (*BasicUser, error) {
+		found, codes, err := db.verifySecondFactor(name, code)
+		recoveryCodes = codes
+		return found, err
+	})
+	return user, recoveryCodes, err
+}
+
+func (db *UserDatabase) verifySecondFactor(name, code string) (*BasicUser, []string, error) {
+	var user totpUser
+	if err := db.plugin.Find(name, &user); err != nil {
+		return nil, nil, err
+	}
+	if user.Inactive {
+		return nil, nil, InactiveUserError(name)
+	}
+
+	if len(user.TOTPSecret) == 0 {
+		if !RequiresSecondFactor(user.Roles) {
+			return nil, nil, SecondFactorError(name)
+		}
+		codes, err := db.confirmTOTP(&user, code)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &user.BasicUser, codes, nil
+	}
+
+	if err := db.useCode(&user, code); err != nil {
+		return nil, nil, err
+	}
+	return &user.BasicUser, nil, nil
+}
+
+// VerifyTOTP verifies a TOTP code or a recovery code of a user who has
+// enabled the second factor, such as before the second factor is disabled
+// by the user. The code can only be used once.
+func (db *UserDatabase) VerifyTOTP(name, code string) error {
+	var user totpUser
+	if err := db.plugin.Find(name, &user); err != nil {
+		return err
+	}
+	if len(user.TOTPSecret) == 0 {
+		return InvalidArgumentError("TOTP not enabled")
+	}
+	return db.useCode(&user, code)
+}
+
+// useCode uses a TOTP code or a recovery code of the user.
+func (db *UserDatabase) useCode(user *totpUser, code string) error {
+	// The code of a time step can only be used once
+	if step, ok := matchTOTP(user.TOTPSecret, code, user.TOTPStep, time.Now()); ok {
+		return db.plugin.Update(user.Name, Args{totpStepField: step})
+	}
+
+	if i := matchRecoveryCode(user.RecoveryCodes, code); i >= 0 {
+		codes := append(append([][]byte{}, user.RecoveryCodes[:i]...), user.RecoveryCodes[i+1:]...)
+		return db.plugin.Update(user.Name, Args{recoveryCodesField: codes})
+	}
+	return SecondFactorError(user.Name)
+}
+
+// totpCode returns the code of the time step, as specified by RFC 4226.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// matchTOTP returns the time step of the code if it's the code of a step
+// around the time and later than the last used step.
+func matchTOTP(secret []byte, code string, last int64, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > last && subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes generates recovery codes and their hashes. The codes
+// have 50 random bits, so they are hashed by SHA-256.
+func newRecoveryCodes() (codes []string, hashes [][]byte, err error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		if _, err = rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		s := strings.ToLower(encoding.EncodeToString(b)[:10])
+		codes = append(codes, s[:5]+"-"+s[5:])
+		hashes = append(hashes, hashRecoveryCode(s))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	h := sha256.Sum256([]byte(code))
+	return h[:]
+}
+
+// matchRecoveryCode returns the index of the hash of the recovery code,
+// or -1 if not found.
+func matchRecoveryCode(hashes [][]byte, code string) int {
+	h := hashRecoveryCode(code)
+	for i, hash := range hashes {
+		if subtle.ConstantTimeCompare(hash, h) == 1 {
+			return i
+		}
+	}
+	return -1
+}
@@ -1,5 +1,11 @@
 package userdb
 
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
 // The User interface encapsulates a cloud user. The concret User type must
 // embedded a BasicUser struct that contains core information that used by
 // Iota server. Extra fields may be maintained by concret User type and
@@ -9,13 +15,94 @@ type User interface {
 	Basic() *BasicUser
 }
 
-// The basic user interface implementation
+// The basic user interface implementation. Users of a tenant can only
+// access devices and alarms of the tenant, and users without tenant are
+// system users that can access all tenants.
 type BasicUser struct {
 	Name     string
 	Password []byte
 	Inactive bool
+	Roles    []string `bson:",omitempty"`
+	Tenant   string   `bson:",omitempty"`
 }
 
 func (user *BasicUser) Basic() *BasicUser {
 	return user
 }
+
+// basicFields are the fields of BasicUser in lower case.
+var basicFields = map[string]bool{
+	"name":     true,
+	"password": true,
+	"inactive": true,
+	"roles":    true,
+	"tenant":   true,
+}
+
+// IsBasicField returns true if the key is a field of BasicUser, case
+// insensitive.
+func IsBasicField(key string) bool {
+	return basicFields[strings.ToLower(key)]
+}
+
+// ExtraFields returns the JSON encoded fields of a concrete User type other
+// than the fields of BasicUser, keyed by lower case field names as they are
+// in MongoDB. It's used by plugins that keep extra fields as JSON, which are
+// decoded into users by json.Unmarshal.
+func ExtraFields(user User) (map[string]json.RawMessage, error) {
+	extra := make(map[string]json.RawMessage)
+	if _, ok := user.(*BasicUser); ok {
+		return extra, nil
+	}
+
+	data, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, Unsupported{}
+	}
+	for key, value := range fields {
+		if key = strings.ToLower(key); !basicFields[key] {
+			extra[key] = value
+		}
+	}
+	return extra, nil
+}
+
+// FillUser copies a user record to the result, for plugins that keep extra
+// fields as JSON. The extra fields are decoded into concrete User types,
+// field names are matched case-insensitively.
+func FillUser(result User, basic BasicUser, extra []byte) error {
+	if _, ok := result.(*BasicUser); !ok && len(extra) != 0 {
+		if err := json.Unmarshal(extra, result); err != nil {
+			return err
+		}
+	}
+	basic.Roles = append([]string(nil), basic.Roles...)
+	*result.Basic() = basic
+	return nil
+}
+
+// NewUserElem creates an element of a slice of users, which is a user or
+// a pointer to user. The user of the element is returned by UserOf.
+func NewUserElem(t reflect.Type) reflect.Value {
+	if t.Kind() == reflect.Ptr {
+		return reflect.New(t.Elem())
+	}
+	return reflect.New(t).Elem()
+}
+
+// UserOf returns the user of a slice element, or nil if the element is not
+// a user.
+func UserOf(v reflect.Value) User {
+	if v.Kind() != reflect.Ptr {
+		v = v.Addr()
+	}
+	if v.IsNil() {
+		return nil
+	}
+	user, _ := v.Interface().(User)
+	return user
+}
@@ -2,14 +2,18 @@ package userdb
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
 	"net/url"
+	"reflect"
+	"regexp"
 	"strings"
 
 	"github.com/redhill42/iota/config"
+	"github.com/sirupsen/logrus"
 )
 
 // The Plugin interface represents a user database plugin. This interface
@@ -22,7 +26,10 @@ type Plugin interface {
 	// Find the user by name.
 	Find(name string, result User) error
 
-	// Search user database by the given filter.
+	// Search user database by the given filter. The filter is an Args of
+	// field names and values to match, and the result is a pointer to a
+	// slice of users, or a user to find the first match. The MongoDB
+	// plugin also accepts MongoDB queries as filter.
 	Search(filter interface{}, result interface{}) error
 
 	// Remove the user from the database.
@@ -36,6 +43,9 @@ type Plugin interface {
 	// and saved to the database.
 	GetSecret(key string, gen func() ([]byte, error)) ([]byte, error)
 
+	// SetSecret replaces a secret key in the database.
+	SetSecret(key string, secret []byte) error
+
 	// Close the user database.
 	Close()
 }
@@ -52,9 +62,16 @@ func RegisterPlugin(scheme string, f PluginFunc) {
 
 // NewPlugin create a new plugin according to the configured user database URL.
 func NewPlugin() (Plugin, error) {
-	dbtype := config.Get("userdb.type")
-	dburl := config.Get("userdb.url")
+	return newPlugin(config.Get("userdb.type"), config.Get("userdb.url"))
+}
 
+// NewPluginURL creates a new plugin of the database URL. It's used by
+// plugins that delegate to other plugins.
+func NewPluginURL(dburl string) (Plugin, error) {
+	return newPlugin("", dburl)
+}
+
+func newPlugin(dbtype, dburl string) (Plugin, error) {
 	if dbtype == "" && dburl != "" {
 		u, err := url.Parse(dburl)
 		if err != nil {
@@ -72,9 +89,130 @@ func NewPlugin() (Plugin, error) {
 	}
 }
 
+// PasswordAuthenticator is implemented by plugins that verify passwords
+// by the backing service, such as a directory service that authenticates
+// users by bind. The user is found into result if the password is correct.
+type PasswordAuthenticator interface {
+	Authenticate(name, password string, result User) error
+}
+
 // Utility type to create filters and update fields
 type Args map[string]interface{}
 
+// FilterArgs returns the fields of a search filter, which is nil or a map
+// of field names to values. It's used by plugins that interpret filters
+// instead of passing them to the backing database.
+func FilterArgs(filter interface{}) (Args, error) {
+	switch f := filter.(type) {
+	case nil:
+		return Args{}, nil
+	case Args:
+		return f, nil
+	case map[string]interface{}:
+		return Args(f), nil
+	default:
+		return nil, Unsupported{}
+	}
+}
+
+// UserFilter is a search filter compiled from FilterArgs, for plugins that
+// match users themselves. Field names are case insensitive. The name is
+// interpreted by the plugin, other fields of users must be equal to the
+// filter, and users must have all roles of the filter.
+type UserFilter struct {
+	Name     *string
+	Tenant   *string
+	Inactive *bool
+	Roles    []string
+
+	// Extra fields keyed by lower case field names, with values
+	// normalized as decoded from JSON
+	Extra map[string]interface{}
+}
+
+// CompileFilter compiles the search filter. Users can't be searched by
+// password.
+func CompileFilter(filter interface{}) (*UserFilter, error) {
+	args, err := FilterArgs(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &UserFilter{Extra: make(map[string]interface{})}
+	for key, value := range args {
+		invalid := InvalidArgumentError(fmt.Sprintf("Invalid filter of %s", key))
+		switch key = strings.ToLower(key); key {
+		case "name", "tenant":
+			s, ok := value.(string)
+			if !ok {
+				return nil, invalid
+			}
+			if key == "name" {
+				f.Name = &s
+			} else {
+				f.Tenant = &s
+			}
+
+		case "inactive":
+			b, ok := value.(bool)
+			if !ok {
+				return nil, invalid
+			}
+			f.Inactive = &b
+
+		case "roles":
+			s, ok := value.(string)
+			if !ok {
+				return nil, invalid
+			}
+			f.Roles = append(f.Roles, s)
+
+		case "password":
+			return nil, invalid
+
+		default:
+			// Normalize the value as it's decoded from JSON
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, invalid
+			}
+			var v interface{}
+			json.Unmarshal(data, &v)
+			f.Extra[key] = v
+		}
+	}
+	return f, nil
+}
+
+// MatchRoles returns true if the roles contain all roles of the filter.
+func (f *UserFilter) MatchRoles(roles []string) bool {
+	for _, role := range f.Roles {
+		found := false
+		for _, r := range roles {
+			if r == role {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchExtra returns true if the JSON encoded extra fields, as returned by
+// ExtraFields, match the extra fields of the filter.
+func (f *UserFilter) MatchExtra(extra map[string]json.RawMessage) bool {
+	for key, value := range f.Extra {
+		var v interface{}
+		if b, ok := extra[key]; !ok || json.Unmarshal(b, &v) != nil || !reflect.DeepEqual(v, value) {
+			return false
+		}
+	}
+	return true
+}
+
 // The DuplicateUserError indicates that an user already exists in the database
 // when creating user.
 type DuplicateUserError string
@@ -109,6 +247,18 @@ func (e InactiveUserError) HTTPErrorStatusCode() int {
 	return http.StatusUnauthorized
 }
 
+// The InvalidArgumentError indicates that a user can't be created or
+// updated with the given arguments.
+type InvalidArgumentError string
+
+func (e InvalidArgumentError) Error() string {
+	return string(e)
+}
+
+func (e InvalidArgumentError) HTTPErrorStatusCode() int {
+	return http.StatusBadRequest
+}
+
 type Unsupported struct {
 }
 
@@ -122,6 +272,7 @@ func (e Unsupported) HTTPErrorStatusCode() int {
 
 // The UserDatabase type is the central point of user management.
 type UserDatabase struct {
+	purged int64 // the time login events were last purged, accessed atomically
 	plugin Plugin
 }
 
@@ -130,14 +281,70 @@ func Open() (*UserDatabase, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &UserDatabase{plugin}, nil
+	db := &UserDatabase{plugin: plugin}
+	if err = db.migrateRoles(); err != nil {
+		plugin.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// rolesMigrationKey is the secret that records the roles migration.
+const rolesMigrationKey = "userdb.migration.roles"
+
+var errNotMigrated = errors.New("not migrated")
+
+// migrateRoles gives the admin role to users created before roles were
+// introduced, who had all permissions. The migration runs once, and then
+// users without role get the default roles.
+func (db *UserDatabase) migrateRoles() error {
+	_, err := db.plugin.GetSecret(rolesMigrationKey, func() ([]byte, error) {
+		return nil, errNotMigrated
+	})
+	if err != errNotMigrated {
+		return err
+	}
+
+	var users []*BasicUser
+	if err = db.plugin.Search(Args{}, &users); err != nil {
+		return err
+	}
+	for _, user := range users {
+		if len(user.Roles) == 0 {
+			if err = db.plugin.Update(user.Name, Args{"roles": []string{RoleAdmin}}); err != nil {
+				return err
+			}
+			logrus.Infof("Granted the admin role to user %s", user.Name)
+		}
+	}
+	return db.plugin.SetSecret(rolesMigrationKey, []byte("done"))
 }
 
 func (db *UserDatabase) Create(user User, password string) error {
 	basic := user.Basic()
 
 	if basic.Name == "" || len(password) == 0 {
-		return errors.New("missing required parameters")
+		return InvalidArgumentError("missing required parameters")
+	}
+	if strings.HasPrefix(basic.Name, ServiceAccountPrefix) {
+		return InvalidArgumentError("Reserved user name: " + basic.Name)
+	}
+
+	if len(basic.Roles) == 0 {
+		return InvalidArgumentError("missing roles")
+	}
+	if err := ValidateRoles(basic.Roles); err != nil {
+		return err
+	}
+	if err := ValidateTenant(basic.Tenant); err != nil {
+		return err
+	}
+
+	// passwords that are already hashed can't be checked against the policy
+	if !isHashedPassword(password) {
+		if err := CheckPasswordPolicy(password); err != nil {
+			return err
+		}
 	}
 
 	hashedPassword, err := hashPassword(password)
@@ -152,10 +359,8 @@ func (db *UserDatabase) Create(user User, password string) error {
 
 func hashPassword(password string) ([]byte, error) {
 	// use the password if it's already hashed
-	if strings.HasPrefix(password, "$2a$") {
-		if _, err := bcrypt.Cost([]byte(password)); err == nil {
-			return []byte(password), nil
-		}
+	if isHashedPassword(password) {
+		return []byte(password), nil
 	}
 
 	// otherwise, generate a hashed password
@@ -180,6 +385,17 @@ func (db *UserDatabase) Update(name string, fields interface{}) error {
 
 func (db *UserDatabase) Authenticate(name string, password string) (*BasicUser, error) {
 	var user BasicUser
+
+	if pa, ok := db.plugin.(PasswordAuthenticator); ok {
+		if err := pa.Authenticate(name, password, &user); err != nil {
+			return nil, err
+		}
+		if user.Inactive {
+			return nil, InactiveUserError(name)
+		}
+		return &user, nil
+	}
+
 	if err := db.plugin.Find(name, &user); err != nil {
 		return nil, err
 	}
@@ -196,23 +412,211 @@ func (db *UserDatabase) Authenticate(name string, password string) (*BasicUser,
 	return &user, nil
 }
 
+// VerifyPassword checks the password of a user found in the database. It's
+// used by plugins that keep some users in the database and implement
+// PasswordAuthenticator.
+func VerifyPassword(user *BasicUser, password string) error {
+	return bcrypt.CompareHashAndPassword(user.Password, []byte(password))
+}
+
 func (db *UserDatabase) ChangePassword(name string, oldPassword, newPassword string) error {
+	var user BasicUser
+	if pa, ok := db.plugin.(PasswordAuthenticator); ok {
+		if err := pa.Authenticate(name, oldPassword, &user); err != nil {
+			return PermissionDeniedError("incorrect password")
+		}
+	} else {
+		if err := db.plugin.Find(name, &user); err != nil {
+			return err
+		}
+
+		err := bcrypt.CompareHashAndPassword(user.Password, []byte(oldPassword))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return PermissionDeniedError("incorrect password")
+		} else if err != nil {
+			return err
+		}
+	}
+	return db.setPassword(name, newPassword)
+}
+
+// List returns users of the tenant, or all users if the tenant is empty.
+func (db *UserDatabase) List(tenant string) ([]*BasicUser, error) {
+	filter := Args{}
+	if tenant != "" {
+		filter["tenant"] = tenant
+	}
+	users := make([]*BasicUser, 0)
+	if err := db.plugin.Search(filter, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// FindManaged finds a user managed by the admin. Users the admin is not
+// permitted to manage are reported as not found, so that users of other
+// tenants are not disclosed.
+func (db *UserDatabase) FindManaged(admin *BasicUser, name string) (*BasicUser, error) {
+	if !admin.HasPermission(UserManage) {
+		return nil, PermissionDeniedError(UserManage)
+	}
 	var user BasicUser
 	if err := db.plugin.Find(name, &user); err != nil {
+		return nil, err
+	}
+	if !admin.CanManage(&user) {
+		return nil, UserNotFoundError(name)
+	}
+	return &user, nil
+}
+
+// CreateManaged creates a user on behalf of the admin. Users of a tenant
+// can only create users in the tenant, and roles must be granted by the
+// admin.
+func (db *UserDatabase) CreateManaged(admin *BasicUser, user *BasicUser, password string) error {
+	if !admin.HasPermission(UserManage) {
+		return PermissionDeniedError(UserManage)
+	}
+	if admin.Tenant != "" {
+		user.Tenant = admin.Tenant
+	}
+	if err := ValidateRoles(user.Roles); err != nil {
 		return err
 	}
+	if !admin.CanGrant(user.Roles) {
+		return PermissionDeniedError(strings.Join(user.Roles, ","))
+	}
+	return db.Create(user, password)
+}
 
-	err := bcrypt.CompareHashAndPassword(user.Password, []byte(oldPassword))
-	if err != nil {
+// UpdateProfile updates the roles, tenant and inactive flag of a user
+// managed by the admin. Roles must be granted by the admin, and only system
+// users can move users between tenants. Field names are case insensitive,
+// other fields can't be updated as profile.
+func (db *UserDatabase) UpdateProfile(admin *BasicUser, name string, updates Args) error {
+	if _, err := db.FindManaged(admin, name); err != nil {
 		return err
 	}
 
-	hashedPassword, err := hashPassword(newPassword)
-	if err != nil {
+	fields := Args{}
+	for key, value := range updates {
+		// Plugins store field names in lower case, and MongoDB interprets
+		// dots and dollar signs in field names
+		key = strings.ToLower(key)
+		if strings.Contains(key, ".") || strings.HasPrefix(key, "$") {
+			return InvalidArgumentError("Invalid field: " + key)
+		}
+
+		switch key {
+		case "roles":
+			roles, err := toStrings(value)
+			if err != nil {
+				return err
+			}
+			if err = ValidateRoles(roles); err != nil {
+				return err
+			}
+			if !admin.CanGrant(roles) {
+				return PermissionDeniedError(strings.Join(roles, ","))
+			}
+			if roles == nil {
+				roles = []string{}
+			}
+			fields[key] = roles
+
+		case "tenant":
+			tenant, ok := value.(string)
+			if !ok {
+				return InvalidArgumentError("Invalid tenant")
+			}
+			if admin.Tenant != "" {
+				return PermissionDeniedError("tenant")
+			}
+			if err := ValidateTenant(tenant); err != nil {
+				return err
+			}
+			fields[key] = tenant
+
+		case "inactive":
+			inactive, ok := value.(bool)
+			if !ok {
+				return InvalidArgumentError("Invalid inactive flag")
+			}
+			fields[key] = inactive
+
+		default:
+			return InvalidArgumentError("Cannot update " + key)
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+	return db.plugin.Update(name, fields)
+}
+
+// toStrings converts a decoded JSON array to a string slice.
+func toStrings(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []string:
+		return v, nil
+	case []interface{}:
+		result := make([]string, len(v))
+		for i, s := range v {
+			if result[i], _ = s.(string); result[i] == "" {
+				return nil, InvalidArgumentError("Invalid roles")
+			}
+		}
+		return result, nil
+	default:
+		return nil, InvalidArgumentError("Invalid roles")
+	}
+}
+
+// ResetPassword sets the password of the user without checking the old
+// password.
+func (db *UserDatabase) ResetPassword(name string, password string) error {
+	return db.setPassword(name, password)
+}
+
+// SetInactive disables or enables the user. Inactive users can't login.
+func (db *UserDatabase) SetInactive(name string, inactive bool) error {
+	return db.plugin.Update(name, Args{"inactive": inactive})
+}
+
+// SetRoles replaces the roles of the user. The default roles apply to the
+// user if no role is given.
+func (db *UserDatabase) SetRoles(name string, roles []string) error {
+	if err := ValidateRoles(roles); err != nil {
+		return err
+	}
+	if roles == nil {
+		roles = []string{}
+	}
+	return db.plugin.Update(name, Args{"roles": roles})
+}
+
+// SetTenant moves the user to a tenant, or makes the user a system user
+// if the tenant is empty.
+func (db *UserDatabase) SetTenant(name string, tenant string) error {
+	if err := ValidateTenant(tenant); err != nil {
 		return err
 	}
+	return db.plugin.Update(name, Args{"tenant": tenant})
+}
+
+var validTenantPattern = regexp.MustCompile(`^[a-zA-Z0-9_\-.]*$`)
 
-	return db.plugin.Update(name, Args{"password": hashedPassword})
+// ValidateTenant returns an error if the tenant name is invalid. Tenant
+// names are used as tags of time series records, so only letters, digits,
+// '_', '-' and '.' are allowed.
+func ValidateTenant(tenant string) error {
+	if !validTenantPattern.MatchString(tenant) {
+		return InvalidArgumentError("Invalid tenant name: " + tenant)
+	}
+	return nil
 }
 
 // GetSecret returns a secret key used to sign the JWT token. If the
@@ -226,6 +630,17 @@ func (db *UserDatabase) GetSecret(key string) ([]byte, error) {
 	})
 }
 
+// SecretStore stores secret keys in the user database.
+type SecretStore interface {
+	GetSecret(key string, gen func() ([]byte, error)) ([]byte, error)
+	SetSecret(key string, secret []byte) error
+}
+
+// Secrets returns the secret store of the user database.
+func (db *UserDatabase) Secrets() SecretStore {
+	return db.plugin
+}
+
 // GetPassword returns a human readable password. If the password does
 // not exist in the database, a new password is generated and saved
 // to the database.
@@ -1,9 +1,17 @@
 package userdb_test
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -12,6 +20,7 @@ import (
 	_ "github.com/redhill42/iota/auth/userdb/file"
 	. "github.com/redhill42/iota/auth/userdb/matchers"
 	_ "github.com/redhill42/iota/auth/userdb/mongodb"
+	_ "github.com/redhill42/iota/auth/userdb/sqldb"
 )
 
 func TestUserDB(t *testing.T) {
@@ -19,6 +28,14 @@ func TestUserDB(t *testing.T) {
 	RunSpecs(t, "UserDB Suite")
 }
 
+// The sqlite database is created in a temporary directory, which is removed
+// after the tests.
+var sqliteDir, _ = ioutil.TempDir("", "userdb_test")
+
+var _ = AfterSuite(func() {
+	os.RemoveAll(sqliteDir)
+})
+
 var _ = Describe("UserDB", func() {
 	Describe("file", func() {
 		testSuite("file:///data/userdb_test")
@@ -26,6 +43,80 @@ var _ = Describe("UserDB", func() {
 	Describe("mongodb", func() {
 		testSuite("mongodb://127.0.0.1:27017/userdb_test")
 	})
+	Describe("sqlite", func() {
+		testSuite("sqlite://" + filepath.Join(sqliteDir, "userdb_test.db"))
+	})
+	Describe("postgres", func() {
+		testSuite("postgres://postgres@127.0.0.1:5432/userdb_test?sslmode=disable")
+	})
+})
+
+var _ = Describe("Permissions", func() {
+	AfterEach(func() {
+		os.Unsetenv("IOTA_ROLES_AUDITOR")
+		os.Unsetenv("IOTA_AUTH_DEFAULTROLE")
+	})
+
+	It("should grant permissions of built-in roles", func() {
+		viewer := &userdb.BasicUser{Roles: []string{userdb.RoleViewer}}
+		Expect(viewer.HasPermission(userdb.DeviceRead)).To(BeTrue())
+		Expect(viewer.HasPermission(userdb.DeviceDelete)).To(BeFalse())
+
+		operator := &userdb.BasicUser{Roles: []string{userdb.RoleViewer, userdb.RoleOperator}}
+		Expect(operator.HasPermission(userdb.AlarmWrite)).To(BeTrue())
+		Expect(operator.HasPermission(userdb.DeviceApprove)).To(BeFalse())
+		Expect(operator.HasPermission(userdb.SystemRead)).To(BeFalse())
+
+		admin := &userdb.BasicUser{Roles: []string{userdb.RoleAdmin}}
+		Expect(admin.HasPermission(userdb.DeviceApprove)).To(BeTrue())
+		Expect(admin.HasPermission(userdb.SystemRead)).To(BeTrue())
+	})
+
+	It("should grant permissions of configured roles", func() {
+		os.Setenv("IOTA_ROLES_AUDITOR", "alarm:*, device:read")
+		auditor := &userdb.BasicUser{Roles: []string{"auditor"}}
+		Expect(auditor.HasPermission(userdb.AlarmWrite)).To(BeTrue())
+		Expect(auditor.HasPermission(userdb.DeviceRead)).To(BeTrue())
+		Expect(auditor.HasPermission(userdb.DeviceWrite)).To(BeFalse())
+		Expect(userdb.ValidateRoles([]string{"auditor"})).To(Succeed())
+		Expect(userdb.ValidateRoles([]string{"superman"})).NotTo(Succeed())
+	})
+
+	It("should apply the default role to users without roles", func() {
+		user := &userdb.BasicUser{}
+		Expect(user.HasPermission(userdb.DeviceDelete)).To(BeFalse())
+		Expect(user.HasPermission(userdb.DeviceRead)).To(BeTrue())
+		os.Setenv("IOTA_AUTH_DEFAULTROLE", userdb.RoleOperator)
+		Expect(user.HasPermission(userdb.AlarmWrite)).To(BeTrue())
+	})
+
+	It("should check expiration and IP allowlist of API keys", func() {
+		key := &userdb.APIKey{}
+		Expect(key.Expired()).To(BeFalse())
+		Expect(key.AllowIP("")).To(BeTrue())
+
+		key.Expires = time.Now().Add(-time.Minute)
+		Expect(key.Expired()).To(BeTrue())
+
+		key.AllowedIPs = []string{"10.0.0.0/8", "192.168.1.10"}
+		Expect(key.AllowIP("10.1.2.3")).To(BeTrue())
+		Expect(key.AllowIP("192.168.1.10")).To(BeTrue())
+		Expect(key.AllowIP("192.168.1.11")).To(BeFalse())
+		Expect(key.AllowIP("")).To(BeFalse())
+	})
+
+	It("should only manage users of the same tenant", func() {
+		system := &userdb.BasicUser{Roles: []string{userdb.RoleAdmin}}
+		admin := &userdb.BasicUser{Roles: []string{userdb.RoleAdmin}, Tenant: "acme"}
+		viewer := &userdb.BasicUser{Roles: []string{userdb.RoleViewer}, Tenant: "acme"}
+		other := &userdb.BasicUser{Tenant: "other"}
+
+		Expect(system.CanManage(other)).To(BeTrue())
+		Expect(admin.CanManage(viewer)).To(BeTrue())
+		Expect(admin.CanManage(other)).To(BeFalse())
+		Expect(admin.CanManage(system)).To(BeFalse())
+		Expect(viewer.CanManage(viewer)).To(BeFalse())
+	})
 })
 
 func testSuite(dburl string) {
@@ -45,8 +136,8 @@ func testSuite(dburl string) {
 		db, err = userdb.Open()
 		Expect(err).NotTo(HaveOccurred())
 
-		testUser := userdb.BasicUser{Name: TEST_USER}
-		otherUser := userdb.BasicUser{Name: OTHER_USER}
+		testUser := userdb.BasicUser{Name: TEST_USER, Roles: []string{userdb.RoleViewer}}
+		otherUser := userdb.BasicUser{Name: OTHER_USER, Roles: []string{userdb.RoleViewer}}
 		Expect(db.Create(&testUser, "test")).To(Succeed())
 		Expect(db.Create(&otherUser, "other")).To(Succeed())
 	})
@@ -60,7 +151,8 @@ func testSuite(dburl string) {
 	Describe("Create user", func() {
 		It("should fail with duplicate name", func() {
 			user := userdb.BasicUser{
-				Name: TEST_USER,
+				Name:  TEST_USER,
+				Roles: []string{userdb.RoleViewer},
 			}
 			Expect(db.Create(&user, "test")).To(BeDuplicateUser(TEST_USER))
 		})
@@ -71,9 +163,14 @@ func testSuite(dburl string) {
 		})
 
 		It("should fail with empty password", func() {
-			user := userdb.BasicUser{Name: NEW_USER}
+			user := userdb.BasicUser{Name: NEW_USER, Roles: []string{userdb.RoleViewer}}
 			Expect(db.Create(&user, "")).NotTo(Succeed())
 		})
+
+		It("should fail without roles", func() {
+			user := userdb.BasicUser{Name: NEW_USER}
+			Expect(db.Create(&user, "test")).To(BeAssignableToTypeOf(userdb.InvalidArgumentError("")))
+		})
 	})
 
 	Describe("Find user", func() {
@@ -133,6 +230,61 @@ func testSuite(dburl string) {
 		})
 	})
 
+	Describe("Roles", func() {
+		It("should persist roles", func() {
+			Expect(db.SetRoles(TEST_USER, []string{userdb.RoleViewer, userdb.RoleOperator})).To(Succeed())
+			user, err := db.Authenticate(TEST_USER, "test")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Roles).To(Equal([]string{userdb.RoleViewer, userdb.RoleOperator}))
+
+			Expect(db.SetRoles(TEST_USER, nil)).To(Succeed())
+			user, err = db.Authenticate(TEST_USER, "test")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Roles).To(BeEmpty())
+		})
+
+		It("should reject unknown roles", func() {
+			Expect(db.SetRoles(TEST_USER, []string{"superman"})).NotTo(Succeed())
+			user := userdb.BasicUser{Name: NEW_USER, Roles: []string{"superman"}}
+			Expect(db.Create(&user, "test")).NotTo(Succeed())
+		})
+
+		It("should fail if user does not exist", func() {
+			Expect(db.SetRoles(NOSUCH_USER, []string{userdb.RoleViewer})).To(BeUserNotFound(NOSUCH_USER))
+		})
+	})
+
+	Describe("Tenant", func() {
+		It("should persist tenant", func() {
+			Expect(db.SetTenant(TEST_USER, "acme")).To(Succeed())
+			user, err := db.Authenticate(TEST_USER, "test")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Tenant).To(Equal("acme"))
+
+			Expect(db.SetTenant(TEST_USER, "")).To(Succeed())
+			user, err = db.Authenticate(TEST_USER, "test")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Tenant).To(BeEmpty())
+		})
+
+		It("should create user in tenant", func() {
+			Expect(db.Create(&userdb.BasicUser{Name: NEW_USER, Roles: []string{userdb.RoleViewer}, Tenant: "acme"}, "test")).To(Succeed())
+			defer db.Remove(NEW_USER)
+			var user userdb.BasicUser
+			Expect(db.Find(NEW_USER, &user)).To(Succeed())
+			Expect(user.Tenant).To(Equal("acme"))
+		})
+
+		It("should reject invalid tenant", func() {
+			Expect(db.SetTenant(TEST_USER, "a/b")).NotTo(Succeed())
+			Expect(db.Create(&userdb.BasicUser{Name: NEW_USER, Roles: []string{userdb.RoleViewer}, Tenant: "a b"}, "test")).NotTo(Succeed())
+		})
+
+		It("should fail if user does not exist", func() {
+			Expect(db.SetTenant(NOSUCH_USER, "acme")).To(BeUserNotFound(NOSUCH_USER))
+		})
+	})
+
 	Describe("Remove user", func() {
 		It("should success if user exist", func() {
 			Expect(db.Remove(TEST_USER)).To(Succeed())
@@ -155,104 +307,559 @@ func testSuite(dburl string) {
 		})
 	})
 
-	// Custom user is not supported by file backed user database
-	if !strings.HasPrefix(dburl, "file://") {
-		Describe("Custom user", func() {
-			type CustomUser struct {
-				userdb.BasicUser `bson:",inline"`
+	Describe("User management", func() {
+		system := &userdb.BasicUser{Name: "system", Roles: []string{userdb.RoleAdmin}}
+		admin := &userdb.BasicUser{Name: "admin", Roles: []string{userdb.RoleAdmin}, Tenant: "acme"}
+		operator := &userdb.BasicUser{Name: "operator", Roles: []string{userdb.RoleOperator}, Tenant: "acme"}
 
-				StringField  string
-				IntegerField int
-				BoolField    bool
-			}
+		AfterEach(func() {
+			db.Remove(NEW_USER)
+		})
 
-			const (
-				CUSTOM_USER  = "custom@example.com"
-				CUSTOM_FIELD = "custom user"
-			)
+		It("should create users in the tenant of the admin", func() {
+			user := &userdb.BasicUser{Name: NEW_USER, Roles: []string{userdb.RoleViewer}, Tenant: "other"}
+			Expect(db.CreateManaged(admin, user, "test")).To(Succeed())
+			found, err := db.FindManaged(admin, NEW_USER)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found.Tenant).To(Equal("acme"))
+		})
 
-			BeforeEach(func() {
-				customUser := &CustomUser{
-					BasicUser:    userdb.BasicUser{Name: CUSTOM_USER},
-					StringField:  CUSTOM_FIELD,
-					IntegerField: 42,
-					BoolField:    true,
-				}
+		It("should not create users without permission", func() {
+			user := &userdb.BasicUser{Name: NEW_USER, Roles: []string{userdb.RoleViewer}}
+			Expect(db.CreateManaged(operator, user, "test")).To(MatchError(userdb.PermissionDeniedError(userdb.UserManage)))
+		})
 
-				Expect(db.Create(customUser, "custom")).To(Succeed())
-			})
+		It("should not grant roles with more permissions", func() {
+			os.Setenv("IOTA_ROLES_USERADMIN", "user:manage,device:read")
+			defer os.Unsetenv("IOTA_ROLES_USERADMIN")
+			useradmin := &userdb.BasicUser{Name: "useradmin", Roles: []string{"useradmin"}}
+
+			user := &userdb.BasicUser{Name: NEW_USER, Roles: []string{userdb.RoleAdmin}}
+			Expect(db.CreateManaged(useradmin, user, "test")).NotTo(Succeed())
+			user.Roles = []string{userdb.RoleViewer}
+			Expect(db.CreateManaged(useradmin, user, "test")).NotTo(Succeed())
+			user.Roles = []string{"useradmin"}
+			Expect(db.CreateManaged(useradmin, user, "test")).To(Succeed())
+			Expect(db.UpdateProfile(useradmin, NEW_USER, userdb.Args{"roles": []interface{}{"admin"}})).NotTo(Succeed())
+		})
 
-			AfterEach(func() {
-				db.Remove(CUSTOM_USER)
-			})
+		It("should hide users of other tenants", func() {
+			_, err := db.FindManaged(admin, TEST_USER)
+			Expect(err).To(BeUserNotFound(TEST_USER))
+			_, err = db.FindManaged(system, TEST_USER)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(db.UpdateProfile(admin, TEST_USER, userdb.Args{"roles": []interface{}{"viewer"}})).To(BeUserNotFound(TEST_USER))
+		})
+
+		It("should update profile", func() {
+			Expect(db.UpdateProfile(system, TEST_USER, userdb.Args{"roles": []interface{}{"viewer"}, "tenant": "acme"})).To(Succeed())
+			user, err := db.FindManaged(admin, TEST_USER)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Roles).To(Equal([]string{userdb.RoleViewer}))
+			Expect(user.Tenant).To(Equal("acme"))
+
+			Expect(db.UpdateProfile(admin, TEST_USER, userdb.Args{"tenant": "other"})).To(MatchError(userdb.PermissionDeniedError("tenant")))
+			Expect(db.UpdateProfile(admin, TEST_USER, userdb.Args{"Tenant": ""})).To(MatchError(userdb.PermissionDeniedError("tenant")))
+			Expect(db.UpdateProfile(admin, TEST_USER, userdb.Args{"password": "secret"})).NotTo(Succeed())
+			Expect(db.UpdateProfile(admin, TEST_USER, userdb.Args{"Name": "renamed"})).NotTo(Succeed())
+			Expect(db.UpdateProfile(admin, TEST_USER, userdb.Args{"TOTPSecret": "secret"})).NotTo(Succeed())
+			Expect(db.UpdateProfile(admin, TEST_USER, userdb.Args{"roles.0": "admin"})).NotTo(Succeed())
+			Expect(db.UpdateProfile(admin, TEST_USER, userdb.Args{"$set": userdb.Args{"tenant": ""}})).NotTo(Succeed())
+			Expect(db.UpdateProfile(admin, TEST_USER, userdb.Args{"roles": []interface{}{"superman"}})).NotTo(Succeed())
+
+			user, err = db.FindManaged(system, TEST_USER)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Roles).To(Equal([]string{userdb.RoleViewer}))
+			Expect(user.Tenant).To(Equal("acme"))
+		})
+
+		It("should reset password", func() {
+			Expect(db.ResetPassword(TEST_USER, "reset")).To(Succeed())
+			_, err := db.Authenticate(TEST_USER, "reset")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(db.ResetPassword(TEST_USER, "")).NotTo(Succeed())
+			Expect(db.ResetPassword(NOSUCH_USER, "reset")).To(BeUserNotFound(NOSUCH_USER))
+		})
+
+		It("should deny password change with incorrect old password", func() {
+			Expect(db.ChangePassword(TEST_USER, "wrong", "changed")).To(MatchError(userdb.PermissionDeniedError("incorrect password")))
+		})
+	})
+
+	Describe("List users", func() {
+		It("should list users of the tenant", func() {
+			Expect(db.SetTenant(OTHER_USER, "acme")).To(Succeed())
+
+			users, err := db.List("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(users).To(HaveLen(2))
+
+			users, err = db.List("acme")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(users).To(HaveLen(1))
+			Expect(users[0].Name).To(Equal(OTHER_USER))
+		})
+	})
+
+	Describe("Disable user", func() {
+		It("should not authenticate disabled user", func() {
+			Expect(db.SetInactive(TEST_USER, true)).To(Succeed())
+			_, err := db.Authenticate(TEST_USER, "test")
+			Expect(err).To(MatchError(userdb.InactiveUserError(TEST_USER)))
+
+			Expect(db.SetInactive(TEST_USER, false)).To(Succeed())
+			_, err = db.Authenticate(TEST_USER, "test")
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("Password policy", func() {
+		BeforeEach(func() {
+			os.Setenv("IOTA_PASSWORD_MINLENGTH", "8")
+			os.Setenv("IOTA_PASSWORD_MINCLASSES", "3")
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("IOTA_PASSWORD_MINLENGTH")
+			os.Unsetenv("IOTA_PASSWORD_MINCLASSES")
+			os.Unsetenv("IOTA_PASSWORD_HISTORY")
+			db.Remove(NEW_USER)
+		})
+
+		It("should reject weak passwords", func() {
+			user := &userdb.BasicUser{Name: NEW_USER, Roles: []string{userdb.RoleViewer}}
+			Expect(db.Create(user, "Sh0rt")).To(BeAssignableToTypeOf(userdb.PasswordPolicyError("")))
+			Expect(db.Create(user, "lowercase1")).To(BeAssignableToTypeOf(userdb.PasswordPolicyError("")))
+			Expect(db.ResetPassword(TEST_USER, "password")).To(BeAssignableToTypeOf(userdb.PasswordPolicyError("")))
+			Expect(db.ChangePassword(TEST_USER, "test", "password")).To(BeAssignableToTypeOf(userdb.PasswordPolicyError("")))
+			Expect(db.Create(user, "Str0ng-pass")).To(Succeed())
+		})
+
+		It("should accept hashed passwords", func() {
+			var user userdb.BasicUser
+			Expect(db.Find(TEST_USER, &user)).To(Succeed())
+			Expect(db.Create(&userdb.BasicUser{Name: NEW_USER, Roles: []string{userdb.RoleViewer}}, string(user.Password))).To(Succeed())
+			_, err := db.Authenticate(NEW_USER, "test")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should reject recently used passwords", func() {
+			os.Unsetenv("IOTA_PASSWORD_MINLENGTH")
+			os.Unsetenv("IOTA_PASSWORD_MINCLASSES")
+			os.Setenv("IOTA_PASSWORD_HISTORY", "2")
+			Expect(db.ChangePassword(TEST_USER, "test", "test")).To(BeAssignableToTypeOf(userdb.PasswordPolicyError("")))
+			Expect(db.ChangePassword(TEST_USER, "test", "Passw0rd-1")).To(Succeed())
+			Expect(db.ChangePassword(TEST_USER, "Passw0rd-1", "test")).To(BeAssignableToTypeOf(userdb.PasswordPolicyError("")))
+			Expect(db.ResetPassword(TEST_USER, "Passw0rd-1")).To(BeAssignableToTypeOf(userdb.PasswordPolicyError("")))
+			Expect(db.ResetPassword(TEST_USER, "Passw0rd-2")).To(Succeed())
+			Expect(db.ResetPassword(TEST_USER, "test")).To(Succeed())
+
+			admin := &userdb.BasicUser{Roles: []string{userdb.RoleAdmin}}
+			Expect(db.UpdateProfile(admin, TEST_USER, userdb.Args{"passwordhistory": nil})).NotTo(Succeed())
+		})
+	})
+
+	Describe("Login", func() {
+		const IP = "192.0.2.1"
+
+		BeforeEach(func() {
+			// Forget login events of earlier tests on the first login
+			os.Setenv("IOTA_AUTH_LOGINAUDITRETENTION", "1ns")
+			os.Setenv("IOTA_AUTH_MAXLOGINFAILURES", "4")
+			os.Setenv("IOTA_AUTH_MAXIPLOGINFAILURES", "0")
+			os.Setenv("IOTA_AUTH_LOGINDELAY", "100ms")
+			os.Setenv("IOTA_AUTH_LOCKOUTDURATION", "1h")
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("IOTA_AUTH_LOGINAUDITRETENTION")
+			os.Unsetenv("IOTA_AUTH_MAXLOGINFAILURES")
+			os.Unsetenv("IOTA_AUTH_MAXIPLOGINFAILURES")
+			os.Unsetenv("IOTA_AUTH_LOGINDELAY")
+			os.Unsetenv("IOTA_AUTH_LOCKOUTDURATION")
+		})
+
+		login := func(name, password string) error {
+			_, err := db.Login(name, password, IP, userdb.ChannelHTTP)
+			return err
+		}
+
+		It("should delay and lock out after failed logins", func() {
+			Expect(login(TEST_USER, "test")).To(Succeed())
+			Expect(login(TEST_USER, "wrong")).NotTo(Succeed())
+			Expect(login(TEST_USER, "wrong")).NotTo(Succeed())
+			Expect(login(TEST_USER, "test")).To(Succeed())
+
+			// Failures are reset by successful login, and delayed after
+			// half of the allowed failures
+			Expect(login(TEST_USER, "wrong")).NotTo(Succeed())
+			Expect(login(TEST_USER, "wrong")).NotTo(Succeed())
+			Expect(login(TEST_USER, "wrong")).NotTo(Succeed())
+			Expect(login(TEST_USER, "test")).To(BeAssignableToTypeOf(&userdb.LoginLockedError{}))
+			time.Sleep(150 * time.Millisecond)
+			Expect(login(TEST_USER, "wrong")).NotTo(Succeed())
+
+			err := login(TEST_USER, "test")
+			Expect(err).To(BeAssignableToTypeOf(&userdb.LoginLockedError{}))
+			Expect(err.(*userdb.LoginLockedError).Until).To(BeTemporally(">", time.Now().Add(50*time.Minute)))
+			Expect(login(OTHER_USER, "other")).To(Succeed())
+		})
+
+		It("should lock out client address", func() {
+			os.Setenv("IOTA_AUTH_MAXIPLOGINFAILURES", "2")
+			Expect(login(TEST_USER, "test")).To(Succeed())
+			Expect(login(NOSUCH_USER, "wrong")).To(BeUserNotFound(NOSUCH_USER))
+			Expect(login(OTHER_USER, "wrong")).NotTo(Succeed())
+			Expect(login(TEST_USER, "test")).To(BeAssignableToTypeOf(&userdb.LoginLockedError{}))
 
-			var assertCustomFields = func(user *CustomUser) {
-				ExpectWithOffset(1, user.StringField).To(Equal(CUSTOM_FIELD))
-				ExpectWithOffset(1, user.IntegerField).To(Equal(42))
-				ExpectWithOffset(1, user.BoolField).To(BeTrue())
+			_, err := db.Login(TEST_USER, "test", "192.0.2.2", userdb.ChannelMQTT)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should record login events", func() {
+			Expect(db.SetTenant(OTHER_USER, "acme")).To(Succeed())
+			Expect(login(TEST_USER, "test")).To(Succeed())
+			Expect(login(OTHER_USER, "wrong")).NotTo(Succeed())
+			Expect(login(NOSUCH_USER, "wrong")).NotTo(Succeed())
+
+			system := &userdb.BasicUser{Name: "system", Roles: []string{userdb.RoleAdmin}}
+			events, err := db.LoginEvents(system, &userdb.LoginFilter{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(events).To(HaveLen(3))
+			Expect(events[0].User).To(Equal(NOSUCH_USER))
+			Expect(events[0].Reason).To(Equal("unknown user"))
+			Expect(events[1].User).To(Equal(OTHER_USER))
+			Expect(events[1].Tenant).To(Equal("acme"))
+			Expect(events[1].Result).To(Equal(userdb.LoginFailure))
+			Expect(events[1].Reason).To(Equal("password"))
+			Expect(events[2].User).To(Equal(TEST_USER))
+			Expect(events[2].Result).To(Equal(userdb.LoginSuccess))
+			Expect(events[2].IP).To(Equal(IP))
+			Expect(events[2].Channel).To(Equal(userdb.ChannelHTTP))
+
+			events, err = db.LoginEvents(system, &userdb.LoginFilter{Result: userdb.LoginFailure, Limit: 1})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(events).To(HaveLen(1))
+			Expect(events[0].User).To(Equal(NOSUCH_USER))
+
+			// Tenant admins only see login events of the tenant
+			admin := &userdb.BasicUser{Name: "admin", Roles: []string{userdb.RoleAdmin}, Tenant: "acme"}
+			events, err = db.LoginEvents(admin, &userdb.LoginFilter{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(events).To(HaveLen(1))
+			Expect(events[0].User).To(Equal(OTHER_USER))
+
+			// Users can only see their own login events
+			user := &userdb.BasicUser{Name: TEST_USER, Roles: []string{userdb.RoleViewer}}
+			events, err = db.LoginEvents(user, &userdb.LoginFilter{User: TEST_USER})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(events).To(HaveLen(1))
+			_, err = db.LoginEvents(user, &userdb.LoginFilter{})
+			Expect(err).To(MatchError(userdb.PermissionDeniedError(userdb.UserManage)))
+		})
+	})
+
+	Describe("Two-factor authentication", func() {
+		BeforeEach(func() {
+			// Forget login events of earlier tests on the first login
+			os.Setenv("IOTA_AUTH_LOGINAUDITRETENTION", "1ns")
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("IOTA_AUTH_LOGINAUDITRETENTION")
+			os.Unsetenv("IOTA_AUTH_TWOFACTORROLES")
+		})
+
+		login := func(name, password string) error {
+			_, err := db.Login(name, password, "", userdb.ChannelHTTP)
+			return err
+		}
+
+		It("should login with TOTP code or recovery code", func() {
+			enroll, err := db.EnrollTOTP(TEST_USER)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(enroll.URI).To(HavePrefix("otpauth://totp/iota:" + TEST_USER + "?"))
+			Expect(enroll.URI).To(ContainSubstring("secret=" + enroll.Secret))
+
+			// Not enabled until confirmed
+			Expect(login(TEST_USER, "test")).To(Succeed())
+			_, err = db.ConfirmTOTP(TEST_USER, "000000")
+			Expect(err).To(BeAssignableToTypeOf(userdb.SecondFactorError("")))
+			code := totpCode(enroll.Secret, time.Now())
+			codes, err := db.ConfirmTOTP(TEST_USER, code)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(codes).To(HaveLen(10))
+
+			Expect(login(TEST_USER, "wrong")).NotTo(BeAssignableToTypeOf(&userdb.SecondFactorRequiredError{}))
+			Expect(login(TEST_USER, "test")).To(Equal(&userdb.SecondFactorRequiredError{User: TEST_USER}))
+
+			// Codes can't be reused
+			_, _, err = db.LoginSecondFactor(TEST_USER, code, "", userdb.ChannelHTTP)
+			Expect(err).To(BeAssignableToTypeOf(userdb.SecondFactorError("")))
+			user, _, err := db.LoginSecondFactor(TEST_USER, totpCode(enroll.Secret, time.Now().Add(30*time.Second)), "", userdb.ChannelHTTP)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Name).To(Equal(TEST_USER))
+
+			_, _, err = db.LoginSecondFactor(TEST_USER, strings.ToUpper(codes[0]), "", userdb.ChannelHTTP)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, err = db.LoginSecondFactor(TEST_USER, codes[0], "", userdb.ChannelHTTP)
+			Expect(err).To(BeAssignableToTypeOf(userdb.SecondFactorError("")))
+
+			admin := &userdb.BasicUser{Roles: []string{userdb.RoleAdmin}}
+			Expect(db.UpdateProfile(admin, TEST_USER, userdb.Args{"totpsecret": nil})).NotTo(Succeed())
+
+			Expect(db.DisableTOTP(TEST_USER)).To(Succeed())
+			Expect(login(TEST_USER, "test")).To(Succeed())
+			_, _, err = db.LoginSecondFactor(TEST_USER, codes[1], "", userdb.ChannelHTTP)
+			Expect(err).To(BeAssignableToTypeOf(userdb.SecondFactorError("")))
+		})
+
+		It("should verify TOTP code or recovery code", func() {
+			Expect(db.VerifyTOTP(TEST_USER, "000000")).To(BeAssignableToTypeOf(userdb.InvalidArgumentError("")))
+
+			enroll, err := db.EnrollTOTP(TEST_USER)
+			Expect(err).NotTo(HaveOccurred())
+			code := totpCode(enroll.Secret, time.Now())
+			codes, err := db.ConfirmTOTP(TEST_USER, code)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(db.VerifyTOTP(TEST_USER, "000000")).To(BeAssignableToTypeOf(userdb.SecondFactorError("")))
+			Expect(db.VerifyTOTP(TEST_USER, code)).To(BeAssignableToTypeOf(userdb.SecondFactorError("")))
+			Expect(db.VerifyTOTP(TEST_USER, totpCode(enroll.Secret, time.Now().Add(30*time.Second)))).To(Succeed())
+			Expect(db.VerifyTOTP(TEST_USER, codes[0])).To(Succeed())
+			Expect(db.VerifyTOTP(TEST_USER, codes[0])).To(BeAssignableToTypeOf(userdb.SecondFactorError("")))
+			Expect(db.DisableTOTP(TEST_USER)).To(Succeed())
+		})
+
+		It("should enroll users of required roles at login", func() {
+			os.Setenv("IOTA_AUTH_TWOFACTORROLES", userdb.RoleOperator)
+			Expect(db.SetRoles(TEST_USER, []string{userdb.RoleOperator})).To(Succeed())
+			Expect(login(OTHER_USER, "other")).To(Succeed())
+			Expect(login(TEST_USER, "test")).To(Equal(&userdb.SecondFactorRequiredError{User: TEST_USER, Enroll: true}))
+
+			enroll, err := db.EnrollTOTP(TEST_USER)
+			Expect(err).NotTo(HaveOccurred())
+			_, codes, err := db.LoginSecondFactor(TEST_USER, totpCode(enroll.Secret, time.Now()), "", userdb.ChannelHTTP)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(codes).To(HaveLen(10))
+			Expect(login(TEST_USER, "test")).To(Equal(&userdb.SecondFactorRequiredError{User: TEST_USER}))
+		})
+	})
+
+	Describe("API keys", func() {
+		system := &userdb.BasicUser{Name: "system", Roles: []string{userdb.RoleAdmin}}
+		admin := &userdb.BasicUser{Name: "admin", Roles: []string{userdb.RoleAdmin}, Tenant: "acme"}
+		operator := &userdb.BasicUser{Name: "operator", Roles: []string{userdb.RoleOperator}, Tenant: "acme"}
+
+		AfterEach(func() {
+			db.RemoveAPIKey("ci")
+			db.RemoveAPIKey("other")
+		})
+
+		It("should verify created key", func() {
+			key := &userdb.APIKey{Name: "ci", Role: userdb.RoleViewer}
+			apikey, err := db.CreateAPIKey(system, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apikey).To(HavePrefix(userdb.APIKeyPrefix))
+			Expect(key.Account).To(Equal("ci"))
+			Expect(key.CreatedBy).To(Equal("system"))
+
+			found, err := db.VerifyAPIKey(apikey)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found.Name).To(Equal("ci"))
+			Expect(found.Hash).NotTo(ContainSubstring(apikey[len(userdb.APIKeyPrefix)+17:]))
+
+			user := found.User()
+			Expect(user.Name).To(Equal(userdb.ServiceAccountPrefix + "ci"))
+			Expect(user.Roles).To(Equal([]string{userdb.RoleViewer}))
+		})
+
+		It("should reject invalid keys", func() {
+			apikey, err := db.CreateAPIKey(system, &userdb.APIKey{Name: "ci", Role: userdb.RoleViewer})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = db.VerifyAPIKey(apikey + "x")
+			Expect(err).To(BeAssignableToTypeOf(userdb.InvalidAPIKeyError("")))
+			_, err = db.VerifyAPIKey("iota_malformed")
+			Expect(err).To(HaveOccurred())
+			_, err = db.VerifyAPIKey(strings.TrimPrefix(apikey, userdb.APIKeyPrefix))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject duplicate names", func() {
+			_, err := db.CreateAPIKey(system, &userdb.APIKey{Name: "ci", Role: userdb.RoleViewer})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = db.CreateAPIKey(system, &userdb.APIKey{Name: "ci", Role: userdb.RoleViewer})
+			Expect(err).To(MatchError(userdb.DuplicateAPIKeyError("ci")))
+		})
+
+		It("should reject invalid arguments", func() {
+			_, err := db.CreateAPIKey(system, &userdb.APIKey{Name: "ci", Role: userdb.RoleViewer, AllowedIPs: []string{"localhost"}})
+			Expect(err).To(HaveOccurred())
+			_, err = db.CreateAPIKey(system, &userdb.APIKey{Name: "ci", Role: "superman"})
+			Expect(err).To(HaveOccurred())
+			_, err = db.CreateAPIKey(system, &userdb.APIKey{Name: "c i", Role: userdb.RoleViewer})
+			Expect(err).To(HaveOccurred())
+			_, err = db.CreateAPIKey(system, &userdb.APIKey{Name: "ci"})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should create keys in the tenant of the admin", func() {
+			key := &userdb.APIKey{Name: "ci", Role: userdb.RoleViewer, Tenant: "other"}
+			_, err := db.CreateAPIKey(admin, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(key.Tenant).To(Equal("acme"))
+
+			_, err = db.CreateAPIKey(operator, &userdb.APIKey{Name: "other", Role: userdb.RoleViewer})
+			Expect(err).To(MatchError(userdb.PermissionDeniedError(userdb.UserManage)))
+		})
+
+		It("should hide keys of other tenants", func() {
+			_, err := db.CreateAPIKey(system, &userdb.APIKey{Name: "other", Role: userdb.RoleViewer, Tenant: "other"})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = db.CreateAPIKey(admin, &userdb.APIKey{Name: "ci", Role: userdb.RoleViewer})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = db.FindManagedAPIKey(admin, "other")
+			Expect(err).To(MatchError(userdb.APIKeyNotFoundError("other")))
+			_, err = db.FindManagedAPIKey(system, "other")
+			Expect(err).NotTo(HaveOccurred())
+
+			keys, err := db.ListAPIKeys("acme")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys).To(HaveLen(1))
+			Expect(keys[0].Name).To(Equal("ci"))
+
+			keys, err = db.ListAPIKeys("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys).To(HaveLen(2))
+		})
+
+		It("should not verify removed key", func() {
+			apikey, err := db.CreateAPIKey(system, &userdb.APIKey{Name: "ci", Role: userdb.RoleViewer})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(db.RemoveAPIKey("ci")).To(Succeed())
+			_, err = db.VerifyAPIKey(apikey)
+			Expect(err).To(HaveOccurred())
+			Expect(db.RemoveAPIKey("ci")).To(MatchError(userdb.APIKeyNotFoundError("ci")))
+		})
+
+		It("should reserve names of service accounts", func() {
+			user := &userdb.BasicUser{Name: userdb.ServiceAccountPrefix + "ci", Roles: []string{userdb.RoleViewer}}
+			Expect(db.Create(user, "test")).NotTo(Succeed())
+		})
+	})
+
+	Describe("Custom user", func() {
+		type CustomUser struct {
+			userdb.BasicUser `bson:",inline"`
+
+			StringField  string
+			IntegerField int
+			BoolField    bool
+		}
+
+		const (
+			CUSTOM_USER  = "custom@example.com"
+			CUSTOM_FIELD = "custom user"
+		)
+
+		BeforeEach(func() {
+			customUser := &CustomUser{
+				BasicUser:    userdb.BasicUser{Name: CUSTOM_USER, Roles: []string{userdb.RoleViewer}},
+				StringField:  CUSTOM_FIELD,
+				IntegerField: 42,
+				BoolField:    true,
 			}
 
-			It("should persist custom field values", func() {
-				var user CustomUser
-				Expect(db.Find(CUSTOM_USER, &user)).To(Succeed())
-				assertCustomFields(&user)
-			})
+			Expect(db.Create(customUser, "custom")).To(Succeed())
+		})
 
-			It("should success to modify custom fields", func() {
-				Expect(db.Update(CUSTOM_USER, userdb.Args{
-					"stringfield":  "set to new value",
-					"integerfield": 2020,
-					"boolfield":    false,
-				})).To(Succeed())
+		AfterEach(func() {
+			db.Remove(CUSTOM_USER)
+		})
 
-				var user CustomUser
-				Expect(db.Find(CUSTOM_USER, &user)).To(Succeed())
-				Expect(user.StringField).To(Equal("set to new value"))
-				Expect(user.IntegerField).To(Equal(2020))
-				Expect(user.BoolField).To(BeFalse())
-			})
+		var assertCustomFields = func(user *CustomUser) {
+			ExpectWithOffset(1, user.StringField).To(Equal(CUSTOM_FIELD))
+			ExpectWithOffset(1, user.IntegerField).To(Equal(42))
+			ExpectWithOffset(1, user.BoolField).To(BeTrue())
+		}
 
-			It("should success to load non-custom user with custom field values set to zero", func() {
+		It("should persist custom field values", func() {
+			var user CustomUser
+			Expect(db.Find(CUSTOM_USER, &user)).To(Succeed())
+			assertCustomFields(&user)
+		})
+
+		It("should success to modify custom fields", func() {
+			Expect(db.Update(CUSTOM_USER, userdb.Args{
+				"stringfield":  "set to new value",
+				"integerfield": 2020,
+				"boolfield":    false,
+			})).To(Succeed())
+
+			var user CustomUser
+			Expect(db.Find(CUSTOM_USER, &user)).To(Succeed())
+			Expect(user.StringField).To(Equal("set to new value"))
+			Expect(user.IntegerField).To(Equal(2020))
+			Expect(user.BoolField).To(BeFalse())
+		})
+
+		It("should success to load non-custom user with custom field values set to zero", func() {
+			var user CustomUser
+			Expect(db.Find(TEST_USER, &user)).To(Succeed())
+			Expect(user.StringField).To(BeZero())
+			Expect(user.IntegerField).To(BeZero())
+			Expect(user.BoolField).To(BeZero())
+		})
+
+		It("should act as a basic user", func() {
+			var user userdb.BasicUser
+			Expect(db.Find(CUSTOM_USER, &user)).To(Succeed())
+			Expect(user.Name).To(Equal(CUSTOM_USER))
+		})
+
+		Context("search for user with custom fields", func() {
+			It("should success if custom fields exists", func() {
 				var user CustomUser
-				Expect(db.Find(TEST_USER, &user)).To(Succeed())
-				Expect(user.StringField).To(BeZero())
-				Expect(user.IntegerField).To(BeZero())
-				Expect(user.BoolField).To(BeZero())
+				Expect(db.Search(userdb.Args{"stringfield": "custom user"}, &user)).To(Succeed())
+				assertCustomFields(&user)
 			})
 
-			It("should act as a basic user", func() {
-				var user userdb.BasicUser
-				Expect(db.Find(CUSTOM_USER, &user)).To(Succeed())
-				Expect(user.Name).To(Equal(CUSTOM_USER))
+			It("should fail if custom fields does not exist", func() {
+				var user CustomUser
+				Expect(db.Search(userdb.Args{"stringfield": "no such user"}, &user)).To(BeUserNotFound(""))
 			})
+		})
 
-			Context("search for user with custom fields", func() {
-				It("should success if custom fields exists", func() {
-					var user CustomUser
-					Expect(db.Search(userdb.Args{"stringfield": "custom user"}, &user)).To(Succeed())
-					assertCustomFields(&user)
-				})
-
-				It("should fail if custom fields does not exist", func() {
-					var user CustomUser
-					Expect(db.Search(userdb.Args{"stringfield": "no such user"}, &user)).To(BeUserNotFound(""))
-				})
+		Context("search for collection of users with custom fields", func() {
+			It("should success if custom fields exists", func() {
+				var users []*CustomUser
+				Expect(db.Search(userdb.Args{"stringfield": "custom user"}, &users)).To(Succeed())
+				Expect(users).To(HaveLen(1))
+				assertCustomFields(users[0])
 			})
 
-			Context("search for collection of users with custom fields", func() {
-				It("should success if custom fields exists", func() {
-					var users []*CustomUser
-					Expect(db.Search(userdb.Args{"stringfield": "custom user"}, &users)).To(Succeed())
-					Expect(users).To(HaveLen(1))
-					assertCustomFields(users[0])
-				})
-
-				It("should success if custom fields does not exist", func() {
-					var users []*CustomUser
-					Expect(db.Search(userdb.Args{"stringfield": "no such user"}, &users)).To(Succeed())
-					Expect(users).To(BeEmpty())
-				})
+			It("should success if custom fields does not exist", func() {
+				var users []*CustomUser
+				Expect(db.Search(userdb.Args{"stringfield": "no such user"}, &users)).To(Succeed())
+				Expect(users).To(BeEmpty())
 			})
 		})
-	}
+	})
+}
+
+// totpCode returns the TOTP code of the secret at the time, as specified
+// by RFC 6238.
+func totpCode(secret string, t time.Time) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(t.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
 }
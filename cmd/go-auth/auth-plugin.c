@@ -71,20 +71,25 @@ int mosquitto_auth_unpwd_check(void *user_data, const char *usernamae, const cha
 {
 #if MOSQ_AUTH_PLUGIN_VERSION >= 3
     const char *clientid = mosquitto_client_id(client);
+    const char *address = mosquitto_client_address(client);
 #else
     const char *clientid = "";
+    const char *address = "";
 #endif
 
     if (username == NULL)
         username = "";
     if (password == NULL)
         password = "";
+    if (address == NULL)
+        address = "";
 
     GoString go_username = {username, strlen(username)};
     GoString go_password = {password, strlen(password)};
     GoString go_clientid = {clientid, strlen(clientid)};
+    GoString go_address = {address, strlen(address)};
 
-    if (AuthUnpwdCheck(go_username, go_password, go_clientid)) {
+    if (AuthUnpwdCheck(go_username, go_password, go_clientid, go_address)) {
         return MOSQ_ERR_SUCCESS;
     }
 
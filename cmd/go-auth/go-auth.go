@@ -19,8 +19,8 @@ func AuthPluginCleanup() {
 }
 
 //export AuthUnpwdCheck
-func AuthUnpwdCheck(username, password, clientid string) bool {
-	return mosquitto.AuthUnpwdCheck(username, password, clientid)
+func AuthUnpwdCheck(username, password, clientid, addr string) bool {
+	return mosquitto.AuthUnpwdCheck(username, password, clientid, addr)
 }
 
 //export AuthAclCheck
@@ -10,14 +10,17 @@ import (
 
 	"github.com/redhill42/iota/agent"
 	"github.com/redhill42/iota/api/server"
+	"github.com/redhill42/iota/coap"
+	"github.com/redhill42/iota/config"
 	"github.com/sirupsen/logrus"
 )
 
 func (cli *ServerCli) CmdAPIServer(args ...string) (err error) {
-	var addr string
+	var addr, coapAddr string
 
 	cmd := cli.Subcmd("apiserver")
 	cmd.StringVar(&addr, []string{"-bind"}, ":8080", "API server bind address")
+	cmd.StringVar(&coapAddr, []string{"-coap"}, config.Get("coap.bind"), "CoAP server bind address, disabled if empty")
 	cmd.ParseFlags(args, true)
 
 	stopc := make(chan bool)
@@ -40,12 +43,33 @@ func (cli *ServerCli) CmdAPIServer(args ...string) (err error) {
 	}
 	api.Accept(addr, l)
 
+	// Serve constrained devices with CoAP on the same API
+	var coapServer *coap.Server
+	if coapAddr != "" {
+		coapServer = coap.NewServer(api.Mux, agent.MQTTBroker, func(token string) bool {
+			id, err := agent.DeviceManager.VerifyToken(token)
+			if err != nil {
+				return false
+			}
+			current, err := agent.DeviceManager.GetToken(id)
+			return err == nil && current == token
+		})
+		go func() {
+			if err := coapServer.ListenAndServe(coapAddr); err != coap.ErrServerClosed {
+				logrus.WithError(err).Error("CoAP server error")
+			}
+		}()
+	}
+
 	// The serve API routine never exists unless an error occurs
 	// we need to start it as a goroutine and wait on it so
 	// daemon doesn't exit
 	waitChan := make(chan error)
 	go api.Wait(waitChan)
 	trapSignals(func() {
+		if coapServer != nil {
+			coapServer.Close()
+		}
 		api.Close()
 		<-stopc // wait for CmdServer to return
 	})
@@ -20,8 +20,10 @@ type ServerCli struct {
 var CommandUsage = []Command{
 	{"apiserver", "Start the API server"},
 	{"config", "Get or set a configuration value"},
+	{"secret", "Manage keys that sign tokens"},
 	{"useradd", "Add a user"},
 	{"userdel", "Remove a user"},
+	{"usermod", "Change roles of a user"},
 }
 
 var Commands = make(map[string]Command)
@@ -39,8 +41,10 @@ func Init() *ServerCli {
 	c.handlers = map[string]func(...string) error{
 		"apiserver": c.CmdAPIServer,
 		"config":    c.CmdConfig,
+		"secret":    c.CmdSecret,
 		"useradd":   c.CmdUserAdd,
 		"userdel":   c.CmdUserDel,
+		"usermod":   c.CmdUserMod,
 	}
 	return c
 }
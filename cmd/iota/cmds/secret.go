@@ -0,0 +1,153 @@
+package cmds
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/redhill42/iota/auth"
+	"github.com/redhill42/iota/auth/jwks"
+	"github.com/redhill42/iota/auth/userdb"
+	"github.com/redhill42/iota/config"
+	"github.com/redhill42/iota/device"
+	"github.com/redhill42/iota/pkg/mflag"
+)
+
+const secretCmdUsage = `Usage: iota secret [KIND]
+       iota secret rotate [--alg ALG] [KIND]
+       iota secret remove KIND KID
+
+Manage keys that sign user tokens and device tokens. KIND is "user" or
+"device", both key sets are listed or rotated if omitted.
+
+A rotated key still verifies tokens signed by it until it's removed.
+Removing a key invalidates the tokens signed by it, devices must be
+given new tokens if the key signed device tokens.
+`
+
+// keySet is a key set opened from the database.
+type keySet struct {
+	kind  string
+	keys  *jwks.KeySet
+	close func()
+}
+
+func (cli *ServerCli) CmdSecret(args ...string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "rotate":
+			return cli.secretRotate(args[1:]...)
+		case "remove":
+			return cli.secretRemove(args[1:]...)
+		}
+	}
+
+	var help bool
+	cmd := cli.Subcmd("secret", "[KIND]")
+	cmd.BoolVar(&help, []string{"-help"}, false, "Print usage")
+	cmd.Require(mflag.Max, 1)
+	cmd.ParseFlags(args, false)
+
+	if help {
+		fmt.Fprint(os.Stdout, secretCmdUsage)
+		os.Exit(0)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tKID\tALG\tCREATED\tSTATUS")
+	err := withKeySets(cmd.Arg(0), func(ks keySet) error {
+		for i, key := range ks.keys.Keys() {
+			created, status := "-", "verify"
+			if !key.Created.IsZero() {
+				created = key.Created.Local().Format(time.RFC3339)
+			}
+			if i == 0 {
+				status = "sign"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", ks.kind, key.ID, key.Algorithm, created, status)
+		}
+		return nil
+	})
+	w.Flush()
+	return err
+}
+
+func (cli *ServerCli) secretRotate(args ...string) error {
+	var alg string
+
+	cmd := cli.Subcmd("secret rotate", "[KIND]")
+	cmd.StringVar(&alg, []string{"-alg"}, config.GetOrDefault("auth.signingMethod", "RS256"), "Signing method of the new key, RS256 or EdDSA")
+	cmd.Require(mflag.Max, 1)
+	cmd.ParseFlags(args, true)
+
+	return withKeySets(cmd.Arg(0), func(ks keySet) error {
+		key, err := ks.keys.Rotate(alg)
+		if err == nil {
+			fmt.Printf("New %s signing key: %s\n", ks.kind, key.ID)
+		}
+		return err
+	})
+}
+
+func (cli *ServerCli) secretRemove(args ...string) error {
+	cmd := cli.Subcmd("secret remove", "KIND KID")
+	cmd.Require(mflag.Exact, 2)
+	cmd.ParseFlags(args, true)
+
+	if cmd.Arg(0) == "" {
+		return errors.New("Key type must be \"user\" or \"device\"")
+	}
+	return withKeySets(cmd.Arg(0), func(ks keySet) error {
+		return ks.keys.Remove(cmd.Arg(1))
+	})
+}
+
+// withKeySets opens the key set of the kind, or all key sets if kind is
+// empty, and invokes the function with the key sets.
+func withKeySets(kind string, f func(ks keySet) error) error {
+	var kinds []string
+	switch kind {
+	case "user", "device":
+		kinds = []string{kind}
+	case "":
+		kinds = []string{"user", "device"}
+	default:
+		return fmt.Errorf("Unknown key type: %s, must be \"user\" or \"device\"", kind)
+	}
+
+	for _, kind := range kinds {
+		ks, err := openKeySet(kind)
+		if err != nil {
+			return err
+		}
+		err = f(ks)
+		ks.close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func openKeySet(kind string) (keySet, error) {
+	if kind == "user" {
+		users, err := userdb.Open()
+		if err != nil {
+			return keySet{}, err
+		}
+		keys, err := auth.OpenKeys(users)
+		if err != nil {
+			users.Close()
+			return keySet{}, err
+		}
+		return keySet{kind, keys, users.Close}, nil
+	}
+
+	devices, err := device.NewManager(nil)
+	if err != nil {
+		return keySet{}, err
+	}
+	return keySet{kind, devices.Keys(), devices.Close}, nil
+}
@@ -1,12 +1,16 @@
 package cmds
 
 import (
+	"strings"
+
 	"github.com/redhill42/iota/auth/userdb"
 	"github.com/redhill42/iota/pkg/mflag"
 )
 
 func (cli *ServerCli) CmdUserAdd(args ...string) (err error) {
 	cmd := cli.Subcmd("useradd", "USERNAME PASSWORD")
+	roles := cmd.String([]string{"-role"}, "", "Comma separated list of roles, required")
+	tenant := cmd.String([]string{"-tenant"}, "", "Tenant of the user, a system user if empty")
 	cmd.Require(mflag.Min, 2)
 	cmd.Require(mflag.Max, 2)
 	cmd.ParseFlags(args, true)
@@ -19,9 +23,48 @@ func (cli *ServerCli) CmdUserAdd(args ...string) (err error) {
 
 	user := &userdb.BasicUser{}
 	user.Name = cmd.Arg(0)
+	user.Roles = splitRoles(*roles)
+	user.Tenant = *tenant
 	return users.Create(user, cmd.Arg(1))
 }
 
+func (cli *ServerCli) CmdUserMod(args ...string) error {
+	cmd := cli.Subcmd("usermod", "USERNAME")
+	roles := cmd.String([]string{"-role"}, "", "Comma separated list of roles, the default role applies if empty")
+	tenant := cmd.String([]string{"-tenant"}, "", "Tenant of the user, a system user if empty")
+	cmd.Require(mflag.Exact, 1)
+	cmd.ParseFlags(args, true)
+
+	users, err := userdb.Open()
+	if err != nil {
+		return err
+	}
+	defer users.Close()
+
+	// Only change the attributes given on the command line
+	if cmd.IsSet("-role") {
+		if err = users.SetRoles(cmd.Arg(0), splitRoles(*roles)); err != nil {
+			return err
+		}
+	}
+	if cmd.IsSet("-tenant") {
+		if err = users.SetTenant(cmd.Arg(0), *tenant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func splitRoles(s string) []string {
+	var roles []string
+	for _, role := range strings.Split(s, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
 func (cli *ServerCli) CmdUserDel(args ...string) error {
 	cmd := cli.Subcmd("userdel", "USERNAME")
 	cmd.Require(mflag.Exact, 1)
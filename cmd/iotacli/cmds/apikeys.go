@@ -0,0 +1,83 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redhill42/iota/api/types"
+	"github.com/redhill42/iota/pkg/mflag"
+)
+
+func (cli *ClientCli) CmdAPIKeyList(args ...string) error {
+	var tenant string
+
+	cmd := cli.Subcmd("apikey:list", "")
+	cmd.StringVar(&tenant, []string{"-tenant"}, "", "Only list API keys of the tenant")
+	cmd.Require(mflag.Exact, 0)
+	cmd.ParseFlags(args, true)
+
+	if err := cli.ConnectAndLogin(); err != nil {
+		return err
+	}
+	keys, err := cli.GetAPIKeys(context.Background(), tenant)
+	if err == nil {
+		cli.writeJson(keys)
+	}
+	return err
+}
+
+// CmdAPIKeyCreate creates an API key and prints the key, which can't be
+// shown again.
+func (cli *ClientCli) CmdAPIKeyCreate(args ...string) error {
+	var key types.APIKey
+	var expires time.Duration
+	var allowedIPs string
+
+	cmd := cli.Subcmd("apikey:create", "NAME")
+	cmd.StringVar(&key.Account, []string{"-account"}, "", "Service account of the key, same as the key name if empty")
+	cmd.StringVar(&key.Role, []string{"-role"}, "", "Role of the service account, required")
+	cmd.StringVar(&key.Tenant, []string{"-tenant"}, "", "Tenant of the service account, a system account if empty")
+	cmd.DurationVar(&expires, []string{"-expires"}, 0, "Duration before the key expires, such as 720h, never expires if zero")
+	cmd.StringVar(&allowedIPs, []string{"-allow-ip"}, "", "Comma separated list of IP addresses or CIDR blocks allowed to use the key")
+	cmd.Require(mflag.Exact, 1)
+	cmd.ParseFlags(args, true)
+
+	key.Name = cmd.Arg(0)
+	if expires > 0 {
+		t := time.Now().Add(expires)
+		key.Expires = &t
+	}
+	for _, ip := range strings.Split(allowedIPs, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			key.AllowedIPs = append(key.AllowedIPs, ip)
+		}
+	}
+
+	if err := cli.ConnectAndLogin(); err != nil {
+		return err
+	}
+	created, err := cli.CreateAPIKey(context.Background(), &key)
+	if err == nil {
+		fmt.Fprintln(cli.stdout, created.Key)
+	}
+	return err
+}
+
+func (cli *ClientCli) CmdAPIKeyRevoke(args ...string) error {
+	var yes bool
+
+	cmd := cli.Subcmd("apikey:revoke", "NAME")
+	cmd.Require(mflag.Exact, 1)
+	cmd.BoolVar(&yes, []string{"y"}, false, "Confirm 'yes' to revoke the API key")
+	cmd.ParseFlags(args, true)
+
+	if !yes && !cli.confirm("Services using the API key will no longer be authorized") {
+		return nil
+	}
+	if err := cli.ConnectAndLogin(); err != nil {
+		return err
+	}
+	return cli.RevokeAPIKey(context.Background(), cmd.Arg(0))
+}
@@ -8,7 +8,11 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redhill42/iota/api/client"
+	"github.com/redhill42/iota/api/types"
 	"github.com/redhill42/iota/config"
 	"github.com/redhill42/iota/pkg/gopass"
 	"github.com/redhill42/iota/pkg/mflag"
@@ -16,13 +20,19 @@ import (
 )
 
 func (cli *ClientCli) CmdLogin(args ...string) error {
+	var sso bool
+
 	cmd := cli.Subcmd("login", "[USERNAME [PASSWORD]]")
+	cmd.BoolVar(&sso, []string{"-sso"}, false, "Login with the identity provider of the server")
 	cmd.Require(mflag.Max, 2)
 	cmd.ParseFlags(args, true)
 
 	if err := cli.Connect(); err != nil {
 		return err
 	}
+	if sso {
+		return cli.loginDevice()
+	}
 
 	var username, password string
 	if cmd.NArg() > 0 {
@@ -34,16 +44,74 @@ func (cli *ClientCli) CmdLogin(args ...string) error {
 	return cli.authenticate("Enter user credentials.", username, password)
 }
 
+// loginDevice logs in with the identity provider. The user approves the
+// login in a browser, possibly on another device, while the login is
+// polled until approved or expired.
+func (c *ClientCli) loginDevice() error {
+	ctx := context.Background()
+	login, err := c.LoginDevice(ctx)
+	if err != nil {
+		return err
+	}
+
+	if login.VerificationURIComplete != "" {
+		fmt.Fprintf(c.stdout, "To login, open %s\n", login.VerificationURIComplete)
+		fmt.Fprintf(c.stdout, "and confirm the code %s\n", login.UserCode)
+	} else {
+		fmt.Fprintf(c.stdout, "To login, open %s\n", login.VerificationURI)
+		fmt.Fprintf(c.stdout, "and enter the code %s\n", login.UserCode)
+	}
+
+	interval := time.Duration(login.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(login.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		token, err := c.DeviceToken(ctx, login.DeviceCode)
+		if err == client.ErrLoginPending {
+			continue
+		}
+		if se, ok := err.(rest.ServerError); ok {
+			switch se.StatusCode() {
+			case http.StatusTooManyRequests:
+				interval += 5 * time.Second
+				continue
+			case http.StatusUnauthorized:
+				return errors.New("Login failed.")
+			}
+		}
+		if err != nil {
+			return err
+		}
+		return c.saveToken(token)
+	}
+	return errors.New("Login expired.")
+}
+
+// CmdLogout revokes the login session on the server and removes the saved
+// tokens.
 func (cli *ClientCli) CmdLogout(args ...string) error {
+	var all bool
+
 	cmd := cli.Subcmd("logout", "")
 	cmd.Require(mflag.Exact, 0)
+	cmd.BoolVar(&all, []string{"-all"}, false, "Logout from all sessions")
 	cmd.ParseFlags(args, true)
 
-	if cli.host != "" {
-		config.RemoveOption(cli.host, "token")
-		config.Save()
+	if err := cli.Connect(); err != nil {
+		return err
+	}
+
+	var err error
+	if refresh := config.GetOption(cli.host, "refresh"); refresh != "" {
+		err = cli.Logout(context.Background(), refresh, all)
+	}
+	config.RemoveOption(cli.host, "token")
+	config.RemoveOption(cli.host, "refresh")
+	if serr := config.Save(); err == nil {
+		err = serr
 	}
-	return nil
+	return err
 }
 
 func (c *ClientCli) authenticate(prompt, username, password string) (err error) {
@@ -80,7 +148,105 @@ func (c *ClientCli) authenticate(prompt, username, password string) (err error)
 		return err
 	}
 
-	c.SetToken(token)
-	config.AddOption(c.host, "token", token)
+	if token.Challenge != "" {
+		if token, err = c.authenticateTOTP(token); err != nil {
+			return err
+		}
+	}
+	return c.saveToken(token)
+}
+
+// authenticateTOTP completes a login challenged for a second factor. The
+// user enrolls first if required by the server.
+func (c *ClientCli) authenticateTOTP(challenge *types.Token) (*types.Token, error) {
+	if challenge.Enroll != nil {
+		fmt.Fprintln(c.stdout, "Two-factor authentication is required for your account.")
+		c.printEnrollment(challenge.Enroll)
+	}
+
+	code, err := c.readCode("Verification code: ")
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.AuthenticateTOTP(context.Background(), challenge.Challenge, code)
+	if err != nil {
+		if se, ok := err.(rest.ServerError); ok && se.StatusCode() == http.StatusUnauthorized {
+			err = errors.New("Login failed. Please enter a valid verification code or recovery code.")
+		}
+		return nil, err
+	}
+
+	if len(token.RecoveryCodes) != 0 {
+		c.printRecoveryCodes(token.RecoveryCodes)
+	}
+	return token, nil
+}
+
+// printEnrollment shows the TOTP enrollment to be added to an authenticator
+// app.
+func (c *ClientCli) printEnrollment(enroll *types.TOTPEnrollment) {
+	fmt.Fprintln(c.stdout, "Add the following key to your authenticator app, or open the URI")
+	fmt.Fprintln(c.stdout, "as a QR code:")
+	fmt.Fprintf(c.stdout, "\n  Key: %s\n  URI: %s\n\n", enroll.Secret, enroll.URI)
+}
+
+// printRecoveryCodes shows the recovery codes, which can't be shown again.
+func (c *ClientCli) printRecoveryCodes(codes []string) {
+	fmt.Fprintln(c.stdout, "Save the following recovery codes in a safe place. Each code can be")
+	fmt.Fprintln(c.stdout, "used once to login if you lose your authenticator:")
+	fmt.Fprintln(c.stdout)
+	for _, code := range codes {
+		fmt.Fprintf(c.stdout, "  %s\n", code)
+	}
+	fmt.Fprintln(c.stdout)
+}
+
+// readCode prompts for a verification code.
+func (c *ClientCli) readCode(prompt string) (string, error) {
+	fmt.Fprint(c.stdout, prompt)
+	code, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(code), nil
+}
+
+// saveToken uses the access token for subsequent requests and saves tokens
+// in the configuration file.
+func (c *ClientCli) saveToken(token *types.Token) error {
+	c.SetToken(token.Token)
+	config.AddOption(c.host, "token", token.Token)
+	if token.RefreshToken != "" {
+		config.AddOption(c.host, "refresh", token.RefreshToken)
+	} else {
+		config.RemoveOption(c.host, "refresh")
+	}
 	return config.Save()
 }
+
+// refreshToken refreshes the access token if it's expired or about to
+// expire. The saved tokens are removed if the session is no longer valid.
+func (c *ClientCli) refreshToken(token string) (string, error) {
+	var claims jwt.StandardClaims
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, &claims); err != nil {
+		return token, nil
+	}
+	if claims.ExpiresAt == 0 || time.Until(time.Unix(claims.ExpiresAt, 0)) > time.Minute {
+		return token, nil
+	}
+
+	refresh := config.GetOption(c.host, "refresh")
+	if refresh == "" {
+		return token, nil
+	}
+	newToken, err := c.RefreshToken(context.Background(), refresh)
+	if err != nil {
+		if se, ok := err.(rest.ServerError); ok && se.StatusCode() == http.StatusUnauthorized {
+			config.RemoveOption(c.host, "token")
+			config.RemoveOption(c.host, "refresh")
+			return "", config.Save()
+		}
+		return "", err
+	}
+	return newToken.Token, c.saveToken(newToken)
+}
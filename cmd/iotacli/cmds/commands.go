@@ -45,6 +45,19 @@ var CommandUsage = []Command{
 	{"device:claims", "Show current device claims"},
 	{"device:approve", "Approve a device claim"},
 	{"device:reject", "Reject a device claim"},
+	{"user", "list users or show user information"},
+	{"user:create", "Create a user"},
+	{"user:update", "Update roles or tenant of a user"},
+	{"user:delete", "Permanently remove a user"},
+	{"user:enable", "Enable a user to login"},
+	{"user:disable", "Disable a user from login"},
+	{"user:passwd", "Change your password or reset password of a user"},
+	{"user:logout", "Log out a user from all sessions"},
+	{"user:logins", "Show login history of users"},
+	{"user:totp", "Enable or disable two-factor authentication"},
+	{"apikey:list", "List API keys of service accounts"},
+	{"apikey:create", "Create an API key for a service account"},
+	{"apikey:revoke", "Revoke an API key"},
 }
 
 var Commands = make(map[string]Command)
@@ -75,6 +88,19 @@ func Init(host string, stdout, stderr io.Writer) *ClientCli {
 		"device:claims":  c.CmdDeviceClaims,
 		"device:approve": c.CmdDeviceApprove,
 		"device:reject":  c.CmdDeviceReject,
+		"user":           c.CmdUser,
+		"user:create":    c.CmdUserCreate,
+		"user:update":    c.CmdUserUpdate,
+		"user:delete":    c.CmdUserDelete,
+		"user:enable":    c.CmdUserEnable,
+		"user:disable":   c.CmdUserDisable,
+		"user:passwd":    c.CmdUserPasswd,
+		"user:logout":    c.CmdUserLogout,
+		"user:logins":    c.CmdUserLogins,
+		"user:totp":      c.CmdUserTOTP,
+		"apikey:list":    c.CmdAPIKeyList,
+		"apikey:create":  c.CmdAPIKeyCreate,
+		"apikey:revoke":  c.CmdAPIKeyRevoke,
 	}
 
 	return c
@@ -116,7 +142,19 @@ func (c *ClientCli) ConnectAndLogin() (err error) {
 		return err
 	}
 
+	// Scripts authenticate with an API key instead of login
+	if apikey := os.Getenv("IOTA_API_KEY"); apikey != "" {
+		c.AddCustomHeader("X-API-Key", apikey)
+		return nil
+	}
+
 	token := config.GetOption(c.host, "token")
+	if token != "" {
+		token, err = c.refreshToken(token)
+		if err != nil {
+			return err
+		}
+	}
 	if token != "" {
 		c.SetToken(token)
 	} else {
@@ -0,0 +1,339 @@
+package cmds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redhill42/iota/api/types"
+	"github.com/redhill42/iota/config"
+	"github.com/redhill42/iota/pkg/gopass"
+	"github.com/redhill42/iota/pkg/mflag"
+)
+
+const usersCmdUsage = `Usage: iotacli user [NAME]
+
+list users or show user information (if a NAME is provided).
+
+Additional commands, type iotacli help COMMAND for more details:
+
+  user:create        Create a new user
+  user:update        Update roles or tenant of a user
+  user:delete        Permanently remove a user
+  user:enable        Enable a user to login
+  user:disable       Disable a user from login
+  user:passwd        Change your password or reset password of a user
+  user:logout        Log out a user from all sessions
+  user:logins        Show login history of users
+  user:totp          Enable or disable two-factor authentication
+`
+
+func (cli *ClientCli) CmdUser(args ...string) error {
+	var help bool
+	var tenant string
+	var err error
+
+	cmd := cli.Subcmd("user", "[NAME]")
+	cmd.Require(mflag.Max, 1)
+	cmd.BoolVar(&help, []string{"-help"}, false, "Print usage")
+	cmd.StringVar(&tenant, []string{"-tenant"}, "", "Only list users of the tenant")
+	cmd.ParseFlags(args, false)
+
+	if help {
+		fmt.Fprint(cli.stdout, usersCmdUsage)
+		os.Exit(0)
+	}
+
+	if err = cli.ConnectAndLogin(); err != nil {
+		return err
+	}
+
+	if cmd.NArg() == 0 {
+		var users []*types.User
+		if users, err = cli.GetUsers(context.Background(), tenant); err == nil {
+			cli.writeJson(users)
+		}
+	} else {
+		var user *types.User
+		if user, err = cli.GetUser(context.Background(), cmd.Arg(0)); err == nil {
+			cli.writeJson(user)
+		}
+	}
+	return err
+}
+
+func (cli *ClientCli) CmdUserCreate(args ...string) error {
+	var user types.UserCreate
+	var roles string
+
+	cmd := cli.Subcmd("user:create", "NAME")
+	cmd.StringVar(&roles, []string{"-role"}, "", "Comma separated list of roles, required")
+	cmd.StringVar(&user.Tenant, []string{"-tenant"}, "", "Tenant of the user, a system user if empty")
+	cmd.StringVar(&user.Password, []string{"p", "-password"}, "", "Password of the user, prompted if not given")
+	cmd.Require(mflag.Exact, 1)
+	cmd.ParseFlags(args, true)
+
+	user.Name = cmd.Arg(0)
+	user.Roles = splitRoles(roles)
+	if user.Password == "" {
+		password, err := cli.readPassword("New password: ", true)
+		if err != nil {
+			return err
+		}
+		user.Password = password
+	}
+
+	if err := cli.ConnectAndLogin(); err != nil {
+		return err
+	}
+	return cli.CreateUser(context.Background(), &user)
+}
+
+func (cli *ClientCli) CmdUserUpdate(args ...string) error {
+	var roles, tenant string
+
+	cmd := cli.Subcmd("user:update", "NAME")
+	cmd.StringVar(&roles, []string{"-role"}, "", "Comma separated list of roles, the default role applies if empty")
+	cmd.StringVar(&tenant, []string{"-tenant"}, "", "Tenant of the user, a system user if empty")
+	cmd.Require(mflag.Exact, 1)
+	cmd.ParseFlags(args, true)
+
+	// Only change the attributes given on the command line
+	updates := make(map[string]interface{})
+	if cmd.IsSet("-role") {
+		updates["roles"] = splitRoles(roles)
+	}
+	if cmd.IsSet("-tenant") {
+		updates["tenant"] = tenant
+	}
+	if len(updates) == 0 {
+		return errors.New("Nothing to update, specify --role or --tenant")
+	}
+
+	if err := cli.ConnectAndLogin(); err != nil {
+		return err
+	}
+	return cli.UpdateUser(context.Background(), cmd.Arg(0), updates)
+}
+
+func (cli *ClientCli) CmdUserDelete(args ...string) error {
+	var yes bool
+
+	cmd := cli.Subcmd("user:delete", "NAME")
+	cmd.Require(mflag.Exact, 1)
+	cmd.BoolVar(&yes, []string{"y"}, false, "Confirm 'yes' to remove the user")
+	cmd.ParseFlags(args, true)
+
+	if !yes && !cli.confirm("The user will no longer be able to login") {
+		return nil
+	}
+	if err := cli.ConnectAndLogin(); err != nil {
+		return err
+	}
+	return cli.DeleteUser(context.Background(), cmd.Arg(0))
+}
+
+func (cli *ClientCli) CmdUserEnable(args ...string) error {
+	cmd := cli.Subcmd("user:enable", "NAME")
+	cmd.Require(mflag.Exact, 1)
+	cmd.ParseFlags(args, true)
+
+	if err := cli.ConnectAndLogin(); err != nil {
+		return err
+	}
+	return cli.EnableUser(context.Background(), cmd.Arg(0), true)
+}
+
+func (cli *ClientCli) CmdUserDisable(args ...string) error {
+	cmd := cli.Subcmd("user:disable", "NAME")
+	cmd.Require(mflag.Exact, 1)
+	cmd.ParseFlags(args, true)
+
+	if err := cli.ConnectAndLogin(); err != nil {
+		return err
+	}
+	return cli.EnableUser(context.Background(), cmd.Arg(0), false)
+}
+
+// CmdUserPasswd changes the password of the logged in user, which requires
+// the old password, or resets the password of another user.
+func (cli *ClientCli) CmdUserPasswd(args ...string) error {
+	cmd := cli.Subcmd("user:passwd", "[NAME]")
+	cmd.Require(mflag.Max, 1)
+	cmd.ParseFlags(args, true)
+
+	if err := cli.ConnectAndLogin(); err != nil {
+		return err
+	}
+
+	current := cli.currentUser()
+	name := cmd.Arg(0)
+	if name == "" {
+		if name = current; name == "" {
+			return errors.New("Unable to determine the logged in user, please specify the user name")
+		}
+	}
+
+	var oldPassword string
+	var err error
+	if name == current {
+		if oldPassword, err = cli.readPassword("Old password: ", false); err != nil {
+			return err
+		}
+	}
+	newPassword, err := cli.readPassword("New password: ", true)
+	if err != nil {
+		return err
+	}
+	return cli.ChangePassword(context.Background(), name, oldPassword, newPassword)
+}
+
+// CmdUserLogout revokes all login sessions of a user. The user has to
+// login again when the current access token expires.
+func (cli *ClientCli) CmdUserLogout(args ...string) error {
+	cmd := cli.Subcmd("user:logout", "NAME")
+	cmd.Require(mflag.Exact, 1)
+	cmd.ParseFlags(args, true)
+
+	if err := cli.ConnectAndLogin(); err != nil {
+		return err
+	}
+	return cli.RevokeSessions(context.Background(), cmd.Arg(0))
+}
+
+// CmdUserLogins shows login events of a user, or of all users managed by
+// the logged in user if no user is given, latest first.
+func (cli *ClientCli) CmdUserLogins(args ...string) error {
+	var ip, result, since string
+	var limit int
+
+	cmd := cli.Subcmd("user:logins", "[NAME]")
+	cmd.StringVar(&ip, []string{"-ip"}, "", "Only show logins from the IP address")
+	cmd.StringVar(&result, []string{"-result"}, "", "Only show logins with the result, success, failure or locked")
+	cmd.StringVar(&since, []string{"-since"}, "", "Only show logins since the time in RFC 3339 format, or the duration before now, such as 24h")
+	cmd.IntVar(&limit, []string{"-limit"}, 0, "Maximum number of logins to show")
+	cmd.Require(mflag.Max, 1)
+	cmd.ParseFlags(args, true)
+
+	query := url.Values{}
+	for key, value := range map[string]string{"ip": ip, "result": result, "since": since} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	if err := cli.ConnectAndLogin(); err != nil {
+		return err
+	}
+	events, err := cli.GetLogins(context.Background(), cmd.Arg(0), query)
+	if err == nil {
+		cli.writeJson(events)
+	}
+	return err
+}
+
+// CmdUserTOTP enrolls the logged in user in two-factor authentication,
+// or disables two-factor authentication of a user.
+func (cli *ClientCli) CmdUserTOTP(args ...string) error {
+	var disable bool
+
+	cmd := cli.Subcmd("user:totp", "[NAME]")
+	cmd.BoolVar(&disable, []string{"-disable"}, false, "Disable two-factor authentication of the user")
+	cmd.Require(mflag.Max, 1)
+	cmd.ParseFlags(args, true)
+
+	if err := cli.ConnectAndLogin(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	current := cli.currentUser()
+	name := cmd.Arg(0)
+	if name == "" {
+		if name = current; name == "" {
+			return errors.New("Unable to determine the logged in user, please specify the user name")
+		}
+	}
+	if disable {
+		// Users must verify their own second factor to disable it
+		var code string
+		if name == current {
+			var err error
+			if code, err = cli.readCode("Verification code or recovery code: "); err != nil {
+				return err
+			}
+		}
+		return cli.DisableTOTP(ctx, name, code)
+	}
+
+	enroll, err := cli.EnrollTOTP(ctx, name)
+	if err != nil {
+		return err
+	}
+	cli.printEnrollment(enroll)
+	code, err := cli.readCode("Verification code: ")
+	if err != nil {
+		return err
+	}
+	codes, err := cli.ConfirmTOTP(ctx, name, code)
+	if err != nil {
+		return err
+	}
+	cli.printRecoveryCodes(codes)
+	return nil
+}
+
+// currentUser returns the name of the logged in user from the saved token.
+// The token is verified by the server, so it's parsed without verification.
+func (cli *ClientCli) currentUser() string {
+	var claims jwt.StandardClaims
+	token := config.GetOption(cli.host, "token")
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, &claims); err != nil {
+		return ""
+	}
+	return claims.Subject
+}
+
+// readPassword prompts for a password, which is prompted twice to confirm
+// if it's a new password.
+func (cli *ClientCli) readPassword(prompt string, confirm bool) (string, error) {
+	fmt.Fprint(cli.stdout, prompt)
+	pass, err := gopass.GetPasswdMasked()
+	if err != nil {
+		return "", err
+	}
+	password := strings.TrimSpace(string(pass))
+	if password == "" {
+		return "", errors.New("Password must not be empty")
+	}
+
+	if confirm {
+		fmt.Fprint(cli.stdout, "Retype password: ")
+		again, err := gopass.GetPasswdMasked()
+		if err != nil {
+			return "", err
+		}
+		if string(again) != string(pass) {
+			return "", errors.New("Passwords do not match")
+		}
+	}
+	return password, nil
+}
+
+func splitRoles(s string) []string {
+	var roles []string
+	for _, role := range strings.Split(s, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
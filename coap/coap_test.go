@@ -0,0 +1,366 @@
+package coap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCoAP(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CoAP Suite")
+}
+
+var _ = Describe("Message", func() {
+	It("should encode and decode messages", func() {
+		m := &Message{
+			Type:      Confirmable,
+			Code:      POST,
+			MessageID: 0x1234,
+			Token:     []byte{1, 2, 3},
+			Payload:   []byte(`{"a":1}`),
+		}
+		m.SetPath("api/v1/TOKEN/me/attributes")
+		m.SetUint(ContentFormat, JSON)
+		m.Add(URIQuery, []byte(strings.Repeat("q", 300)))
+
+		p, err := Parse(m.Encode())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Type).To(Equal(Confirmable))
+		Expect(p.Code).To(Equal(POST))
+		Expect(p.MessageID).To(Equal(uint16(0x1234)))
+		Expect(p.Token).To(Equal([]byte{1, 2, 3}))
+		Expect(p.Path()).To(Equal("api/v1/TOKEN/me/attributes"))
+		Expect(uintOf(p, ContentFormat)).To(BeEquivalentTo(JSON))
+		Expect(p.Strings(URIQuery)).To(Equal([]string{strings.Repeat("q", 300)}))
+		Expect(p.Payload).To(Equal([]byte(`{"a":1}`)))
+	})
+
+	It("should reject malformed messages", func() {
+		_, err := Parse([]byte{0x40, 0x01})
+		Expect(err).To(Equal(ErrMalformed))
+		_, err = Parse([]byte{0x49, 0x01, 0, 1})
+		Expect(err).To(Equal(ErrMalformed))
+		_, err = Parse([]byte{0x40, 0x01, 0, 1, 0xff})
+		Expect(err).To(Equal(ErrMalformed))
+		_, err = Parse([]byte{0x80, 0x01, 0, 1})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should encode block options", func() {
+		b := Block{Num: 5, More: true, Size: 256}
+		Expect(ParseBlock(b.Value())).To(Equal(b))
+		Expect(Block{Size: 16}.Value()).To(BeEquivalentTo(0))
+	})
+
+	It("should map content formats", func() {
+		f, ok := FormatOf("application/json; charset=utf-8")
+		Expect(ok).To(BeTrue())
+		Expect(f).To(Equal(JSON))
+		t, _ := MediaType(TextPlain)
+		Expect(t).To(HavePrefix("text/plain"))
+		_, ok = FormatOf("image/png")
+		Expect(ok).To(BeFalse())
+	})
+})
+
+// uintOf returns the value of a uint option, or zero if not present.
+func uintOf(m *Message, number int) uint32 {
+	v, _ := m.Uint(number)
+	return v
+}
+
+type fakeBroker struct {
+	mu            sync.Mutex
+	published     map[string][]byte
+	subscriptions map[string]func(string, []byte)
+}
+
+func (b *fakeBroker) Publish(topic string, payload interface{}) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published[topic] = payload.([]byte)
+	return nil
+}
+
+func (b *fakeBroker) Subscribe(topic string, callback func(string, []byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscriptions[topic] = callback
+	return nil
+}
+
+func (b *fakeBroker) Unsubscribe(topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscriptions, topic)
+}
+
+func (b *fakeBroker) deliver(filter, topic string, payload []byte) bool {
+	b.mu.Lock()
+	cb := b.subscriptions[filter]
+	b.mu.Unlock()
+	if cb != nil {
+		cb(topic, payload)
+	}
+	return cb != nil
+}
+
+func (b *fakeBroker) subscribed(filter string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subscriptions[filter] != nil
+}
+
+var _ = Describe("Server", func() {
+	const TOKEN = "TOKEN"
+
+	var (
+		srv      *Server
+		broker   *fakeBroker
+		client   net.Conn
+		firmware []byte
+		release  chan struct{}
+		nextID   uint16
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/me/attributes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "bearer "+TOKEN {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case "GET":
+			w.Write([]byte(`{"name":"` + r.URL.Query().Get("name") + `"}`))
+		case "POST":
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write(body)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/v1/me/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	mux.HandleFunc("/api/v1/me/firmware", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(firmware)
+	})
+
+	BeforeEach(func() {
+		firmware = bytes.Repeat([]byte("0123456789"), 250)
+		release = make(chan struct{})
+		broker = &fakeBroker{
+			published:     make(map[string][]byte),
+			subscriptions: make(map[string]func(string, []byte)),
+		}
+		srv = NewServer(mux, broker, func(token string) bool { return token == TOKEN })
+
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		go srv.Serve(conn)
+
+		client, err = net.Dial("udp", conn.LocalAddr().String())
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		srv.Close()
+	})
+
+	send := func(m *Message) {
+		_, err := client.Write(m.Encode())
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	receive := func() *Message {
+		buf := make([]byte, 2048)
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := client.Read(buf)
+		Expect(err).NotTo(HaveOccurred())
+		m, err := Parse(buf[:n])
+		Expect(err).NotTo(HaveOccurred())
+		return m
+	}
+
+	request := func(code Code, path string, payload []byte, options ...Option) *Message {
+		nextID++
+		m := &Message{Type: Confirmable, Code: code, MessageID: nextID, Token: []byte{byte(nextID)}, Payload: payload}
+		m.SetPath(path)
+		m.Options = append(m.Options, options...)
+		send(m)
+		resp := receive()
+		Expect(resp.Type).To(Equal(Acknowledgement))
+		Expect(resp.MessageID).To(Equal(m.MessageID))
+		Expect(resp.Token).To(Equal(m.Token))
+		return resp
+	}
+
+	uintOption := func(number int, v uint32) Option {
+		return Option{number, encodeUint(v)}
+	}
+
+	It("should serve requests with API server", func() {
+		resp := request(GET, "api/v1/TOKEN/me/attributes", nil, Option{URIQuery, []byte("name=test")})
+		Expect(resp.Code).To(Equal(Content))
+		Expect(uintOf(resp, ContentFormat)).To(BeEquivalentTo(JSON))
+		Expect(string(resp.Payload)).To(Equal(`{"name":"test"}`))
+
+		resp = request(POST, "api/v1/TOKEN/me/attributes", []byte(`{"a":1}`))
+		Expect(resp.Code).To(Equal(Changed))
+		Expect(string(resp.Payload)).To(Equal(`{"a":1}`))
+
+		resp = request(DELETE, "api/v1/TOKEN/me/attributes", nil)
+		Expect(resp.Code).To(Equal(MethodNotAllowed))
+	})
+
+	It("should reject invalid requests", func() {
+		Expect(request(GET, "api/v1/FAKE/me/attributes", nil).Code).To(Equal(Unauthorized))
+		Expect(request(GET, "api/v1", nil).Code).To(Equal(NotFound))
+		Expect(request(GET, "api/v1/TOKEN/me/unknown", nil).Code).To(Equal(NotFound))
+		Expect(request(GET, "api/v1/TOKEN/me/attributes", nil, Option{9, nil}).Code).To(Equal(BadOption))
+	})
+
+	It("should reply ping with reset", func() {
+		send(&Message{Type: Confirmable, MessageID: 42})
+		resp := receive()
+		Expect(resp.Type).To(Equal(Reset))
+		Expect(resp.MessageID).To(Equal(uint16(42)))
+	})
+
+	It("should send the same response to duplicate requests", func() {
+		m := &Message{Type: Confirmable, Code: POST, MessageID: 1000, Payload: []byte(`{"a":1}`)}
+		m.SetPath("api/v1/TOKEN/me/attributes")
+		send(m)
+		first := receive()
+		send(m)
+		Expect(receive()).To(Equal(first))
+	})
+
+	It("should reject requests if the client has too many requests in progress", func() {
+		srv.mu.Lock()
+		srv.peerLimit = 1
+		srv.mu.Unlock()
+
+		slow := &Message{Type: Confirmable, Code: GET, MessageID: 3000, Token: []byte{1}}
+		slow.SetPath("api/v1/TOKEN/me/slow")
+		send(slow)
+		resp := request(GET, "api/v1/TOKEN/me/attributes", nil)
+		Expect(resp.Code).To(Equal(ServiceUnavailable))
+
+		close(release)
+		resp = receive()
+		Expect(resp.MessageID).To(Equal(slow.MessageID))
+		Expect(resp.Code).To(Equal(Content))
+		Expect(request(GET, "api/v1/TOKEN/me/attributes", nil).Code).To(Equal(Content))
+	})
+
+	It("should transfer large responses block by block", func() {
+		var data []byte
+		for num := uint32(0); ; num++ {
+			resp := request(GET, "api/v1/TOKEN/me/firmware", nil, uintOption(Block2, Block{Num: num, Size: 512}.Value()))
+			Expect(resp.Code).To(Equal(Content))
+			Expect(uintOf(resp, ContentFormat)).To(BeEquivalentTo(OctetStream))
+			v, ok := resp.Uint(Block2)
+			Expect(ok).To(BeTrue())
+			block := ParseBlock(v)
+			Expect(block.Num).To(Equal(num))
+			Expect(block.Size).To(Equal(512))
+			if num == 0 {
+				Expect(uintOf(resp, Size2)).To(BeEquivalentTo(len(firmware)))
+			}
+			data = append(data, resp.Payload...)
+			if !block.More {
+				break
+			}
+		}
+		Expect(data).To(Equal(firmware))
+	})
+
+	It("should start block-wise transfer if response is too large", func() {
+		resp := request(GET, "api/v1/TOKEN/me/firmware", nil)
+		v, ok := resp.Uint(Block2)
+		Expect(ok).To(BeTrue())
+		Expect(ParseBlock(v)).To(Equal(Block{Num: 0, More: true, Size: 1024}))
+		Expect(resp.Payload).To(Equal(firmware[:1024]))
+
+		resp = request(GET, "api/v1/TOKEN/me/firmware", nil, uintOption(Block2, Block{Num: 10, Size: 1024}.Value()))
+		Expect(resp.Code).To(Equal(BadOption))
+	})
+
+	It("should notify observers of attribute updates", func() {
+		resp := request(GET, "api/v1/TOKEN/me/attributes", nil, uintOption(Observe, 0))
+		Expect(resp.Code).To(Equal(Content))
+		seq, ok := resp.Uint(Observe)
+		Expect(ok).To(BeTrue())
+		token := resp.Token
+
+		Expect(broker.deliver(TOKEN+"/me/attributes", TOKEN+"/me/attributes", []byte(`{"a":2}`))).To(BeTrue())
+		n := receive()
+		Expect(n.Type).To(Equal(Confirmable))
+		Expect(n.Token).To(Equal(token))
+		Expect(uintOf(n, Observe)).To(BeNumerically(">", seq))
+		Expect(string(n.Payload)).To(Equal(`{"a":2}`))
+		send(&Message{Type: Acknowledgement, MessageID: n.MessageID})
+
+		// Reset cancels the observation
+		Expect(broker.deliver(TOKEN+"/me/attributes", TOKEN+"/me/attributes", []byte(`{"a":3}`))).To(BeTrue())
+		n = receive()
+		send(&Message{Type: Reset, MessageID: n.MessageID})
+		Eventually(func() bool { return broker.subscribed(TOKEN + "/me/attributes") }).Should(BeFalse())
+	})
+
+	It("should not observe unauthorized resources", func() {
+		resp := request(GET, "api/v1/FAKE/me/attributes", nil, uintOption(Observe, 0))
+		Expect(resp.Code).To(Equal(Unauthorized))
+		_, ok := resp.Uint(Observe)
+		Expect(ok).To(BeFalse())
+		Expect(broker.subscribed("FAKE/me/attributes")).To(BeFalse())
+
+		resp = request(GET, "api/v1/FAKE/me/rpc/request", nil, uintOption(Observe, 0))
+		Expect(resp.Code).To(Equal(Unauthorized))
+	})
+
+	It("should deregister observers", func() {
+		resp := request(GET, "api/v1/TOKEN/me/attributes", nil, uintOption(Observe, 0))
+		Expect(broker.subscribed(TOKEN + "/me/attributes")).To(BeTrue())
+
+		// Deregistration is identified by the token of the observe request
+		m := &Message{Type: Confirmable, Code: GET, MessageID: 2000, Token: resp.Token}
+		m.SetPath("api/v1/TOKEN/me/attributes")
+		m.SetUint(Observe, 1)
+		send(m)
+		Expect(receive().Code).To(Equal(Content))
+		Expect(broker.subscribed(TOKEN + "/me/attributes")).To(BeFalse())
+	})
+
+	It("should deliver RPC requests and responses", func() {
+		resp := request(GET, "api/v1/TOKEN/me/rpc/request", nil, uintOption(Observe, 0))
+		Expect(resp.Code).To(Equal(Content))
+
+		req := []byte(`{"jsonrpc":"2.0","method":"reboot","id":1}`)
+		Expect(broker.deliver(TOKEN+"/me/rpc/request/+", TOKEN+"/me/rpc/request/abc-1", req)).To(BeTrue())
+		n := receive()
+		Expect(n.Payload).To(Equal(req))
+		Expect(n.Strings(LocationPath)).To(Equal([]string{"me", "rpc", "response", "abc-1"}))
+		send(&Message{Type: Acknowledgement, MessageID: n.MessageID})
+
+		result := []byte(`{"jsonrpc":"2.0","result":true,"id":1}`)
+		resp = request(POST, "api/v1/TOKEN/me/rpc/response/abc-1", result)
+		Expect(resp.Code).To(Equal(Changed))
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		Expect(broker.published).To(HaveKeyWithValue(TOKEN+"/me/rpc/response/abc-1", result))
+	})
+})
@@ -0,0 +1,426 @@
+// Package coap implements a CoAP (RFC 7252) endpoint for constrained devices
+// that can't afford MQTT over TCP. Requests are served by the API server,
+// and devices can observe resources (RFC 7641) and transfer large payloads
+// block by block (RFC 7959).
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Message types
+const (
+	Confirmable     byte = 0
+	NonConfirmable  byte = 1
+	Acknowledgement byte = 2
+	Reset           byte = 3
+)
+
+// Code is the request method or response code of a message, in the form
+// class.detail.
+type Code byte
+
+func code(class, detail byte) Code {
+	return Code(class<<5 | detail)
+}
+
+// Class returns the class of the code, 0 for requests, 2 for success
+// responses, 4 for client errors and 5 for server errors.
+func (c Code) Class() byte {
+	return byte(c) >> 5
+}
+
+func (c Code) String() string {
+	return fmt.Sprintf("%d.%02d", c>>5, c&0x1f)
+}
+
+// Request methods
+const (
+	Empty  Code = 0
+	GET    Code = 1
+	POST   Code = 2
+	PUT    Code = 3
+	DELETE Code = 4
+)
+
+// Response codes
+var (
+	Created                  = code(2, 1)
+	Deleted                  = code(2, 2)
+	Valid                    = code(2, 3)
+	Changed                  = code(2, 4)
+	Content                  = code(2, 5)
+	Continue                 = code(2, 31)
+	BadRequest               = code(4, 0)
+	Unauthorized             = code(4, 1)
+	BadOption                = code(4, 2)
+	Forbidden                = code(4, 3)
+	NotFound                 = code(4, 4)
+	MethodNotAllowed         = code(4, 5)
+	NotAcceptable            = code(4, 6)
+	RequestEntityIncomplete  = code(4, 8)
+	PreconditionFailed       = code(4, 12)
+	RequestEntityTooLarge    = code(4, 13)
+	UnsupportedContentFormat = code(4, 15)
+	InternalServerError      = code(5, 0)
+	NotImplemented           = code(5, 1)
+	BadGateway               = code(5, 2)
+	ServiceUnavailable       = code(5, 3)
+	GatewayTimeout           = code(5, 4)
+)
+
+// Option numbers
+const (
+	IfMatch       = 1
+	URIHost       = 3
+	ETag          = 4
+	IfNoneMatch   = 5
+	Observe       = 6
+	URIPort       = 7
+	LocationPath  = 8
+	URIPath       = 11
+	ContentFormat = 12
+	MaxAge        = 14
+	URIQuery      = 15
+	Accept        = 17
+	LocationQuery = 20
+	Block2        = 23
+	Block1        = 27
+	Size2         = 28
+	ProxyURI      = 35
+	ProxyScheme   = 39
+	Size1         = 60
+)
+
+// critical returns true if an unrecognized option must cause the message
+// to be rejected.
+func critical(option int) bool {
+	return option&1 != 0
+}
+
+// knownOptions are the options recognized by the server.
+var knownOptions = map[int]bool{
+	IfMatch: true, URIHost: true, ETag: true, IfNoneMatch: true, Observe: true,
+	URIPort: true, LocationPath: true, URIPath: true, ContentFormat: true,
+	MaxAge: true, URIQuery: true, Accept: true, LocationQuery: true,
+	Block2: true, Block1: true, Size2: true, Size1: true,
+}
+
+// Content formats
+const (
+	TextPlain   = 0
+	LinkFormat  = 40
+	XML         = 41
+	OctetStream = 42
+	EXI         = 47
+	JSON        = 50
+	CBOR        = 60
+)
+
+var mediaTypes = map[int]string{
+	TextPlain:   "text/plain; charset=utf-8",
+	LinkFormat:  "application/link-format",
+	XML:         "application/xml",
+	OctetStream: "application/octet-stream",
+	EXI:         "application/exi",
+	JSON:        "application/json",
+	CBOR:        "application/cbor",
+}
+
+// MediaType returns the media type of a content format.
+func MediaType(format int) (string, bool) {
+	t, ok := mediaTypes[format]
+	return t, ok
+}
+
+// FormatOf returns the content format of a media type.
+func FormatOf(mediaType string) (int, bool) {
+	if i := strings.IndexByte(mediaType, ';'); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+	mediaType = strings.TrimSpace(mediaType)
+	for f, t := range mediaTypes {
+		if i := strings.IndexByte(t, ';'); i >= 0 {
+			t = t[:i]
+		}
+		if t == mediaType {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+// Option is a message option. Values of uint options are encoded in the
+// minimal number of bytes.
+type Option struct {
+	Number int
+	Value  []byte
+}
+
+// Message is a CoAP message.
+type Message struct {
+	Type      byte
+	Code      Code
+	MessageID uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+var (
+	// ErrMalformed indicates that a message could not be parsed.
+	ErrMalformed = errors.New("coap: malformed message")
+
+	// errVersion indicates that a message has unknown version number.
+	errVersion = errors.New("coap: unknown version")
+)
+
+const payloadMarker = 0xff
+
+// Parse decodes a message from a datagram.
+func Parse(data []byte) (*Message, error) {
+	if len(data) < 4 {
+		return nil, ErrMalformed
+	}
+	if data[0]>>6 != 1 {
+		return nil, errVersion
+	}
+
+	m := &Message{
+		Type:      data[0] >> 4 & 3,
+		Code:      Code(data[1]),
+		MessageID: binary.BigEndian.Uint16(data[2:]),
+	}
+	tkl := int(data[0] & 0xf)
+	if tkl > 8 || len(data) < 4+tkl {
+		return nil, ErrMalformed
+	}
+	if tkl > 0 {
+		m.Token = append([]byte(nil), data[4:4+tkl]...)
+	}
+
+	b := data[4+tkl:]
+	number := 0
+	for len(b) > 0 {
+		if b[0] == payloadMarker {
+			if len(b) == 1 {
+				return nil, ErrMalformed
+			}
+			m.Payload = append([]byte(nil), b[1:]...)
+			break
+		}
+
+		delta, length := int(b[0]>>4), int(b[0]&0xf)
+		b = b[1:]
+		var ok bool
+		if delta, b, ok = extended(delta, b); !ok {
+			return nil, ErrMalformed
+		}
+		if length, b, ok = extended(length, b); !ok {
+			return nil, ErrMalformed
+		}
+		if len(b) < length {
+			return nil, ErrMalformed
+		}
+		number += delta
+		m.Options = append(m.Options, Option{number, append([]byte(nil), b[:length]...)})
+		b = b[length:]
+	}
+	return m, nil
+}
+
+// extended decodes an extended option delta or length.
+func extended(v int, b []byte) (int, []byte, bool) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, false
+		}
+		return int(b[0]) + 13, b[1:], true
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, false
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], true
+	case 15:
+		return 0, nil, false
+	default:
+		return v, b, true
+	}
+}
+
+// Encode encodes the message into a datagram.
+func (m *Message) Encode() []byte {
+	buf := make([]byte, 4, 4+len(m.Token)+len(m.Payload)+32)
+	buf[0] = 1<<6 | m.Type<<4 | byte(len(m.Token))
+	buf[1] = byte(m.Code)
+	binary.BigEndian.PutUint16(buf[2:], m.MessageID)
+	buf = append(buf, m.Token...)
+
+	options := append([]Option(nil), m.Options...)
+	sort.SliceStable(options, func(i, j int) bool {
+		return options[i].Number < options[j].Number
+	})
+
+	number := 0
+	for _, opt := range options {
+		delta, dext := nibble(opt.Number - number)
+		length, lext := nibble(len(opt.Value))
+		buf = append(buf, byte(delta<<4|length))
+		buf = append(buf, dext...)
+		buf = append(buf, lext...)
+		buf = append(buf, opt.Value...)
+		number = opt.Number
+	}
+
+	if len(m.Payload) != 0 {
+		buf = append(buf, payloadMarker)
+		buf = append(buf, m.Payload...)
+	}
+	return buf
+}
+
+// nibble encodes an option delta or length to the 4-bit value and extended
+// bytes.
+func nibble(v int) (int, []byte) {
+	switch {
+	case v < 13:
+		return v, nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(v-269))
+		return 14, ext
+	}
+}
+
+// Option returns the first value of an option.
+func (m *Message) Option(number int) ([]byte, bool) {
+	for _, opt := range m.Options {
+		if opt.Number == number {
+			return opt.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Uint returns the first value of a uint option.
+func (m *Message) Uint(number int) (uint32, bool) {
+	v, ok := m.Option(number)
+	if !ok || len(v) > 4 {
+		return 0, false
+	}
+	var n uint32
+	for _, b := range v {
+		n = n<<8 | uint32(b)
+	}
+	return n, true
+}
+
+// Strings returns all values of a repeatable string option.
+func (m *Message) Strings(number int) []string {
+	var values []string
+	for _, opt := range m.Options {
+		if opt.Number == number {
+			values = append(values, string(opt.Value))
+		}
+	}
+	return values
+}
+
+// Path returns the request path from the Uri-Path options.
+func (m *Message) Path() string {
+	return strings.Join(m.Strings(URIPath), "/")
+}
+
+// SetPath replaces the Uri-Path options with the segments of the path.
+func (m *Message) SetPath(path string) {
+	m.Remove(URIPath)
+	for _, seg := range strings.Split(strings.Trim(path, "/"), "/") {
+		if seg != "" {
+			m.Add(URIPath, []byte(seg))
+		}
+	}
+}
+
+// Add appends an option value.
+func (m *Message) Add(number int, value []byte) {
+	m.Options = append(m.Options, Option{number, value})
+}
+
+// SetUint replaces an option with a uint value.
+func (m *Message) SetUint(number int, v uint32) {
+	m.Remove(number)
+	m.Add(number, encodeUint(v))
+}
+
+// Remove removes all values of an option.
+func (m *Message) Remove(number int) {
+	options := m.Options[:0]
+	for _, opt := range m.Options {
+		if opt.Number != number {
+			options = append(options, opt)
+		}
+	}
+	m.Options = options
+}
+
+// unknownCritical returns the first critical option not recognized by the
+// server, or zero if all critical options are recognized.
+func (m *Message) unknownCritical() int {
+	for _, opt := range m.Options {
+		if critical(opt.Number) && !knownOptions[opt.Number] {
+			return opt.Number
+		}
+	}
+	return 0
+}
+
+func encodeUint(v uint32) []byte {
+	switch {
+	case v == 0:
+		return nil
+	case v < 1<<8:
+		return []byte{byte(v)}
+	case v < 1<<16:
+		return []byte{byte(v >> 8), byte(v)}
+	case v < 1<<24:
+		return []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+	default:
+		return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+}
+
+// Block is the value of a Block1 or Block2 option.
+type Block struct {
+	Num  uint32
+	More bool
+	Size int // block size, a power of two between 16 and 1024
+}
+
+// ParseBlock decodes the value of a block option.
+func ParseBlock(v uint32) Block {
+	return Block{
+		Num:  v >> 4,
+		More: v&8 != 0,
+		Size: 1 << (v&7 + 4),
+	}
+}
+
+// Value encodes the block option.
+func (b Block) Value() uint32 {
+	szx := uint32(0)
+	for 1<<(szx+4) < b.Size && szx < 6 {
+		szx++
+	}
+	v := b.Num<<4 | szx
+	if b.More {
+		v |= 8
+	}
+	return v
+}
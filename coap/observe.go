@@ -0,0 +1,224 @@
+package coap
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// resource is an observable resource. Observers are notified of messages
+// published on the topic filter.
+type resource struct {
+	filter string // topic filter, %s is replaced by the device token
+	get    bool   // the current state is read from API server
+	reply  bool   // notifications are requests the device replies to
+}
+
+var observable = map[string]resource{
+	"me/attributes":  {filter: "%s/me/attributes", get: true},
+	"me/rpc/request": {filter: "%s/me/rpc/request/+", reply: true},
+}
+
+// observer is a client observing a resource, identified by the client
+// address and the token of the observe request.
+type observer struct {
+	key   string
+	topic string
+	addr  net.Addr
+	token []byte
+	res   resource
+	seq   uint32
+}
+
+// observation holds observers of the same topic filter, which is
+// subscribed once for all observers.
+type observation struct {
+	observers map[string]*observer
+}
+
+func observerKey(addr net.Addr, token []byte) string {
+	return addr.String() + "|" + string(token)
+}
+
+// observe registers or deregisters an observer of the resource, and
+// returns the current state of the resource.
+func (s *Server) observe(m *Message, addr net.Addr, version, token, path string, res resource, obs uint32) *Message {
+	topic := fmt.Sprintf(res.filter, token)
+	key := observerKey(addr, m.Token)
+
+	if obs != 0 {
+		s.deregister(topic, key)
+	}
+
+	var resp *Message
+	if res.get {
+		resp = s.forward(m, version, token, path)
+		if resp.Code.Class() != 2 {
+			return resp
+		}
+	} else {
+		if s.verify != nil && !s.verify(token) {
+			return errorResponse(Unauthorized, "Unauthorized")
+		}
+		resp = &Message{Code: Content}
+	}
+	if obs != 0 {
+		return resp
+	}
+
+	o := &observer{key: key, topic: topic, addr: addr, token: m.Token, res: res, seq: 1}
+	if err := s.register(o); err != nil {
+		return errorResponse(ServiceUnavailable, err.Error())
+	}
+	resp.SetUint(Observe, o.seq)
+	return resp
+}
+
+// register adds an observer, and subscribes to the topic for the first
+// observer of the topic.
+func (s *Server) register(o *observer) error {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	obsn, ok := s.observations[o.topic]
+	if !ok {
+		obsn = &observation{observers: make(map[string]*observer)}
+		s.observations[o.topic] = obsn
+	}
+	obsn.observers[o.key] = o
+	s.mu.Unlock()
+
+	if !ok {
+		topic := o.topic
+		err := s.broker.Subscribe(topic, func(name string, payload []byte) {
+			s.notify(topic, name, payload)
+		})
+		if err != nil {
+			s.mu.Lock()
+			delete(s.observations, topic)
+			s.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// deregister removes an observer, and unsubscribes from the topic after
+// the last observer of the topic is removed.
+func (s *Server) deregister(topic, key string) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	s.mu.Lock()
+	obsn, ok := s.observations[topic]
+	if ok {
+		delete(obsn.observers, key)
+		if len(obsn.observers) != 0 {
+			ok = false
+		} else {
+			delete(s.observations, topic)
+		}
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.broker.Unsubscribe(topic)
+	}
+}
+
+// cancel removes an observer that no longer receives notifications.
+func (s *Server) cancel(o *observer) {
+	s.mu.Lock()
+	current := false
+	if obsn, ok := s.observations[o.topic]; ok {
+		current = obsn.observers[o.key] == o
+	}
+	s.mu.Unlock()
+
+	if current {
+		s.deregister(o.topic, o.key)
+	}
+}
+
+// notify sends a message published on the topic to observers of the topic.
+func (s *Server) notify(topic, name string, payload []byte) {
+	s.mu.Lock()
+	var observers []*observer
+	if obsn, ok := s.observations[topic]; ok {
+		for _, o := range obsn.observers {
+			observers = append(observers, o)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, o := range observers {
+		m := &Message{
+			Type:      Confirmable,
+			Code:      Content,
+			MessageID: s.nextMessageID(),
+			Token:     o.token,
+			Payload:   payload,
+		}
+
+		s.mu.Lock()
+		o.seq = (o.seq + 1) & 0xffffff
+		m.SetUint(Observe, o.seq)
+		s.mu.Unlock()
+
+		m.SetUint(ContentFormat, JSON)
+		if o.res.reply {
+			id := name[strings.LastIndexByte(name, '/')+1:]
+			for _, seg := range []string{"me", "rpc", "response", id} {
+				m.Add(LocationPath, []byte(seg))
+			}
+		}
+		s.sendConfirmable(m, o)
+	}
+}
+
+// sendConfirmable sends a confirmable notification, which is retransmitted
+// until acknowledged. The observer is removed if the notification is
+// never acknowledged.
+func (s *Server) sendConfirmable(m *Message, o *observer) {
+	key := exchangeKey{o.addr.String(), m.MessageID}
+	p := &pending{data: m.Encode(), addr: o.addr, observer: o}
+	timeout := time.Duration(float64(ackTimeout) * (1 + rand.Float64()*(ackRandomFactor-1)))
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.pending[key] = p
+	p.timer = time.AfterFunc(timeout, func() { s.retransmit(key, timeout*2) })
+	s.mu.Unlock()
+
+	s.sendData(p.data, p.addr)
+}
+
+func (s *Server) retransmit(key exchangeKey, timeout time.Duration) {
+	s.mu.Lock()
+	p, ok := s.pending[key]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	if p.retries >= maxRetransmit {
+		delete(s.pending, key)
+		s.mu.Unlock()
+		s.cancel(p.observer)
+		return
+	}
+	p.retries++
+	p.timer = time.AfterFunc(timeout, func() { s.retransmit(key, timeout*2) })
+	s.mu.Unlock()
+
+	s.sendData(p.data, p.addr)
+}
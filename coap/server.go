@@ -0,0 +1,624 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhill42/iota/api/server/httputils"
+	"github.com/redhill42/iota/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Broker publishes and subscribes messages on behalf of CoAP clients. It's
+// implemented by mqtt.Broker.
+type Broker interface {
+	Publish(topic string, payload interface{}) error
+	Subscribe(topic string, callback func(string, []byte)) error
+	Unsubscribe(topic string)
+}
+
+// ErrServerClosed is returned by Serve after the server has been closed.
+var ErrServerClosed = errors.New("coap: server closed")
+
+// Transmission parameters, see RFC 7252 section 4.8.
+const (
+	ackTimeout       = 2 * time.Second
+	ackRandomFactor  = 1.5
+	maxRetransmit    = 4
+	exchangeLifetime = 247 * time.Second
+)
+
+// Server serves CoAP requests with the API server. The request URI has the
+// same form as the MQTT api topic:
+//
+//	coap://host/api/<ver>/<token>/<path>
+//
+// which is served by the API server as "/api/<ver>/<path>" authorized by
+// the device token. For example, a device can read its attributes with
+// "GET coap://host/api/v1/XXX/me/attributes".
+//
+// Devices can observe the following resources to be notified of messages
+// sent to the device:
+//
+//	api/<ver>/<token>/me/attributes   attribute updates
+//	api/<ver>/<token>/me/rpc/request  RPC requests
+//
+// Notifications of RPC requests carry the path of the response in the
+// Location-Path option, "me/rpc/response/<id>", to which the device posts
+// the response, i.e. "POST coap://host/api/v1/XXX/me/rpc/response/<id>".
+//
+// Responses larger than the block size are transferred block by block with
+// the Block2 option, which is used to download firmware images. DTLS is
+// not supported, deployments that require encryption should terminate DTLS
+// in front of the server.
+//
+// Requests are processed by a bounded pool of workers. Requests are
+// rejected with 5.03 Service Unavailable if the queue is full or the client
+// has too many requests in progress, and the client may retransmit them.
+type Server struct {
+	mux       http.Handler
+	broker    Broker
+	verify    func(token string) bool
+	blockSize int
+	queue     chan *request
+	peerLimit int
+
+	subMu        sync.Mutex // serializes subscriptions of observed topics
+	mu           sync.Mutex
+	conn         net.PacketConn
+	closed       bool
+	done         chan struct{}
+	messageID    uint16
+	exchanges    map[exchangeKey]*exchange
+	active       map[string]int // requests in progress of each client
+	pending      map[exchangeKey]*pending
+	observations map[string]*observation
+}
+
+type exchangeKey struct {
+	addr string
+	id   uint16
+}
+
+// exchange is a request received recently, which is kept to detect
+// duplicate requests and to retransmit the response.
+type exchange struct {
+	response []byte // nil while the request is being processed
+	expires  time.Time
+}
+
+// request is a request waiting for a worker.
+type request struct {
+	m    *Message
+	addr net.Addr
+	ex   *exchange
+}
+
+// pending is a confirmable notification waiting for acknowledgement.
+type pending struct {
+	data     []byte
+	addr     net.Addr
+	retries  int
+	timer    *time.Timer
+	observer *observer
+}
+
+// NewServer creates a CoAP server that serves requests with the API
+// server mux. Devices are notified of messages received from the broker.
+// The verify function checks device tokens of observations that are not
+// authorized by the API server. The block size of block-wise transfer is
+// configured by the "coap.blockSize" option, and the workers by the
+// "coap.workers", "coap.queueSize" and "coap.maxPeerRequests" options.
+func NewServer(mux http.Handler, broker Broker, verify func(token string) bool) *Server {
+	blockSize, err := strconv.Atoi(config.GetOrDefault("coap.blockSize", "1024"))
+	if err != nil || blockSize < 16 || blockSize > 1024 || blockSize&(blockSize-1) != 0 {
+		logrus.Warnf("coap: Invalid block size: %s", config.Get("coap.blockSize"))
+		blockSize = 1024
+	}
+
+	s := &Server{
+		mux:          mux,
+		broker:       broker,
+		verify:       verify,
+		blockSize:    blockSize,
+		queue:        make(chan *request, positiveOption("coap.queueSize", 1000)),
+		peerLimit:    positiveOption("coap.maxPeerRequests", 16),
+		done:         make(chan struct{}),
+		messageID:    uint16(rand.Uint32()),
+		exchanges:    make(map[exchangeKey]*exchange),
+		active:       make(map[string]int),
+		pending:      make(map[exchangeKey]*pending),
+		observations: make(map[string]*observation),
+	}
+	for i := positiveOption("coap.workers", 16); i > 0; i-- {
+		go s.work()
+	}
+	return s
+}
+
+func positiveOption(key string, def int) int {
+	v, err := strconv.Atoi(config.GetOrDefault(key, strconv.Itoa(def)))
+	if err != nil || v <= 0 {
+		logrus.Warnf("coap: Invalid %s: %s", key, config.Get(key))
+		v = def
+	}
+	return v
+}
+
+// ListenAndServe listens on the UDP network address and serves CoAP
+// requests.
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Serve serves CoAP requests received on the connection. It always
+// returns a non-nil error, ErrServerClosed after the server is closed.
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	logrus.Infof("CoAP server listen on %s", conn.LocalAddr())
+	go s.expireExchanges()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return ErrServerClosed
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		m, err := Parse(buf[:n])
+		if err != nil {
+			// Reject malformed confirmable messages, see RFC 7252 section 4.2
+			if err == ErrMalformed && n >= 4 && buf[0]>>4&3 == Confirmable {
+				s.send(&Message{Type: Reset, MessageID: uint16(buf[2])<<8 | uint16(buf[3])}, addr)
+			}
+			continue
+		}
+		s.receive(m, addr)
+	}
+}
+
+// Close stops the server and cancels all observations.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	conn := s.conn
+	observations := s.observations
+	s.observations = make(map[string]*observation)
+	for key, p := range s.pending {
+		p.timer.Stop()
+		delete(s.pending, key)
+	}
+	s.mu.Unlock()
+
+	for topic := range observations {
+		s.broker.Unsubscribe(topic)
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// expireExchanges removes expired exchanges periodically.
+func (s *Server) expireExchanges() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, ex := range s.exchanges {
+				if now.After(ex.expires) {
+					delete(s.exchanges, key)
+				}
+			}
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Server) send(m *Message, addr net.Addr) {
+	s.sendData(m.Encode(), addr)
+}
+
+func (s *Server) sendData(data []byte, addr net.Addr) {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn != nil {
+		if _, err := conn.WriteTo(data, addr); err != nil {
+			logrus.WithError(err).Debugf("coap: Failed to send message to %s", addr)
+		}
+	}
+}
+
+func (s *Server) nextMessageID() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messageID++
+	return s.messageID
+}
+
+// receive processes a message received from a client.
+func (s *Server) receive(m *Message, addr net.Addr) {
+	switch m.Type {
+	case Acknowledgement, Reset:
+		s.acknowledge(m, addr)
+		return
+	}
+
+	// Empty confirmable message is a ping
+	if m.Code == Empty {
+		if m.Type == Confirmable {
+			s.send(&Message{Type: Reset, MessageID: m.MessageID}, addr)
+		}
+		return
+	}
+
+	// Only requests are accepted from clients
+	if m.Code.Class() != 0 {
+		if m.Type == Confirmable {
+			s.send(&Message{Type: Reset, MessageID: m.MessageID}, addr)
+		}
+		return
+	}
+
+	// Detect duplicate requests, the response is sent again if available
+	peer := addr.String()
+	key := exchangeKey{peer, m.MessageID}
+	s.mu.Lock()
+	if ex, ok := s.exchanges[key]; ok {
+		s.mu.Unlock()
+		if ex.response != nil {
+			s.sendData(ex.response, addr)
+		}
+		return
+	}
+
+	// A client can't occupy all workers with requests in progress
+	if s.active[peer] >= s.peerLimit {
+		s.mu.Unlock()
+		logrus.Debugf("coap: Too many requests in progress from %s", peer)
+		s.reply(m, addr, errorResponse(ServiceUnavailable, "Too many requests"))
+		return
+	}
+	ex := &exchange{expires: time.Now().Add(exchangeLifetime)}
+	s.exchanges[key] = ex
+	s.active[peer]++
+	s.mu.Unlock()
+
+	select {
+	case s.queue <- &request{m, addr, ex}:
+	default:
+		logrus.Warnf("coap: Queue is full, rejecting request from %s", peer)
+		s.mu.Lock()
+		delete(s.exchanges, key)
+		s.finish(peer)
+		s.mu.Unlock()
+		s.reply(m, addr, errorResponse(ServiceUnavailable, "Server is busy"))
+	}
+}
+
+// work processes queued requests until the server is closed.
+func (s *Server) work() {
+	for {
+		select {
+		case req := <-s.queue:
+			data := s.reply(req.m, req.addr, s.serve(req.m, req.addr))
+			s.mu.Lock()
+			req.ex.response = data
+			s.finish(req.addr.String())
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// finish ends a request in progress of the client, must be called with
+// the lock held.
+func (s *Server) finish(peer string) {
+	if s.active[peer]--; s.active[peer] <= 0 {
+		delete(s.active, peer)
+	}
+}
+
+// reply sends the response of the request and returns the encoded
+// response.
+func (s *Server) reply(m *Message, addr net.Addr, resp *Message) []byte {
+	resp.Token = m.Token
+	if m.Type == Confirmable {
+		resp.Type, resp.MessageID = Acknowledgement, m.MessageID
+	} else {
+		resp.Type, resp.MessageID = NonConfirmable, s.nextMessageID()
+	}
+
+	data := resp.Encode()
+	s.sendData(data, addr)
+	return data
+}
+
+// acknowledge processes acknowledgement or reset of a notification.
+func (s *Server) acknowledge(m *Message, addr net.Addr) {
+	key := exchangeKey{addr.String(), m.MessageID}
+	s.mu.Lock()
+	p, ok := s.pending[key]
+	if ok {
+		delete(s.pending, key)
+		p.timer.Stop()
+	}
+	s.mu.Unlock()
+
+	// The client is no longer interested in the observed resource
+	if ok && m.Type == Reset && p.observer != nil {
+		s.cancel(p.observer)
+	}
+}
+
+// serve processes a request and returns the response.
+func (s *Server) serve(m *Message, addr net.Addr) *Message {
+	if opt := m.unknownCritical(); opt != 0 {
+		return errorResponse(BadOption, "Unrecognized option: "+strconv.Itoa(opt))
+	}
+	if b, ok := m.Uint(Block1); ok && (b != 0 || len(m.Payload) > s.blockSize) {
+		return errorResponse(NotImplemented, "Block-wise request is not supported")
+	}
+
+	sp := strings.Split(m.Path(), "/")
+	if len(sp) < 4 || sp[0] != "api" || sp[2] == "" {
+		return errorResponse(NotFound, "Not found")
+	}
+	version, token, path := sp[1], sp[2], strings.Join(sp[3:], "/")
+
+	// Responses of RPC calls are forwarded to the API server that made
+	// the call
+	if m.Code == POST && strings.HasPrefix(path, "me/rpc/response/") && len(sp) == 7 {
+		if s.verify != nil && !s.verify(token) {
+			return errorResponse(Unauthorized, "Unauthorized")
+		}
+		if err := s.broker.Publish(token+"/"+path, m.Payload); err != nil {
+			return errorResponse(ServiceUnavailable, err.Error())
+		}
+		return &Message{Code: Changed}
+	}
+
+	if obs, ok := m.Uint(Observe); ok && m.Code == GET {
+		if res, ok := observable[path]; ok {
+			return s.observe(m, addr, version, token, path, res, obs)
+		}
+	}
+	return s.forward(m, version, token, path)
+}
+
+// forward serves a request with the API server.
+func (s *Server) forward(m *Message, version, token, path string) *Message {
+	var method string
+	switch m.Code {
+	case GET:
+		method = "GET"
+	case POST:
+		method = "POST"
+	case PUT:
+		method = "PUT"
+	case DELETE:
+		method = "DELETE"
+	default:
+		return errorResponse(MethodNotAllowed, "Method not allowed")
+	}
+
+	// Create fake HTTP request
+	apiPath := "/api/" + version + "/" + path
+	if query := m.Strings(URIQuery); len(query) != 0 {
+		apiPath += "?" + strings.Join(query, "&")
+	}
+	var body *bytes.Reader
+	if method == "POST" || method == "PUT" {
+		body = bytes.NewReader(m.Payload)
+	}
+	var r *http.Request
+	var err error
+	if body != nil {
+		r, err = http.NewRequest(method, apiPath, body)
+	} else {
+		r, err = http.NewRequest(method, apiPath, nil)
+	}
+	if err != nil {
+		return errorResponse(BadRequest, err.Error())
+	}
+
+	r.Header.Set("Authorization", "bearer "+token)
+	if f, ok := m.Uint(ContentFormat); ok {
+		mediaType, ok := MediaType(int(f))
+		if !ok {
+			return errorResponse(UnsupportedContentFormat, "Unsupported content format")
+		}
+		r.Header.Set("Content-Type", mediaType)
+	} else if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if f, ok := m.Uint(Accept); ok {
+		if mediaType, ok := MediaType(int(f)); ok {
+			r.Header.Set("Accept", mediaType)
+		}
+	}
+
+	// Route to API server
+	r = r.WithContext(context.WithValue(r.Context(), httputils.ForwardedKey, true))
+	w := responseWriter{header: make(http.Header)}
+	s.mux.ServeHTTP(&w, r)
+
+	resp := &Message{Code: responseCode(m.Code, w.status)}
+	if f, ok := FormatOf(w.header.Get("Content-Type")); ok && w.body.Len() != 0 {
+		resp.SetUint(ContentFormat, uint32(f))
+	}
+	if m.Code == GET {
+		return s.block(m, resp, w.body.Bytes())
+	}
+	resp.Payload = w.body.Bytes()
+	return resp
+}
+
+// block returns the requested block of a response payload if the payload
+// is larger than the block size. The requested block is given by the
+// Block2 option of the request, or the first block if the option is not
+// given. The ETag option is set so that the client can detect changes of
+// the payload between the requests of blocks.
+func (s *Server) block(req, resp *Message, payload []byte) *Message {
+	size := s.blockSize
+	var num uint32
+	if v, ok := req.Uint(Block2); ok {
+		b := ParseBlock(v)
+		if b.Size > 1024 {
+			return errorResponse(BadOption, "Invalid block size")
+		}
+		if b.Size < size {
+			size = b.Size
+		}
+		num = b.Num
+	} else if len(payload) <= size {
+		resp.Payload = payload
+		return resp
+	}
+
+	offset := int(num) * size
+	if offset > len(payload) || (offset == len(payload) && offset != 0) {
+		return errorResponse(BadOption, "Block out of range")
+	}
+	end := offset + size
+	if end > len(payload) {
+		end = len(payload)
+	}
+
+	if resp.Code.Class() == 2 {
+		h := fnv.New64a()
+		h.Write(payload)
+		resp.Add(ETag, h.Sum(nil))
+	}
+	resp.SetUint(Block2, Block{Num: num, More: end < len(payload), Size: size}.Value())
+	if num == 0 {
+		resp.SetUint(Size2, uint32(len(payload)))
+	}
+	resp.Payload = payload[offset:end]
+	return resp
+}
+
+func errorResponse(code Code, message string) *Message {
+	m := &Message{Code: code, Payload: []byte(message)}
+	m.SetUint(ContentFormat, TextPlain)
+	return m
+}
+
+// responseCode maps the HTTP status code to CoAP response code.
+func responseCode(method Code, status int) Code {
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	switch status {
+	case http.StatusCreated:
+		return Created
+	case http.StatusNotModified:
+		return Valid
+	case http.StatusBadRequest:
+		return BadRequest
+	case http.StatusUnauthorized:
+		return Unauthorized
+	case http.StatusForbidden:
+		return Forbidden
+	case http.StatusNotFound:
+		return NotFound
+	case http.StatusMethodNotAllowed:
+		return MethodNotAllowed
+	case http.StatusNotAcceptable:
+		return NotAcceptable
+	case http.StatusPreconditionFailed:
+		return PreconditionFailed
+	case http.StatusRequestEntityTooLarge:
+		return RequestEntityTooLarge
+	case http.StatusUnsupportedMediaType:
+		return UnsupportedContentFormat
+	case http.StatusNotImplemented:
+		return NotImplemented
+	case http.StatusBadGateway:
+		return BadGateway
+	case http.StatusServiceUnavailable:
+		return ServiceUnavailable
+	case http.StatusGatewayTimeout:
+		return GatewayTimeout
+	}
+
+	switch {
+	case status >= 200 && status < 300:
+		switch method {
+		case GET:
+			return Content
+		case DELETE:
+			return Deleted
+		default:
+			return Changed
+		}
+	case status >= 400 && status < 500:
+		return BadRequest
+	default:
+		return InternalServerError
+	}
+}
+
+// responseWriter records the response of the API server.
+type responseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
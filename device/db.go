@@ -1,7 +1,6 @@
 package device
 
 import (
-	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"gopkg.in/mgo.v2"
@@ -14,7 +13,8 @@ import (
 
 type deviceDB struct {
 	session *mgo.Session
-	cache   sync.Map
+	cache   sync.Map // cached tokens by device id
+	tenants sync.Map // cached tenants by device id
 }
 
 type selector bson.M
@@ -28,6 +28,8 @@ func newSelector(keys []string) selector {
 				key = "_id"
 			} else if key == "token" {
 				key = "_token"
+			} else if key == "tenant" {
+				key = "_tenant"
 			}
 			sel[key] = 1
 		}
@@ -57,6 +59,29 @@ func (r Record) afterLoad(sel selector) {
 		delete(r, "_token")
 		r["token"] = tok
 	}
+	if tenant, ok := r["_tenant"]; ok {
+		delete(r, "_tenant")
+		r["tenant"] = tenant
+	}
+}
+
+// tenantQuery selects records of a tenant, or all records if the tenant
+// is empty.
+func tenantQuery(tenant string) bson.M {
+	if tenant == "" {
+		return nil
+	}
+	return bson.M{"_tenant": tenant}
+}
+
+// moveTenant moves the "tenant" attribute to the protected "_tenant" field.
+func moveTenant(r Record) {
+	tenant, _ := r["tenant"].(string)
+	delete(r, "tenant")
+	delete(r, "_tenant")
+	if tenant != "" {
+		r["_tenant"] = tenant
+	}
 }
 
 func (r Record) GetID() string {
@@ -81,8 +106,12 @@ func openDatabase() (*deviceDB, error) {
 }
 
 func (db *deviceDB) do(f func(c *mgo.Collection) error) error {
+	return db.doC("devices", f)
+}
+
+func (db *deviceDB) doC(name string, f func(c *mgo.Collection) error) error {
 	session := db.session.Copy()
-	err := f(session.DB("").C("devices"))
+	err := f(session.DB("").C(name))
 	session.Close()
 	return err
 }
@@ -96,6 +125,7 @@ func (db *deviceDB) Create(id, token string, attributes Record) error {
 	}
 	delete(attributes, "id")
 	delete(attributes, "token")
+	moveTenant(attributes)
 	attributes["_id"] = id
 	attributes["_token"] = token
 
@@ -126,17 +156,19 @@ func (db *deviceDB) Find(id string, keys []string) (result Record, err error) {
 	return
 }
 
-func (db *deviceDB) FindAll(keys []string) (result []Record, err error) {
+// FindAll returns all devices of the tenant, or all devices if the tenant
+// is empty.
+func (db *deviceDB) FindAll(tenant string, keys []string) (result []Record, err error) {
 	err = db.do(func(c *mgo.Collection) error {
 		var iter *mgo.Iter
 		var sel selector
 		var record Record
 
 		if len(keys) == 0 {
-			iter = c.Find(nil).Iter()
+			iter = c.Find(tenantQuery(tenant)).Iter()
 		} else {
 			sel = newSelector(keys)
-			iter = c.Find(nil).Select(sel).Iter()
+			iter = c.Find(tenantQuery(tenant)).Select(sel).Iter()
 		}
 		for iter.Next(&record) {
 			record.afterLoad(sel)
@@ -169,11 +201,53 @@ func (db *deviceDB) GetToken(id string) (string, error) {
 	return v.Token, err
 }
 
+// GetTenant returns the tenant of the device, which is empty if the device
+// doesn't belong to a tenant.
+func (db *deviceDB) GetTenant(id string) (string, error) {
+	if tenant, ok := db.tenants.Load(id); ok {
+		return tenant.(string), nil
+	}
+
+	var v struct {
+		Tenant string `bson:"_tenant"`
+	}
+	err := db.do(func(c *mgo.Collection) error {
+		err := c.FindId(id).Select(bson.M{"_tenant": 1}).One(&v)
+		if err == mgo.ErrNotFound {
+			err = DeviceNotFoundError(id)
+		}
+		return err
+	})
+	if err == nil {
+		db.tenants.Store(id, v.Tenant)
+	}
+	return v.Tenant, err
+}
+
+// SetTenant moves the device to the tenant, or removes the device from its
+// tenant if the tenant is empty.
+func (db *deviceDB) SetTenant(id, tenant string) error {
+	update := bson.M{"$set": bson.M{"_tenant": tenant}}
+	if tenant == "" {
+		update = bson.M{"$unset": bson.M{"_tenant": 1}}
+	}
+	return db.do(func(c *mgo.Collection) error {
+		db.tenants.Delete(id)
+		err := c.UpdateId(id, update)
+		if err == mgo.ErrNotFound {
+			err = DeviceNotFoundError(id)
+		}
+		return err
+	})
+}
+
 func (db *deviceDB) Update(id string, fields Record) error {
 	delete(fields, "_id")
 	delete(fields, "id")
 	delete(fields, "_token")
 	delete(fields, "token")
+	delete(fields, "_tenant")
+	delete(fields, "tenant")
 	if len(fields) == 0 {
 		return nil
 	}
@@ -211,9 +285,12 @@ func (db *deviceDB) Upsert(id, token string, fields Record) error {
 	delete(fields, "id")
 	delete(fields, "_id")
 	delete(fields, "token")
+	moveTenant(fields)
 	fields["_token"] = token
 
 	return db.do(func(c *mgo.Collection) error {
+		db.cache.Delete(id)
+		db.tenants.Delete(id)
 		_, err := c.UpsertId(id, bson.M{"$set": fields})
 		return err
 	})
@@ -222,6 +299,7 @@ func (db *deviceDB) Upsert(id, token string, fields Record) error {
 func (db *deviceDB) Remove(id string) error {
 	return db.do(func(c *mgo.Collection) error {
 		db.cache.Delete(id)
+		db.tenants.Delete(id)
 		err := c.RemoveId(id)
 		if err == mgo.ErrNotFound {
 			err = DeviceNotFoundError(id)
@@ -230,7 +308,68 @@ func (db *deviceDB) Remove(id string) error {
 	})
 }
 
-func (db *deviceDB) getSecret(key string) ([]byte, error) {
+// Pending device claims are stored in the database so that they can be
+// approved or rejected on any API server. Claims never carry the "tenant"
+// attribute, they are visible to system users only until approved.
+
+func (db *deviceDB) addClaim(claimId string, attributes Record) error {
+	claim := make(Record, len(attributes)+1)
+	for k, v := range attributes {
+		claim[k] = v
+	}
+	claim["_id"] = claimId
+
+	return db.doC("claims", func(c *mgo.Collection) error {
+		err := c.Insert(claim)
+		if mgo.IsDup(err) {
+			err = DuplicateClaimError(claimId)
+		}
+		return err
+	})
+}
+
+func (db *deviceDB) findClaims(tenant string) (result []Record, err error) {
+	var query bson.M
+	if tenant != "" {
+		query = bson.M{"tenant": tenant}
+	}
+
+	result = make([]Record, 0)
+	err = db.doC("claims", func(c *mgo.Collection) error {
+		var claim Record
+		iter := c.Find(query).Iter()
+		for iter.Next(&claim) {
+			delete(claim, "_id")
+			result = append(result, claim)
+			claim = nil
+		}
+		return iter.Close()
+	})
+	return
+}
+
+// removeClaim removes a pending claim of the tenant, or a claim of any
+// tenant if the tenant is empty.
+func (db *deviceDB) removeClaim(tenant, claimId string) (claim Record, err error) {
+	query := bson.M{"_id": claimId}
+	if tenant != "" {
+		query["tenant"] = tenant
+	}
+
+	err = db.doC("claims", func(c *mgo.Collection) error {
+		_, err := c.Find(query).Apply(mgo.Change{Remove: true}, &claim)
+		if err == mgo.ErrNotFound {
+			err = ClaimNotFoundError(claimId)
+		}
+		return err
+	})
+	delete(claim, "_id")
+	return
+}
+
+// getSecret returns a secret key, the key is generated and saved if it
+// does not exist.
+func (db *deviceDB) getSecret(key string, gen func() ([]byte, error)) ([]byte, error) {
 	session := db.session.Copy()
 	c := session.DB("").C("secret")
 	defer session.Close()
@@ -242,14 +381,37 @@ func (db *deviceDB) getSecret(key string) ([]byte, error) {
 
 	err := c.FindId(key).One(&record)
 	if err == mgo.ErrNotFound {
-		record.Key = key
-		record.Secret = make([]byte, 64)
-		rand.Read(record.Secret)
-		err = c.Insert(&record)
+		if record.Secret, err = gen(); err == nil {
+			record.Key = key
+			err = c.Insert(&record)
+		}
 	}
 	return record.Secret, err
 }
 
+// setSecret replaces a secret key.
+func (db *deviceDB) setSecret(key string, secret []byte) error {
+	session := db.session.Copy()
+	c := session.DB("").C("secret")
+	defer session.Close()
+
+	_, err := c.UpsertId(key, bson.M{"$set": bson.M{"secret": secret}})
+	return err
+}
+
+// secretStore stores key sets in the device database.
+type secretStore struct {
+	db *deviceDB
+}
+
+func (s secretStore) GetSecret(key string, gen func() ([]byte, error)) ([]byte, error) {
+	return s.db.getSecret(key, gen)
+}
+
+func (s secretStore) SetSecret(key string, secret []byte) error {
+	return s.db.setSecret(key, secret)
+}
+
 func (db *deviceDB) Close() {
 	db.session.Close()
 }
@@ -5,16 +5,18 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/dgrijalva/jwt-go/request"
 	"github.com/redhill42/iota/api/server/httputils"
 	"github.com/redhill42/iota/api/types"
+	"github.com/redhill42/iota/auth/jwks"
 	"github.com/redhill42/iota/config"
 	"github.com/redhill42/iota/mqtt"
 	"github.com/sirupsen/logrus"
@@ -22,15 +24,27 @@ import (
 
 type UpdateCallback func(updates Record)
 
+// AttributeFunc computes the values of a read-only device attribute for
+// devices given by their ids and tenants, so that the attribute of a page
+// of devices is computed at once. The attribute is omitted from devices
+// without value in the result.
+type AttributeFunc func(devices map[string]string) (map[string]interface{}, error)
+
 type Manager struct {
 	*deviceDB
 	broker          *mqtt.Broker
-	secret          []byte
+	keys            *jwks.KeySet
 	updateCallbacks []UpdateCallback
-	claims          *sync.Map
+	tokenCallbacks  []func(id string)
+	attributes      map[string]AttributeFunc
 	autoapprove     bool
 	rpcTimeout      time.Duration
-	rpcRequestId    int64
+	rpcCalls        *rpcCalls
+	rpcMu           sync.Mutex
+	rpcSubscribed   bool
+	mailboxes       map[string]*mailbox
+	pollMu          sync.Mutex
+	pollSubMu       sync.Mutex // serializes subscriptions of mailboxes
 }
 
 func NewManager(broker *mqtt.Broker) (*Manager, error) {
@@ -39,54 +53,358 @@ func NewManager(broker *mqtt.Broker) (*Manager, error) {
 		return nil, err
 	}
 
-	secret, err := db.getSecret("device")
+	keys, err := jwks.Open(secretStore{db}, "device.keys", "device")
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	autoapprove, _ := strconv.ParseBool(config.GetOrDefault("device.autoapprove", "false"))
 	rpcTimeout, _ := strconv.ParseInt(config.GetOrDefault("device.rpcTimeout", "5"), 10, 0)
 
-	return &Manager{
-		deviceDB:     db,
-		broker:       broker,
-		secret:       secret,
-		claims:       new(sync.Map),
-		autoapprove:  autoapprove,
-		rpcTimeout:   time.Duration(rpcTimeout) * time.Second,
-		rpcRequestId: time.Now().Unix(),
-	}, nil
+	mgr := &Manager{
+		deviceDB:    db,
+		broker:      broker,
+		keys:        keys,
+		attributes:  make(map[string]AttributeFunc),
+		autoapprove: autoapprove,
+		rpcTimeout:  time.Duration(rpcTimeout) * time.Second,
+		rpcCalls:    newRPCCalls(),
+		mailboxes:   make(map[string]*mailbox),
+	}
+
+	if broker != nil {
+		// Responses of pending RPC calls will never arrive after the
+		// connection is lost, so fail them immediately
+		broker.OnConnectionLost(mgr.rpcCalls.failAll)
+
+		// Receive device updates and token changes from other API servers
+		if err = broker.OnBroadcast(updateEvent, mgr.remoteUpdate); err != nil {
+			return nil, err
+		}
+		if err = broker.OnBroadcast(tokenEvent, mgr.remoteTokenChange); err != nil {
+			return nil, err
+		}
+	}
+	return mgr, nil
+}
+
+// Events broadcast to other API servers of the cluster
+const (
+	updateEvent = "devices"
+	tokenEvent  = "tokens"
+)
+
+// broadcast sends an event to other API servers of the cluster.
+func (mgr *Manager) broadcast(event string, payload interface{}) {
+	if mgr.broker != nil {
+		if err := mgr.broker.Broadcast(event, payload); err != nil {
+			logrus.WithError(err).Errorf("Failed to broadcast %s event", event)
+		}
+	}
+}
+
+// remoteUpdate invokes update callbacks for device updates made by other
+// API servers.
+func (mgr *Manager) remoteUpdate(payload []byte) {
+	var updates Record
+	if err := json.Unmarshal(payload, &updates); err != nil {
+		logrus.WithError(err).Error("Invalid device update event")
+		return
+	}
+	if _, ok := updates["id"].(string); !ok {
+		return
+	}
+	for _, cb := range mgr.updateCallbacks {
+		cb(updates)
+	}
+}
+
+// remoteTokenChange removes the cached token of a device whose token was
+// changed or removed by other API servers.
+func (mgr *Manager) remoteTokenChange(payload []byte) {
+	id := string(payload)
+	mgr.cache.Delete(id)
+	mgr.tenants.Delete(id)
+	mgr.tokenChanged(id)
+}
+
+// tokenChanged invokes token change callbacks.
+func (mgr *Manager) tokenChanged(id string) {
+	for _, cb := range mgr.tokenCallbacks {
+		cb(id)
+	}
 }
 
 // CreateToken create an access token for the device. The access token
 // can be used by device for further operations.
 func (mgr *Manager) CreateToken(id string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{
-		Subject: id,
+	return mgr.keys.Sign(&jwt.StandardClaims{
+		Issuer:   jwks.Issuer,
+		Audience: jwks.DeviceAudience,
+		Subject:  id,
 	})
-	return token.SignedString(mgr.secret)
+}
+
+// tokenClaims are the claims of a device token. Tokens issued by earlier
+// versions have no issuer and audience, they are accepted until replaced
+// since device tokens never expire.
+type tokenClaims struct {
+	jwt.StandardClaims
+}
+
+func (c *tokenClaims) Valid() error {
+	if err := c.StandardClaims.Valid(); err != nil {
+		return err
+	}
+	if c.Issuer == "" && c.Audience == "" {
+		return nil
+	}
+	return jwks.VerifyAudience(&c.StandardClaims, jwks.DeviceAudience)
 }
 
 func (mgr *Manager) Verify(r *http.Request) (string, error) {
-	var claims jwt.StandardClaims
+	var claims tokenClaims
 
 	// Get token from request
 	_, err := request.ParseFromRequest(r, request.AuthorizationHeaderExtractor,
-		func(token *jwt.Token) (interface{}, error) {
-			return mgr.secret, nil
-		}, request.WithClaims(&claims))
+		mgr.keys.Keyfunc, request.WithClaims(&claims))
 	return claims.Subject, err
 }
 
+// Keys returns the key set that signs device tokens.
+func (mgr *Manager) Keys() *jwks.KeySet {
+	return mgr.keys
+}
+
 func (mgr *Manager) VerifyToken(token string) (string, error) {
-	var claims jwt.StandardClaims
-	_, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
-		return mgr.secret, nil
-	})
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(token, &claims, mgr.keys.Keyfunc)
 	return claims.Subject, err
 }
 
+// AddReadOnlyAttribute adds a computed attribute to devices. The attribute
+// value is evaluated each time the device is read, and it cannot be
+// modified by clients.
+func (mgr *Manager) AddReadOnlyAttribute(name string, f AttributeFunc) {
+	mgr.attributes[name] = f
+}
+
+func (mgr *Manager) Create(id, token string, attributes Record) error {
+	mgr.removeReadOnly(attributes)
+	return mgr.deviceDB.Create(id, token, attributes)
+}
+
+func (mgr *Manager) Upsert(id, token string, fields Record) error {
+	mgr.removeReadOnly(fields)
+	err := mgr.deviceDB.Upsert(id, token, fields)
+	if err == nil {
+		mgr.tokenChanged(id)
+		mgr.broadcast(tokenEvent, id)
+	}
+	return err
+}
+
+func (mgr *Manager) Remove(id string) error {
+	err := mgr.deviceDB.Remove(id)
+	if err == nil {
+		mgr.tokenChanged(id)
+		mgr.broadcast(tokenEvent, id)
+	}
+	return err
+}
+
+func (mgr *Manager) Find(id string, keys []string) (Record, error) {
+	result, err := mgr.deviceDB.Find(id, keys)
+	if err != nil {
+		return nil, err
+	}
+	sel := newSelector(keys)
+	if mgr.hasReadOnly(sel) {
+		tenant, err := mgr.GetTenant(id)
+		if err != nil {
+			return nil, err
+		}
+		err = mgr.addReadOnly(map[string]Record{id: result}, map[string]string{id: tenant}, sel)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// FindAll returns all devices of the tenant, or all devices if the tenant
+// is empty.
+func (mgr *Manager) FindAll(tenant string, keys []string) ([]Record, error) {
+	sel := newSelector(keys)
+	if !mgr.hasReadOnly(sel) {
+		return mgr.deviceDB.FindAll(tenant, keys)
+	}
+
+	// The device id and tenant are required to evaluate read-only
+	// attributes. The keys are copied so that the caller's array is
+	// not modified.
+	if len(keys) != 0 {
+		keys = append(append(make([]string, 0, len(keys)+2), keys...), "id", "tenant")
+	}
+
+	result, err := mgr.deviceDB.FindAll(tenant, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]Record, len(result))
+	tenants := make(map[string]string, len(result))
+	for _, r := range result {
+		id := r.GetID()
+		records[id] = r
+		tenants[id], _ = r["tenant"].(string)
+		if !sel.contains("_id") {
+			delete(r, "id")
+		}
+		if !sel.contains("_tenant") {
+			delete(r, "tenant")
+		}
+	}
+	if err = mgr.addReadOnly(records, tenants, sel); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CheckTenant returns DeviceNotFoundError if the device doesn't belong to
+// the tenant, so that users can't tell devices of other tenants from
+// nonexistent devices. All devices are accessible if the tenant is empty.
+func (mgr *Manager) CheckTenant(id, tenant string) error {
+	if tenant == "" {
+		return nil
+	}
+	t, err := mgr.GetTenant(id)
+	if err == nil && t != tenant {
+		err = DeviceNotFoundError(id)
+	}
+	return err
+}
+
+// SetTenant moves the device to the tenant, or removes the device from its
+// tenant if the tenant is empty.
+func (mgr *Manager) SetTenant(id, tenant string) error {
+	err := mgr.deviceDB.SetTenant(id, tenant)
+	if err == nil {
+		mgr.tokenChanged(id)
+		mgr.broadcast(tokenEvent, id)
+	}
+	return err
+}
+
+// hasReadOnly returns true if any read-only attribute is selected.
+func (mgr *Manager) hasReadOnly(sel selector) bool {
+	for name := range mgr.attributes {
+		if sel.contains(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// addReadOnly adds the selected read-only attributes to the records of
+// devices, which are given by device ids with the tenants of the devices.
+func (mgr *Manager) addReadOnly(records map[string]Record, tenants map[string]string, sel selector) error {
+	for name, f := range mgr.attributes {
+		if !sel.contains(name) {
+			continue
+		}
+		values, err := f(tenants)
+		if err != nil {
+			return err
+		}
+		for id, value := range values {
+			if r := records[id]; r != nil && value != nil {
+				r[name] = value
+			}
+		}
+	}
+	return nil
+}
+
+func (mgr *Manager) removeReadOnly(r Record) {
+	for name := range mgr.attributes {
+		delete(r, name)
+	}
+}
+
+// Related returns the entities related to a device. These are the ancestors
+// of the device, found by following the "parent" attribute, and the groups
+// listed in the "groups" attribute of the device and its ancestors. Unknown
+// devices have no related entities. Devices can set these attributes
+// themselves, so devices of other tenants are not related, and ancestors
+// are not followed beyond them.
+func (mgr *Manager) Related(id string) ([]string, error) {
+	info, err := mgr.deviceDB.Find(id, relationKeys)
+	if err != nil {
+		if _, ok := err.(DeviceNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	tenant, _ := info["tenant"].(string)
+
+	var result []string
+	visited := map[string]bool{id: true}
+	for info != nil {
+		if groups, ok := info["groups"].([]interface{}); ok {
+			for _, g := range groups {
+				if group, ok := g.(string); ok && !visited[group] {
+					visited[group] = true
+					_, same, err := mgr.relatedDevice(group, tenant)
+					if err != nil {
+						return nil, err
+					}
+					if same {
+						result = append(result, group)
+					}
+				}
+			}
+		}
+
+		parent, _ := info["parent"].(string)
+		if parent == "" || visited[parent] {
+			break // stop on cycles
+		}
+		visited[parent] = true
+
+		var same bool
+		if info, same, err = mgr.relatedDevice(parent, tenant); err != nil {
+			return nil, err
+		}
+		if !same {
+			break
+		}
+		result = append(result, parent)
+	}
+
+	return result, nil
+}
+
+var relationKeys = []string{"parent", "groups", "tenant"}
+
+// relatedDevice returns the relation attributes of a related entity, which
+// are nil if the entity is not a device. The boolean result is false if the
+// entity is a device of another tenant.
+func (mgr *Manager) relatedDevice(id, tenant string) (Record, bool, error) {
+	info, err := mgr.deviceDB.Find(id, relationKeys)
+	if err != nil {
+		if _, ok := err.(DeviceNotFoundError); ok {
+			return nil, true, nil
+		}
+		return nil, false, err
+	}
+	t, _ := info["tenant"].(string)
+	return info, t == tenant, nil
+}
+
 func (mgr *Manager) Update(id string, updates Record) error {
+	mgr.removeReadOnly(updates)
 	err := mgr.deviceDB.Update(id, updates)
 	if err != nil {
 		return err
@@ -102,6 +420,7 @@ func (mgr *Manager) Update(id string, updates Record) error {
 	for _, cb := range mgr.updateCallbacks {
 		cb(updates)
 	}
+	mgr.broadcast(updateEvent, updates)
 
 	// Publish device attribute updates to device
 	if mgr.broker != nil {
@@ -119,6 +438,13 @@ func (mgr *Manager) OnUpdate(callback UpdateCallback) {
 	mgr.updateCallbacks = append(mgr.updateCallbacks, callback)
 }
 
+// OnTokenChange registers a callback invoked with the device id when a
+// device is removed or its access token is replaced, either by this or
+// other API servers.
+func (mgr *Manager) OnTokenChange(callback func(id string)) {
+	mgr.tokenCallbacks = append(mgr.tokenCallbacks, callback)
+}
+
 type RPCRequest struct {
 	Version string      `json:"jsonrpc,omitempty"`
 	Method  string      `json:"method"`
@@ -174,7 +500,11 @@ func (mgr *Manager) RPC(ctx context.Context, id string, req []byte) ([]byte, err
 		return nil, err
 	}
 
-	requestId := strconv.FormatInt(atomic.AddInt64(&mgr.rpcRequestId, 1), 10)
+	if !mgr.broker.IsConnected() {
+		return nil, httputils.NewStatusError(http.StatusServiceUnavailable, errors.New("MQTT broker not connected"))
+	}
+
+	requestId := mgr.rpcCalls.next()
 	requestTopic := token + "/me/rpc/request/" + requestId
 	responseTopic := token + "/me/rpc/response/" + requestId
 
@@ -182,18 +512,22 @@ func (mgr *Manager) RPC(ctx context.Context, id string, req []byte) ([]byte, err
 		return nil, mgr.broker.Publish(requestTopic, req)
 	}
 
-	// Subscribe on response
-	respCh := make(chan []byte)
-	err = mgr.broker.Subscribe(responseTopic, func(topic string, message []byte) {
-		respCh <- message
-	})
-	if err != nil {
+	// Register the call before sending request so that the response
+	// can't arrive before we are waiting for it
+	if err = mgr.subscribeRPCResponse(); err != nil {
 		return nil, err
 	}
-	defer mgr.broker.Unsubscribe(responseTopic)
-
-	// Send request to device
-	if err = mgr.broker.Publish(requestTopic, req); err != nil {
+	call := mgr.rpcCalls.add(requestId, token)
+	defer mgr.rpcCalls.remove(requestId)
+
+	// Send request to device. MQTT 5 devices can reply to the response
+	// topic with the correlation data instead of building response topic
+	// from the request topic.
+	props := &mqtt.Properties{
+		ResponseTopic:   responseTopic,
+		CorrelationData: []byte(requestId),
+	}
+	if err = mgr.broker.PublishWithProperties(requestTopic, req, props); err != nil {
 		return nil, err
 	}
 
@@ -203,12 +537,35 @@ func (mgr *Manager) RPC(ctx context.Context, id string, req []byte) ([]byte, err
 	select {
 	case <-ctx.Done():
 		logrus.Debug(ctx.Err())
+		if ctx.Err() != context.DeadlineExceeded {
+			rpcMetrics.Add("cancelled", 1)
+			return nil, ctx.Err()
+		}
+		rpcMetrics.Add("timeouts", 1)
 		return nil, httputils.NewStatusError(http.StatusServiceUnavailable, errors.New("RPC time out"))
-	case msg := <-respCh:
+	case err := <-call.failed:
+		rpcMetrics.Add("failed", 1)
+		return nil, httputils.NewStatusError(http.StatusServiceUnavailable, err)
+	case msg := <-call.ch:
 		return msg, nil
 	}
 }
 
+// subscribeRPCResponse subscribes to responses of all RPC calls on first
+// use. The subscription is retried on next call if failed.
+func (mgr *Manager) subscribeRPCResponse() error {
+	mgr.rpcMu.Lock()
+	defer mgr.rpcMu.Unlock()
+	if mgr.rpcSubscribed {
+		return nil
+	}
+	if err := mgr.broker.Subscribe(rpcResponseTopic, mgr.rpcCalls.dispatch); err != nil {
+		return err
+	}
+	mgr.rpcSubscribed = true
+	return nil
+}
+
 func (mgr *Manager) Claim(claimId string, attributes Record) error {
 	if !validateDeviceId(claimId) {
 		return InvalidDeviceIdError(claimId)
@@ -216,38 +573,43 @@ func (mgr *Manager) Claim(claimId string, attributes Record) error {
 	if attributes == nil {
 		attributes = make(Record)
 	}
+	// Only the approver can set the device id and tenant
+	for k := range attributes {
+		if k == "id" || k == "token" || k == "tenant" || strings.HasPrefix(k, "_") {
+			delete(attributes, k)
+		}
+	}
 	attributes["claim-id"] = claimId
 	attributes["claim-time"] = time.Now()
 
-	if _, loaded := mgr.claims.Load(claimId); loaded {
-		return DuplicateClaimError(claimId)
-	}
 	if mgr.autoapprove {
 		_, err := mgr.internalApprove(claimId, attributes)
 		return err
 	} else {
-		mgr.claims.Store(claimId, attributes)
-		return nil
+		return mgr.addClaim(claimId, attributes)
 	}
 }
 
-func (mgr *Manager) GetClaims() []Record {
-	result := make([]Record, 0)
-	mgr.claims.Range(func(key, value interface{}) bool {
-		result = append(result, value.(Record))
-		return true
-	})
-	return result
+// GetClaims returns pending claims of the tenant, or all pending claims if
+// the tenant is empty.
+func (mgr *Manager) GetClaims(tenant string) ([]Record, error) {
+	return mgr.findClaims(tenant)
 }
 
-func (mgr *Manager) Approve(claimId string, updates Record) (token string, err error) {
-	v, loaded := mgr.claims.LoadAndDelete(claimId)
-	if !loaded {
-		return "", ClaimNotFoundError(claimId)
+// Approve approves a pending claim of the tenant, or a claim of any tenant
+// if the tenant is empty. The device is created in the tenant of the
+// approver, or in the tenant given by a system approver.
+func (mgr *Manager) Approve(tenant, claimId string, updates Record) (token string, err error) {
+	claim, err := mgr.removeClaim(tenant, claimId)
+	if err != nil {
+		return "", err
 	}
 
 	// Override claim attributes with approver provided attributes.
-	attributes := v.(Record)
+	attributes := make(Record, len(claim)+len(updates))
+	for k, v := range claim {
+		attributes[k] = v
+	}
 	for k, v := range updates {
 		if v == nil {
 			delete(attributes, k)
@@ -256,6 +618,21 @@ func (mgr *Manager) Approve(claimId string, updates Record) (token string, err e
 		}
 	}
 
+	// A tenant can't take over devices of other tenants by reclaiming
+	if tenant != "" {
+		attributes["tenant"] = tenant
+		id, _ := attributes["id"].(string)
+		if id == "" {
+			id = claimId
+		}
+		if t, err := mgr.GetTenant(id); err == nil && t != tenant {
+			if err = mgr.addClaim(claimId, claim); err != nil {
+				logrus.WithError(err).Errorf("Failed to restore claim %s", claimId)
+			}
+			return "", DuplicateDeviceError(id)
+		}
+	}
+
 	return mgr.internalApprove(claimId, attributes)
 }
 
@@ -266,7 +643,9 @@ func (mgr *Manager) internalApprove(claimId string, attributes Record) (token st
 	delete(attributes, "claim-id")
 	delete(attributes, "claim-time")
 	if newId, ok := attributes["id"]; ok {
-		id = newId.(string)
+		if id, ok = newId.(string); !ok {
+			return "", InvalidDeviceIdError(fmt.Sprint(newId))
+		}
 	}
 
 	if token, err = mgr.CreateToken(id); err != nil {
@@ -288,10 +667,11 @@ func (mgr *Manager) internalApprove(claimId string, attributes Record) (token st
 	return
 }
 
-func (mgr *Manager) Reject(claimId string) error {
-	if _, loaded := mgr.claims.LoadAndDelete(claimId); loaded {
-		return mgr.broker.Publish("me/claim/"+claimId, map[string]string{"error": "Rejected"})
-	} else {
-		return ClaimNotFoundError(claimId)
+// Reject rejects a pending claim of the tenant, or a claim of any tenant if
+// the tenant is empty.
+func (mgr *Manager) Reject(tenant, claimId string) error {
+	if _, err := mgr.removeClaim(tenant, claimId); err != nil {
+		return err
 	}
+	return mgr.broker.Publish("me/claim/"+claimId, map[string]string{"error": "Rejected"})
 }
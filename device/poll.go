@@ -0,0 +1,239 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redhill42/iota/api/server/httputils"
+	"github.com/sirupsen/logrus"
+)
+
+// PendingRPC is an RPC request delivered to a device that polls over HTTP.
+// The device replies to the request with the request id.
+type PendingRPC struct {
+	ID      string          `json:"id"`
+	Request json.RawMessage `json:"request"`
+}
+
+const (
+	// mailboxExpiry is how long messages are buffered for a device after
+	// it stopped polling
+	mailboxExpiry = 5 * time.Minute
+
+	// mailboxSize is the maximum number of buffered RPC requests, the
+	// oldest requests are dropped when the mailbox is full
+	mailboxSize = 100
+)
+
+// mailbox buffers messages sent to a device that polls over HTTP instead
+// of subscribing to its MQTT topics. The mailbox subscribes to the topics
+// on the first poll, and is removed after the device stopped polling for
+// a while. Messages sent before the first poll are not delivered.
+//
+// The mailbox lives in the API server that is polled, clustered API
+// servers should route the polls of a device to the same server.
+type mailbox struct {
+	token   string
+	rpc     []PendingRPC
+	updates Record
+	changed chan struct{} // closed when a message arrives
+	polls   int
+	expiry  *time.Timer
+}
+
+func (mb *mailbox) signal() {
+	close(mb.changed)
+	mb.changed = make(chan struct{})
+}
+
+func rpcRequestTopic(token string) string {
+	return token + "/me/rpc/request/+"
+}
+
+func attributesTopic(token string) string {
+	return token + "/me/attributes"
+}
+
+// openMailbox returns the mailbox of the device, which is created and
+// subscribed if not exist. The mailbox must be closed after polled.
+func (mgr *Manager) openMailbox(token string) (*mailbox, error) {
+	mgr.pollSubMu.Lock()
+	defer mgr.pollSubMu.Unlock()
+
+	mgr.pollMu.Lock()
+	if mb, ok := mgr.mailboxes[token]; ok {
+		if mb.polls == 0 {
+			mb.expiry.Stop()
+		}
+		mb.polls++
+		mgr.pollMu.Unlock()
+		return mb, nil
+	}
+	mgr.pollMu.Unlock()
+
+	mb := &mailbox{token: token, changed: make(chan struct{}), polls: 1}
+	err := mgr.broker.Subscribe(rpcRequestTopic(token), func(topic string, payload []byte) {
+		mgr.deliverRPC(mb, topic[strings.LastIndexByte(topic, '/')+1:], payload)
+	})
+	if err == nil {
+		err = mgr.broker.Subscribe(attributesTopic(token), func(_ string, payload []byte) {
+			mgr.deliverUpdates(mb, payload)
+		})
+		if err != nil {
+			mgr.broker.Unsubscribe(rpcRequestTopic(token))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mgr.pollMu.Lock()
+	mgr.mailboxes[token] = mb
+	mgr.pollMu.Unlock()
+	return mb, nil
+}
+
+// closeMailbox starts the expiry timer of the mailbox after the last poll
+// finished.
+func (mgr *Manager) closeMailbox(mb *mailbox) {
+	mgr.pollMu.Lock()
+	defer mgr.pollMu.Unlock()
+
+	if mb.polls--; mb.polls == 0 {
+		mb.expiry = time.AfterFunc(mailboxExpiry, func() {
+			mgr.expireMailbox(mb)
+		})
+	}
+}
+
+func (mgr *Manager) expireMailbox(mb *mailbox) {
+	mgr.pollSubMu.Lock()
+	defer mgr.pollSubMu.Unlock()
+
+	mgr.pollMu.Lock()
+	if mb.polls != 0 || mgr.mailboxes[mb.token] != mb {
+		mgr.pollMu.Unlock()
+		return
+	}
+	delete(mgr.mailboxes, mb.token)
+	mgr.pollMu.Unlock()
+
+	mgr.broker.Unsubscribe(rpcRequestTopic(mb.token))
+	mgr.broker.Unsubscribe(attributesTopic(mb.token))
+}
+
+func (mgr *Manager) deliverRPC(mb *mailbox, requestId string, payload []byte) {
+	if !json.Valid(payload) {
+		logrus.Errorf("Invalid RPC request: %s", string(payload))
+		return
+	}
+
+	mgr.pollMu.Lock()
+	defer mgr.pollMu.Unlock()
+	if len(mb.rpc) >= mailboxSize {
+		logrus.Warnf("Mailbox is full, dropping RPC request %s", mb.rpc[0].ID)
+		mb.rpc = mb.rpc[1:]
+	}
+	mb.rpc = append(mb.rpc, PendingRPC{ID: requestId, Request: payload})
+	mb.signal()
+}
+
+func (mgr *Manager) deliverUpdates(mb *mailbox, payload []byte) {
+	var updates Record
+	if err := json.Unmarshal(payload, &updates); err != nil {
+		logrus.WithError(err).Error("Invalid attribute updates")
+		return
+	}
+
+	mgr.pollMu.Lock()
+	defer mgr.pollMu.Unlock()
+	if mb.updates == nil {
+		mb.updates = updates
+	} else {
+		for k, v := range updates {
+			mb.updates[k] = v
+		}
+	}
+	mb.signal()
+}
+
+// poll waits until the take function takes messages from the mailbox of
+// the device, or the timeout expired.
+func (mgr *Manager) poll(ctx context.Context, id string, timeout time.Duration, take func(*mailbox) bool) error {
+	if mgr.broker == nil || !mgr.broker.IsConnected() {
+		return httputils.NewStatusError(http.StatusServiceUnavailable, errors.New("MQTT broker not connected"))
+	}
+
+	token, err := mgr.GetToken(id)
+	if err != nil {
+		return err
+	}
+	mb, err := mgr.openMailbox(token)
+	if err != nil {
+		return err
+	}
+	defer mgr.closeMailbox(mb)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		mgr.pollMu.Lock()
+		if take(mb) {
+			mgr.pollMu.Unlock()
+			return nil
+		}
+		changed := mb.changed
+		mgr.pollMu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// PollRPC waits for RPC requests sent to the device. Returns an empty
+// result if no request arrived before timeout.
+func (mgr *Manager) PollRPC(ctx context.Context, id string, timeout time.Duration) ([]PendingRPC, error) {
+	var result []PendingRPC
+	err := mgr.poll(ctx, id, timeout, func(mb *mailbox) bool {
+		result, mb.rpc = mb.rpc, nil
+		return len(result) != 0
+	})
+	return result, err
+}
+
+// PollUpdates waits for attribute updates sent to the device. Updates
+// received since the last poll are merged into one record. Returns nil
+// if no update arrived before timeout.
+func (mgr *Manager) PollUpdates(ctx context.Context, id string, timeout time.Duration) (Record, error) {
+	var result Record
+	err := mgr.poll(ctx, id, timeout, func(mb *mailbox) bool {
+		result, mb.updates = mb.updates, nil
+		return result != nil
+	})
+	return result, err
+}
+
+// ReplyRPC sends the response of an RPC request received by polling.
+func (mgr *Manager) ReplyRPC(id, requestId string, resp []byte) error {
+	if requestId == "" || strings.ContainsAny(requestId, "/+#") {
+		return httputils.NewStatusError(http.StatusBadRequest, errors.New("Invalid request id"))
+	}
+	if mgr.broker == nil || !mgr.broker.IsConnected() {
+		return httputils.NewStatusError(http.StatusServiceUnavailable, errors.New("MQTT broker not connected"))
+	}
+
+	token, err := mgr.GetToken(id)
+	if err != nil {
+		return err
+	}
+	return mgr.broker.Publish(token+"/me/rpc/response/"+requestId, resp)
+}
@@ -0,0 +1,110 @@
+package device
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// rpcResponseTopic is subscribed once to receive responses of all RPC
+// calls. The response topic has the form <token>/me/rpc/response/<id>.
+const rpcResponseTopic = "+/me/rpc/response/+"
+
+// RPC metrics: calls made, calls waiting for response, calls timed out,
+// cancelled or failed, and responses that have no pending call.
+var rpcMetrics = expvar.NewMap("rpc")
+
+type rpcCall struct {
+	token  string
+	ch     chan []byte
+	failed chan error
+}
+
+// rpcCalls is the table of RPC calls waiting for response, keyed by
+// request id.
+//
+// Request ids are prefixed by a random string so that they are unique
+// among clustered API servers. All API servers receive the responses of
+// all RPC calls, the responses of calls made by other API servers are
+// ignored.
+type rpcCalls struct {
+	mu     sync.Mutex
+	calls  map[string]*rpcCall
+	prefix string
+	seq    int64
+}
+
+func newRPCCalls() *rpcCalls {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return &rpcCalls{
+		calls:  make(map[string]*rpcCall),
+		prefix: hex.EncodeToString(buf) + "-",
+	}
+}
+
+// next allocates a new request id.
+func (t *rpcCalls) next() string {
+	return t.prefix + strconv.FormatInt(atomic.AddInt64(&t.seq, 1), 10)
+}
+
+func (t *rpcCalls) add(requestId, token string) *rpcCall {
+	call := &rpcCall{token: token, ch: make(chan []byte, 1), failed: make(chan error, 1)}
+	t.mu.Lock()
+	t.calls[requestId] = call
+	t.mu.Unlock()
+	rpcMetrics.Add("calls", 1)
+	rpcMetrics.Add("inflight", 1)
+	return call
+}
+
+func (t *rpcCalls) remove(requestId string) {
+	t.mu.Lock()
+	delete(t.calls, requestId)
+	t.mu.Unlock()
+	rpcMetrics.Add("inflight", -1)
+}
+
+// dispatch delivers a response message to the pending call.
+func (t *rpcCalls) dispatch(topic string, message []byte) {
+	sp := strings.Split(topic, "/")
+	if len(sp) != 5 {
+		return
+	}
+	token, requestId := sp[0], sp[4]
+	if !strings.HasPrefix(requestId, t.prefix) {
+		return // called by other API server
+	}
+
+	t.mu.Lock()
+	call, ok := t.calls[requestId]
+	t.mu.Unlock()
+
+	// Only the device that was called can respond
+	if !ok || call.token != token {
+		rpcMetrics.Add("unmatched", 1)
+		return
+	}
+
+	select {
+	case call.ch <- message:
+	default: // duplicate response
+	}
+}
+
+// failAll fails all pending calls without waiting for timeout, for example
+// when the connection to MQTT broker is lost.
+func (t *rpcCalls) failAll(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, call := range t.calls {
+		select {
+		case call.failed <- err:
+		default:
+		}
+	}
+}
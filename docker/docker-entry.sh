@@ -9,6 +9,21 @@ function start() {
     # start mongodb
     gosu mongodb mongod --fork --logpath /var/log/mongodb/mongod.log --bind_ip 127.0.0.1 >/dev/null
 
+    # enable TLS listener for devices authenticated by client certificates
+    # if certificates are provided in /data/certs
+    mkdir -p /app/conf/mosquitto.d
+    if [ -e /data/certs/server.crt ]; then
+        cat > /app/conf/mosquitto.d/tls.conf <<EOF
+listener 8883
+cafile /data/certs/ca.crt
+certfile /data/certs/server.crt
+keyfile /data/certs/server.key
+require_certificate true
+use_identity_as_username true
+EOF
+        /app/bin/iota config mqtt.certAuth true
+    fi
+
     # start mosquitto
     gosu mosquitto /app/bin/mosquitto -c /app/conf/mosquitto.conf & mosq_pid=$!
 
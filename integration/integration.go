@@ -0,0 +1,155 @@
+// Package integration collects data from external systems, such as field
+// buses and industrial protocols, and feeds the data to iota devices.
+package integration
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redhill42/iota/device"
+	"github.com/redhill42/iota/tsdb"
+	"github.com/sirupsen/logrus"
+)
+
+// Sink receives data collected by integrations.
+type Sink interface {
+	// WriteMeasurement writes measurement fields of a device to the time
+	// series database.
+	WriteMeasurement(device, measurement string, fields map[string]interface{}, t time.Time)
+
+	// UpdateAttributes updates attributes of a device.
+	UpdateAttributes(device string, attributes map[string]interface{}) error
+}
+
+// Integration is a running integration.
+type Integration interface {
+	// Close stops the integration.
+	Close()
+}
+
+// PluginFunc starts an integration. It returns nil if the integration is
+// not configured.
+type PluginFunc func(sink Sink) (Integration, error)
+
+var pluginRegistration = make(map[string]PluginFunc)
+
+// RegisterPlugin registers an integration under the given name.
+func RegisterPlugin(name string, f PluginFunc) {
+	pluginRegistration[name] = f
+}
+
+// Start starts all configured integrations.
+func Start(sink Sink) ([]Integration, error) {
+	names := make([]string, 0, len(pluginRegistration))
+	for name := range pluginRegistration {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var started []Integration
+	for _, name := range names {
+		in, err := pluginRegistration[name](sink)
+		if err != nil {
+			for _, s := range started {
+				s.Close()
+			}
+			return nil, err
+		}
+		if in != nil {
+			logrus.Infof("Started %s integration", name)
+			started = append(started, in)
+		}
+	}
+	return started, nil
+}
+
+// NewSink creates a sink that writes measurements to the time series
+// database and updates attributes with the device manager.
+func NewSink(devices *device.Manager, db tsdb.TSDB) Sink {
+	return &sink{devices, db}
+}
+
+type sink struct {
+	devices *device.Manager
+	db      tsdb.TSDB
+}
+
+func (s *sink) WriteMeasurement(device, measurement string, fields map[string]interface{}, t time.Time) {
+	if len(fields) != 0 {
+		tenant, _ := s.devices.GetTenant(device)
+		s.db.WriteRecord(LineProtocol(measurement, device, tenant, fields, t))
+	}
+}
+
+func (s *sink) UpdateAttributes(id string, attributes map[string]interface{}) error {
+	return s.devices.Update(id, device.Record(attributes))
+}
+
+// LineProtocol formats measurement fields of a device in InfluxDB line
+// protocol. The measurement is tagged with the device id and the tenant if
+// not empty, the same as the measurements posted by devices.
+func LineProtocol(measurement, device, tenant string, fields map[string]interface{}, t time.Time) string {
+	var b strings.Builder
+	b.WriteString(escape(measurement, ", "))
+	b.WriteString(",device=")
+	b.WriteString(escape(device, ",= "))
+	if tenant != "" {
+		b.WriteString(",tenant=")
+		b.WriteString(escape(tenant, ",= "))
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(escape(k, ",= "))
+		b.WriteByte('=')
+		switch v := fields[k].(type) {
+		case float64:
+			b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+		case float32:
+			b.WriteString(strconv.FormatFloat(float64(v), 'g', -1, 32))
+		case int:
+			b.WriteString(strconv.Itoa(v) + "i")
+		case int64:
+			b.WriteString(strconv.FormatInt(v, 10) + "i")
+		case bool:
+			b.WriteString(strconv.FormatBool(v))
+		default:
+			b.WriteByte('"')
+			b.WriteString(escape(fmt.Sprint(v), `"\`))
+			b.WriteByte('"')
+		}
+	}
+
+	if !t.IsZero() {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(t.UnixNano(), 10))
+	}
+	return b.String()
+}
+
+func escape(s, chars string) string {
+	if !strings.ContainsAny(s, chars) {
+		return s
+	}
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(chars, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
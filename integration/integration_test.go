@@ -0,0 +1,38 @@
+package integration
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestIntegration(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Integration Suite")
+}
+
+var _ = Describe("Line protocol", func() {
+	It("should format fields", func() {
+		fields := map[string]interface{}{
+			"temp":   23.5,
+			"count":  int64(3),
+			"on":     true,
+			"status": `say "hi"`,
+		}
+		t := time.Unix(1, 5)
+		Expect(LineProtocol("env", "dev1", "", fields, t)).To(Equal(
+			`env,device=dev1 count=3i,on=true,status="say \"hi\"",temp=23.5 1000000005`))
+	})
+
+	It("should escape names", func() {
+		fields := map[string]interface{}{"a b": 1}
+		Expect(LineProtocol("m,x", "d=1", "", fields, time.Time{})).To(Equal(`m\,x,device=d\=1 a\ b=1i`))
+	})
+
+	It("should tag tenant", func() {
+		fields := map[string]interface{}{"temp": 20.0}
+		Expect(LineProtocol("env", "dev1", "acme", fields, time.Time{})).To(Equal(`env,device=dev1,tenant=acme temp=20`))
+	})
+})
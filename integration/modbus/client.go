@@ -0,0 +1,186 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Function codes
+const (
+	ReadCoils            = 1
+	ReadDiscreteInputs   = 2
+	ReadHoldingRegisters = 3
+	ReadInputRegisters   = 4
+)
+
+// Maximum quantities of a read request.
+const (
+	maxRegisters = 125
+	maxBits      = 2000
+)
+
+// Exception is an exception response of a Modbus slave.
+type Exception byte
+
+func (e Exception) Error() string {
+	switch e {
+	case 1:
+		return "modbus: illegal function"
+	case 2:
+		return "modbus: illegal data address"
+	case 3:
+		return "modbus: illegal data value"
+	case 4:
+		return "modbus: slave device failure"
+	case 6:
+		return "modbus: slave device busy"
+	case 10:
+		return "modbus: gateway path unavailable"
+	case 11:
+		return "modbus: gateway target device failed to respond"
+	default:
+		return fmt.Sprintf("modbus: exception %d", byte(e))
+	}
+}
+
+var errInvalidResponse = errors.New("modbus: invalid response")
+
+// Client is a Modbus TCP client. The connection is established on demand,
+// and is reestablished on next request after an error.
+type Client struct {
+	addr    string
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	tid  uint16
+}
+
+// NewClient creates a client of the Modbus TCP slave at the address.
+func NewClient(addr string, timeout time.Duration) *Client {
+	return &Client{addr: addr, timeout: timeout}
+}
+
+// Close closes the connection.
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// ReadRegisters reads holding registers or input registers.
+func (c *Client) ReadRegisters(unit byte, function byte, address, quantity uint16) ([]uint16, error) {
+	if quantity == 0 || quantity > maxRegisters {
+		return nil, fmt.Errorf("modbus: invalid quantity of registers: %d", quantity)
+	}
+	data, err := c.read(unit, function, address, quantity)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != int(quantity)*2 {
+		return nil, errInvalidResponse
+	}
+	regs := make([]uint16, quantity)
+	for i := range regs {
+		regs[i] = binary.BigEndian.Uint16(data[i*2:])
+	}
+	return regs, nil
+}
+
+// ReadBits reads coils or discrete inputs.
+func (c *Client) ReadBits(unit byte, function byte, address, quantity uint16) ([]bool, error) {
+	if quantity == 0 || quantity > maxBits {
+		return nil, fmt.Errorf("modbus: invalid quantity of bits: %d", quantity)
+	}
+	data, err := c.read(unit, function, address, quantity)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != (int(quantity)+7)/8 {
+		return nil, errInvalidResponse
+	}
+	bits := make([]bool, quantity)
+	for i := range bits {
+		bits[i] = data[i/8]&(1<<(i%8)) != 0
+	}
+	return bits, nil
+}
+
+// read sends a read request and returns the data bytes of the response.
+func (c *Client) read(unit, function byte, address, quantity uint16) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+
+	data, err := c.transact(unit, function, address, quantity)
+	if _, ok := err.(Exception); err != nil && !ok {
+		// The connection is out of sync after any other error
+		c.conn.Close()
+		c.conn = nil
+	}
+	return data, err
+}
+
+func (c *Client) transact(unit, function byte, address, quantity uint16) ([]byte, error) {
+	c.tid++
+	req := make([]byte, 12)
+	binary.BigEndian.PutUint16(req[0:], c.tid)
+	binary.BigEndian.PutUint16(req[2:], 0) // protocol id
+	binary.BigEndian.PutUint16(req[4:], 6) // length of the remaining bytes
+	req[6] = unit
+	req[7] = function
+	binary.BigEndian.PutUint16(req[8:], address)
+	binary.BigEndian.PutUint16(req[10:], quantity)
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	// Read MBAP header and function code
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if length < 2 || length > 254 {
+		return nil, errInvalidResponse
+	}
+	body := make([]byte, length-2)
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint16(header[0:]) != c.tid || header[6] != unit {
+		return nil, errInvalidResponse
+	}
+	switch header[7] {
+	case function:
+		if len(body) < 1 || int(body[0]) != len(body)-1 {
+			return nil, errInvalidResponse
+		}
+		return body[1:], nil
+	case function | 0x80:
+		if len(body) != 1 {
+			return nil, errInvalidResponse
+		}
+		return nil, Exception(body[0])
+	default:
+		return nil, errInvalidResponse
+	}
+}
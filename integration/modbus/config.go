@@ -0,0 +1,133 @@
+package modbus
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Slave is a Modbus TCP slave polled by the integration.
+type Slave struct {
+	// Device is the id of the iota device that receives the values
+	Device string `yaml:"device"`
+
+	// Address is the host and port of the slave, the port defaults to 502
+	Address string `yaml:"address"`
+
+	// Unit is the unit identifier of the slave behind a gateway
+	Unit byte `yaml:"unit"`
+
+	// Interval is the polling interval, 10 seconds by default
+	Interval time.Duration `yaml:"interval"`
+
+	// Timeout is the timeout of a request, 5 seconds by default
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Profile is the name of the device profile
+	Profile string `yaml:"profile"`
+}
+
+// Config is the configuration of the Modbus integration. For example:
+//
+//	profiles:
+//	  meter:
+//	    measurement: power
+//	    registers:
+//	      - name: voltage
+//	        address: 0
+//	        type: float32
+//	      - name: current
+//	        address: 2
+//	        type: int16
+//	        scale: 0.01
+//	      - name: serial
+//	        table: input
+//	        address: 100
+//	        type: uint32
+//	        attribute: true
+//	slaves:
+//	  - device: meter1
+//	    address: 192.168.1.10
+//	    unit: 1
+//	    interval: 5s
+//	    profile: meter
+type Config struct {
+	Profiles map[string]*Profile `yaml:"profiles"`
+	Slaves   []*Slave            `yaml:"slaves"`
+}
+
+const (
+	defaultPort     = "502"
+	defaultInterval = 10 * time.Second
+	defaultTimeout  = 5 * time.Second
+)
+
+// Parse reads and validates the configuration in YAML format.
+func Parse(r io.Reader) (*Config, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err = yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("modbus: %v", err)
+	}
+	if err = cfg.validate(); err != nil {
+		return nil, fmt.Errorf("modbus: %v", err)
+	}
+	return &cfg, nil
+}
+
+// Load reads the configuration from a file.
+func Load(filename string) (*Config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+func (cfg *Config) validate() error {
+	for name, p := range cfg.Profiles {
+		if p == nil || len(p.Registers) == 0 {
+			return fmt.Errorf("profile %s: no registers defined", name)
+		}
+		if p.Measurement == "" {
+			p.Measurement = "modbus"
+		}
+		for i := range p.Registers {
+			if err := p.Registers[i].validate(); err != nil {
+				return fmt.Errorf("profile %s: %v", name, err)
+			}
+		}
+	}
+
+	for i, s := range cfg.Slaves {
+		if s == nil || s.Device == "" {
+			return fmt.Errorf("slave %d: missing device", i+1)
+		}
+		if s.Address == "" {
+			return fmt.Errorf("slave %s: missing address", s.Device)
+		}
+		if _, _, err := net.SplitHostPort(s.Address); err != nil {
+			s.Address = net.JoinHostPort(s.Address, defaultPort)
+		}
+		if _, ok := cfg.Profiles[s.Profile]; !ok {
+			return fmt.Errorf("slave %s: unknown profile: %s", s.Device, s.Profile)
+		}
+		if s.Interval <= 0 {
+			s.Interval = defaultInterval
+		}
+		if s.Timeout <= 0 {
+			s.Timeout = defaultTimeout
+		}
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+package modbus
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhill42/iota/integration/modbus/modbustest"
+)
+
+func TestModbus(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Modbus Suite")
+}
+
+func register(typ, order string) *Register {
+	r := &Register{Name: "r", Type: typ, Order: order}
+	Expect(r.validate()).To(Succeed())
+	return r
+}
+
+var _ = Describe("Register", func() {
+	It("should decode integers", func() {
+		Expect(register("int16", "").decode([]uint16{0xFFFE})).To(Equal(int64(-2)))
+		Expect(register("uint16", "").decode([]uint16{0xFFFE})).To(Equal(int64(0xFFFE)))
+		Expect(register("int32", "").decode([]uint16{0xFFFF, 0xFFFD})).To(Equal(int64(-3)))
+		Expect(register("uint32", "").decode([]uint16{0x1234, 0x5678})).To(Equal(int64(0x12345678)))
+		Expect(register("bool", "").decode([]uint16{1})).To(Equal(true))
+	})
+
+	It("should decode with byte order", func() {
+		Expect(register("uint32", "ABCD").decode([]uint16{0x1234, 0x5678})).To(Equal(int64(0x12345678)))
+		Expect(register("uint32", "CDAB").decode([]uint16{0x5678, 0x1234})).To(Equal(int64(0x12345678)))
+		Expect(register("uint32", "BADC").decode([]uint16{0x3412, 0x7856})).To(Equal(int64(0x12345678)))
+		Expect(register("uint32", "DCBA").decode([]uint16{0x7856, 0x3412})).To(Equal(int64(0x12345678)))
+		Expect(register("uint16", "BADC").decode([]uint16{0x3412})).To(Equal(int64(0x1234)))
+	})
+
+	It("should decode float32", func() {
+		bits := math.Float32bits(12.5)
+		hi, lo := uint16(bits>>16), uint16(bits)
+		Expect(register("float32", "").decode([]uint16{hi, lo})).To(Equal(12.5))
+		Expect(register("float32", "CDAB").decode([]uint16{lo, hi})).To(Equal(12.5))
+	})
+
+	It("should scale values", func() {
+		r := register("int16", "")
+		r.Scale = 0.1
+		Expect(r.decode([]uint16{235})).To(BeNumerically("~", 23.5, 1e-9))
+		r.Offset = -40
+		Expect(r.decode([]uint16{235})).To(BeNumerically("~", -16.5, 1e-9))
+	})
+
+	It("should reject invalid definitions", func() {
+		Expect((&Register{Name: "r", Type: "int64"}).validate()).NotTo(Succeed())
+		Expect((&Register{Name: "r", Order: "ACBD"}).validate()).NotTo(Succeed())
+		Expect((&Register{Name: "r", Table: "coil", Type: "int16"}).validate()).NotTo(Succeed())
+		Expect((&Register{Name: "r", Address: 65535, Type: "int32"}).validate()).NotTo(Succeed())
+		Expect((&Register{Type: "int16"}).validate()).NotTo(Succeed())
+	})
+
+	It("should coalesce adjacent registers", func() {
+		p := &Profile{Registers: []Register{
+			{Name: "a", Address: 2, Type: "int32"},
+			{Name: "b", Address: 0, Type: "int16"},
+			{Name: "c", Address: 1, Type: "int16"},
+			{Name: "d", Address: 10},
+			{Name: "e", Address: 0, Table: "input"},
+			{Name: "f", Address: 0, Table: "coil"},
+			{Name: "g", Address: 1, Table: "coil"},
+		}}
+		for i := range p.Registers {
+			Expect(p.Registers[i].validate()).To(Succeed())
+		}
+
+		reqs := p.requests()
+		Expect(reqs).To(HaveLen(4))
+		Expect(reqs[0].function).To(Equal(byte(ReadCoils)))
+		Expect(reqs[0].quantity).To(Equal(uint16(2)))
+		Expect(reqs[1].function).To(Equal(byte(ReadHoldingRegisters)))
+		Expect(reqs[1].address).To(Equal(uint16(0)))
+		Expect(reqs[1].quantity).To(Equal(uint16(4)))
+		Expect(reqs[1].registers).To(HaveLen(3))
+		Expect(reqs[2].address).To(Equal(uint16(10)))
+		Expect(reqs[3].function).To(Equal(byte(ReadInputRegisters)))
+	})
+
+	It("should limit the quantity of a request", func() {
+		p := &Profile{}
+		for i := 0; i < 130; i++ {
+			p.Registers = append(p.Registers, Register{Name: "r", Address: uint16(i)})
+		}
+		for i := range p.Registers {
+			Expect(p.Registers[i].validate()).To(Succeed())
+		}
+		reqs := p.requests()
+		Expect(reqs).To(HaveLen(2))
+		Expect(reqs[0].quantity).To(Equal(uint16(125)))
+		Expect(reqs[1].address).To(Equal(uint16(125)))
+		Expect(reqs[1].quantity).To(Equal(uint16(5)))
+	})
+})
+
+const testConfig = `
+profiles:
+  meter:
+    measurement: power
+    registers:
+      - name: voltage
+        address: 0
+        type: float32
+      - name: current
+        address: 2
+        type: int16
+        scale: 0.01
+      - name: "on"
+        table: coil
+        address: 0
+      - name: serial
+        table: input
+        address: 100
+        type: uint32
+        order: CDAB
+        attribute: true
+slaves:
+  - device: meter1
+    address: %s
+    interval: 20ms
+    timeout: 1s
+    profile: meter
+`
+
+var _ = Describe("Config", func() {
+	It("should parse configuration", func() {
+		cfg, err := Parse(strings.NewReader(strings.Replace(testConfig, "%s", "10.0.0.1", 1)))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Slaves).To(HaveLen(1))
+		Expect(cfg.Slaves[0].Address).To(Equal("10.0.0.1:502"))
+		Expect(cfg.Slaves[0].Interval).To(Equal(20 * time.Millisecond))
+		Expect(cfg.Profiles["meter"].Measurement).To(Equal("power"))
+		Expect(cfg.Profiles["meter"].Registers[2].Type).To(Equal("bool"))
+	})
+
+	It("should apply defaults", func() {
+		cfg, err := Parse(strings.NewReader(`
+profiles:
+  p:
+    registers: [{name: a}]
+slaves:
+  - {device: d, address: "localhost:1502", profile: p}
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Profiles["p"].Measurement).To(Equal("modbus"))
+		Expect(cfg.Slaves[0].Address).To(Equal("localhost:1502"))
+		Expect(cfg.Slaves[0].Interval).To(Equal(defaultInterval))
+		Expect(cfg.Slaves[0].Timeout).To(Equal(defaultTimeout))
+	})
+
+	It("should reject invalid configuration", func() {
+		_, err := Parse(strings.NewReader(`
+profiles:
+  p:
+    registers: [{name: a}]
+slaves:
+  - {device: d, address: localhost, profile: q}
+`))
+		Expect(err).To(MatchError(ContainSubstring("unknown profile")))
+
+		_, err = Parse(strings.NewReader(`
+profiles:
+  p:
+    registers: [{name: a, type: double}]
+`))
+		Expect(err).To(MatchError(ContainSubstring("invalid type")))
+
+		_, err = Parse(strings.NewReader(`
+profiles:
+  p:
+    registers: [{name: a, adress: 1}]
+`))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Client", func() {
+	var server *modbustest.Server
+	var client *Client
+
+	BeforeEach(func() {
+		var err error
+		server, err = modbustest.NewServer()
+		Expect(err).NotTo(HaveOccurred())
+		client = NewClient(server.Addr, time.Second)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		server.Close()
+	})
+
+	It("should read registers", func() {
+		server.SetHolding(10, 1, 2, 3)
+		server.SetInput(20, 4, 5)
+
+		regs, err := client.ReadRegisters(1, ReadHoldingRegisters, 10, 3)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(regs).To(Equal([]uint16{1, 2, 3}))
+
+		regs, err = client.ReadRegisters(1, ReadInputRegisters, 20, 2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(regs).To(Equal([]uint16{4, 5}))
+	})
+
+	It("should read bits", func() {
+		server.SetCoils(0, true, false, true, false, false, false, false, false, true)
+		server.SetDiscrete(5, true)
+
+		bits, err := client.ReadBits(1, ReadCoils, 0, 9)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bits).To(Equal([]bool{true, false, true, false, false, false, false, false, true}))
+
+		bits, err = client.ReadBits(1, ReadDiscreteInputs, 4, 2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bits).To(Equal([]bool{false, true}))
+	})
+
+	It("should return exceptions", func() {
+		_, err := client.ReadRegisters(1, ReadHoldingRegisters, modbustest.TableSize-1, 2)
+		Expect(err).To(Equal(Exception(2)))
+		Expect(err.Error()).To(Equal("modbus: illegal data address"))
+
+		// The connection is kept after an exception
+		regs, err := client.ReadRegisters(1, ReadHoldingRegisters, 0, 1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(regs).To(HaveLen(1))
+	})
+
+	It("should reject invalid quantity", func() {
+		_, err := client.ReadRegisters(1, ReadHoldingRegisters, 0, 126)
+		Expect(err).To(HaveOccurred())
+		_, err = client.ReadBits(1, ReadCoils, 0, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reconnect after connection lost", func() {
+		_, err := client.ReadRegisters(1, ReadHoldingRegisters, 0, 1)
+		Expect(err).NotTo(HaveOccurred())
+
+		server.CloseConnections()
+		Eventually(func() error {
+			_, err := client.ReadRegisters(1, ReadHoldingRegisters, 0, 1)
+			return err
+		}).Should(Succeed())
+	})
+})
+
+type measurement struct {
+	device, name string
+	fields       map[string]interface{}
+}
+
+type fakeSink struct {
+	mu           sync.Mutex
+	measurements []measurement
+	attributes   []map[string]interface{}
+}
+
+func (s *fakeSink) WriteMeasurement(device, name string, fields map[string]interface{}, _ time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.measurements = append(s.measurements, measurement{device, name, fields})
+}
+
+func (s *fakeSink) UpdateAttributes(device string, attributes map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, attributes)
+	return nil
+}
+
+func (s *fakeSink) count() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.measurements), len(s.attributes)
+}
+
+func (s *fakeSink) last() measurement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.measurements[len(s.measurements)-1]
+}
+
+var _ = Describe("Poller", func() {
+	var server *modbustest.Server
+	var sink *fakeSink
+	var poller *Poller
+
+	BeforeEach(func() {
+		var err error
+		server, err = modbustest.NewServer()
+		Expect(err).NotTo(HaveOccurred())
+		sink = &fakeSink{}
+
+		bits := math.Float32bits(230.5)
+		server.SetHolding(0, uint16(bits>>16), uint16(bits), 1234)
+		server.SetCoils(0, true)
+		server.SetInput(100, 0x5678, 0x1234)
+
+		cfg, err := Parse(strings.NewReader(strings.Replace(testConfig, "%s", server.Addr, 1)))
+		Expect(err).NotTo(HaveOccurred())
+		poller = Start(cfg, sink)
+	})
+
+	AfterEach(func() {
+		poller.Close()
+		server.Close()
+	})
+
+	measurements := func() int {
+		n, _ := sink.count()
+		return n
+	}
+	attributes := func() int {
+		_, n := sink.count()
+		return n
+	}
+
+	It("should write measurements and attributes", func() {
+		Eventually(measurements).Should(BeNumerically(">=", 3))
+
+		m := sink.last()
+		Expect(m.device).To(Equal("meter1"))
+		Expect(m.name).To(Equal("power"))
+		Expect(m.fields).To(HaveKeyWithValue("voltage", 230.5))
+		Expect(m.fields["current"]).To(BeNumerically("~", 12.34, 1e-9))
+		Expect(m.fields).To(HaveKeyWithValue("on", true))
+		Expect(m.fields).NotTo(HaveKey("serial"))
+
+		// Unchanged attributes are updated only once
+		Expect(attributes()).To(Equal(1))
+		Expect(sink.attributes[0]).To(Equal(map[string]interface{}{"serial": int64(0x12345678)}))
+
+		server.SetInput(100, 1)
+		Eventually(attributes).Should(Equal(2))
+	})
+
+	It("should continue polling after failures", func() {
+		Eventually(measurements).Should(BeNumerically(">=", 1))
+		server.Close()
+		n := measurements()
+		Consistently(measurements, 100*time.Millisecond).Should(BeNumerically("<=", n+1))
+	})
+})
@@ -0,0 +1,200 @@
+// Package modbustest provides a Modbus TCP slave simulator for testing.
+package modbustest
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+// TableSize is the number of entries in each table of the simulator.
+const TableSize = 10000
+
+// Server is a Modbus TCP slave that serves reads from in-memory tables.
+// The server responds to any unit identifier.
+type Server struct {
+	// Addr is the address the server is listening on
+	Addr string
+
+	listener net.Listener
+	mu       sync.Mutex
+	holding  []uint16
+	input    []uint16
+	coils    []bool
+	discrete []bool
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a server listening on a random local port.
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Addr:     l.Addr().String(),
+		listener: l,
+		holding:  make([]uint16, TableSize),
+		input:    make([]uint16, TableSize),
+		coils:    make([]bool, TableSize),
+		discrete: make([]bool, TableSize),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Close stops the server and closes all connections.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.CloseConnections()
+	s.wg.Wait()
+}
+
+// CloseConnections closes all client connections, the server continues
+// accepting new connections.
+func (s *Server) CloseConnections() {
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+}
+
+// SetHolding sets holding registers starting from the address.
+func (s *Server) SetHolding(address int, values ...uint16) {
+	s.mu.Lock()
+	copy(s.holding[address:], values)
+	s.mu.Unlock()
+}
+
+// SetInput sets input registers starting from the address.
+func (s *Server) SetInput(address int, values ...uint16) {
+	s.mu.Lock()
+	copy(s.input[address:], values)
+	s.mu.Unlock()
+}
+
+// SetCoils sets coils starting from the address.
+func (s *Server) SetCoils(address int, values ...bool) {
+	s.mu.Lock()
+	copy(s.coils[address:], values)
+	s.mu.Unlock()
+}
+
+// SetDiscrete sets discrete inputs starting from the address.
+func (s *Server) SetDiscrete(address int, values ...bool) {
+	s.mu.Lock()
+	copy(s.discrete[address:], values)
+	s.mu.Unlock()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	header := make([]byte, 7)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if length < 2 {
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+
+		resp := s.process(pdu)
+		out := make([]byte, 7+len(resp))
+		copy(out, header[:4])
+		binary.BigEndian.PutUint16(out[4:], uint16(len(resp)+1))
+		out[6] = header[6]
+		copy(out[7:], resp)
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// process handles a request PDU and returns the response PDU.
+func (s *Server) process(pdu []byte) []byte {
+	function := pdu[0]
+	if function < 1 || function > 4 {
+		return []byte{function | 0x80, 1}
+	}
+	if len(pdu) != 5 {
+		return []byte{function | 0x80, 3}
+	}
+	address := int(binary.BigEndian.Uint16(pdu[1:]))
+	quantity := int(binary.BigEndian.Uint16(pdu[3:]))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch function {
+	case 1, 2:
+		if quantity < 1 || quantity > 2000 {
+			return []byte{function | 0x80, 3}
+		}
+		table := s.coils
+		if function == 2 {
+			table = s.discrete
+		}
+		if address+quantity > len(table) {
+			return []byte{function | 0x80, 2}
+		}
+		resp := make([]byte, 2+(quantity+7)/8)
+		resp[0], resp[1] = function, byte(len(resp)-2)
+		for i := 0; i < quantity; i++ {
+			if table[address+i] {
+				resp[2+i/8] |= 1 << (i % 8)
+			}
+		}
+		return resp
+
+	default:
+		if quantity < 1 || quantity > 125 {
+			return []byte{function | 0x80, 3}
+		}
+		table := s.holding
+		if function == 4 {
+			table = s.input
+		}
+		if address+quantity > len(table) {
+			return []byte{function | 0x80, 2}
+		}
+		resp := make([]byte, 2+quantity*2)
+		resp[0], resp[1] = function, byte(quantity*2)
+		for i := 0; i < quantity; i++ {
+			binary.BigEndian.PutUint16(resp[2+i*2:], table[address+i])
+		}
+		return resp
+	}
+}
@@ -0,0 +1,158 @@
+// Package modbus implements an integration that polls Modbus TCP slaves
+// and writes the register values as measurements and attributes of iota
+// devices.
+package modbus
+
+import (
+	"expvar"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/redhill42/iota/config"
+	"github.com/redhill42/iota/integration"
+	"github.com/sirupsen/logrus"
+)
+
+var metrics = expvar.NewMap("modbus")
+
+func init() {
+	integration.RegisterPlugin("modbus", func(sink integration.Sink) (integration.Integration, error) {
+		filename := config.Get("modbus.config")
+		if filename == "" {
+			return nil, nil
+		}
+		cfg, err := Load(filename)
+		if err != nil {
+			return nil, err
+		}
+		return Start(cfg, sink), nil
+	})
+}
+
+// Poller polls the configured slaves.
+type Poller struct {
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Start starts polling the slaves in the configuration.
+func Start(cfg *Config, sink integration.Sink) *Poller {
+	p := &Poller{done: make(chan struct{})}
+	for _, s := range cfg.Slaves {
+		profile := cfg.Profiles[s.Profile]
+		sp := &slavePoller{
+			slave:       s,
+			client:      NewClient(s.Address, s.Timeout),
+			sink:        sink,
+			measurement: profile.Measurement,
+			requests:    profile.requests(),
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			sp.run(p.done)
+		}()
+	}
+	return p
+}
+
+// Close stops polling and waits for the pollers to finish.
+func (p *Poller) Close() {
+	close(p.done)
+	p.wg.Wait()
+}
+
+type slavePoller struct {
+	slave       *Slave
+	client      *Client
+	sink        integration.Sink
+	measurement string
+	requests    []*request
+	attributes  map[string]interface{}
+	failed      bool
+}
+
+func (sp *slavePoller) run(done <-chan struct{}) {
+	defer sp.client.Close()
+
+	ticker := time.NewTicker(sp.slave.Interval)
+	defer ticker.Stop()
+	for {
+		sp.poll()
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// poll reads all registers of the slave once.
+func (sp *slavePoller) poll() {
+	log := logrus.WithField("device", sp.slave.Device).WithField("slave", sp.slave.Address)
+	metrics.Add("polls", 1)
+
+	now := time.Now()
+	fields := make(map[string]interface{})
+	attributes := make(map[string]interface{})
+	if err := sp.read(fields, attributes); err != nil {
+		metrics.Add("failures", 1)
+		if !sp.failed {
+			log.WithError(err).Error("modbus: Failed to poll slave")
+			sp.failed = true
+		}
+		return
+	}
+	if sp.failed {
+		log.Info("modbus: Slave recovered")
+		sp.failed = false
+	}
+
+	sp.sink.WriteMeasurement(sp.slave.Device, sp.measurement, fields, now)
+
+	// Attributes are only updated when changed, since they are stored in
+	// database and published to subscribers
+	if len(attributes) != 0 && !reflect.DeepEqual(attributes, sp.attributes) {
+		if err := sp.sink.UpdateAttributes(sp.slave.Device, attributes); err != nil {
+			log.WithError(err).Error("modbus: Failed to update attributes")
+			return
+		}
+		sp.attributes = attributes
+	}
+}
+
+func (sp *slavePoller) read(fields, attributes map[string]interface{}) error {
+	unit := sp.slave.Unit
+	for _, req := range sp.requests {
+		var regs []uint16
+		if req.function == ReadCoils || req.function == ReadDiscreteInputs {
+			bits, err := sp.client.ReadBits(unit, req.function, req.address, req.quantity)
+			if err != nil {
+				return err
+			}
+			regs = make([]uint16, len(bits))
+			for i, b := range bits {
+				if b {
+					regs[i] = 1
+				}
+			}
+		} else {
+			var err error
+			regs, err = sp.client.ReadRegisters(unit, req.function, req.address, req.quantity)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, r := range req.registers {
+			v := r.decode(regs[r.Address-req.address:])
+			if r.Attribute {
+				attributes[r.Name] = v
+			} else {
+				fields[r.Name] = v
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package modbus
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Register maps a register, or a coil or discrete input, of a Modbus slave
+// to a measurement field or attribute of a device.
+type Register struct {
+	// Name of the measurement field or attribute
+	Name string `yaml:"name"`
+
+	// Table is one of "holding" (the default), "input", "coil" and
+	// "discrete"
+	Table string `yaml:"table"`
+
+	// Address of the first register
+	Address uint16 `yaml:"address"`
+
+	// Type is one of "int16", "uint16" (the default), "int32", "uint32",
+	// "float32" and "bool". Coils and discrete inputs are always bool.
+	Type string `yaml:"type"`
+
+	// Order is the byte order of the value, where A is the most significant
+	// byte and the registers are in order. "ABCD" (the default) is big
+	// endian, "DCBA" is little endian, "CDAB" swaps words and "BADC" swaps
+	// bytes in words. Byte swapping also applies to 16-bit values.
+	Order string `yaml:"order"`
+
+	// The value is multiplied by scale and added by offset. Scaled values
+	// are always floating point numbers.
+	Scale  float64 `yaml:"scale"`
+	Offset float64 `yaml:"offset"`
+
+	// Attribute indicates that the value is written as device attribute
+	// instead of measurement field.
+	Attribute bool `yaml:"attribute"`
+}
+
+// Profile describes the registers of a kind of equipment.
+type Profile struct {
+	// Measurement is the name of the measurement, "modbus" by default
+	Measurement string `yaml:"measurement"`
+
+	Registers []Register `yaml:"registers"`
+}
+
+// Tables
+const (
+	Holding  = "holding"
+	Input    = "input"
+	Coil     = "coil"
+	Discrete = "discrete"
+)
+
+func (r *Register) function() byte {
+	switch r.Table {
+	case Input:
+		return ReadInputRegisters
+	case Coil:
+		return ReadCoils
+	case Discrete:
+		return ReadDiscreteInputs
+	default:
+		return ReadHoldingRegisters
+	}
+}
+
+func (r *Register) bits() bool {
+	return r.Table == Coil || r.Table == Discrete
+}
+
+// size returns the number of registers or bits of the value.
+func (r *Register) size() uint16 {
+	switch r.Type {
+	case "int32", "uint32", "float32":
+		return 2
+	default:
+		return 1
+	}
+}
+
+// validate checks and normalizes the register definition.
+func (r *Register) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("missing register name")
+	}
+
+	switch r.Table {
+	case "":
+		r.Table = Holding
+	case Holding, Input:
+	case Coil, Discrete:
+		if r.Type != "" && r.Type != "bool" {
+			return fmt.Errorf("register %s: %s must be bool", r.Name, r.Table)
+		}
+		r.Type = "bool"
+	default:
+		return fmt.Errorf("register %s: invalid table: %s", r.Name, r.Table)
+	}
+
+	switch r.Type {
+	case "":
+		r.Type = "uint16"
+	case "int16", "uint16", "int32", "uint32", "float32", "bool":
+	default:
+		return fmt.Errorf("register %s: invalid type: %s", r.Name, r.Type)
+	}
+
+	switch r.Order {
+	case "":
+		r.Order = "ABCD"
+	case "ABCD", "DCBA", "CDAB", "BADC":
+	default:
+		return fmt.Errorf("register %s: invalid byte order: %s", r.Name, r.Order)
+	}
+
+	if int(r.Address)+int(r.size()) > 65536 {
+		return fmt.Errorf("register %s: address out of range", r.Name)
+	}
+	return nil
+}
+
+// decode decodes the value from registers.
+func (r *Register) decode(regs []uint16) interface{} {
+	var v float64
+	var integer bool
+
+	switch r.Type {
+	case "bool":
+		return regs[0] != 0
+	case "int16":
+		v, integer = float64(int16(r.word(regs[0]))), true
+	case "uint16":
+		v, integer = float64(r.word(regs[0])), true
+	case "int32":
+		v, integer = float64(int32(r.dword(regs))), true
+	case "uint32":
+		v, integer = float64(r.dword(regs)), true
+	case "float32":
+		v = float64(math.Float32frombits(r.dword(regs)))
+	}
+
+	if r.Scale != 0 && r.Scale != 1 || r.Offset != 0 {
+		scale := r.Scale
+		if scale == 0 {
+			scale = 1
+		}
+		return v*scale + r.Offset
+	}
+	if integer {
+		return int64(v)
+	}
+	return v
+}
+
+func (r *Register) word(w uint16) uint16 {
+	if r.Order == "BADC" || r.Order == "DCBA" {
+		return w<<8 | w>>8
+	}
+	return w
+}
+
+func (r *Register) dword(regs []uint16) uint32 {
+	hi, lo := r.word(regs[0]), r.word(regs[1])
+	if r.Order == "CDAB" || r.Order == "DCBA" {
+		hi, lo = lo, hi
+	}
+	return uint32(hi)<<16 | uint32(lo)
+}
+
+// request is a read request that covers a range of registers.
+type request struct {
+	function  byte
+	address   uint16
+	quantity  uint16
+	registers []*Register
+}
+
+// requests groups registers into as few read requests as possible.
+// Only adjacent or overlapping registers are read together, since reading
+// undefined addresses may fail.
+func (p *Profile) requests() []*request {
+	regs := make([]*Register, len(p.Registers))
+	for i := range p.Registers {
+		regs[i] = &p.Registers[i]
+	}
+	sort.SliceStable(regs, func(i, j int) bool {
+		if regs[i].function() != regs[j].function() {
+			return regs[i].function() < regs[j].function()
+		}
+		return regs[i].Address < regs[j].Address
+	})
+
+	var result []*request
+	var last *request
+	for _, r := range regs {
+		limit := uint16(maxRegisters)
+		if r.bits() {
+			limit = maxBits
+		}
+
+		end := uint32(r.Address) + uint32(r.size())
+		if last != nil && last.function == r.function() && r.Address <= last.address+last.quantity &&
+			end-uint32(last.address) <= uint32(limit) {
+			if end > uint32(last.address)+uint32(last.quantity) {
+				last.quantity = uint16(end - uint32(last.address))
+			}
+			last.registers = append(last.registers, r)
+			continue
+		}
+
+		last = &request{function: r.function(), address: r.Address, quantity: r.size(), registers: []*Register{r}}
+		result = append(result, last)
+	}
+	return result
+}
@@ -0,0 +1,285 @@
+// Package acl implements rule based access control of MQTT topics.
+//
+// Rules are grouped by role. The rules of the client's role are checked in
+// order, and the first rule that matches the topic and either denies access
+// or grants the requested access decides. Access is denied if no rule
+// decides. Users may also have roles assigned in the user database, whose
+// rules are checked before the rules of the built-in "user" role.
+//
+// Rule topics are topic filters in which the following variables are
+// substituted by the attributes of the client:
+//
+//	%u  user name
+//	%c  client id
+//	%d  device id
+//	%t  device access token
+//	%n  tenant of the user or device
+//
+// A rule doesn't match if a variable is not available for the client or its
+// value contains any of the characters '/', '+' or '#'. In addition, the
+// topic level "%T" matches the access token of any device, which allows
+// gateways to act on behalf of the devices they hold the token of.
+//
+// Rules match topic names of messages being published or received with the
+// usual topic filter semantics. A subscription matches a rule only if the
+// rule covers all topics the subscription may receive, so that "a/+" matches
+// the rule "a/#" but not the rule "a/b".
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Access types, compatible with the access types used by mosquitto.
+const (
+	Read      = 1
+	Write     = 2
+	Subscribe = 4
+
+	// ReadWrite grants all access types
+	ReadWrite = Read | Write | Subscribe
+
+	// Deny denies all access types
+	Deny = 0
+)
+
+// Built-in roles of clients.
+const (
+	RoleAnonymous = "anonymous"
+	RoleDevice    = "device"
+	RoleUser      = "user"
+)
+
+// Rule grants or denies access to topics matched by a topic filter.
+type Rule struct {
+	Access int
+	Topic  string
+}
+
+// Client is the MQTT client that requests access to a topic.
+type Client struct {
+	Role     string
+	Roles    []string // roles assigned to a user
+	Tenant   string
+	Username string
+	ClientID string
+	DeviceID string
+	Token    string
+}
+
+// ACL is a set of rules grouped by role.
+type ACL struct {
+	roles map[string][]Rule
+
+	// VerifyToken checks whether a topic level is an access token of a
+	// device. It's used to match the "%T" topic level.
+	VerifyToken func(token string) bool
+}
+
+// New creates an empty ACL that denies all access.
+func New() *ACL {
+	return &ACL{roles: make(map[string][]Rule)}
+}
+
+// Add appends a rule to the rules of a role.
+func (acl *ACL) Add(role string, rule Rule) {
+	acl.roles[role] = append(acl.roles[role], rule)
+}
+
+// ParseAccess parses an access specification, which is "deny" or a comma
+// separated list of "read", "write", "subscribe" and "readwrite". As in
+// mosquitto, "read" also grants subscription.
+func ParseAccess(s string) (int, error) {
+	if s == "deny" {
+		return Deny, nil
+	}
+	access := 0
+	for _, a := range strings.Split(s, ",") {
+		switch strings.TrimSpace(a) {
+		case "read":
+			access |= Read | Subscribe
+		case "write":
+			access |= Write
+		case "subscribe":
+			access |= Subscribe
+		case "readwrite":
+			access |= ReadWrite
+		default:
+			return 0, fmt.Errorf("acl: invalid access: %s", s)
+		}
+	}
+	return access, nil
+}
+
+// Parse reads rules in text format. Each line of the text is a role
+// declaration or a rule of the last declared role:
+//
+//	role <role>
+//	topic [<access>] <topic>
+//
+// The access defaults to "readwrite". Empty lines and lines starting
+// with '#' are ignored.
+func Parse(r io.Reader) (*ACL, error) {
+	acl := New()
+	role := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch {
+		case fields[0] == "role" && len(fields) == 2:
+			role = fields[1]
+		case fields[0] == "topic" && (len(fields) == 2 || len(fields) == 3):
+			if role == "" {
+				return nil, fmt.Errorf("acl: line %d: rule without role", n)
+			}
+			rule := Rule{Access: ReadWrite, Topic: fields[len(fields)-1]}
+			if len(fields) == 3 {
+				access, err := ParseAccess(fields[1])
+				if err != nil {
+					return nil, fmt.Errorf("acl: line %d: invalid access: %s", n, fields[1])
+				}
+				rule.Access = access
+			}
+			acl.Add(role, rule)
+		default:
+			return nil, fmt.Errorf("acl: line %d: syntax error", n)
+		}
+	}
+	return acl, scanner.Err()
+}
+
+// Load reads rules from a file in text format.
+func Load(filename string) (*ACL, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Check returns true if the client has the requested access to the topic.
+// The topic is a topic filter for subscribe access.
+func (acl *ACL) Check(c *Client, topic string, acc int) bool {
+	// Shared subscriptions are checked on the topic filter
+	if acc == Subscribe && strings.HasPrefix(topic, "$share/") {
+		if sp := strings.SplitN(topic, "/", 3); len(sp) == 3 {
+			topic = sp[2]
+		}
+	}
+
+	levels := strings.Split(topic, "/")
+	for _, role := range c.Roles {
+		if allow, ok := acl.check(role, c, levels, acc); ok {
+			return allow
+		}
+	}
+	allow, _ := acl.check(c.Role, c, levels, acc)
+	return allow
+}
+
+// check checks the rules of a role. Returns false if no rule decides.
+func (acl *ACL) check(role string, c *Client, levels []string, acc int) (allow, ok bool) {
+	for _, rule := range acl.roles[role] {
+		if !acl.match(c, rule.Topic, levels, acc == Subscribe) {
+			continue
+		}
+		if rule.Access == Deny {
+			return false, true
+		}
+		if rule.Access&acc != 0 {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// match returns true if the rule topic matches the topic levels. If cover
+// is true the levels are of a topic filter, which must be covered by the
+// rule topic.
+func (acl *ACL) match(c *Client, pattern string, levels []string, cover bool) bool {
+	pattern = substitute(pattern, c)
+	if pattern == "" {
+		return false
+	}
+
+	// Topic names starting with '$' are not matched by wildcards on the
+	// first level
+	if strings.HasPrefix(levels[0], "$") && (strings.HasPrefix(pattern, "+") || strings.HasPrefix(pattern, "#")) {
+		return false
+	}
+
+	ps := strings.Split(pattern, "/")
+	for i, p := range ps {
+		if p == "#" {
+			return true
+		}
+		if i >= len(levels) {
+			return false
+		}
+		l := levels[i]
+		if cover && l == "#" {
+			return false
+		}
+		switch p {
+		case "+":
+			// matches any level
+		case "%T":
+			if l == "+" || acl.VerifyToken == nil || !acl.VerifyToken(l) {
+				return false
+			}
+		default:
+			if p != l {
+				return false
+			}
+		}
+	}
+	return len(ps) == len(levels)
+}
+
+// substitute replaces variables in the rule topic with client attributes.
+// Returns an empty string if a variable can't be substituted.
+func substitute(pattern string, c *Client) string {
+	if !strings.Contains(pattern, "%") {
+		return pattern
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			b.WriteByte(pattern[i])
+			continue
+		}
+
+		var value string
+		switch pattern[i+1] {
+		case 'u':
+			value = c.Username
+		case 'c':
+			value = c.ClientID
+		case 'd':
+			value = c.DeviceID
+		case 't':
+			value = c.Token
+		case 'n':
+			value = c.Tenant
+		default:
+			b.WriteByte('%')
+			continue
+		}
+		if value == "" || strings.ContainsAny(value, "/+#") {
+			return ""
+		}
+		b.WriteString(value)
+		i++
+	}
+	return b.String()
+}
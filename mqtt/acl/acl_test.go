@@ -0,0 +1,153 @@
+package acl
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestACL(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ACL Suite")
+}
+
+const rules = `
+# anonymous devices can only claim itself
+role anonymous
+topic write api/+/me/claim
+topic read  me/claim/%c
+
+role device
+topic write     api/+/%T/#
+topic readwrite %T/me/#
+topic deny      devices/%d/secret
+topic readwrite devices/%d/#
+topic subscribe broadcast/#
+topic read      broadcast/%d
+
+role user
+topic deny iota/#
+topic #
+
+# viewers can only read device topics
+role viewer
+topic read devices/#
+topic deny #
+`
+
+var _ = Describe("ACL", func() {
+	var acl *ACL
+
+	anonymous := &Client{Role: RoleAnonymous, ClientID: "dev1"}
+	device := &Client{Role: RoleDevice, Username: "TOKEN1", DeviceID: "dev1", Token: "TOKEN1", ClientID: "c1"}
+	user := &Client{Role: RoleUser, Username: "admin", ClientID: "c2"}
+
+	BeforeEach(func() {
+		var err error
+		acl, err = Parse(strings.NewReader(rules))
+		Expect(err).NotTo(HaveOccurred())
+		acl.VerifyToken = func(token string) bool {
+			return token == "TOKEN1" || token == "TOKEN2"
+		}
+	})
+
+	It("should parse access", func() {
+		Expect(ParseAccess("deny")).To(Equal(Deny))
+		Expect(ParseAccess("read")).To(Equal(Read | Subscribe))
+		Expect(ParseAccess("write,subscribe")).To(Equal(Write | Subscribe))
+		Expect(ParseAccess("readwrite")).To(Equal(ReadWrite))
+		_, err := ParseAccess("execute")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should report syntax errors", func() {
+		_, err := Parse(strings.NewReader("topic read a/b"))
+		Expect(err).To(MatchError(ContainSubstring("line 1")))
+		_, err = Parse(strings.NewReader("role user\ntopic read a/b extra"))
+		Expect(err).To(MatchError(ContainSubstring("line 2")))
+		_, err = Parse(strings.NewReader("role user\ntopic all a/b"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should substitute client attributes", func() {
+		Expect(acl.Check(anonymous, "api/v1/me/claim", Write)).To(BeTrue())
+		Expect(acl.Check(anonymous, "me/claim/dev1", Read)).To(BeTrue())
+		Expect(acl.Check(anonymous, "me/claim/dev2", Read)).To(BeFalse())
+		Expect(acl.Check(anonymous, "me/claim/+", Subscribe)).To(BeFalse())
+
+		Expect(acl.Check(device, "devices/dev1/status", Write)).To(BeTrue())
+		Expect(acl.Check(device, "devices/dev2/status", Write)).To(BeFalse())
+	})
+
+	It("should not match rules with unavailable or unsafe variables", func() {
+		Expect(acl.Check(&Client{Role: RoleDevice}, "devices//status", Write)).To(BeFalse())
+		Expect(acl.Check(&Client{Role: RoleAnonymous, ClientID: "+"}, "me/claim/+", Subscribe)).To(BeFalse())
+		Expect(acl.Check(&Client{Role: RoleAnonymous, ClientID: "#"}, "me/claim/#", Subscribe)).To(BeFalse())
+	})
+
+	It("should substitute tenant", func() {
+		acl.Add("tenant", Rule{Access: ReadWrite, Topic: "tenants/%n/#"})
+		c := &Client{Roles: []string{"tenant"}, Username: "bob", Tenant: "acme"}
+		Expect(acl.Check(c, "tenants/acme/status", Write)).To(BeTrue())
+		Expect(acl.Check(c, "tenants/other/status", Write)).To(BeFalse())
+
+		c = &Client{Roles: []string{"tenant"}}
+		Expect(acl.Check(c, "tenants//status", Write)).To(BeFalse())
+	})
+
+	It("should match access token of any device", func() {
+		Expect(acl.Check(device, "api/v1/TOKEN1/me/attributes", Write)).To(BeTrue())
+		Expect(acl.Check(device, "api/v1/TOKEN2/me/attributes", Write)).To(BeTrue())
+		Expect(acl.Check(device, "api/v1/FAKE/me/attributes", Write)).To(BeFalse())
+		Expect(acl.Check(device, "api/v1/TOKEN1/me/attributes", Read)).To(BeFalse())
+
+		Expect(acl.Check(device, "TOKEN2/me/attributes", Read)).To(BeTrue())
+		Expect(acl.Check(device, "TOKEN2/me/rpc/request/+", Subscribe)).To(BeTrue())
+		Expect(acl.Check(device, "+/me/rpc/request/+", Subscribe)).To(BeFalse())
+	})
+
+	It("should apply first matching rule", func() {
+		Expect(acl.Check(device, "devices/dev1/secret", Read)).To(BeFalse())
+		Expect(acl.Check(device, "devices/dev1/secret", Write)).To(BeFalse())
+		Expect(acl.Check(device, "devices/dev1/public", Read)).To(BeTrue())
+
+		Expect(acl.Check(user, "iota/events/x/devices", Read)).To(BeFalse())
+		Expect(acl.Check(user, "anything/else", Write)).To(BeTrue())
+	})
+
+	It("should only allow subscriptions covered by rules", func() {
+		Expect(acl.Check(device, "devices/dev1/#", Subscribe)).To(BeTrue())
+		Expect(acl.Check(device, "devices/dev1/+", Subscribe)).To(BeTrue())
+		Expect(acl.Check(device, "devices/+/status", Subscribe)).To(BeFalse())
+		Expect(acl.Check(device, "devices/#", Subscribe)).To(BeFalse())
+		Expect(acl.Check(device, "#", Subscribe)).To(BeFalse())
+		Expect(acl.Check(device, "$share/group/devices/dev1/#", Subscribe)).To(BeTrue())
+	})
+
+	It("should check subscribe and read access separately", func() {
+		Expect(acl.Check(device, "broadcast/#", Subscribe)).To(BeTrue())
+		Expect(acl.Check(device, "broadcast/dev1", Read)).To(BeTrue())
+		Expect(acl.Check(device, "broadcast/dev2", Read)).To(BeFalse())
+	})
+
+	It("should not match system topics with wildcards", func() {
+		Expect(acl.Check(user, "$SYS/broker/uptime", Read)).To(BeFalse())
+	})
+
+	It("should check assigned roles before the built-in role", func() {
+		viewer := &Client{Role: RoleUser, Roles: []string{"viewer"}, Username: "bob", ClientID: "c3"}
+		Expect(acl.Check(viewer, "devices/dev1/status", Read)).To(BeTrue())
+		Expect(acl.Check(viewer, "devices/dev1/status", Write)).To(BeFalse())
+		Expect(acl.Check(viewer, "anything/else", Read)).To(BeFalse())
+
+		// Roles without rules fall through to the built-in role
+		operator := &Client{Role: RoleUser, Roles: []string{"operator"}, Username: "alice", ClientID: "c4"}
+		Expect(acl.Check(operator, "anything/else", Write)).To(BeTrue())
+	})
+
+	It("should deny access to unknown roles", func() {
+		Expect(acl.Check(&Client{Role: "guest"}, "a/b", Read)).To(BeFalse())
+	})
+})
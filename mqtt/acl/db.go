@@ -0,0 +1,50 @@
+package acl
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2"
+)
+
+// LoadDB reads rules from the "acl" collection of a MongoDB database. Each
+// document in the collection holds the rules of a role, for example:
+//
+//	{
+//	  "_id": "device",
+//	  "rules": [
+//	    {"access": "write", "topic": "api/+/%t/#"},
+//	    {"access": "readwrite", "topic": "%t/me/#"}
+//	  ]
+//	}
+func LoadDB(url string) (*ACL, error) {
+	session, err := mgo.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var roles []struct {
+		Role  string `bson:"_id"`
+		Rules []struct {
+			Access string
+			Topic  string
+		}
+	}
+	if err = session.DB("").C("acl").Find(nil).All(&roles); err != nil {
+		return nil, err
+	}
+
+	acl := New()
+	for _, role := range roles {
+		for _, r := range role.Rules {
+			rule := Rule{Access: ReadWrite, Topic: r.Topic}
+			if r.Access != "" {
+				if rule.Access, err = ParseAccess(r.Access); err != nil {
+					return nil, fmt.Errorf("acl: role %s: %v", role.Role, err)
+				}
+			}
+			acl.Add(role.Role, rule)
+		}
+	}
+	return acl, nil
+}
@@ -2,16 +2,25 @@ package mqtt
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/redhill42/iota/api/server/httputils"
+	"github.com/redhill42/iota/api/types"
 	"github.com/redhill42/iota/config"
+	"github.com/redhill42/iota/mqtt/packet"
+	"github.com/redhill42/iota/mqtt/server"
 	"github.com/sirupsen/logrus"
 )
 
@@ -31,32 +40,65 @@ func init() {
 }
 
 type Broker struct {
-	client mqtt.Client
-	mux    http.Handler
-	qos    byte
-	tokenQ chan mqtt.Token
+	client     mqtt.Client
+	server     *server.Server
+	mux        http.Handler
+	dispatcher *dispatcher
+	qos        byte
+	tokenQ     chan mqtt.Token
+	clientid   string
+	group      string // share group of clustered API servers
+
+	mu            sync.Mutex
+	subscriptions map[string]func(string, []byte) // restored on reconnect
+	forwarded     bool
+	status        types.MQTTStatus
+	lostCallbacks []func(error)
 }
 
 func NewBroker(username, password string) (*Broker, error) {
-	broker := new(Broker)
-	opts := broker.configure(username, password)
+	broker := &Broker{subscriptions: make(map[string]func(string, []byte))}
+	broker.status.Since = time.Now()
+	opts, err := broker.configure(username, password)
+	if err != nil {
+		return nil, err
+	}
 	broker.client = mqtt.NewClient(opts)
 
 	broker.tokenQ = make(chan mqtt.Token, 100)
 	go broker.drainTokenQ()
+	broker.dispatcher = newDispatcher(broker.serveRequest, broker.rejectRequest)
 	return broker, nil
 }
 
-func (broker *Broker) configure(username, password string) *mqtt.ClientOptions {
-	server := config.GetOrDefault("mqtt.url", "tcp://127.0.0.1:1883")
+// NewEmbeddedBroker creates a broker that runs an MQTT server in process
+// instead of connecting to an external MQTT broker. Clients connected to
+// the embedded server are authenticated and authorized by the given
+// functions. The server starts listening when the broker is forwarded.
+func NewEmbeddedBroker(auth server.AuthFunc, acl server.ACLFunc) (*Broker, error) {
+	broker := &Broker{server: server.New(auth, acl)}
+	broker.status = types.MQTTStatus{Connected: true, Embedded: true, Since: time.Now()}
+	broker.qos = configureQoS()
+	broker.dispatcher = newDispatcher(broker.serveRequest, broker.rejectRequest)
+	return broker, nil
+}
 
+func configureQoS() byte {
 	qosStr := config.GetOrDefault("mqtt.qos", "1")
 	qos, err := strconv.Atoi(qosStr)
 	if err != nil || qos < 0 || qos > 2 {
 		logrus.Warnf("mqtt: Invalid Quality of Service level: %s", qosStr)
 		qos = 1
 	}
-	broker.qos = byte(qos)
+	return byte(qos)
+}
+
+func (broker *Broker) configure(username, password string) (*mqtt.ClientOptions, error) {
+	server, secure, err := brokerURL(config.GetOrDefault("mqtt.url", "tcp://127.0.0.1:1883"))
+	if err != nil {
+		return nil, err
+	}
+	broker.qos = configureQoS()
 
 	clean, _ := strconv.ParseBool(config.GetOrDefault("mqtt.clean", "false"))
 
@@ -68,6 +110,8 @@ func (broker *Broker) configure(username, password string) *mqtt.ClientOptions {
 		config.AddOption("mqtt", "clientid", clientid)
 		config.Save()
 	}
+	broker.clientid = clientid
+	broker.group = config.Get("mqtt.shareGroup")
 
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(server)
@@ -76,11 +120,82 @@ func (broker *Broker) configure(username, password string) *mqtt.ClientOptions {
 	opts.SetPassword(password)
 	opts.SetCleanSession(clean)
 
+	if secure {
+		tlsConfig, err := configureTLS()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	opts.SetAutoReconnect(true)
+	opts.SetOnConnectHandler(broker.onConnect)
+	opts.SetConnectionLostHandler(broker.onConnectionLost)
+
 	opts.SetDefaultPublishHandler(func(_ mqtt.Client, msg mqtt.Message) {
-		go broker.serveMQTT(msg)
+		broker.serveMQTT(msg.Topic(), msg.Payload(), nil)
 	})
 
-	return opts
+	return opts, nil
+}
+
+func (broker *Broker) onConnect(_ mqtt.Client) {
+	logrus.Info("Connected to MQTT broker")
+	broker.setStatus(true, nil)
+
+	// Subscriptions are restored by Forward on first connect
+	broker.mu.Lock()
+	forwarded := broker.forwarded
+	broker.mu.Unlock()
+	if forwarded {
+		if err := broker.resubscribe(); err != nil {
+			logrus.WithError(err).Error("Failed to restore MQTT subscriptions")
+		}
+	}
+}
+
+func (broker *Broker) onConnectionLost(_ mqtt.Client, err error) {
+	logrus.WithError(err).Warn("Lost connection to MQTT broker")
+	broker.setStatus(false, err)
+
+	broker.mu.Lock()
+	callbacks := broker.lostCallbacks
+	broker.mu.Unlock()
+	for _, callback := range callbacks {
+		callback(err)
+	}
+}
+
+func (broker *Broker) setStatus(connected bool, err error) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	broker.status.Connected = connected
+	broker.status.Error = ""
+	if err != nil {
+		broker.status.Error = err.Error()
+	}
+	broker.status.Since = time.Now()
+}
+
+// Status returns the status of the connection to MQTT broker.
+func (broker *Broker) Status() types.MQTTStatus {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	return broker.status
+}
+
+// IsConnected returns true if the broker is connected and messages can be
+// published.
+func (broker *Broker) IsConnected() bool {
+	return broker.Status().Connected
+}
+
+// OnConnectionLost registers a callback that is called when the connection
+// to MQTT broker is lost. The broker reconnects automatically.
+func (broker *Broker) OnConnectionLost(callback func(error)) {
+	broker.mu.Lock()
+	broker.lostCallbacks = append(broker.lostCallbacks, callback)
+	broker.mu.Unlock()
 }
 
 func (broker *Broker) drainTokenQ() {
@@ -96,7 +211,61 @@ func (broker *Broker) drainTokenQ() {
 	}
 }
 
-func (broker *Broker) Publish(topic string, payload interface{}) (err error) {
+// Properties are the MQTT 5 request/response properties of a message.
+// Only the embedded broker carries these properties, they are dropped
+// by the MQTT 3.1.1 client used to connect to an external broker.
+type Properties struct {
+	ResponseTopic   string
+	CorrelationData []byte
+	ContentType     string
+	User            map[string]string
+}
+
+func (props *Properties) encode() *packet.Properties {
+	if props == nil {
+		return nil
+	}
+	p := &packet.Properties{
+		ResponseTopic:   props.ResponseTopic,
+		CorrelationData: props.CorrelationData,
+		ContentType:     props.ContentType,
+	}
+	keys := make([]string, 0, len(props.User))
+	for k := range props.User {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p.AddUser(k, props.User[k])
+	}
+	return p
+}
+
+func decodeProperties(p *packet.Properties) *Properties {
+	if p == nil {
+		return nil
+	}
+	props := &Properties{
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+		ContentType:     p.ContentType,
+	}
+	if len(p.User) != 0 {
+		props.User = make(map[string]string, len(p.User))
+		for _, u := range p.User {
+			props.User[u.Key] = u.Value
+		}
+	}
+	return props
+}
+
+func (broker *Broker) Publish(topic string, payload interface{}) error {
+	return broker.PublishWithProperties(topic, payload, nil)
+}
+
+// PublishWithProperties publishes a message with MQTT 5 properties. The
+// properties are ignored when connected to an external broker.
+func (broker *Broker) PublishWithProperties(topic string, payload interface{}, props *Properties) (err error) {
 	switch payload.(type) {
 	case string, []byte, bytes.Buffer:
 		// message type is ok
@@ -106,29 +275,145 @@ func (broker *Broker) Publish(topic string, payload interface{}) (err error) {
 			return err
 		}
 	}
+
+	if broker.server != nil {
+		var data []byte
+		switch p := payload.(type) {
+		case string:
+			data = []byte(p)
+		case []byte:
+			data = p
+		case bytes.Buffer:
+			data = p.Bytes()
+		}
+		broker.server.Publish(&packet.Publish{
+			Topic:      topic,
+			QoS:        broker.qos,
+			Properties: props.encode(),
+			Payload:    data,
+		})
+		return nil
+	}
+
 	broker.tokenQ <- broker.client.Publish(topic, broker.qos, false, payload)
 	return nil
 }
 
 func (broker *Broker) Subscribe(topic string, callback func(string, []byte)) error {
-	t := broker.client.Subscribe(topic, broker.qos, func(client mqtt.Client, msg mqtt.Message) {
-		callback(msg.Topic(), msg.Payload())
-	})
+	if broker.server != nil {
+		return broker.server.Subscribe(topic, broker.qos, func(msg *packet.Publish) {
+			callback(msg.Topic, msg.Payload)
+		})
+	}
+
+	// Remember the subscription so that it can be restored on reconnect
+	broker.mu.Lock()
+	broker.subscriptions[topic] = callback
+	broker.mu.Unlock()
+	if !broker.client.IsConnected() {
+		return nil
+	}
+	return broker.subscribe(topic, callback)
+}
+
+func (broker *Broker) subscribe(topic string, callback func(string, []byte)) error {
+	var handler mqtt.MessageHandler
+	if callback != nil {
+		handler = func(_ mqtt.Client, msg mqtt.Message) {
+			callback(msg.Topic(), msg.Payload())
+		}
+	}
+	t := broker.client.Subscribe(topic, broker.qos, handler)
 	t.Wait()
 	return t.Error()
 }
 
+// resubscribe restores all subscriptions. The subscriptions may have been
+// lost when the broker restarted or the session expired.
+func (broker *Broker) resubscribe() error {
+	broker.mu.Lock()
+	subscriptions := make(map[string]func(string, []byte), len(broker.subscriptions))
+	for topic, callback := range broker.subscriptions {
+		subscriptions[topic] = callback
+	}
+	broker.mu.Unlock()
+
+	for topic, callback := range subscriptions {
+		logrus.Debugf("Subscribe to %s", topic)
+		if err := broker.subscribe(topic, callback); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (broker *Broker) Unsubscribe(topic string) {
+	if broker.server != nil {
+		broker.server.Unsubscribe(topic)
+		return
+	}
+
+	broker.mu.Lock()
+	delete(broker.subscriptions, topic)
+	broker.mu.Unlock()
 	broker.tokenQ <- broker.client.Unsubscribe(topic)
 }
 
 func (broker *Broker) Close() {
-	broker.tokenQ <- nil
-	broker.client.Disconnect(250)
+	if broker.server != nil {
+		broker.server.Close()
+	} else {
+		broker.tokenQ <- nil
+		broker.client.Disconnect(250)
+	}
+	broker.dispatcher.close()
+	broker.setStatus(false, nil)
 }
 
 const apiTopic = "api/#"
 
+// InternalTopicPrefix is the prefix of internal topics that only the API
+// servers can access.
+const InternalTopicPrefix = "iota/"
+
+// eventTopic is the prefix of topics on which clustered API servers
+// broadcast events to each other. The topic has the form
+//
+//    iota/events/<clientid>/<event>
+//
+// where clientid identifies the API server that sent the event.
+const eventTopic = InternalTopicPrefix + "events/"
+
+// Clustered returns true if multiple API servers share the load of
+// inbound API requests. The API servers are clustered by setting the
+// "mqtt.shareGroup" option to the same share group.
+func (broker *Broker) Clustered() bool {
+	return broker.group != ""
+}
+
+// Broadcast sends an event to all other API servers of the cluster. It
+// does nothing if the API server is not clustered.
+func (broker *Broker) Broadcast(event string, payload interface{}) error {
+	if !broker.Clustered() {
+		return nil
+	}
+	return broker.Publish(eventTopic+broker.clientid+"/"+event, payload)
+}
+
+// OnBroadcast registers a callback for events broadcast by other API
+// servers of the cluster. Events sent by this API server are ignored.
+func (broker *Broker) OnBroadcast(event string, callback func([]byte)) error {
+	if !broker.Clustered() {
+		return nil
+	}
+	return broker.Subscribe(eventTopic+"+/"+event, func(topic string, payload []byte) {
+		sp := strings.Split(topic, "/")
+		if len(sp) == 4 && sp[2] != broker.clientid {
+			callback(payload)
+		}
+	})
+}
+
 // Subscribe mqtt topic and forward to API server. The topic has the
 // following pattern:
 //
@@ -150,27 +435,73 @@ const apiTopic = "api/#"
 // for example, to get device attributes, device send an empty message to
 // "api/v1/XXX/me/attributes/request/1" and subscribe to "XXX/me/attributes/response/1"
 // to receive the result.
+//
+// If the "mqtt.shareGroup" option is set, the api topic is subscribed as a
+// shared subscription "$share/<group>/api/#", so that each request is
+// processed by only one of the API servers in the share group.
+//
+// MQTT 5 clients can instead set the Response Topic and Correlation Data
+// properties on any request. The method of the request is then taken
+// from the "method" user property, and the response is published to the
+// response topic, which must be in the namespace of the device token, with
+// the correlation data and the HTTP status code in the "status" user
+// property. For example, a device may publish to "api/v1/XXX/me/attributes"
+// with method "GET" and response topic "XXX/me/attributes/response".
 func (broker *Broker) Forward(mux http.Handler) error {
 	if broker.mux != nil {
 		panic("MQTT broker already forwarded")
 	}
 	broker.mux = mux
 
+	if broker.server != nil {
+		return broker.forwardEmbedded()
+	}
+
 	// Connect to MQTT broker
-	t := broker.client.Connect().(*mqtt.ConnectToken)
+	topic := apiTopic
+	if broker.group != "" {
+		topic = "$share/" + broker.group + "/" + apiTopic
+	}
+	broker.mu.Lock()
+	broker.subscriptions[topic] = nil
+	broker.mu.Unlock()
+	t := broker.client.Connect()
 	if t.Wait() && t.Error() != nil {
 		return t.Error()
 	}
 
-	// Subscribe on api topic if no session present
-	if !t.SessionPresent() {
-		logrus.Debugf("Subscribe to %s", apiTopic)
-		t := broker.client.Subscribe(apiTopic, broker.qos, nil)
-		if t.Wait() && t.Error() != nil {
-			return t.Error()
-		}
+	// Subscribe on api topic and all other topics subscribed before
+	// connected. The subscriptions are restored on every reconnect as
+	// the broker may not keep the session.
+	broker.mu.Lock()
+	broker.forwarded = true
+	broker.mu.Unlock()
+	return broker.resubscribe()
+}
+
+// forwardEmbedded dispatches api messages published to the embedded
+// server and starts listening for MQTT clients. The listen addresses are
+// configured by the comma separated "mqtt.listen" option.
+func (broker *Broker) forwardEmbedded() error {
+	err := broker.server.Subscribe(apiTopic, broker.qos, func(msg *packet.Publish) {
+		broker.serveMQTT(msg.Topic, msg.Payload, decodeProperties(msg.Properties))
+	})
+	if err != nil {
+		return err
 	}
 
+	for _, addr := range strings.Split(config.GetOrDefault("mqtt.listen", ":1883"), ",") {
+		l, err := net.Listen("tcp", strings.TrimSpace(addr))
+		if err != nil {
+			broker.server.Close()
+			return err
+		}
+		go func() {
+			if err := broker.server.Serve(l); err != server.ErrServerClosed {
+				logrus.WithError(err).Error("MQTT broker error")
+			}
+		}()
+	}
 	return nil
 }
 
@@ -195,51 +526,85 @@ func (w *fakeWriter) WriteHeader(statusCode int) {
 	w.statusCode = statusCode
 }
 
-func (broker *Broker) serveMQTT(msg mqtt.Message) {
-	logrus.Debugf("received message: %s, %s\n", msg.Topic(), string(msg.Payload()))
-	if !strings.HasPrefix(msg.Topic(), "api/") {
-		return // not our message
+// apiRequest is an API request received from MQTT.
+type apiRequest struct {
+	topic     string
+	version   string
+	token     string
+	method    string
+	path      string
+	requestId string
+	payload   []byte
+	props     *Properties
+}
+
+// parseRequest parses the request topic. Returns nil if the topic is not
+// an API request.
+func parseRequest(topic string, payload []byte, props *Properties) *apiRequest {
+	if !strings.HasPrefix(topic, "api/") {
+		return nil // not our message
 	}
-	sp := strings.Split(msg.Topic(), "/")
+	sp := strings.Split(topic, "/")
 	if len(sp) < 4 {
-		logrus.Errorf("Invalid topic: %s", msg.Topic())
-		return
+		logrus.Errorf("Invalid topic: %s", topic)
+		return nil
 	}
 
-	var version, token, method, path, requestId string
+	req := &apiRequest{topic: topic, payload: payload, props: props}
 
 	// Parse request topic
 	if len(sp) == 4 && sp[2] == "me" && sp[3] == "claim" {
 		// special case for api/v1/me/claim, there is no token in the topic
-		version, method, path = sp[1], "POST", "me/claim"
+		req.version, req.method, req.path = sp[1], "POST", "me/claim"
 	} else {
-		version, token = sp[1], sp[2]
+		req.version, req.token = sp[1], sp[2]
 		if len(sp) >= 6 && sp[len(sp)-2] == "request" {
-			method = "GET"
-			requestId = sp[len(sp)-1]
-			path = strings.Join(sp[3:len(sp)-2], "/")
+			req.method = "GET"
+			req.requestId = sp[len(sp)-1]
+			req.path = strings.Join(sp[3:len(sp)-2], "/")
 		} else if len(sp) >= 5 && sp[len(sp)-1] == "delete" {
-			method = "DELETE"
-			path = strings.Join(sp[3:len(sp)-1], "/")
+			req.method = "DELETE"
+			req.path = strings.Join(sp[3:len(sp)-1], "/")
 		} else {
-			method = "POST"
-			path = strings.Join(sp[3:], "/")
+			req.method = "POST"
+			req.path = strings.Join(sp[3:], "/")
 		}
 	}
 
+	// MQTT 5 request with response topic
+	if req.reply() && props.User["method"] != "" {
+		req.method = strings.ToUpper(props.User["method"])
+	}
+	return req
+}
+
+// reply returns true if the request is an MQTT 5 request with response topic.
+func (req *apiRequest) reply() bool {
+	return req.props != nil && req.props.ResponseTopic != ""
+}
+
+// serveMQTT queues an inbound message to be processed by API server.
+func (broker *Broker) serveMQTT(topic string, payload []byte, props *Properties) {
+	logrus.Debugf("received message: %s, %s\n", topic, string(payload))
+	if req := parseRequest(topic, payload, props); req != nil {
+		broker.dispatcher.dispatch(req)
+	}
+}
+
+func (broker *Broker) serveRequest(req *apiRequest) {
 	var r *http.Request
 	var err error
 
 	// Create fake HTTP request
-	apiPath := "/api/" + version + "/" + path
-	if method == "GET" {
-		if len(msg.Payload()) == 0 {
-			r, err = http.NewRequest(method, apiPath, nil)
+	apiPath := "/api/" + req.version + "/" + req.path
+	if req.method == "GET" {
+		if len(req.payload) == 0 {
+			r, err = http.NewRequest(req.method, apiPath, nil)
 		} else {
 			var q map[string]string
-			err := json.Unmarshal(msg.Payload(), &q)
+			err := json.Unmarshal(req.payload, &q)
 			if err != nil {
-				logrus.WithError(err).Errorf("Invalid query parameter: %s", string(msg.Payload()))
+				logrus.WithError(err).Errorf("Invalid query parameter: %s", string(req.payload))
 				return
 			}
 
@@ -251,38 +616,72 @@ func (broker *Broker) serveMQTT(msg mqtt.Message) {
 				Path:     apiPath,
 				RawQuery: query.Encode(),
 			}
-			r, err = http.NewRequest(method, u.String(), nil)
+			r, err = http.NewRequest(req.method, u.String(), nil)
 		}
 	} else {
-		body := bytes.NewReader(msg.Payload())
-		r, err = http.NewRequest(method, apiPath, body)
+		body := bytes.NewReader(req.payload)
+		r, err = http.NewRequest(req.method, apiPath, body)
 	}
 	if err != nil {
 		logrus.WithError(err).Error("Failed to create request")
 		return
 	}
 
-	if token != "" {
-		r.Header.Set("Authorization", "bearer "+token)
+	if req.token != "" {
+		r.Header.Set("Authorization", "bearer "+req.token)
 	}
-	if method == "POST" {
+	if req.reply() && req.props.ContentType != "" {
+		r.Header.Set("Content-Type", req.props.ContentType)
+	} else if req.method != "GET" && req.method != "DELETE" {
 		r.Header.Set("Content-Type", "application/json")
 	}
 
 	// Route to API server
+	r = r.WithContext(context.WithValue(r.Context(), httputils.ForwardedKey, true))
 	w := fakeWriter{}
 	broker.mux.ServeHTTP(&w, r)
 
 	// Send response message
-	if method == "GET" {
-		responseTopic := token + "/" + path + "/response/" + requestId
-		if w.statusCode < 200 || w.statusCode >= 300 {
+	broker.respond(req, w.statusCode, w.body.Bytes(), w.Header().Get("Content-Type"))
+}
+
+// rejectRequest replies a request that was rejected because the server is busy.
+func (broker *Broker) rejectRequest(req *apiRequest) {
+	broker.respond(req, http.StatusServiceUnavailable, []byte("Server busy"), "text/plain")
+}
+
+// respond publishes the response of a request if the client expects one.
+func (broker *Broker) respond(req *apiRequest, status int, body []byte, contentType string) {
+	if req.reply() {
+		broker.reply(req.token, req.props, status, body, contentType)
+	} else if req.method == "GET" {
+		responseTopic := req.token + "/" + req.path + "/response/" + req.requestId
+		if status < 200 || status >= 300 {
 			_ = broker.Publish(responseTopic, map[string]interface{}{
-				"$status": w.statusCode,
-				"$error":  string(w.body.Bytes()),
+				"$status": status,
+				"$error":  string(body),
 			})
 		} else {
-			_ = broker.Publish(responseTopic, w.body.Bytes())
+			_ = broker.Publish(responseTopic, body)
 		}
 	}
 }
+
+// reply publishes the response of an MQTT 5 request to the response topic.
+func (broker *Broker) reply(token string, props *Properties, status int, body []byte, contentType string) {
+	// Prevent devices from publishing to topics of other devices through
+	// the response topic
+	if token == "" || !strings.HasPrefix(props.ResponseTopic, token+"/") {
+		logrus.Errorf("Invalid response topic: %s", props.ResponseTopic)
+		return
+	}
+
+	if status == 0 {
+		status = http.StatusOK
+	}
+	_ = broker.PublishWithProperties(props.ResponseTopic, body, &Properties{
+		CorrelationData: props.CorrelationData,
+		ContentType:     contentType,
+		User:            map[string]string{"status": strconv.Itoa(status)},
+	})
+}
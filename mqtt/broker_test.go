@@ -0,0 +1,379 @@
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhill42/iota/mqtt/packet"
+	"github.com/redhill42/iota/mqtt/server"
+)
+
+func TestBroker(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "MQTT Broker Suite")
+}
+
+// client is a minimal MQTT 5 client connected to the embedded broker
+type client struct {
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+func dial(broker *Broker) *client {
+	nc, sc := net.Pipe()
+	go broker.server.ServeConn(sc)
+
+	c := &client{nc, bufio.NewReader(nc)}
+	c.write(&packet.Connect{ProtocolName: "MQTT", ProtocolVersion: packet.V5, CleanStart: true, ClientID: "device"})
+	ExpectWithOffset(1, c.read()).To(BeAssignableToTypeOf(&packet.Connack{}))
+	return c
+}
+
+func (c *client) write(p packet.Packet) {
+	c.nc.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	ExpectWithOffset(1, packet.Write(c.nc, p, packet.V5)).To(Succeed())
+}
+
+func (c *client) read() packet.Packet {
+	c.nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := packet.Read(c.r, packet.V5, 0)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	return p
+}
+
+var _ = Describe("Embedded broker", func() {
+	var (
+		broker *Broker
+		c      *client
+	)
+
+	mux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("Authorization") != "bearer TOKEN" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"method":"` + r.Method + `","path":"` + r.URL.Path + `"}`))
+	})
+
+	BeforeEach(func() {
+		b, err := NewEmbeddedBroker(nil, nil)
+		Expect(err).NotTo(HaveOccurred())
+		b.mux = mux
+		Expect(b.server.Subscribe(apiTopic, 1, func(msg *packet.Publish) {
+			b.serveMQTT(msg.Topic, msg.Payload, decodeProperties(msg.Properties))
+		})).To(Succeed())
+		broker = b
+		c = dial(broker)
+	})
+
+	AfterEach(func() {
+		c.nc.Close()
+		broker.Close()
+	})
+
+	subscribe := func(filter string) {
+		c.write(&packet.Subscribe{PacketID: 1, Subscriptions: []packet.Subscription{{Filter: filter}}})
+		ExpectWithOffset(1, c.read()).To(BeAssignableToTypeOf(&packet.Suback{}))
+	}
+
+	It("should reply MQTT 5 requests on response topic", func() {
+		subscribe("TOKEN/me/response")
+
+		props := &packet.Properties{ResponseTopic: "TOKEN/me/response", CorrelationData: []byte("42")}
+		props.AddUser("method", "put")
+		c.write(&packet.Publish{Topic: "api/v1/TOKEN/me/attributes", Properties: props, Payload: []byte("{}")})
+
+		resp := c.read().(*packet.Publish)
+		Expect(resp.Topic).To(Equal("TOKEN/me/response"))
+		Expect(resp.Properties.CorrelationData).To(Equal([]byte("42")))
+		status, _ := resp.Properties.GetUser("status")
+		Expect(status).To(Equal("200"))
+		Expect(resp.Properties.ContentType).To(Equal("application/json"))
+		Expect(string(resp.Payload)).To(Equal(`{"method":"PUT","path":"/api/v1/me/attributes"}`))
+	})
+
+	It("should report error status in user property", func() {
+		subscribe("WRONG/me/response")
+
+		props := &packet.Properties{ResponseTopic: "WRONG/me/response", CorrelationData: []byte("1")}
+		c.write(&packet.Publish{Topic: "api/v1/WRONG/me/attributes", Properties: props})
+
+		resp := c.read().(*packet.Publish)
+		status, _ := resp.Properties.GetUser("status")
+		Expect(status).To(Equal("401"))
+	})
+
+	It("should keep legacy response topic for requests without properties", func() {
+		subscribe("TOKEN/me/attributes/response/7")
+		c.write(&packet.Publish{Topic: "api/v1/TOKEN/me/attributes/request/7"})
+
+		resp := c.read().(*packet.Publish)
+		Expect(resp.Topic).To(Equal("TOKEN/me/attributes/response/7"))
+		Expect(string(resp.Payload)).To(Equal(`{"method":"GET","path":"/api/v1/me/attributes"}`))
+	})
+
+	It("should not publish response to topics of other devices", func() {
+		subscribe("OTHER/#")
+
+		props := &packet.Properties{ResponseTopic: "OTHER/me/attributes", CorrelationData: []byte("1")}
+		c.write(&packet.Publish{Topic: "api/v1/TOKEN/me/attributes", Properties: props})
+
+		c.nc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := packet.Read(c.r, packet.V5, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should deliver properties of messages published by server", func() {
+		subscribe("TOKEN/me/rpc/request/+")
+
+		err := broker.PublishWithProperties("TOKEN/me/rpc/request/1", []byte("{}"), &Properties{
+			ResponseTopic:   "TOKEN/me/rpc/response/1",
+			CorrelationData: []byte("1"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		req := c.read().(*packet.Publish)
+		Expect(req.Properties.ResponseTopic).To(Equal("TOKEN/me/rpc/response/1"))
+		Expect(req.Properties.CorrelationData).To(Equal([]byte("1")))
+	})
+})
+
+var _ = Describe("Dispatcher", func() {
+	request := func(token string, n int) *apiRequest {
+		return &apiRequest{token: token, topic: token, payload: []byte{byte(n)}}
+	}
+
+	It("should process requests of same device in order", func() {
+		var mu sync.Mutex
+		received := make(map[string][]byte)
+		done := make(chan bool, 200)
+
+		d := startDispatcher(4, 100, false, func(req *apiRequest) {
+			mu.Lock()
+			received[req.token] = append(received[req.token], req.payload[0])
+			mu.Unlock()
+			done <- true
+		}, nil)
+		defer d.close()
+
+		for i := 0; i < 50; i++ {
+			for _, token := range []string{"a", "b", "c", "d"} {
+				d.dispatch(request(token, i))
+			}
+		}
+		for i := 0; i < 200; i++ {
+			Eventually(done).Should(Receive())
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, token := range []string{"a", "b", "c", "d"} {
+			Expect(received[token]).To(HaveLen(50))
+			for i, n := range received[token] {
+				Expect(n).To(Equal(byte(i)))
+			}
+		}
+	})
+
+	// blocked returns a dispatcher with a single worker that is blocked on
+	// the first request until the returned channel is closed
+	blocked := func(size int, reject bool, rejected chan *apiRequest) (*dispatcher, chan struct{}, chan byte) {
+		unblock := make(chan struct{})
+		started := make(chan bool)
+		served := make(chan byte, 10)
+		d := startDispatcher(1, size, reject, func(req *apiRequest) {
+			if req.payload[0] == 0 {
+				started <- true
+				<-unblock
+			}
+			served <- req.payload[0]
+		}, func(req *apiRequest) {
+			rejected <- req
+		})
+		d.dispatch(request("a", 0))
+		Eventually(started).Should(Receive())
+		return d, unblock, served
+	}
+
+	It("should drop oldest requests when queue is full", func() {
+		d, unblock, served := blocked(2, false, nil)
+		defer d.close()
+
+		for i := 1; i <= 3; i++ {
+			d.dispatch(request("a", i))
+		}
+		close(unblock)
+
+		Eventually(served).Should(Receive(Equal(byte(0))))
+		Eventually(served).Should(Receive(Equal(byte(2))))
+		Eventually(served).Should(Receive(Equal(byte(3))))
+	})
+
+	It("should reject new requests when queue is full", func() {
+		rejected := make(chan *apiRequest, 10)
+		d, unblock, served := blocked(2, true, rejected)
+		defer d.close()
+
+		for i := 1; i <= 3; i++ {
+			d.dispatch(request("a", i))
+		}
+		var req *apiRequest
+		Expect(rejected).To(Receive(&req))
+		Expect(req.payload[0]).To(Equal(byte(3)))
+		close(unblock)
+
+		Eventually(served).Should(Receive(Equal(byte(0))))
+		Eventually(served).Should(Receive(Equal(byte(1))))
+		Eventually(served).Should(Receive(Equal(byte(2))))
+	})
+})
+
+var _ = Describe("Broker client", func() {
+	var (
+		addr   string
+		srv    *server.Server
+		broker *Broker
+	)
+
+	serve := func() {
+		l, err := net.Listen("tcp", addr)
+		ExpectWithOffset(1, err).NotTo(HaveOccurred())
+		addr = l.Addr().String()
+		srv = server.New(nil, nil)
+		go srv.Serve(l)
+	}
+
+	BeforeEach(func() {
+		addr = "127.0.0.1:0"
+		serve()
+		os.Setenv("IOTA_MQTT_URL", "tcp://"+addr)
+		os.Setenv("IOTA_MQTT_CLIENTID", "apiserver")
+
+		var err error
+		broker, err = NewBroker("", "")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		broker.Close()
+		srv.Close()
+		os.Unsetenv("IOTA_MQTT_URL")
+		os.Unsetenv("IOTA_MQTT_CLIENTID")
+	})
+
+	It("should restore subscriptions after reconnect", func() {
+		received := make(chan string, 10)
+		Expect(broker.Subscribe("x/+", func(topic string, _ []byte) {
+			received <- topic
+		})).To(Succeed())
+
+		requests := make(chan string, 10)
+		Expect(broker.Forward(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- r.URL.Path
+		}))).To(Succeed())
+		Expect(broker.IsConnected()).To(BeTrue())
+
+		lost := make(chan error, 1)
+		broker.OnConnectionLost(func(err error) { lost <- err })
+
+		srv.Publish(&packet.Publish{Topic: "x/1"})
+		Eventually(received).Should(Receive(Equal("x/1")))
+
+		// Restart the server, all sessions are lost
+		srv.Close()
+		Eventually(lost).Should(Receive())
+		Expect(broker.IsConnected()).To(BeFalse())
+		Expect(broker.Status().Error).NotTo(BeEmpty())
+		serve()
+
+		Eventually(broker.IsConnected, 10*time.Second).Should(BeTrue())
+		Eventually(func() string {
+			srv.Publish(&packet.Publish{Topic: "x/2"})
+			select {
+			case topic := <-received:
+				return topic
+			case <-time.After(100 * time.Millisecond):
+				return ""
+			}
+		}, 5*time.Second).Should(Equal("x/2"))
+
+		srv.Publish(&packet.Publish{Topic: "api/v1/TOKEN/me/attributes"})
+		Eventually(requests).Should(Receive(Equal("/api/v1/me/attributes")))
+	})
+})
+
+var _ = Describe("Clustered brokers", func() {
+	var (
+		srv     *server.Server
+		brokers []*Broker
+	)
+
+	BeforeEach(func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		srv = server.New(nil, nil)
+		go srv.Serve(l)
+
+		os.Setenv("IOTA_MQTT_URL", "tcp://"+l.Addr().String())
+		os.Setenv("IOTA_MQTT_SHAREGROUP", "apiservers")
+		brokers = nil
+		for _, clientid := range []string{"apiserver1", "apiserver2"} {
+			os.Setenv("IOTA_MQTT_CLIENTID", clientid)
+			b, err := NewBroker("", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b.Clustered()).To(BeTrue())
+			brokers = append(brokers, b)
+		}
+	})
+
+	AfterEach(func() {
+		for _, b := range brokers {
+			b.Close()
+		}
+		srv.Close()
+		os.Unsetenv("IOTA_MQTT_URL")
+		os.Unsetenv("IOTA_MQTT_SHAREGROUP")
+		os.Unsetenv("IOTA_MQTT_CLIENTID")
+	})
+
+	It("should process each request on only one API server", func() {
+		requests := make(chan int, 100)
+		for i, b := range brokers {
+			i := i
+			Expect(b.Forward(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests <- i
+			}))).To(Succeed())
+		}
+
+		for i := 0; i < 20; i++ {
+			srv.Publish(&packet.Publish{Topic: "api/v1/TOKEN/me/attributes", QoS: 1})
+		}
+		Eventually(func() int { return len(requests) }).Should(Equal(20))
+		Consistently(func() int { return len(requests) }, 200*time.Millisecond).Should(Equal(20))
+	})
+
+	It("should broadcast events to other API servers", func() {
+		events := make([]chan string, len(brokers))
+		for i, b := range brokers {
+			ch := make(chan string, 10)
+			events[i] = ch
+			Expect(b.OnBroadcast("test", func(payload []byte) {
+				ch <- string(payload)
+			})).To(Succeed())
+			Expect(b.Forward(http.NotFoundHandler())).To(Succeed())
+		}
+
+		Expect(brokers[0].Broadcast("test", "hello")).To(Succeed())
+		Eventually(events[1]).Should(Receive(Equal("hello")))
+		Consistently(events[0], 200*time.Millisecond).ShouldNot(Receive())
+	})
+})
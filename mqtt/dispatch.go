@@ -0,0 +1,136 @@
+package mqtt
+
+import (
+	"expvar"
+	"hash/fnv"
+	"strconv"
+	"sync"
+
+	"github.com/redhill42/iota/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Overflow policies applied when the inbound message queue is full.
+const (
+	// DropOldest drops the oldest queued message to make room for the new one
+	DropOldest = "drop-oldest"
+
+	// Reject rejects the new message. Requests that expect a response are
+	// replied with status 503 Service Unavailable.
+	Reject = "reject"
+)
+
+// Inbound queue metrics: messages currently queued, processed, dropped by
+// the drop-oldest policy, and rejected by the reject policy.
+var queueMetrics = expvar.NewMap("mqtt")
+
+// dispatcher processes inbound API requests with a bounded pool of workers.
+// Each worker has its own bounded queue, and all requests of the same device
+// token are processed by the same worker so that they are processed in the
+// order they were received.
+type dispatcher struct {
+	queues []chan *apiRequest
+	reject bool
+	serve  func(*apiRequest)
+	reply  func(*apiRequest)
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newDispatcher creates a dispatcher configured by the "mqtt.workers",
+// "mqtt.queueSize" and "mqtt.overflow" options.
+func newDispatcher(serve, reject func(*apiRequest)) *dispatcher {
+	workers, err := strconv.Atoi(config.GetOrDefault("mqtt.workers", "16"))
+	if err != nil || workers <= 0 {
+		logrus.Warnf("mqtt: Invalid number of workers: %s", config.Get("mqtt.workers"))
+		workers = 16
+	}
+
+	size, err := strconv.Atoi(config.GetOrDefault("mqtt.queueSize", "1000"))
+	if err != nil || size <= 0 {
+		logrus.Warnf("mqtt: Invalid queue size: %s", config.Get("mqtt.queueSize"))
+		size = 1000
+	}
+
+	overflow := config.GetOrDefault("mqtt.overflow", DropOldest)
+	if overflow != DropOldest && overflow != Reject {
+		logrus.Warnf("mqtt: Invalid overflow policy: %s", overflow)
+		overflow = DropOldest
+	}
+
+	return startDispatcher(workers, size, overflow == Reject, serve, reject)
+}
+
+func startDispatcher(workers, size int, reject bool, serve, reply func(*apiRequest)) *dispatcher {
+	d := &dispatcher{
+		queues: make([]chan *apiRequest, workers),
+		reject: reject,
+		serve:  serve,
+		reply:  reply,
+		done:   make(chan struct{}),
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan *apiRequest, size)
+		d.wg.Add(1)
+		go d.work(d.queues[i])
+	}
+	return d
+}
+
+func (d *dispatcher) work(q chan *apiRequest) {
+	defer d.wg.Done()
+	for {
+		select {
+		case req := <-q:
+			queueMetrics.Add("queued", -1)
+			d.serve(req)
+			queueMetrics.Add("processed", 1)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// dispatch queues a request to the worker of the device. It never blocks,
+// the overflow policy is applied if the queue is full.
+func (d *dispatcher) dispatch(req *apiRequest) {
+	h := fnv.New32a()
+	h.Write([]byte(req.token))
+	q := d.queues[h.Sum32()%uint32(len(d.queues))]
+
+	for {
+		select {
+		case q <- req:
+			queueMetrics.Add("queued", 1)
+			return
+		default:
+		}
+
+		if d.reject {
+			logrus.Warnf("mqtt: Queue is full, rejecting message on %s", req.topic)
+			queueMetrics.Add("rejected", 1)
+			d.reply(req)
+			return
+		}
+
+		select {
+		case old := <-q:
+			logrus.Warnf("mqtt: Queue is full, dropping message on %s", old.topic)
+			queueMetrics.Add("queued", -1)
+			queueMetrics.Add("dropped", 1)
+		default:
+		}
+	}
+}
+
+// close stops all workers. Queued requests are discarded.
+func (d *dispatcher) close() {
+	close(d.done)
+	d.wg.Wait()
+	for _, q := range d.queues {
+		for len(q) > 0 {
+			<-q
+			queueMetrics.Add("queued", -1)
+		}
+	}
+}
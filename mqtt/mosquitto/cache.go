@@ -0,0 +1,109 @@
+package mosquitto
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Decision cache metrics: cache hits and misses, and cached decisions
+// invalidated because the device was removed or its token changed.
+var cacheMetrics = expvar.NewMap("authcache")
+
+// decisionCache caches token authentication and ACL decisions, so that
+// tokens are not verified on every message. Password logins are never
+// cached. The decisions are cached for a limited time. The decisions made for a device
+// are invalidated when the device is removed or its token is changed.
+type decisionCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]decision
+}
+
+type decision struct {
+	allow   bool
+	device  string // the device the decision was made for
+	expires time.Time
+}
+
+// newDecisionCache creates a cache that keeps at most size decisions for
+// the ttl duration. Nothing is cached if ttl is not positive.
+func newDecisionCache(ttl time.Duration, size int) *decisionCache {
+	return &decisionCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]decision),
+	}
+}
+
+func (c *decisionCache) get(key string) (allow, ok bool) {
+	if c.ttl <= 0 {
+		return false, false
+	}
+
+	c.mu.Lock()
+	d, ok := c.entries[key]
+	if ok && time.Now().After(d.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+
+	if ok {
+		cacheMetrics.Add("hits", 1)
+	} else {
+		cacheMetrics.Add("misses", 1)
+	}
+	return d.allow, ok
+}
+
+func (c *decisionCache) put(key string, allow bool, device string) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Remove expired decisions when the cache is full, and start over if
+	// all decisions are still valid
+	if len(c.entries) >= c.size {
+		for k, d := range c.entries {
+			if now.After(d.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.size {
+			c.entries = make(map[string]decision)
+		}
+	}
+	c.entries[key] = decision{allow, device, now.Add(c.ttl)}
+}
+
+// invalidate removes all decisions made for the device.
+func (c *decisionCache) invalidate(device string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, d := range c.entries {
+		if d.device == device {
+			delete(c.entries, k)
+			cacheMetrics.Add("invalidated", 1)
+		}
+	}
+}
+
+// flush removes all decisions.
+func (c *decisionCache) flush() {
+	c.mu.Lock()
+	c.entries = make(map[string]decision)
+	c.mu.Unlock()
+}
+
+// cacheKey joins the parts of a cache key with a separator that can't
+// appear in user names, client ids or topics.
+func cacheKey(parts ...string) string {
+	return strings.Join(parts, "\x00")
+}
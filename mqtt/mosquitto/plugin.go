@@ -4,15 +4,22 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/redhill42/iota/auth"
 	"github.com/redhill42/iota/auth/userdb"
 	"github.com/redhill42/iota/config"
 	"github.com/redhill42/iota/device"
+	"github.com/redhill42/iota/mqtt"
+	"github.com/redhill42/iota/mqtt/acl"
 
 	_ "github.com/redhill42/iota/auth/userdb/file"
+	_ "github.com/redhill42/iota/auth/userdb/ldap"
 	_ "github.com/redhill42/iota/auth/userdb/mongodb"
+	_ "github.com/redhill42/iota/auth/userdb/sqldb"
 )
 
 var users *userdb.UserDatabase
@@ -23,7 +30,41 @@ const superUser = "iota"
 
 var superUserPw string
 
+// certAuth enables devices to authenticate with X.509 client certificates.
+var certAuth bool
+
+// passwordClients are the user names of clients authenticated by
+// AuthUnpwdCheck, keyed by client id. Mosquitto doesn't check the password
+// of clients identified by their certificates, so the certificate mapping
+// only applies to clients that are not recorded here.
+var passwordClients = new(sync.Map)
+
+// aclRules are the configured ACL rules. The built-in policy is used if
+// no rule source is configured.
+var aclRules *acl.ACL
+
+// decisions caches the authentication and ACL decisions.
+var decisions = newDecisionCache(0, 0)
+
+// pluginOpts are the auth_opt_* options in mosquitto configuration, which
+// override the options in iota configuration file.
+var pluginOpts = map[string]string{}
+
+// option returns the value of a plugin option, or the configuration value
+// if the plugin option is not set.
+func option(name, key, deflt string) string {
+	if v, ok := pluginOpts[name]; ok {
+		return v
+	}
+	return config.GetOrDefault(key, deflt)
+}
+
 func AuthPluginInit(keys []string, values []string, authOptsNum int) bool {
+	pluginOpts = make(map[string]string, authOptsNum)
+	for i := 0; i < authOptsNum && i < len(keys) && i < len(values); i++ {
+		pluginOpts[keys[i]] = values[i]
+	}
+
 	err := config.Initialize()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "go-auth: cannot open configuration file: %v\n", err)
@@ -35,13 +76,6 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) bool {
 		return false
 	}
 
-	password, err := users.GetPassword("mqtt", 32)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "go-auth: user database error: %v\n", err)
-		return false
-	}
-	superUserPw = string(password)
-
 	if authz, err = auth.NewAuthenticator(users); err != nil {
 		fmt.Fprintf(os.Stderr, "go-auth: cannot initialize authenticator")
 		return false
@@ -52,9 +86,66 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) bool {
 		return false
 	}
 
+	if err = Init(users, authz, devices); err != nil {
+		fmt.Fprintf(os.Stderr, "go-auth: initialization error: %v\n", err)
+		return false
+	}
+
 	return true
 }
 
+// Init initializes the authentication and ACL checks with opened
+// databases. It's used by the embedded MQTT broker, which shares the
+// databases with the API server instead of opening its own.
+func Init(u *userdb.UserDatabase, a *auth.Authenticator, d *device.Manager) error {
+	password, err := u.GetPassword("mqtt", 32)
+	if err != nil {
+		return err
+	}
+	users, authz, devices = u, a, d
+	superUserPw = string(password)
+	certAuth, _ = strconv.ParseBool(option("cert_auth", "mqtt.certAuth", "false"))
+	passwordClients = new(sync.Map)
+	initCache()
+	return loadACL()
+}
+
+// initCache creates the decision cache configured by the "cache_ttl" and
+// "cache_size" plugin options, or the "mqtt.cacheTTL" and "mqtt.cacheSize"
+// configuration options. The TTL is in seconds, and caching is disabled if
+// it's zero. Decisions made for a device are invalidated when the device is
+// removed or its token is replaced, but only if the change is made through
+// the same device manager. Otherwise, as with a separate mosquitto process,
+// stale decisions are kept until the TTL expires.
+func initCache() {
+	ttl, _ := strconv.Atoi(option("cache_ttl", "mqtt.cacheTTL", "60"))
+	size, _ := strconv.Atoi(option("cache_size", "mqtt.cacheSize", "10000"))
+	if size <= 0 {
+		size = 10000
+	}
+	decisions = newDecisionCache(time.Duration(ttl)*time.Second, size)
+	devices.OnTokenChange(decisions.invalidate)
+}
+
+// loadACL loads ACL rules from the file or MongoDB database configured by
+// the "acl_file" or "acl_db" plugin options, or the "mqtt.aclFile" or
+// "mqtt.aclDB" configuration options.
+func loadACL() (err error) {
+	aclRules = nil
+	if file := option("acl_file", "mqtt.aclFile", ""); file != "" {
+		aclRules, err = acl.Load(file)
+	} else if url := option("acl_db", "mqtt.aclDB", ""); url != "" {
+		aclRules, err = acl.LoadDB(url)
+	}
+	if aclRules != nil {
+		aclRules.VerifyToken = func(token string) bool {
+			_, ok := validToken(token)
+			return ok
+		}
+	}
+	return err
+}
+
 func AuthPluginCleanup() {
 	if users != nil {
 		users.Close()
@@ -62,11 +153,14 @@ func AuthPluginCleanup() {
 	if devices != nil {
 		devices.Close()
 	}
+	decisions.flush()
 }
 
-func AuthUnpwdCheck(username, password, clientid string) bool {
-	var err error
-
+// AuthUnpwdCheck authenticates a client with the user name and password.
+// The IP address of the client is recorded in the login audit trail and
+// locked out after too many failed password logins. It's empty if not
+// known, such as with mosquitto versions before 1.5.
+func AuthUnpwdCheck(username, password, clientid, addr string) bool {
 	// super user has full access to all topic
 	if username == superUser {
 		return password == superUserPw
@@ -77,23 +171,107 @@ func AuthUnpwdCheck(username, password, clientid string) bool {
 		return true
 	}
 
+	// Password logins are never cached, so that password changes, disabled
+	// users and lockouts take effect at once, and every login is audited
+	var allow bool
+	if password != "" {
+		allow, _ = checkUnpwd(username, password, addr)
+	} else {
+		var ok bool
+		key := cacheKey("auth", username)
+		if allow, ok = decisions.get(key); !ok {
+			var id string
+			allow, id = checkUnpwd(username, password, addr)
+			decisions.put(key, allow, id)
+		}
+	}
+
+	if allow {
+		passwordClients.Store(clientid, username)
+	} else {
+		passwordClients.Delete(clientid)
+	}
+	return allow
+}
+
+// checkUnpwd authenticates a user or device. Returns the device id if a
+// device is authenticated.
+func checkUnpwd(username, password, addr string) (bool, string) {
 	// A user can authenticate itself with username and password
 	if password != "" {
-		_, err = users.Authenticate(username, password)
-		return err == nil
+		_, err := users.Login(username, password, addr, userdb.ChannelMQTT)
+		return err == nil, ""
 	}
 
 	// User can also authenticate with the access token
-	if _, err = authz.VerifyToken(username); err == nil {
-		return true
+	if _, err := authz.VerifyToken(username); err == nil {
+		return true, ""
 	}
 
-	// Authorized device must provide a valid token
-	if _, err = devices.VerifyToken(username); err == nil {
-		return true
+	// Service accounts authenticate with API keys. The client address is
+	// not known, so keys with IP allowlist are rejected.
+	if auth.IsAPIKey(username) {
+		_, err := authz.VerifyAPIKey(username, "")
+		return err == nil, ""
+	}
+
+	// Authorized device must provide a valid token. The device id is
+	// returned even if the token was revoked, so that the decision is
+	// invalidated when a new token is issued to the device.
+	id, ok := validToken(username)
+	return ok, id
+}
+
+// validToken checks that the token is the current access token of an
+// existing device, so that tokens of removed devices and replaced tokens
+// are rejected. The device database is always queried, since the cached
+// tokens are not invalidated when devices are changed by the API server.
+// The device id is returned if the token is signed for a device, whether
+// or not it's current.
+func validToken(token string) (string, bool) {
+	id, err := devices.VerifyToken(token)
+	if err != nil {
+		return "", false
+	}
+	current, ok := currentToken(id)
+	return id, ok && current == token
+}
+
+// currentToken returns the access token of a device from device database.
+func currentToken(id string) (string, bool) {
+	r, err := devices.Find(id, []string{"token"})
+	if err != nil {
+		return "", false
+	}
+	token, ok := r["token"].(string)
+	return token, ok
+}
+
+// deviceToken returns the id and access token of a device connected with
+// the user name. Devices use the access token as user name, or
+// authenticate with an X.509 client certificate if "mqtt.certAuth" is
+// enabled. The common name of the certificate is the device id, which
+// mosquitto uses as the user name when use_identity_as_username is set on
+// the listener. Clients that logged in with a password are never
+// identified by the user name. The device id of a revoked token is
+// returned with ok set to false.
+func deviceToken(clientid, username string) (id, token string, ok bool) {
+	if id, ok = validToken(username); ok || id != "" {
+		return id, username, ok
 	}
+	if certAuth && !byPassword(clientid, username) {
+		if token, ok := currentToken(username); ok {
+			return username, token, true
+		}
+	}
+	return "", "", false
+}
 
-	return false
+// byPassword returns true if the client was authenticated by AuthUnpwdCheck
+// rather than by a certificate.
+func byPassword(clientid, username string) bool {
+	name, ok := passwordClients.Load(clientid)
+	return ok && name == username
 }
 
 const (
@@ -115,43 +293,127 @@ func AuthAclCheck(clientid, username, topic string, acc int) bool {
 		return true
 	}
 
-	// anonymous device can publish request to "api/v1/me/claim" and
-	// subscribe response on "me/claim/%c"
+	// Internal topics are only used among API servers
+	if strings.HasPrefix(topic, mqtt.InternalTopicPrefix) {
+		return false
+	}
+
+	key := cacheKey("acl", clientid, username, topic, strconv.Itoa(acc))
+	if allow, ok := decisions.get(key); ok {
+		return allow
+	}
+
+	c, ok := resolveClient(clientid, username)
+	allow := false
+	if ok && aclRules != nil {
+		allow = aclRules.Check(c, topic, acc)
+	} else if ok {
+		allow = checkDefault(c, topic, acc)
+	}
+	decisions.put(key, allow, c.DeviceID)
+	return allow
+}
+
+// resolveClient determines the role of a client. Clients have the built-in
+// roles of anonymous devices, authorized devices and users. Users also have
+// the roles assigned in the user database or API key. Returns false if the
+// client is a device whose token was revoked after it connected, or a
+// service account whose API key was revoked.
+func resolveClient(clientid, username string) (*acl.Client, bool) {
+	c := &acl.Client{Username: username, ClientID: clientid}
 	if username == "" {
-		if clientid == "" {
+		c.Role = acl.RoleAnonymous
+	} else if auth.IsAPIKey(username) {
+		user, err := authz.VerifyAPIKey(username, "")
+		if err != nil {
+			return c, false
+		}
+		c.Role = acl.RoleUser
+		c.Roles, c.Tenant = user.Roles, user.Tenant
+		if len(c.Roles) == 0 {
+			c.Roles = userdb.DefaultRoles()
+		}
+	} else if id, token, ok := deviceToken(clientid, username); id != "" {
+		c.Role, c.DeviceID, c.Token = acl.RoleDevice, id, token
+		c.Tenant, _ = devices.GetTenant(id)
+		return c, ok
+	} else {
+		c.Role = acl.RoleUser
+		c.Roles, c.Tenant = userInfo(username)
+	}
+	return c, true
+}
+
+// userInfo returns the roles and tenant of a user connected with the user
+// name, which is a user token or the name of the user.
+func userInfo(username string) (roles []string, tenant string) {
+	if user, err := authz.VerifyUserToken(username); err == nil {
+		roles, tenant = user.Roles, user.Tenant
+	} else {
+		var user userdb.BasicUser
+		if err := users.Find(username, &user); err == nil {
+			roles, tenant = user.Roles, user.Tenant
+		}
+	}
+	if len(roles) == 0 {
+		roles = userdb.DefaultRoles()
+	}
+	return roles, tenant
+}
+
+// sameTenant returns true if the device identified by the access token is
+// valid and belongs to the tenant of the client.
+func sameTenant(c *acl.Client, token string) bool {
+	id, ok := validToken(token)
+	if !ok {
+		return false
+	}
+	tenant, err := devices.GetTenant(id)
+	return err == nil && tenant == c.Tenant
+}
+
+// deviceTopic returns the device access token in an API request or
+// response topic.
+func deviceTopic(topic string) string {
+	if m := apiRequestPattern.FindStringSubmatch(topic); len(m) == 2 {
+		return m[1]
+	}
+	if m := apiResponsePattern.FindStringSubmatch(topic); len(m) == 2 {
+		return m[1]
+	}
+	return ""
+}
+
+// checkDefault checks access with the built-in policy, which is used if no
+// ACL rules are configured.
+func checkDefault(c *acl.Client, topic string, acc int) bool {
+	switch c.Role {
+	case acl.RoleAnonymous:
+		// anonymous device can publish request to "api/v1/me/claim" and
+		// subscribe response on "me/claim/%c"
+		if c.ClientID == "" {
 			return false
 		}
 		if acc == _MOSQ_ACL_WRITE {
 			return claimRequestPattern.MatchString(topic)
 		} else {
 			m := claimResponsePattern.FindStringSubmatch(topic)
-			return len(m) == 2 && m[1] == clientid
+			return len(m) == 2 && m[1] == c.ClientID
 		}
-	}
 
-	if _, err := devices.VerifyToken(username); err == nil {
+	case acl.RoleDevice:
 		// authorized device can publish request to api request topic, either
 		// for itself or other devices
 		if m := apiRequestPattern.FindStringSubmatch(topic); len(m) == 2 {
 			if acc == _MOSQ_ACL_WRITE {
-				if m[1] == username {
-					return true
-				} else {
-					_, err = devices.VerifyToken(m[1])
-					return err == nil
-				}
+				return m[1] == c.Token || sameTenant(c, m[1])
 			}
 			return false
 		}
 
 		// device can subscribe api response topic for itself or other devices
 		if m := apiResponsePattern.FindStringSubmatch(topic); len(m) == 2 {
-			if m[1] == username {
-				return true
-			} else {
-				_, err = devices.VerifyToken(m[1])
-				return err == nil
-			}
+			return m[1] == c.Token || sameTenant(c, m[1])
 		}
 
 		// check for wildcard topics
@@ -163,8 +425,24 @@ func AuthAclCheck(clientid, username, topic string, acc int) bool {
 
 		// devices can communicate each other on any topics
 		return true
-	}
 
-	// authorized users has full access on any topic
-	return true
+	default:
+		// authorized users can subscribe to any topic if permitted to read
+		// devices, and publish to any topic if permitted to write devices
+		perm := userdb.DeviceRead
+		if acc == _MOSQ_ACL_WRITE {
+			perm = userdb.DeviceWrite
+		}
+		if !userdb.HasPermission(c.Roles, perm) {
+			return false
+		}
+
+		// users of a tenant can only access API topics of devices in the
+		// tenant
+		if c.Tenant != "" {
+			token := deviceTopic(topic)
+			return token != "" && sameTenant(c, token)
+		}
+		return true
+	}
 }
@@ -1,8 +1,12 @@
 package mosquitto
 
 import (
+	"expvar"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -11,11 +15,16 @@ import (
 	"github.com/redhill42/iota/auth/userdb"
 	_ "github.com/redhill42/iota/auth/userdb/mongodb"
 	"github.com/redhill42/iota/device"
+	"github.com/redhill42/iota/mqtt/acl"
 )
 
-func TestAuthPlugin(t *testing.T) {
+func setupDatabase() {
 	os.Setenv("IOTA_USERDB_URL", "mongodb://127.0.0.1:27017/mos_auth_test")
 	os.Setenv("IOTA_DEVICEDB_URL", "mongodb://127.0.0.1:27017/mos_auth_test")
+}
+
+func TestAuthPlugin(t *testing.T) {
+	setupDatabase()
 
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "AuthPlugin Suite")
@@ -28,6 +37,7 @@ var _ = Describe("AuthPlugin", func() {
 		TEST_DEVICE    = "test"
 		OTHER_DEVICE   = "other"
 		TEST_CLIENT_ID = "TEST_CLIENT"
+		TEST_ADDR      = "10.1.2.3"
 	)
 
 	var (
@@ -50,10 +60,11 @@ var _ = Describe("AuthPlugin", func() {
 		mgr, err = device.NewManager(nil)
 		Expect(err).NotTo(HaveOccurred())
 
-		user := userdb.BasicUser{Name: TEST_USER}
+		user := userdb.BasicUser{Name: TEST_USER, Roles: []string{userdb.RoleAdmin}}
 		Ω(db.Create(&user, TEST_PASSWORD)).Should(Succeed())
-		_, userToken, err = authz.Authenticate(TEST_USER, TEST_PASSWORD)
+		_, token, err := authz.Authenticate(TEST_USER, TEST_PASSWORD)
 		Expect(err).ShouldNot(HaveOccurred())
+		userToken = token.AccessToken
 
 		deviceToken, err = mgr.CreateToken(TEST_DEVICE)
 		Expect(err).NotTo(HaveOccurred())
@@ -80,35 +91,45 @@ var _ = Describe("AuthPlugin", func() {
 	Describe("Authentication", func() {
 		Context("Authorized user", func() {
 			It("should authenticate by mosquitto with user name and password", func() {
-				Ω(AuthUnpwdCheck(TEST_USER, TEST_PASSWORD, TEST_CLIENT_ID)).Should(BeTrue())
+				Ω(AuthUnpwdCheck(TEST_USER, TEST_PASSWORD, TEST_CLIENT_ID, TEST_ADDR)).Should(BeTrue())
 			})
 
 			It("should authenticate by mosquitto with access token", func() {
-				Ω(AuthUnpwdCheck(userToken, "", TEST_CLIENT_ID)).Should(BeTrue())
+				Ω(AuthUnpwdCheck(userToken, "", TEST_CLIENT_ID, TEST_ADDR)).Should(BeTrue())
 			})
 		})
 
 		Context("Unauthorized user", func() {
 			It("should reject by mosquitto", func() {
-				Ω(AuthUnpwdCheck("nobody", "nobody", TEST_CLIENT_ID)).Should(BeFalse())
+				Ω(AuthUnpwdCheck("nobody", "nobody", TEST_CLIENT_ID, TEST_ADDR)).Should(BeFalse())
+			})
+
+			It("should record the client address of failed logins", func() {
+				Ω(AuthUnpwdCheck(TEST_USER, "wrong", TEST_CLIENT_ID, TEST_ADDR)).Should(BeFalse())
+
+				admin := &userdb.BasicUser{Name: "admin", Roles: []string{userdb.RoleAdmin}}
+				events, err := db.LoginEvents(admin, &userdb.LoginFilter{User: TEST_USER, IP: TEST_ADDR, Result: userdb.LoginFailure})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(events).ShouldNot(BeEmpty())
+				Ω(events[0].Channel).Should(Equal(userdb.ChannelMQTT))
 			})
 		})
 
 		Context("Authorized device", func() {
 			It("should authenticate by mosquitto with access token", func() {
-				Ω(AuthUnpwdCheck(deviceToken, "", TEST_CLIENT_ID)).Should(BeTrue())
+				Ω(AuthUnpwdCheck(deviceToken, "", TEST_CLIENT_ID, TEST_ADDR)).Should(BeTrue())
 			})
 		})
 
 		Context("Unauthorized device", func() {
 			It("should reject by mosquitto", func() {
-				Ω(AuthUnpwdCheck("FAKE_TOKEN", "", TEST_CLIENT_ID)).Should(BeFalse())
+				Ω(AuthUnpwdCheck("FAKE_TOKEN", "", TEST_CLIENT_ID, TEST_ADDR)).Should(BeFalse())
 			})
 		})
 
 		Context("Anonymous device", func() {
 			It("should accept by mosquitto for claiming", func() {
-				Ω(AuthUnpwdCheck("", "", TEST_CLIENT_ID)).Should(BeTrue())
+				Ω(AuthUnpwdCheck("", "", TEST_CLIENT_ID, TEST_ADDR)).Should(BeTrue())
 			})
 		})
 	})
@@ -124,6 +145,13 @@ var _ = Describe("AuthPlugin", func() {
 				Ω(AuthAclCheck(TEST_CLIENT_ID, userToken, "test/topic", _MOSQ_ACL_WRITE)).Should(BeTrue())
 				Ω(AuthAclCheck(TEST_CLIENT_ID, userToken, "test/#", _MOSQ_ACL_SUBSCRIBE)).Should(BeTrue())
 			})
+
+			It("should not access internal topics of API servers", func() {
+				Ω(AuthAclCheck(TEST_CLIENT_ID, TEST_USER, "iota/events/x/devices", _MOSQ_ACL_READ)).Should(BeFalse())
+				Ω(AuthAclCheck(TEST_CLIENT_ID, TEST_USER, "iota/events/x/devices", _MOSQ_ACL_WRITE)).Should(BeFalse())
+				Ω(AuthAclCheck(TEST_CLIENT_ID, deviceToken, "iota/events/x/devices", _MOSQ_ACL_WRITE)).Should(BeFalse())
+				Ω(AuthAclCheck(TEST_CLIENT_ID, deviceToken, "iota/#", _MOSQ_ACL_SUBSCRIBE)).Should(BeFalse())
+			})
 		})
 
 		Context("Authorized device", func() {
@@ -165,5 +193,238 @@ var _ = Describe("AuthPlugin", func() {
 				Ω(AuthAclCheck(TEST_CLIENT_ID, deviceToken, "+/+/attributes", _MOSQ_ACL_SUBSCRIBE)).Should(BeFalse())
 			})
 		})
+
+		Context("Configured ACL rules", func() {
+			var dir string
+
+			BeforeEach(func() {
+				var err error
+				dir, err = ioutil.TempDir("", "acl")
+				Expect(err).NotTo(HaveOccurred())
+				file := filepath.Join(dir, "acl.conf")
+				Expect(ioutil.WriteFile(file, []byte(`
+role anonymous
+topic write api/+/me/claim
+topic read  me/claim/%c
+
+role device
+topic write     api/+/%T/#
+topic readwrite %T/me/#
+topic readwrite devices/%d/#
+
+role user
+topic read devices/#
+`), 0600)).To(Succeed())
+
+				Ω(AuthPluginInit([]string{"acl_file"}, []string{file}, 1)).Should(BeTrue())
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(dir)
+			})
+
+			It("should apply rules of anonymous devices", func() {
+				Ω(AuthAclCheck(TEST_CLIENT_ID, "", "api/v1/me/claim", _MOSQ_ACL_WRITE)).Should(BeTrue())
+				Ω(AuthAclCheck(TEST_CLIENT_ID, "", "me/claim/"+TEST_CLIENT_ID, _MOSQ_ACL_READ)).Should(BeTrue())
+				Ω(AuthAclCheck(TEST_CLIENT_ID, "", "me/claim/other", _MOSQ_ACL_READ)).Should(BeFalse())
+			})
+
+			It("should apply rules of devices", func() {
+				Ω(AuthAclCheck(TEST_CLIENT_ID, deviceToken, "api/v1/"+otherToken+"/me/attributes", _MOSQ_ACL_WRITE)).Should(BeTrue())
+				Ω(AuthAclCheck(TEST_CLIENT_ID, deviceToken, "api/v1/FAKE/me/attributes", _MOSQ_ACL_WRITE)).Should(BeFalse())
+				Ω(AuthAclCheck(TEST_CLIENT_ID, deviceToken, "devices/"+TEST_DEVICE+"/status", _MOSQ_ACL_WRITE)).Should(BeTrue())
+				Ω(AuthAclCheck(TEST_CLIENT_ID, deviceToken, "devices/"+OTHER_DEVICE+"/status", _MOSQ_ACL_WRITE)).Should(BeFalse())
+				Ω(AuthAclCheck(TEST_CLIENT_ID, deviceToken, "test/topic", _MOSQ_ACL_WRITE)).Should(BeFalse())
+			})
+
+			It("should apply rules of users", func() {
+				Ω(AuthAclCheck(TEST_CLIENT_ID, TEST_USER, "devices/"+TEST_DEVICE+"/status", _MOSQ_ACL_READ)).Should(BeTrue())
+				Ω(AuthAclCheck(TEST_CLIENT_ID, TEST_USER, "devices/#", _MOSQ_ACL_SUBSCRIBE)).Should(BeTrue())
+				Ω(AuthAclCheck(TEST_CLIENT_ID, TEST_USER, "devices/"+TEST_DEVICE+"/status", _MOSQ_ACL_WRITE)).Should(BeFalse())
+			})
+
+			It("should not apply to super user", func() {
+				Ω(AuthAclCheck(TEST_CLIENT_ID, superUser, "test/topic", _MOSQ_ACL_WRITE)).Should(BeTrue())
+			})
+		})
+
+		Context("Device authenticated by client certificate", func() {
+			BeforeEach(func() {
+				certAuth = true
+			})
+
+			AfterEach(func() {
+				certAuth = false
+			})
+
+			It("should be identified by device id", func() {
+				Ω(AuthAclCheck(TEST_CLIENT_ID, TEST_DEVICE, "api/v1/"+deviceToken+"/me/attributes", _MOSQ_ACL_WRITE)).Should(BeTrue())
+				Ω(AuthAclCheck(TEST_CLIENT_ID, TEST_DEVICE, "api/v1/"+deviceToken+"/me/attributes", _MOSQ_ACL_READ)).Should(BeFalse())
+				Ω(AuthAclCheck(TEST_CLIENT_ID, TEST_DEVICE, deviceToken+"/me/attributes/response/+", _MOSQ_ACL_SUBSCRIBE)).Should(BeTrue())
+				Ω(AuthAclCheck(TEST_CLIENT_ID, TEST_DEVICE, "api/#", _MOSQ_ACL_SUBSCRIBE)).Should(BeFalse())
+			})
+
+			It("should not be identified if disabled", func() {
+				certAuth = false
+				Ω(AuthAclCheck(TEST_CLIENT_ID, TEST_DEVICE, "api/#", _MOSQ_ACL_SUBSCRIBE)).Should(BeTrue())
+			})
+
+			It("should not identify users who logged in with password", func() {
+				user := userdb.BasicUser{Name: TEST_DEVICE, Roles: []string{userdb.RoleAdmin}}
+				Ω(db.Create(&user, TEST_PASSWORD)).Should(Succeed())
+				defer db.Remove(TEST_DEVICE)
+
+				Ω(AuthUnpwdCheck(TEST_DEVICE, TEST_PASSWORD, TEST_CLIENT_ID, TEST_ADDR)).Should(BeTrue())
+				c, ok := resolveClient(TEST_CLIENT_ID, TEST_DEVICE)
+				Ω(ok).Should(BeTrue())
+				Ω(c.Role).Should(Equal(acl.RoleUser))
+				Ω(c.DeviceID).Should(BeEmpty())
+			})
+		})
+	})
+
+	Describe("Decision cache", func() {
+		var pu *userdb.UserDatabase
+		var pa *auth.Authenticator
+		var pd *device.Manager
+
+		BeforeEach(func() {
+			// Share the device manager with the plugin to receive token changes
+			pu, pa, pd = users, authz, devices
+			Ω(Init(db, authz, mgr)).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			users, authz, devices = pu, pa, pd
+		})
+
+		It("should cache decisions", func() {
+			hits, misses := cacheCount("hits"), cacheCount("misses")
+			Ω(AuthUnpwdCheck(deviceToken, "", TEST_CLIENT_ID, TEST_ADDR)).Should(BeTrue())
+			Ω(AuthUnpwdCheck(deviceToken, "", TEST_CLIENT_ID, TEST_ADDR)).Should(BeTrue())
+			Ω(AuthAclCheck(TEST_CLIENT_ID, deviceToken, "test/topic", _MOSQ_ACL_WRITE)).Should(BeTrue())
+			Ω(AuthAclCheck(TEST_CLIENT_ID, deviceToken, "test/topic", _MOSQ_ACL_WRITE)).Should(BeTrue())
+			Ω(cacheCount("hits") - hits).Should(Equal(int64(2)))
+			Ω(cacheCount("misses") - misses).Should(Equal(int64(2)))
+		})
+
+		It("should not cache password logins", func() {
+			Ω(AuthUnpwdCheck(TEST_USER, TEST_PASSWORD, TEST_CLIENT_ID, TEST_ADDR)).Should(BeTrue())
+			Ω(decisions.entries).Should(BeEmpty())
+
+			Ω(db.SetInactive(TEST_USER, true)).Should(Succeed())
+			Ω(AuthUnpwdCheck(TEST_USER, TEST_PASSWORD, TEST_CLIENT_ID, TEST_ADDR)).Should(BeFalse())
+		})
+
+		It("should invalidate decisions when device is removed", func() {
+			Ω(AuthUnpwdCheck(deviceToken, "", TEST_CLIENT_ID, TEST_ADDR)).Should(BeTrue())
+			Ω(AuthAclCheck(TEST_CLIENT_ID, deviceToken, "test/topic", _MOSQ_ACL_WRITE)).Should(BeTrue())
+
+			Ω(mgr.Remove(TEST_DEVICE)).Should(Succeed())
+			Ω(AuthUnpwdCheck(deviceToken, "", TEST_CLIENT_ID, TEST_ADDR)).Should(BeFalse())
+			Ω(AuthAclCheck(TEST_CLIENT_ID, deviceToken, "test/topic", _MOSQ_ACL_WRITE)).Should(BeFalse())
+			Ω(AuthAclCheck(TEST_CLIENT_ID, otherToken, "api/v1/"+deviceToken+"/me/attributes", _MOSQ_ACL_WRITE)).Should(BeFalse())
+		})
+
+		It("should invalidate decisions when token is issued", func() {
+			Ω(mgr.Remove(TEST_DEVICE)).Should(Succeed())
+			Ω(AuthUnpwdCheck(deviceToken, "", TEST_CLIENT_ID, TEST_ADDR)).Should(BeFalse())
+
+			Ω(mgr.Upsert(TEST_DEVICE, deviceToken, device.Record{})).Should(Succeed())
+			Ω(AuthUnpwdCheck(deviceToken, "", TEST_CLIENT_ID, TEST_ADDR)).Should(BeTrue())
+		})
+
+		It("should expire decisions", func() {
+			c := newDecisionCache(10*time.Millisecond, 10)
+			c.put("key", true, TEST_DEVICE)
+			allow, ok := c.get("key")
+			Ω(ok).Should(BeTrue())
+			Ω(allow).Should(BeTrue())
+			time.Sleep(20 * time.Millisecond)
+			_, ok = c.get("key")
+			Ω(ok).Should(BeFalse())
+		})
+
+		It("should limit the number of decisions", func() {
+			c := newDecisionCache(time.Minute, 2)
+			c.put("a", true, "")
+			c.put("b", true, "")
+			c.put("c", true, "")
+			Ω(len(c.entries)).Should(BeNumerically("<=", 2))
+			_, ok := c.get("c")
+			Ω(ok).Should(BeTrue())
+		})
+
+		It("should not cache decisions if disabled", func() {
+			c := newDecisionCache(0, 10)
+			c.put("key", true, "")
+			_, ok := c.get("key")
+			Ω(ok).Should(BeFalse())
+		})
 	})
 })
+
+func cacheCount(name string) int64 {
+	if v, ok := cacheMetrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+const (
+	benchDevice = "bench"
+	benchClient = "BENCH_CLIENT"
+)
+
+// benchmarkPlugin initializes the plugin with the given cache TTL, and
+// returns the access token of a device created for the benchmark.
+func benchmarkPlugin(b *testing.B, ttl string) string {
+	setupDatabase()
+
+	mgr, err := device.NewManager(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	token, err := mgr.CreateToken(benchDevice)
+	if err == nil {
+		err = mgr.Create(benchDevice, token, device.Record{})
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+	if !AuthPluginInit([]string{"cache_ttl"}, []string{ttl}, 1) {
+		b.Fatal("plugin initialization failed")
+	}
+
+	b.Cleanup(func() {
+		mgr.Remove(benchDevice)
+		mgr.Close()
+		AuthPluginCleanup()
+	})
+	b.ResetTimer()
+	return token
+}
+
+func benchmarkUnpwdCheck(b *testing.B, ttl string) {
+	token := benchmarkPlugin(b, ttl)
+	for i := 0; i < b.N; i++ {
+		if !AuthUnpwdCheck(token, "", benchClient, "") {
+			b.Fatal("device not authenticated")
+		}
+	}
+}
+
+func benchmarkAclCheck(b *testing.B, ttl string) {
+	token := benchmarkPlugin(b, ttl)
+	topic := "api/v1/" + token + "/me/attributes"
+	for i := 0; i < b.N; i++ {
+		if !AuthAclCheck(benchClient, token, topic, _MOSQ_ACL_WRITE) {
+			b.Fatal("access denied")
+		}
+	}
+}
+
+func BenchmarkAuthUnpwdCheck(b *testing.B)         { benchmarkUnpwdCheck(b, "60") }
+func BenchmarkAuthUnpwdCheckUncached(b *testing.B) { benchmarkUnpwdCheck(b, "0") }
+func BenchmarkAuthAclCheck(b *testing.B)           { benchmarkAclCheck(b, "60") }
+func BenchmarkAuthAclCheckUncached(b *testing.B)   { benchmarkAclCheck(b, "0") }
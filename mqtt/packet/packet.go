@@ -0,0 +1,325 @@
+// Package packet implements encoding and decoding of MQTT 3.1.1 and MQTT 5
+// control packets.
+package packet
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Protocol versions
+const (
+	V31  byte = 3 // MQTT 3.1
+	V311 byte = 4 // MQTT 3.1.1
+	V5   byte = 5 // MQTT 5.0
+)
+
+// Control packet types
+const (
+	CONNECT     byte = 1
+	CONNACK     byte = 2
+	PUBLISH     byte = 3
+	PUBACK      byte = 4
+	PUBREC      byte = 5
+	PUBREL      byte = 6
+	PUBCOMP     byte = 7
+	SUBSCRIBE   byte = 8
+	SUBACK      byte = 9
+	UNSUBSCRIBE byte = 10
+	UNSUBACK    byte = 11
+	PINGREQ     byte = 12
+	PINGRESP    byte = 13
+	DISCONNECT  byte = 14
+	AUTH        byte = 15
+)
+
+var packetNames = [...]string{
+	"RESERVED", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP",
+	"SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT", "AUTH",
+}
+
+// TypeName returns the name of a control packet type.
+func TypeName(t byte) string {
+	if int(t) < len(packetNames) {
+		return packetNames[t]
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", t)
+}
+
+// MaxSize is the maximum size of a packet allowed by the protocol.
+const MaxSize = 268435455
+
+var (
+	// ErrMalformed indicates that a packet could not be parsed.
+	ErrMalformed = errors.New("mqtt: malformed packet")
+
+	// ErrTooLarge indicates that a packet exceeds the maximum packet size.
+	ErrTooLarge = errors.New("mqtt: packet too large")
+)
+
+// Packet is an MQTT control packet.
+type Packet interface {
+	// Type returns the control packet type.
+	Type() byte
+
+	// encode returns the fixed header flags and the remaining bytes of
+	// the packet for the given protocol version.
+	encode(version byte) (byte, []byte)
+
+	// decode parses the packet from the fixed header flags and the
+	// remaining bytes of the packet.
+	decode(flags byte, body []byte, version byte) error
+}
+
+func newPacket(t byte) Packet {
+	switch t {
+	case CONNECT:
+		return new(Connect)
+	case CONNACK:
+		return new(Connack)
+	case PUBLISH:
+		return new(Publish)
+	case PUBACK, PUBREC, PUBREL, PUBCOMP:
+		return &Ack{PacketType: t}
+	case SUBSCRIBE:
+		return new(Subscribe)
+	case SUBACK:
+		return new(Suback)
+	case UNSUBSCRIBE:
+		return new(Unsubscribe)
+	case UNSUBACK:
+		return new(Unsuback)
+	case PINGREQ:
+		return new(Pingreq)
+	case PINGRESP:
+		return new(Pingresp)
+	case DISCONNECT:
+		return new(Disconnect)
+	case AUTH:
+		return new(Auth)
+	default:
+		return nil
+	}
+}
+
+// Read reads a control packet from the reader. The version is the protocol
+// version negotiated on the connection and is ignored for CONNECT packets,
+// which carry the version themselves. A maxSize of zero means no limit
+// other than the protocol maximum.
+func Read(r *bufio.Reader, version byte, maxSize uint32) (Packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := readVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize != 0 && uint32(length)+uint32(varintSize(length))+1 > maxSize {
+		return nil, ErrTooLarge
+	}
+
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	p := newPacket(header >> 4)
+	if p == nil {
+		return nil, ErrMalformed
+	}
+	if err = p.decode(header&0x0f, body, version); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Write writes the control packet to the writer encoded in the given
+// protocol version.
+func Write(w io.Writer, p Packet, version byte) error {
+	_, err := w.Write(Encode(p, version))
+	return err
+}
+
+// Encode returns the wire format of the control packet encoded in the
+// given protocol version.
+func Encode(p Packet, version byte) []byte {
+	flags, body := p.encode(version)
+	buf := make([]byte, 0, len(body)+5)
+	buf = append(buf, p.Type()<<4|flags)
+	buf = appendVarint(buf, len(body))
+	return append(buf, body...)
+}
+
+func readVarint(r io.ByteReader) (int, error) {
+	var value, shift int
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && i != 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		value |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, nil
+		}
+		shift += 7
+	}
+	return 0, ErrMalformed
+}
+
+func varintSize(v int) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+func appendVarint(buf []byte, v int) []byte {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if v == 0 {
+			return buf
+		}
+	}
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+func appendBinary(buf []byte, b []byte) []byte {
+	buf = appendUint16(buf, uint16(len(b)))
+	return append(buf, b...)
+}
+
+// decoder reads primitive values from a packet body. The first error
+// encountered is retained and all subsequent reads return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = ErrMalformed
+	}
+	d.buf = nil
+}
+
+func (d *decoder) remaining() int {
+	return len(d.buf)
+}
+
+func (d *decoder) byte() byte {
+	if len(d.buf) < 1 {
+		d.fail()
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if len(d.buf) < 2 {
+		d.fail()
+		return 0
+	}
+	v := uint16(d.buf[0])<<8 | uint16(d.buf[1])
+	d.buf = d.buf[2:]
+	return v
+}
+
+func (d *decoder) uint32() uint32 {
+	if len(d.buf) < 4 {
+		d.fail()
+		return 0
+	}
+	v := uint32(d.buf[0])<<24 | uint32(d.buf[1])<<16 | uint32(d.buf[2])<<8 | uint32(d.buf[3])
+	d.buf = d.buf[4:]
+	return v
+}
+
+func (d *decoder) varint() int {
+	var value, shift int
+	for i := 0; i < 4; i++ {
+		b := d.byte()
+		if d.err != nil {
+			return 0
+		}
+		value |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value
+		}
+		shift += 7
+	}
+	d.fail()
+	return 0
+}
+
+func (d *decoder) binary() []byte {
+	n := int(d.uint16())
+	if len(d.buf) < n {
+		d.fail()
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, d.buf[:n])
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.binary())
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if n < 0 || len(d.buf) < n {
+		d.fail()
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) rest() []byte {
+	b := make([]byte, len(d.buf))
+	copy(b, d.buf)
+	d.buf = nil
+	return b
+}
+
+// finish returns the decoding error, or ErrMalformed if there are
+// unparsed bytes left.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) != 0 {
+		d.err = ErrMalformed
+	}
+	return d.err
+}
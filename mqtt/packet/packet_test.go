@@ -0,0 +1,191 @@
+package packet
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestPacket(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Packet Suite")
+}
+
+func roundTrip(p Packet, version byte) Packet {
+	data := Encode(p, version)
+	result, err := Read(bufio.NewReader(bytes.NewReader(data)), version, 0)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	return result
+}
+
+var _ = Describe("Packet", func() {
+	props := &Properties{
+		ContentType:     "application/json",
+		ResponseTopic:   "response/topic",
+		CorrelationData: []byte{1, 2, 3},
+		MessageExpiry:   Uint32(60),
+		User:            []UserProperty{{"status", "200"}},
+	}
+
+	Describe("CONNECT", func() {
+		It("should encode and decode MQTT 3.1.1 packet", func() {
+			p := &Connect{
+				ProtocolVersion: V311,
+				CleanStart:      true,
+				KeepAlive:       30,
+				ClientID:        "client",
+				Will:            &Will{Topic: "will", Payload: []byte("bye"), QoS: 1, Retain: true},
+				UsernameFlag:    true,
+				Username:        "user",
+				PasswordFlag:    true,
+				Password:        []byte("secret"),
+			}
+			r := roundTrip(p, V311).(*Connect)
+			Expect(r.ProtocolName).To(Equal("MQTT"))
+			r.ProtocolName = ""
+			Expect(r).To(Equal(p))
+		})
+
+		It("should encode and decode MQTT 5 packet with properties", func() {
+			p := &Connect{
+				ProtocolVersion: V5,
+				ClientID:        "client",
+				Properties:      &Properties{SessionExpiryInterval: Uint32(3600), ReceiveMaximum: Uint16(10)},
+				Will:            &Will{Topic: "will", Payload: []byte("bye"), Properties: props},
+			}
+			r := roundTrip(p, V5).(*Connect)
+			r.ProtocolName = ""
+			Expect(r).To(Equal(p))
+		})
+
+		It("should report unsupported protocol version", func() {
+			p := &Connect{ProtocolVersion: 6, ClientID: "client"}
+			data := Encode(p, 6)
+			r, err := Read(bufio.NewReader(bytes.NewReader(data)), 0, 0)
+			Expect(r).To(BeNil())
+			Expect(err).To(Equal(ErrProtocolVersion))
+		})
+	})
+
+	Describe("CONNACK", func() {
+		It("should translate reason code for MQTT 3.1.1", func() {
+			p := &Connack{ReasonCode: BadUsernameOrPassword}
+			r := roundTrip(p, V311).(*Connack)
+			Expect(r.ReasonCode).To(Equal(byte(4)))
+		})
+
+		It("should keep reason code for MQTT 5", func() {
+			p := &Connack{SessionPresent: true, ReasonCode: NotAuthorized, Properties: &Properties{ReasonString: "denied"}}
+			Expect(roundTrip(p, V5)).To(Equal(p))
+		})
+	})
+
+	Describe("PUBLISH", func() {
+		It("should encode and decode QoS 0 message", func() {
+			p := &Publish{Topic: "a/b", Payload: []byte("hello"), Retain: true}
+			Expect(roundTrip(p, V311)).To(Equal(p))
+		})
+
+		It("should encode and decode QoS 1 message", func() {
+			p := &Publish{Topic: "a/b", QoS: 1, Dup: true, PacketID: 42, Payload: []byte("hello")}
+			Expect(roundTrip(p, V311)).To(Equal(p))
+		})
+
+		It("should encode and decode MQTT 5 properties", func() {
+			p := &Publish{Topic: "a/b", QoS: 2, PacketID: 7, Properties: props, Payload: []byte{}}
+			Expect(roundTrip(p, V5)).To(Equal(p))
+		})
+
+		It("should drop properties for MQTT 3.1.1", func() {
+			p := &Publish{Topic: "a/b", Properties: props, Payload: []byte("x")}
+			r := roundTrip(p, V311).(*Publish)
+			Expect(r.Properties).To(BeNil())
+			Expect(r.Payload).To(Equal([]byte("x")))
+		})
+
+		It("should reject QoS 1 message without packet identifier", func() {
+			data := Encode(&Publish{Topic: "a", QoS: 1}, V311)
+			_, err := Read(bufio.NewReader(bytes.NewReader(data)), V311, 0)
+			Expect(err).To(Equal(ErrMalformed))
+		})
+	})
+
+	Describe("Acknowledgements", func() {
+		It("should encode and decode all acknowledgement types", func() {
+			for _, t := range []byte{PUBACK, PUBREC, PUBREL, PUBCOMP} {
+				p := &Ack{PacketType: t, PacketID: 1}
+				Expect(roundTrip(p, V311)).To(Equal(p))
+				p = &Ack{PacketType: t, PacketID: 1, ReasonCode: NoMatchingSubscribers}
+				Expect(roundTrip(p, V5)).To(Equal(p))
+			}
+		})
+	})
+
+	Describe("SUBSCRIBE", func() {
+		It("should encode and decode subscriptions", func() {
+			p := &Subscribe{
+				PacketID: 3,
+				Subscriptions: []Subscription{
+					{Filter: "a/+", QoS: 1},
+					{Filter: "b/#", QoS: 2},
+				},
+			}
+			Expect(roundTrip(p, V311)).To(Equal(p))
+		})
+
+		It("should encode and decode MQTT 5 subscription options", func() {
+			p := &Subscribe{
+				PacketID:   3,
+				Properties: &Properties{SubscriptionIdentifiers: []int{1000}},
+				Subscriptions: []Subscription{
+					{Filter: "a/+", QoS: 1, NoLocal: true, RetainAsPublished: true, RetainHandling: 2},
+				},
+			}
+			Expect(roundTrip(p, V5)).To(Equal(p))
+		})
+
+		It("should translate failure reason codes for MQTT 3.1.1", func() {
+			p := &Suback{PacketID: 3, ReasonCodes: []byte{GrantedQoS1, NotAuthorized}}
+			r := roundTrip(p, V311).(*Suback)
+			Expect(r.ReasonCodes).To(Equal([]byte{1, 0x80}))
+		})
+	})
+
+	Describe("UNSUBSCRIBE", func() {
+		It("should encode and decode topic filters", func() {
+			p := &Unsubscribe{PacketID: 4, Filters: []string{"a/+", "b/#"}}
+			Expect(roundTrip(p, V311)).To(Equal(p))
+			Expect(roundTrip(p, V5)).To(Equal(p))
+		})
+
+		It("should encode reason codes for MQTT 5 only", func() {
+			p := &Unsuback{PacketID: 4, ReasonCodes: []byte{Success, NoSubscriptionExisted}}
+			Expect(roundTrip(p, V5)).To(Equal(p))
+			Expect(roundTrip(p, V311).(*Unsuback).ReasonCodes).To(BeNil())
+		})
+	})
+
+	Describe("DISCONNECT", func() {
+		It("should encode reason code for MQTT 5", func() {
+			p := &Disconnect{ReasonCode: SessionTakenOver}
+			Expect(roundTrip(p, V5)).To(Equal(p))
+			Expect(Encode(p, V311)).To(Equal([]byte{0xe0, 0}))
+		})
+	})
+
+	Describe("Packet size", func() {
+		It("should reject packet exceeding the maximum size", func() {
+			data := Encode(&Publish{Topic: "a", Payload: make([]byte, 200)}, V311)
+			_, err := Read(bufio.NewReader(bytes.NewReader(data)), V311, 100)
+			Expect(err).To(Equal(ErrTooLarge))
+		})
+
+		It("should encode large remaining length", func() {
+			p := &Publish{Topic: "a", Payload: make([]byte, 20000)}
+			Expect(roundTrip(p, V311)).To(Equal(p))
+		})
+	})
+})
@@ -0,0 +1,611 @@
+package packet
+
+import "errors"
+
+// ErrProtocolVersion indicates that a CONNECT packet requested a protocol
+// version that is not supported. The ProtocolVersion field of the packet
+// is still set so that the server can respond accordingly.
+var ErrProtocolVersion = errors.New("mqtt: unsupported protocol version")
+
+// MQTT 5 reason codes. The reason codes are translated to MQTT 3.1.1
+// return codes when encoding CONNACK and SUBACK packets for earlier
+// protocol versions.
+const (
+	Success                         byte = 0x00
+	GrantedQoS0                     byte = 0x00
+	GrantedQoS1                     byte = 0x01
+	GrantedQoS2                     byte = 0x02
+	DisconnectWithWill              byte = 0x04
+	NoMatchingSubscribers           byte = 0x10
+	NoSubscriptionExisted           byte = 0x11
+	UnspecifiedError                byte = 0x80
+	MalformedPacket                 byte = 0x81
+	ProtocolError                   byte = 0x82
+	ImplementationSpecificError     byte = 0x83
+	UnsupportedProtocolVersion      byte = 0x84
+	ClientIdentifierNotValid        byte = 0x85
+	BadUsernameOrPassword           byte = 0x86
+	NotAuthorized                   byte = 0x87
+	ServerUnavailable               byte = 0x88
+	ServerBusy                      byte = 0x89
+	ServerShuttingDown              byte = 0x8B
+	KeepAliveTimeout                byte = 0x8D
+	SessionTakenOver                byte = 0x8E
+	TopicFilterInvalid              byte = 0x8F
+	TopicNameInvalid                byte = 0x90
+	PacketIdentifierInUse           byte = 0x91
+	PacketIdentifierNotFound        byte = 0x92
+	ReceiveMaximumExceeded          byte = 0x93
+	TopicAliasInvalid               byte = 0x94
+	PacketTooLarge                  byte = 0x95
+	QuotaExceeded                   byte = 0x97
+	QoSNotSupported                 byte = 0x9B
+	SharedSubscriptionsNotSupported byte = 0x9E
+)
+
+// Will is the will message of a client, published by the server when the
+// network connection is closed unexpectedly.
+type Will struct {
+	Topic      string
+	Payload    []byte
+	QoS        byte
+	Retain     bool
+	Properties *Properties
+}
+
+// Connect is the CONNECT packet sent by a client to request a connection.
+type Connect struct {
+	ProtocolName    string
+	ProtocolVersion byte
+	CleanStart      bool
+	KeepAlive       uint16
+	ClientID        string
+	Will            *Will
+	UsernameFlag    bool
+	Username        string
+	PasswordFlag    bool
+	Password        []byte
+	Properties      *Properties
+}
+
+func (p *Connect) Type() byte { return CONNECT }
+
+func (p *Connect) encode(_ byte) (byte, []byte) {
+	version := p.ProtocolVersion
+	name := p.ProtocolName
+	if name == "" {
+		if version == V31 {
+			name = "MQIsdp"
+		} else {
+			name = "MQTT"
+		}
+	}
+
+	var flags byte
+	if p.UsernameFlag {
+		flags |= 0x80
+	}
+	if p.PasswordFlag {
+		flags |= 0x40
+	}
+	if p.Will != nil {
+		flags |= 0x04 | (p.Will.QoS&0x03)<<3
+		if p.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if p.CleanStart {
+		flags |= 0x02
+	}
+
+	buf := appendString(nil, name)
+	buf = append(buf, version, flags)
+	buf = appendUint16(buf, p.KeepAlive)
+	if version >= V5 {
+		buf = appendProperties(buf, p.Properties)
+	}
+	buf = appendString(buf, p.ClientID)
+	if p.Will != nil {
+		if version >= V5 {
+			buf = appendProperties(buf, p.Will.Properties)
+		}
+		buf = appendString(buf, p.Will.Topic)
+		buf = appendBinary(buf, p.Will.Payload)
+	}
+	if p.UsernameFlag {
+		buf = appendString(buf, p.Username)
+	}
+	if p.PasswordFlag {
+		buf = appendBinary(buf, p.Password)
+	}
+	return 0, buf
+}
+
+func (p *Connect) decode(flags byte, body []byte, _ byte) error {
+	d := decoder{buf: body}
+	p.ProtocolName = d.string()
+	p.ProtocolVersion = d.byte()
+	if d.err != nil || flags != 0 {
+		return ErrMalformed
+	}
+	switch {
+	case p.ProtocolName == "MQIsdp" && p.ProtocolVersion == V31:
+	case p.ProtocolName == "MQTT" && (p.ProtocolVersion == V311 || p.ProtocolVersion == V5):
+	default:
+		return ErrProtocolVersion
+	}
+
+	cf := d.byte()
+	if cf&0x01 != 0 {
+		return ErrMalformed
+	}
+	p.CleanStart = cf&0x02 != 0
+	p.KeepAlive = d.uint16()
+	if p.ProtocolVersion >= V5 {
+		p.Properties = d.properties()
+	}
+	p.ClientID = d.string()
+	if cf&0x04 != 0 {
+		p.Will = &Will{QoS: (cf >> 3) & 0x03, Retain: cf&0x20 != 0}
+		if p.Will.QoS > 2 {
+			return ErrMalformed
+		}
+		if p.ProtocolVersion >= V5 {
+			p.Will.Properties = d.properties()
+		}
+		p.Will.Topic = d.string()
+		p.Will.Payload = d.binary()
+	} else if cf&0x38 != 0 {
+		return ErrMalformed
+	}
+	if p.UsernameFlag = cf&0x80 != 0; p.UsernameFlag {
+		p.Username = d.string()
+	}
+	if p.PasswordFlag = cf&0x40 != 0; p.PasswordFlag {
+		p.Password = d.binary()
+	}
+	return d.finish()
+}
+
+// Connack is the CONNACK packet sent by the server in response to CONNECT.
+type Connack struct {
+	SessionPresent bool
+	ReasonCode     byte
+	Properties     *Properties
+}
+
+func (p *Connack) Type() byte { return CONNACK }
+
+func (p *Connack) encode(version byte) (byte, []byte) {
+	var buf []byte
+	if p.SessionPresent {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	if version >= V5 {
+		buf = append(buf, p.ReasonCode)
+		buf = appendProperties(buf, p.Properties)
+	} else {
+		buf = append(buf, connackReturnCode(p.ReasonCode))
+	}
+	return 0, buf
+}
+
+// connackReturnCode translates a MQTT 5 reason code to a MQTT 3.1.1
+// CONNACK return code.
+func connackReturnCode(reason byte) byte {
+	switch reason {
+	case Success:
+		return 0
+	case UnsupportedProtocolVersion:
+		return 1
+	case ClientIdentifierNotValid:
+		return 2
+	case BadUsernameOrPassword:
+		return 4
+	case NotAuthorized:
+		return 5
+	default:
+		if reason < 6 {
+			return reason // already a MQTT 3.1.1 return code
+		}
+		return 3 // server unavailable
+	}
+}
+
+func (p *Connack) decode(flags byte, body []byte, version byte) error {
+	d := decoder{buf: body}
+	p.SessionPresent = d.byte()&0x01 != 0
+	p.ReasonCode = d.byte()
+	if version >= V5 && d.remaining() > 0 {
+		p.Properties = d.properties()
+	}
+	if flags != 0 {
+		return ErrMalformed
+	}
+	return d.finish()
+}
+
+// Publish is the PUBLISH packet used to transport application messages.
+type Publish struct {
+	Dup        bool
+	QoS        byte
+	Retain     bool
+	Topic      string
+	PacketID   uint16
+	Properties *Properties
+	Payload    []byte
+}
+
+func (p *Publish) Type() byte { return PUBLISH }
+
+func (p *Publish) encode(version byte) (byte, []byte) {
+	flags := (p.QoS & 0x03) << 1
+	if p.Dup {
+		flags |= 0x08
+	}
+	if p.Retain {
+		flags |= 0x01
+	}
+
+	buf := make([]byte, 0, len(p.Topic)+len(p.Payload)+8)
+	buf = appendString(buf, p.Topic)
+	if p.QoS > 0 {
+		buf = appendUint16(buf, p.PacketID)
+	}
+	if version >= V5 {
+		buf = appendProperties(buf, p.Properties)
+	}
+	return flags, append(buf, p.Payload...)
+}
+
+func (p *Publish) decode(flags byte, body []byte, version byte) error {
+	p.Dup = flags&0x08 != 0
+	p.QoS = (flags >> 1) & 0x03
+	p.Retain = flags&0x01 != 0
+	if p.QoS > 2 {
+		return ErrMalformed
+	}
+
+	d := decoder{buf: body}
+	p.Topic = d.string()
+	if p.QoS > 0 {
+		if p.PacketID = d.uint16(); p.PacketID == 0 {
+			return ErrMalformed
+		}
+	}
+	if version >= V5 {
+		p.Properties = d.properties()
+	}
+	p.Payload = d.rest()
+	return d.err
+}
+
+// Copy returns a shallow copy of the packet. The payload and properties
+// are shared with the original packet.
+func (p *Publish) Copy() *Publish {
+	c := *p
+	return &c
+}
+
+// Ack is one of the PUBACK, PUBREC, PUBREL or PUBCOMP packets that are
+// used in the QoS 1 and QoS 2 publication protocols.
+type Ack struct {
+	PacketType byte
+	PacketID   uint16
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (p *Ack) Type() byte { return p.PacketType }
+
+func (p *Ack) encode(version byte) (byte, []byte) {
+	var flags byte
+	if p.PacketType == PUBREL {
+		flags = 0x02
+	}
+
+	buf := appendUint16(nil, p.PacketID)
+	if version >= V5 && (p.ReasonCode != Success || p.Properties != nil) {
+		buf = append(buf, p.ReasonCode)
+		if p.Properties != nil {
+			buf = appendProperties(buf, p.Properties)
+		}
+	}
+	return flags, buf
+}
+
+func (p *Ack) decode(flags byte, body []byte, version byte) error {
+	if (p.PacketType == PUBREL) != (flags == 0x02) || (p.PacketType != PUBREL && flags != 0) {
+		return ErrMalformed
+	}
+
+	d := decoder{buf: body}
+	p.PacketID = d.uint16()
+	if version >= V5 && d.remaining() > 0 {
+		p.ReasonCode = d.byte()
+		if d.remaining() > 0 {
+			p.Properties = d.properties()
+		}
+	}
+	return d.finish()
+}
+
+// Subscription is a topic filter and subscription options requested
+// in a SUBSCRIBE packet.
+type Subscription struct {
+	Filter            string
+	QoS               byte
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte
+}
+
+// Subscribe is the SUBSCRIBE packet sent by a client to create subscriptions.
+type Subscribe struct {
+	PacketID      uint16
+	Properties    *Properties
+	Subscriptions []Subscription
+}
+
+func (p *Subscribe) Type() byte { return SUBSCRIBE }
+
+func (p *Subscribe) encode(version byte) (byte, []byte) {
+	buf := appendUint16(nil, p.PacketID)
+	if version >= V5 {
+		buf = appendProperties(buf, p.Properties)
+	}
+	for _, s := range p.Subscriptions {
+		opts := s.QoS & 0x03
+		if version >= V5 {
+			if s.NoLocal {
+				opts |= 0x04
+			}
+			if s.RetainAsPublished {
+				opts |= 0x08
+			}
+			opts |= (s.RetainHandling & 0x03) << 4
+		}
+		buf = appendString(buf, s.Filter)
+		buf = append(buf, opts)
+	}
+	return 0x02, buf
+}
+
+func (p *Subscribe) decode(flags byte, body []byte, version byte) error {
+	if flags != 0x02 {
+		return ErrMalformed
+	}
+
+	d := decoder{buf: body}
+	p.PacketID = d.uint16()
+	if version >= V5 {
+		p.Properties = d.properties()
+	}
+	for d.remaining() > 0 && d.err == nil {
+		var s Subscription
+		s.Filter = d.string()
+		opts := d.byte()
+		s.QoS = opts & 0x03
+		if version >= V5 {
+			s.NoLocal = opts&0x04 != 0
+			s.RetainAsPublished = opts&0x08 != 0
+			s.RetainHandling = (opts >> 4) & 0x03
+			if opts&0xc0 != 0 || s.RetainHandling > 2 {
+				d.fail()
+			}
+		} else if opts&0xfc != 0 {
+			d.fail()
+		}
+		if s.QoS > 2 {
+			d.fail()
+		}
+		p.Subscriptions = append(p.Subscriptions, s)
+	}
+	if d.err == nil && (p.PacketID == 0 || len(p.Subscriptions) == 0) {
+		d.fail()
+	}
+	return d.finish()
+}
+
+// Suback is the SUBACK packet sent by the server in response to SUBSCRIBE.
+type Suback struct {
+	PacketID    uint16
+	Properties  *Properties
+	ReasonCodes []byte
+}
+
+func (p *Suback) Type() byte { return SUBACK }
+
+func (p *Suback) encode(version byte) (byte, []byte) {
+	buf := appendUint16(nil, p.PacketID)
+	if version >= V5 {
+		buf = appendProperties(buf, p.Properties)
+		buf = append(buf, p.ReasonCodes...)
+	} else {
+		for _, code := range p.ReasonCodes {
+			if code >= UnspecifiedError {
+				code = 0x80 // failure
+			}
+			buf = append(buf, code)
+		}
+	}
+	return 0, buf
+}
+
+func (p *Suback) decode(flags byte, body []byte, version byte) error {
+	d := decoder{buf: body}
+	p.PacketID = d.uint16()
+	if version >= V5 {
+		p.Properties = d.properties()
+	}
+	p.ReasonCodes = d.rest()
+	if flags != 0 {
+		return ErrMalformed
+	}
+	return d.err
+}
+
+// Unsubscribe is the UNSUBSCRIBE packet sent by a client to remove
+// subscriptions.
+type Unsubscribe struct {
+	PacketID   uint16
+	Properties *Properties
+	Filters    []string
+}
+
+func (p *Unsubscribe) Type() byte { return UNSUBSCRIBE }
+
+func (p *Unsubscribe) encode(version byte) (byte, []byte) {
+	buf := appendUint16(nil, p.PacketID)
+	if version >= V5 {
+		buf = appendProperties(buf, p.Properties)
+	}
+	for _, f := range p.Filters {
+		buf = appendString(buf, f)
+	}
+	return 0x02, buf
+}
+
+func (p *Unsubscribe) decode(flags byte, body []byte, version byte) error {
+	if flags != 0x02 {
+		return ErrMalformed
+	}
+
+	d := decoder{buf: body}
+	p.PacketID = d.uint16()
+	if version >= V5 {
+		p.Properties = d.properties()
+	}
+	for d.remaining() > 0 && d.err == nil {
+		p.Filters = append(p.Filters, d.string())
+	}
+	if d.err == nil && (p.PacketID == 0 || len(p.Filters) == 0) {
+		d.fail()
+	}
+	return d.finish()
+}
+
+// Unsuback is the UNSUBACK packet sent by the server in response to
+// UNSUBSCRIBE. Reason codes are only present in MQTT 5.
+type Unsuback struct {
+	PacketID    uint16
+	Properties  *Properties
+	ReasonCodes []byte
+}
+
+func (p *Unsuback) Type() byte { return UNSUBACK }
+
+func (p *Unsuback) encode(version byte) (byte, []byte) {
+	buf := appendUint16(nil, p.PacketID)
+	if version >= V5 {
+		buf = appendProperties(buf, p.Properties)
+		buf = append(buf, p.ReasonCodes...)
+	}
+	return 0, buf
+}
+
+func (p *Unsuback) decode(flags byte, body []byte, version byte) error {
+	d := decoder{buf: body}
+	p.PacketID = d.uint16()
+	if version >= V5 {
+		p.Properties = d.properties()
+		p.ReasonCodes = d.rest()
+	}
+	if flags != 0 {
+		return ErrMalformed
+	}
+	return d.finish()
+}
+
+// Pingreq is the PINGREQ packet sent by a client to keep the connection alive.
+type Pingreq struct{}
+
+func (p *Pingreq) Type() byte { return PINGREQ }
+
+func (p *Pingreq) encode(_ byte) (byte, []byte) { return 0, nil }
+
+func (p *Pingreq) decode(flags byte, body []byte, _ byte) error {
+	if flags != 0 || len(body) != 0 {
+		return ErrMalformed
+	}
+	return nil
+}
+
+// Pingresp is the PINGRESP packet sent by the server in response to PINGREQ.
+type Pingresp struct{}
+
+func (p *Pingresp) Type() byte { return PINGRESP }
+
+func (p *Pingresp) encode(_ byte) (byte, []byte) { return 0, nil }
+
+func (p *Pingresp) decode(flags byte, body []byte, _ byte) error {
+	if flags != 0 || len(body) != 0 {
+		return ErrMalformed
+	}
+	return nil
+}
+
+// Disconnect is the DISCONNECT packet. In MQTT 3.1.1 it is only sent by
+// clients, in MQTT 5 it can also be sent by the server with a reason code.
+type Disconnect struct {
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (p *Disconnect) Type() byte { return DISCONNECT }
+
+func (p *Disconnect) encode(version byte) (byte, []byte) {
+	if version < V5 || (p.ReasonCode == Success && p.Properties == nil) {
+		return 0, nil
+	}
+	buf := []byte{p.ReasonCode}
+	if p.Properties != nil {
+		buf = appendProperties(buf, p.Properties)
+	}
+	return 0, buf
+}
+
+func (p *Disconnect) decode(flags byte, body []byte, version byte) error {
+	if flags != 0 {
+		return ErrMalformed
+	}
+	d := decoder{buf: body}
+	if version >= V5 && d.remaining() > 0 {
+		p.ReasonCode = d.byte()
+		if d.remaining() > 0 {
+			p.Properties = d.properties()
+		}
+	}
+	return d.finish()
+}
+
+// Auth is the MQTT 5 AUTH packet used for extended authentication.
+type Auth struct {
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (p *Auth) Type() byte { return AUTH }
+
+func (p *Auth) encode(_ byte) (byte, []byte) {
+	if p.ReasonCode == Success && p.Properties == nil {
+		return 0, nil
+	}
+	return 0, appendProperties([]byte{p.ReasonCode}, p.Properties)
+}
+
+func (p *Auth) decode(flags byte, body []byte, version byte) error {
+	if flags != 0 || version < V5 {
+		return ErrMalformed
+	}
+	d := decoder{buf: body}
+	if d.remaining() > 0 {
+		p.ReasonCode = d.byte()
+		if d.remaining() > 0 {
+			p.Properties = d.properties()
+		}
+	}
+	return d.finish()
+}
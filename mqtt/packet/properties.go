@@ -0,0 +1,252 @@
+package packet
+
+// Property identifiers defined by MQTT 5
+const (
+	propPayloadFormat          = 0x01
+	propMessageExpiry          = 0x02
+	propContentType            = 0x03
+	propResponseTopic          = 0x08
+	propCorrelationData        = 0x09
+	propSubscriptionIdentifier = 0x0B
+	propSessionExpiryInterval  = 0x11
+	propAssignedClientID       = 0x12
+	propServerKeepAlive        = 0x13
+	propAuthMethod             = 0x15
+	propAuthData               = 0x16
+	propRequestProblemInfo     = 0x17
+	propWillDelayInterval      = 0x18
+	propRequestResponseInfo    = 0x19
+	propResponseInfo           = 0x1A
+	propServerReference        = 0x1C
+	propReasonString           = 0x1F
+	propReceiveMaximum         = 0x21
+	propTopicAliasMaximum      = 0x22
+	propTopicAlias             = 0x23
+	propMaximumQoS             = 0x24
+	propRetainAvailable        = 0x25
+	propUserProperty           = 0x26
+	propMaximumPacketSize      = 0x27
+	propWildcardSubAvailable   = 0x28
+	propSubIDAvailable         = 0x29
+	propSharedSubAvailable     = 0x2A
+)
+
+// UserProperty is a name/value pair carried by MQTT 5 packets.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties holds the MQTT 5 properties of a packet. Optional numeric
+// properties are represented by pointers, a nil pointer means the property
+// is absent. Properties are silently dropped when a packet is encoded in
+// an earlier protocol version.
+type Properties struct {
+	PayloadFormat           *byte
+	MessageExpiry           *uint32
+	ContentType             string
+	ResponseTopic           string
+	CorrelationData         []byte
+	SubscriptionIdentifiers []int
+	SessionExpiryInterval   *uint32
+	AssignedClientID        string
+	ServerKeepAlive         *uint16
+	AuthMethod              string
+	AuthData                []byte
+	RequestProblemInfo      *byte
+	WillDelayInterval       *uint32
+	RequestResponseInfo     *byte
+	ResponseInfo            string
+	ServerReference         string
+	ReasonString            string
+	ReceiveMaximum          *uint16
+	TopicAliasMaximum       *uint16
+	TopicAlias              *uint16
+	MaximumQoS              *byte
+	RetainAvailable         *byte
+	User                    []UserProperty
+	MaximumPacketSize       *uint32
+	WildcardSubAvailable    *byte
+	SubIDAvailable          *byte
+	SharedSubAvailable      *byte
+}
+
+// Byte returns a pointer to the given value, for use in optional properties.
+func Byte(v byte) *byte { return &v }
+
+// Uint16 returns a pointer to the given value, for use in optional properties.
+func Uint16(v uint16) *uint16 { return &v }
+
+// Uint32 returns a pointer to the given value, for use in optional properties.
+func Uint32(v uint32) *uint32 { return &v }
+
+// GetUser returns the value of the first user property with the given key.
+func (p *Properties) GetUser(key string) (string, bool) {
+	for _, u := range p.User {
+		if u.Key == key {
+			return u.Value, true
+		}
+	}
+	return "", false
+}
+
+// AddUser appends a user property.
+func (p *Properties) AddUser(key, value string) {
+	p.User = append(p.User, UserProperty{key, value})
+}
+
+func (p *Properties) encode() []byte {
+	var buf []byte
+
+	putByte := func(id byte, v *byte) {
+		if v != nil {
+			buf = append(buf, id, *v)
+		}
+	}
+	putUint16 := func(id byte, v *uint16) {
+		if v != nil {
+			buf = appendUint16(append(buf, id), *v)
+		}
+	}
+	putUint32 := func(id byte, v *uint32) {
+		if v != nil {
+			buf = appendUint32(append(buf, id), *v)
+		}
+	}
+	putString := func(id byte, v string) {
+		if v != "" {
+			buf = appendString(append(buf, id), v)
+		}
+	}
+	putBinary := func(id byte, v []byte) {
+		if v != nil {
+			buf = appendBinary(append(buf, id), v)
+		}
+	}
+
+	putByte(propPayloadFormat, p.PayloadFormat)
+	putUint32(propMessageExpiry, p.MessageExpiry)
+	putString(propContentType, p.ContentType)
+	putString(propResponseTopic, p.ResponseTopic)
+	putBinary(propCorrelationData, p.CorrelationData)
+	for _, id := range p.SubscriptionIdentifiers {
+		buf = appendVarint(append(buf, propSubscriptionIdentifier), id)
+	}
+	putUint32(propSessionExpiryInterval, p.SessionExpiryInterval)
+	putString(propAssignedClientID, p.AssignedClientID)
+	putUint16(propServerKeepAlive, p.ServerKeepAlive)
+	putString(propAuthMethod, p.AuthMethod)
+	putBinary(propAuthData, p.AuthData)
+	putByte(propRequestProblemInfo, p.RequestProblemInfo)
+	putUint32(propWillDelayInterval, p.WillDelayInterval)
+	putByte(propRequestResponseInfo, p.RequestResponseInfo)
+	putString(propResponseInfo, p.ResponseInfo)
+	putString(propServerReference, p.ServerReference)
+	putString(propReasonString, p.ReasonString)
+	putUint16(propReceiveMaximum, p.ReceiveMaximum)
+	putUint16(propTopicAliasMaximum, p.TopicAliasMaximum)
+	putUint16(propTopicAlias, p.TopicAlias)
+	putByte(propMaximumQoS, p.MaximumQoS)
+	putByte(propRetainAvailable, p.RetainAvailable)
+	for _, u := range p.User {
+		buf = append(buf, propUserProperty)
+		buf = appendString(buf, u.Key)
+		buf = appendString(buf, u.Value)
+	}
+	putUint32(propMaximumPacketSize, p.MaximumPacketSize)
+	putByte(propWildcardSubAvailable, p.WildcardSubAvailable)
+	putByte(propSubIDAvailable, p.SubIDAvailable)
+	putByte(propSharedSubAvailable, p.SharedSubAvailable)
+
+	return buf
+}
+
+// appendProperties appends the properties, prefixed by their length, to
+// the buffer. A nil Properties is encoded as an empty property list.
+func appendProperties(buf []byte, p *Properties) []byte {
+	if p == nil {
+		return append(buf, 0)
+	}
+	props := p.encode()
+	buf = appendVarint(buf, len(props))
+	return append(buf, props...)
+}
+
+// properties decodes a property list. Nil is returned if the property
+// list is empty.
+func (d *decoder) properties() *Properties {
+	n := d.varint()
+	b := d.bytes(n)
+	if d.err != nil || n == 0 {
+		return nil
+	}
+
+	p := new(Properties)
+	pd := decoder{buf: b}
+	for pd.remaining() > 0 && pd.err == nil {
+		switch id := pd.varint(); id {
+		case propPayloadFormat:
+			p.PayloadFormat = Byte(pd.byte())
+		case propMessageExpiry:
+			p.MessageExpiry = Uint32(pd.uint32())
+		case propContentType:
+			p.ContentType = pd.string()
+		case propResponseTopic:
+			p.ResponseTopic = pd.string()
+		case propCorrelationData:
+			p.CorrelationData = pd.binary()
+		case propSubscriptionIdentifier:
+			p.SubscriptionIdentifiers = append(p.SubscriptionIdentifiers, pd.varint())
+		case propSessionExpiryInterval:
+			p.SessionExpiryInterval = Uint32(pd.uint32())
+		case propAssignedClientID:
+			p.AssignedClientID = pd.string()
+		case propServerKeepAlive:
+			p.ServerKeepAlive = Uint16(pd.uint16())
+		case propAuthMethod:
+			p.AuthMethod = pd.string()
+		case propAuthData:
+			p.AuthData = pd.binary()
+		case propRequestProblemInfo:
+			p.RequestProblemInfo = Byte(pd.byte())
+		case propWillDelayInterval:
+			p.WillDelayInterval = Uint32(pd.uint32())
+		case propRequestResponseInfo:
+			p.RequestResponseInfo = Byte(pd.byte())
+		case propResponseInfo:
+			p.ResponseInfo = pd.string()
+		case propServerReference:
+			p.ServerReference = pd.string()
+		case propReasonString:
+			p.ReasonString = pd.string()
+		case propReceiveMaximum:
+			p.ReceiveMaximum = Uint16(pd.uint16())
+		case propTopicAliasMaximum:
+			p.TopicAliasMaximum = Uint16(pd.uint16())
+		case propTopicAlias:
+			p.TopicAlias = Uint16(pd.uint16())
+		case propMaximumQoS:
+			p.MaximumQoS = Byte(pd.byte())
+		case propRetainAvailable:
+			p.RetainAvailable = Byte(pd.byte())
+		case propUserProperty:
+			key := pd.string()
+			p.User = append(p.User, UserProperty{key, pd.string()})
+		case propMaximumPacketSize:
+			p.MaximumPacketSize = Uint32(pd.uint32())
+		case propWildcardSubAvailable:
+			p.WildcardSubAvailable = Byte(pd.byte())
+		case propSubIDAvailable:
+			p.SubIDAvailable = Byte(pd.byte())
+		case propSharedSubAvailable:
+			p.SharedSubAvailable = Byte(pd.byte())
+		default:
+			pd.fail()
+		}
+	}
+	if pd.err != nil {
+		d.fail()
+		return nil
+	}
+	return p
+}
@@ -0,0 +1,427 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/redhill42/iota/mqtt/packet"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	writeTimeout    = 30 * time.Second
+	takeoverTimeout = 5 * time.Second
+)
+
+// conn is a network connection of a client.
+type conn struct {
+	server    *Server
+	nc        net.Conn
+	r         *bufio.Reader
+	version   byte
+	clientID  string
+	username  string
+	keepAlive time.Duration
+	session   *session
+	will      *packet.Will
+	aliases   map[uint16]string
+
+	out       chan packet.Packet
+	done      chan struct{}
+	finished  chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	c := &conn{
+		server:   s,
+		nc:       nc,
+		r:        bufio.NewReader(nc),
+		aliases:  make(map[uint16]string),
+		out:      make(chan packet.Packet, sendQueueSize),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	defer close(c.finished)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		nc.Close()
+		return
+	}
+	s.conns[c] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+
+	nc.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := packet.Read(c.r, 0, s.MaxPacketSize)
+	if err == packet.ErrProtocolVersion {
+		packet.Write(nc, &packet.Connack{ReasonCode: packet.UnsupportedProtocolVersion}, packet.V311)
+	}
+	connect, ok := p.(*packet.Connect)
+	if err != nil || !ok {
+		nc.Close()
+		return
+	}
+
+	c.version = connect.ProtocolVersion
+	if !c.connect(connect) {
+		nc.Close()
+		return
+	}
+
+	normal := c.readLoop()
+	c.shutdown()
+	c.cleanup(normal)
+}
+
+// connect handles the CONNECT packet. Returns false if the connection
+// was refused.
+func (c *conn) connect(connect *packet.Connect) bool {
+	s := c.server
+
+	refuse := func(reason byte) bool {
+		c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		packet.Write(c.nc, &packet.Connack{ReasonCode: reason}, c.version)
+		return false
+	}
+
+	clientID, assigned := connect.ClientID, ""
+	if clientID == "" {
+		if c.version < packet.V5 && !connect.CleanStart {
+			return refuse(packet.ClientIdentifierNotValid)
+		}
+		clientID = randomClientID()
+		assigned = clientID
+	}
+	c.clientID, c.username = clientID, connect.Username
+
+	addr, _, _ := net.SplitHostPort(c.nc.RemoteAddr().String())
+	if s.auth != nil && !s.auth(connect.Username, string(connect.Password), clientID, addr) {
+		logrus.Debugf("mqtt: client %s authentication failed", clientID)
+		return refuse(packet.BadUsernameOrPassword)
+	}
+
+	// Take over the connection of an existing session with same client id
+	s.mu.Lock()
+	old := s.sessions[clientID]
+	s.mu.Unlock()
+	if old != nil {
+		old.mu.Lock()
+		oc := old.conn
+		old.mu.Unlock()
+		if oc != nil {
+			oc.disconnect(packet.SessionTakenOver)
+			select {
+			case <-oc.finished:
+			case <-time.After(takeoverTimeout):
+			}
+		}
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return refuse(packet.ServerUnavailable)
+	}
+	// The session of another user is discarded, so that clients can't
+	// take over the subscriptions and messages of others by client id
+	sess, present := s.sessions[clientID]
+	if present && (connect.CleanStart || sess.owner() != connect.Username) {
+		s.removeSessionLocked(sess)
+		present = false
+	}
+	if !present {
+		sess = newSession(s, clientID)
+		s.sessions[clientID] = sess
+	}
+	s.mu.Unlock()
+
+	sess.attach(c, connect)
+	c.session = sess
+	c.will = connect.Will
+	c.keepAlive = time.Duration(connect.KeepAlive) * time.Second
+
+	ack := &packet.Connack{SessionPresent: present}
+	if c.version >= packet.V5 {
+		ack.Properties = &packet.Properties{
+			AssignedClientID:  assigned,
+			TopicAliasMaximum: packet.Uint16(topicAliasMaximum),
+			MaximumPacketSize: packet.Uint32(s.MaxPacketSize),
+		}
+	}
+
+	go c.writeLoop()
+	c.send(ack)
+	sess.resume()
+	return true
+}
+
+// readLoop reads and handles packets until the connection is closed.
+// Returns true if the client disconnected normally.
+func (c *conn) readLoop() bool {
+	for {
+		if c.keepAlive > 0 {
+			c.nc.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		} else {
+			c.nc.SetReadDeadline(time.Time{})
+		}
+
+		p, err := packet.Read(c.r, c.version, c.server.MaxPacketSize)
+		if err != nil {
+			switch err {
+			case packet.ErrTooLarge:
+				c.disconnect(packet.PacketTooLarge)
+			case packet.ErrMalformed, packet.ErrProtocolVersion:
+				c.disconnect(packet.MalformedPacket)
+			default:
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					c.disconnect(packet.KeepAliveTimeout)
+				}
+			}
+			return false
+		}
+
+		switch p := p.(type) {
+		case *packet.Publish:
+			if !c.handlePublish(p) {
+				return false
+			}
+		case *packet.Ack:
+			switch p.PacketType {
+			case packet.PUBACK, packet.PUBCOMP:
+				c.session.acknowledge(p.PacketID)
+			case packet.PUBREC:
+				c.session.pubrec(p)
+			case packet.PUBREL:
+				c.handlePubrel(p)
+			}
+		case *packet.Subscribe:
+			c.handleSubscribe(p)
+		case *packet.Unsubscribe:
+			c.handleUnsubscribe(p)
+		case *packet.Pingreq:
+			c.send(&packet.Pingresp{})
+		case *packet.Disconnect:
+			if p.Properties != nil && p.Properties.SessionExpiryInterval != nil {
+				c.session.mu.Lock()
+				c.session.expiry = *p.Properties.SessionExpiryInterval
+				c.session.mu.Unlock()
+			}
+			return p.ReasonCode != packet.DisconnectWithWill
+		default:
+			c.disconnect(packet.ProtocolError)
+			return false
+		}
+	}
+}
+
+func (c *conn) handlePublish(p *packet.Publish) bool {
+	s := c.server
+
+	if c.version >= packet.V5 && p.Properties != nil && p.Properties.TopicAlias != nil {
+		alias := *p.Properties.TopicAlias
+		if alias == 0 || alias > topicAliasMaximum {
+			c.disconnect(packet.TopicAliasInvalid)
+			return false
+		}
+		if p.Topic == "" {
+			topic, ok := c.aliases[alias]
+			if !ok {
+				c.disconnect(packet.ProtocolError)
+				return false
+			}
+			p.Topic = topic
+		} else {
+			c.aliases[alias] = p.Topic
+		}
+	}
+	if !validTopic(p.Topic) {
+		c.disconnect(packet.TopicNameInvalid)
+		return false
+	}
+
+	allowed := s.acl == nil || s.acl(c.clientID, c.username, p.Topic, AccessWrite)
+	if !allowed {
+		logrus.Debugf("mqtt: client %s not authorized to publish to %s", c.clientID, p.Topic)
+	}
+
+	reason := packet.Success
+	switch p.QoS {
+	case 0:
+		if allowed {
+			s.publish(p, c.session)
+		}
+
+	case 1:
+		if !allowed {
+			reason = packet.NotAuthorized
+		} else if s.publish(p, c.session) == 0 {
+			reason = packet.NoMatchingSubscribers
+		}
+		c.send(&packet.Ack{PacketType: packet.PUBACK, PacketID: p.PacketID, ReasonCode: reason})
+
+	case 2:
+		sess := c.session
+		sess.mu.Lock()
+		dup := sess.received[p.PacketID]
+		if allowed {
+			sess.received[p.PacketID] = true
+		}
+		sess.mu.Unlock()
+
+		if !allowed {
+			reason = packet.NotAuthorized
+		} else if !dup && s.publish(p, sess) == 0 {
+			reason = packet.NoMatchingSubscribers
+		}
+		c.send(&packet.Ack{PacketType: packet.PUBREC, PacketID: p.PacketID, ReasonCode: reason})
+	}
+	return true
+}
+
+func (c *conn) handlePubrel(p *packet.Ack) {
+	sess := c.session
+	sess.mu.Lock()
+	_, ok := sess.received[p.PacketID]
+	delete(sess.received, p.PacketID)
+	sess.mu.Unlock()
+
+	reason := packet.Success
+	if !ok && c.version >= packet.V5 {
+		reason = packet.PacketIdentifierNotFound
+	}
+	c.send(&packet.Ack{PacketType: packet.PUBCOMP, PacketID: p.PacketID, ReasonCode: reason})
+}
+
+func (c *conn) handleSubscribe(p *packet.Subscribe) {
+	var identifier int
+	if p.Properties != nil && len(p.Properties.SubscriptionIdentifiers) != 0 {
+		identifier = p.Properties.SubscriptionIdentifiers[0]
+	}
+
+	codes := make([]byte, len(p.Subscriptions))
+	retained := make([][]*packet.Publish, len(p.Subscriptions))
+	for i, sub := range p.Subscriptions {
+		codes[i], retained[i] = c.server.subscribe(c.session, sub, identifier)
+	}
+	c.send(&packet.Suback{PacketID: p.PacketID, ReasonCodes: codes})
+
+	for i, sub := range p.Subscriptions {
+		if len(retained[i]) != 0 {
+			c.server.deliverRetained(c.session, sub, identifier, retained[i])
+		}
+	}
+}
+
+func (c *conn) handleUnsubscribe(p *packet.Unsubscribe) {
+	codes := make([]byte, len(p.Filters))
+	for i, filter := range p.Filters {
+		if !c.server.unsubscribe(c.session, filter) {
+			codes[i] = packet.NoSubscriptionExisted
+		}
+	}
+	c.send(&packet.Unsuback{PacketID: p.PacketID, ReasonCodes: codes})
+}
+
+// cleanup publishes the will message if the connection was closed
+// abnormally, and detaches the connection from the session.
+func (c *conn) cleanup(normal bool) {
+	s := c.server
+	if !normal && c.will != nil {
+		will := c.will
+		if s.acl == nil || s.acl(c.clientID, c.username, will.Topic, AccessWrite) {
+			s.publish(&packet.Publish{
+				Topic:      will.Topic,
+				Payload:    will.Payload,
+				QoS:        will.QoS,
+				Retain:     will.Retain,
+				Properties: will.Properties,
+			}, c.session)
+		}
+	}
+	c.session.detach(c)
+}
+
+// send queues a packet to be sent to the client. A client that can't keep
+// up with the messages sent to it is disconnected.
+func (c *conn) send(p packet.Packet) {
+	select {
+	case c.out <- p:
+	case <-c.done:
+	default:
+		logrus.Warnf("mqtt: client %s is too slow, disconnecting", c.clientID)
+		c.close()
+	}
+}
+
+func (c *conn) writeLoop() {
+	w := bufio.NewWriter(c.nc)
+	for {
+		select {
+		case p := <-c.out:
+			if p == nil {
+				w.Flush()
+				c.close()
+				return
+			}
+			c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := packet.Write(w, p, c.version); err != nil {
+				c.close()
+				return
+			}
+			if _, ok := p.(*packet.Disconnect); ok {
+				w.Flush()
+				c.close()
+				return
+			}
+			if len(c.out) == 0 {
+				if err := w.Flush(); err != nil {
+					c.close()
+					return
+				}
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// disconnect closes the connection. MQTT 5 clients are sent a DISCONNECT
+// packet with the reason code before the connection is closed.
+func (c *conn) disconnect(reason byte) {
+	if c.version >= packet.V5 {
+		select {
+		case c.out <- &packet.Disconnect{ReasonCode: reason}:
+			return
+		case <-c.done:
+			return
+		default:
+		}
+	}
+	c.close()
+}
+
+// shutdown closes the connection after pending packets have been written.
+func (c *conn) shutdown() {
+	select {
+	case c.out <- nil:
+	default:
+		c.close()
+	}
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.nc.Close()
+	})
+}
@@ -0,0 +1,384 @@
+// Package server implements an embedded MQTT broker supporting MQTT 3.1.1
+// and MQTT 5 clients. The broker delegates authentication and access control
+// to hook functions, and allows in-process components to publish and
+// subscribe messages without a network round-trip.
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	mrand "math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhill42/iota/mqtt/packet"
+	"github.com/sirupsen/logrus"
+)
+
+// Access types passed to the ACL function, compatible with the access
+// types used by the mosquitto auth plugin.
+const (
+	AccessRead      = 1
+	AccessWrite     = 2
+	AccessSubscribe = 4
+)
+
+// AuthFunc authenticates a client connection with the user name and
+// password provided in CONNECT packet, and the IP address of the client.
+type AuthFunc func(username, password, clientid, addr string) bool
+
+// ACLFunc checks whether a client has the requested access to a topic.
+type ACLFunc func(clientid, username, topic string, acc int) bool
+
+// Handler is called for messages that match an in-process subscription.
+type Handler func(msg *packet.Publish)
+
+// ErrServerClosed is returned by Serve after the server has been closed.
+var ErrServerClosed = errors.New("mqtt: server closed")
+
+const (
+	defaultMaxPacketSize = 1024 * 1024
+	defaultMaxInflight   = 100
+	defaultMaxQueued     = 1000
+	topicAliasMaximum    = 32
+	sendQueueSize        = 256
+	connectTimeout       = 10 * time.Second
+)
+
+// Server is an embedded MQTT broker.
+type Server struct {
+	// MaxPacketSize is the maximum size of packets accepted from clients.
+	MaxPacketSize uint32
+
+	// MaxInflight is the maximum number of unacknowledged QoS 1 and QoS 2
+	// messages sent to a client.
+	MaxInflight int
+
+	// MaxQueued is the maximum number of messages queued for a client that
+	// is offline or has too many unacknowledged messages. The oldest
+	// messages are dropped when the queue is full.
+	MaxQueued int
+
+	auth AuthFunc
+	acl  ACLFunc
+
+	mu        sync.Mutex
+	sessions  map[string]*session
+	topics    *topicTree
+	retained  map[string]*packet.Publish
+	internal  map[string]*internalSubscriber
+	listeners map[net.Listener]bool
+	conns     map[*conn]bool
+	closed    bool
+}
+
+// New creates an embedded MQTT broker. The broker uses the given functions
+// to authenticate clients and to check access to topics. A nil function
+// allows all access.
+func New(auth AuthFunc, acl ACLFunc) *Server {
+	return &Server{
+		MaxPacketSize: defaultMaxPacketSize,
+		MaxInflight:   defaultMaxInflight,
+		MaxQueued:     defaultMaxQueued,
+		auth:          auth,
+		acl:           acl,
+		sessions:      make(map[string]*session),
+		topics:        newTopicTree(),
+		retained:      make(map[string]*packet.Publish),
+		internal:      make(map[string]*internalSubscriber),
+		listeners:     make(map[net.Listener]bool),
+		conns:         make(map[*conn]bool),
+	}
+}
+
+// ListenAndServe listens on the TCP network address and serves MQTT
+// clients on incoming connections.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts incoming connections on the listener and serves MQTT
+// clients. Serve always returns a non-nil error. After Close, the
+// returned error is ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+
+	logrus.Infof("MQTT broker listen on %s", l.Addr())
+
+	var tempDelay time.Duration
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else if tempDelay *= 2; tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		go s.serveConn(nc)
+	}
+}
+
+// ServeConn serves a single MQTT client connection. It blocks until the
+// connection is closed.
+func (s *Server) ServeConn(nc net.Conn) {
+	s.serveConn(nc)
+}
+
+// Close closes all listeners and disconnects all clients.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	listeners := s.listeners
+	conns := s.conns
+	s.listeners = make(map[net.Listener]bool)
+	s.conns = make(map[*conn]bool)
+	s.mu.Unlock()
+
+	for l := range listeners {
+		l.Close()
+	}
+	for c := range conns {
+		c.disconnect(packet.ServerShuttingDown)
+	}
+}
+
+// Publish publishes a message on behalf of the server. No access control
+// is applied to messages published by the server.
+func (s *Server) Publish(msg *packet.Publish) {
+	s.publish(msg, nil)
+}
+
+// internalSubscriber dispatches messages to in-process handlers.
+type internalSubscriber struct {
+	filter  string
+	handler Handler
+}
+
+func (sub *internalSubscriber) id() string {
+	return "i:" + sub.filter
+}
+
+// Subscribe subscribes an in-process handler to the topic filter. An
+// existing handler for the same topic filter is replaced.
+func (s *Server) Subscribe(filter string, qos byte, handler Handler) error {
+	if !validFilter(filter) {
+		return errors.New("mqtt: invalid topic filter: " + filter)
+	}
+
+	group, topic, _ := parseShared(filter)
+	sub := &internalSubscriber{filter, handler}
+	s.mu.Lock()
+	s.internal[filter] = sub
+	s.topics.add(&subscription{
+		subscriber:   sub,
+		filter:       topic,
+		group:        group,
+		Subscription: packet.Subscription{Filter: filter, QoS: qos},
+	})
+	s.mu.Unlock()
+	return nil
+}
+
+// Unsubscribe removes the in-process handler for the topic filter.
+func (s *Server) Unsubscribe(filter string) {
+	s.mu.Lock()
+	if sub, ok := s.internal[filter]; ok {
+		delete(s.internal, filter)
+		s.topics.remove(filter, sub)
+	}
+	s.mu.Unlock()
+}
+
+// delivery is a message to be delivered to a subscriber.
+type delivery struct {
+	sub         *subscription
+	qos         byte
+	identifiers []int
+}
+
+// publish delivers a message to all matching subscribers. A message that
+// matches shared subscriptions is delivered to only one subscriber of each
+// share group. The sender is the session that published the message, or
+// nil for messages published by the server. Returns the number of
+// subscribers that matched.
+func (s *Server) publish(msg *packet.Publish, sender *session) int {
+	targets := make(map[string]*delivery)
+	groups := make(map[string][]*subscription)
+
+	target := func(key string, sub *subscription) {
+		d, ok := targets[key]
+		if !ok {
+			d = &delivery{sub: sub}
+			targets[key] = d
+		}
+		if sub.QoS > d.qos {
+			d.qos = sub.QoS
+		}
+		if sub.identifier != 0 {
+			d.identifiers = append(d.identifiers, sub.identifier)
+		}
+	}
+
+	s.mu.Lock()
+	if msg.Retain {
+		if len(msg.Payload) == 0 {
+			delete(s.retained, msg.Topic)
+		} else {
+			retained := msg.Copy()
+			retained.Dup, retained.PacketID = false, 0
+			s.retained[msg.Topic] = retained
+		}
+	}
+	s.topics.match(msg.Topic, func(sub *subscription) {
+		if sub.group != "" {
+			g := sharePrefix + sub.group + "/" + sub.filter
+			groups[g] = append(groups[g], sub)
+			return
+		}
+		if sub.NoLocal && sender != nil && sub.subscriber == subscriber(sender) {
+			return
+		}
+		target(sub.subscriber.id(), sub)
+	})
+	s.mu.Unlock()
+
+	// Pick a random subscriber from each share group
+	for _, subs := range groups {
+		sub := subs[mrand.Intn(len(subs))]
+		target(sub.key(), sub)
+	}
+
+	for _, d := range targets {
+		qos := msg.QoS
+		if d.qos < qos {
+			qos = d.qos
+		}
+		switch sub := d.sub.subscriber.(type) {
+		case *internalSubscriber:
+			m := msg.Copy()
+			m.QoS, m.Dup, m.PacketID = qos, false, 0
+			sub.handler(m)
+		case *session:
+			if s.acl != nil && !s.acl(sub.clientID, sub.username, msg.Topic, AccessRead) {
+				continue
+			}
+			sub.deliver(msg, qos, msg.Retain && d.sub.RetainAsPublished, d.identifiers)
+		}
+	}
+	return len(targets)
+}
+
+// subscribe adds a client subscription. Returns the granted QoS or a
+// failure reason code, and the retained messages that match the new
+// subscription.
+func (s *Server) subscribe(sess *session, req packet.Subscription, identifier int) (byte, []*packet.Publish) {
+	if !validFilter(req.Filter) {
+		return packet.TopicFilterInvalid, nil
+	}
+
+	// Access of shared subscriptions is checked on the topic filter
+	group, filter, _ := parseShared(req.Filter)
+	if s.acl != nil && !s.acl(sess.clientID, sess.username, filter, AccessSubscribe) {
+		return packet.NotAuthorized, nil
+	}
+
+	sub := &subscription{
+		subscriber:   sess,
+		filter:       filter,
+		group:        group,
+		Subscription: req,
+		identifier:   identifier,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exists := s.topics.add(sub)
+	sess.subscriptions[req.Filter] = sub
+
+	// Retained messages are not sent to shared subscriptions
+	var retained []*packet.Publish
+	if group == "" && (req.RetainHandling == 0 || (req.RetainHandling == 1 && !exists)) {
+		for topic, msg := range s.retained {
+			if matchTopic(req.Filter, topic) {
+				retained = append(retained, msg)
+			}
+		}
+	}
+	return req.QoS, retained
+}
+
+// deliverRetained delivers retained messages to a new subscription.
+func (s *Server) deliverRetained(sess *session, req packet.Subscription, identifier int, retained []*packet.Publish) {
+	var identifiers []int
+	if identifier != 0 {
+		identifiers = []int{identifier}
+	}
+	for _, msg := range retained {
+		if s.acl != nil && !s.acl(sess.clientID, sess.username, msg.Topic, AccessRead) {
+			continue
+		}
+		qos := msg.QoS
+		if req.QoS < qos {
+			qos = req.QoS
+		}
+		sess.deliver(msg, qos, true, identifiers)
+	}
+}
+
+// unsubscribe removes a client subscription.
+func (s *Server) unsubscribe(sess *session, filter string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(sess.subscriptions, filter)
+	return s.topics.remove(filter, sess)
+}
+
+// removeSession removes a session and all its subscriptions.
+func (s *Server) removeSession(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeSessionLocked(sess)
+}
+
+func (s *Server) removeSessionLocked(sess *session) {
+	if s.sessions[sess.clientID] == sess {
+		delete(s.sessions, sess.clientID)
+	}
+	for filter := range sess.subscriptions {
+		s.topics.remove(filter, sess)
+	}
+}
+
+func randomClientID() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return "auto-" + strings.ToUpper(hex.EncodeToString(buf))
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhill42/iota/mqtt/packet"
+)
+
+func TestServer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "MQTT Server Suite")
+}
+
+var _ = Describe("Topics", func() {
+	It("should validate topic filters", func() {
+		Expect(validFilter("a/b/c")).To(BeTrue())
+		Expect(validFilter("a/+/c")).To(BeTrue())
+		Expect(validFilter("a/#")).To(BeTrue())
+		Expect(validFilter("#")).To(BeTrue())
+		Expect(validFilter("a/#/c")).To(BeFalse())
+		Expect(validFilter("a/b+")).To(BeFalse())
+		Expect(validFilter("")).To(BeFalse())
+	})
+
+	It("should validate shared subscription filters", func() {
+		Expect(validFilter("$share/group/a/+")).To(BeTrue())
+		Expect(validFilter("$share/group/#")).To(BeTrue())
+		Expect(validFilter("$share//a")).To(BeFalse())
+		Expect(validFilter("$share/g+/a")).To(BeFalse())
+		Expect(validFilter("$share/group")).To(BeFalse())
+		Expect(validFilter("$share/group/a/#/b")).To(BeFalse())
+	})
+
+	It("should match topic names", func() {
+		Expect(matchTopic("a/+/c", "a/b/c")).To(BeTrue())
+		Expect(matchTopic("a/#", "a")).To(BeTrue())
+		Expect(matchTopic("a/#", "a/b/c")).To(BeTrue())
+		Expect(matchTopic("a/+", "a/b/c")).To(BeFalse())
+		Expect(matchTopic("#", "$SYS/x")).To(BeFalse())
+	})
+})
+
+var _ = Describe("Server", func() {
+	var (
+		srv  *Server
+		addr string
+	)
+
+	auth := func(username, password, clientid, addr string) bool {
+		return username == "" || password == "secret"
+	}
+	acl := func(clientid, username, topic string, acc int) bool {
+		return topic != "private" || username == "admin"
+	}
+
+	BeforeEach(func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		addr = l.Addr().String()
+		srv = New(auth, acl)
+		go srv.Serve(l)
+	})
+
+	AfterEach(func() {
+		srv.Close()
+	})
+
+	connect := func(clientid, username, password string) (mqtt.Client, error) {
+		opts := mqtt.NewClientOptions()
+		opts.AddBroker("tcp://" + addr)
+		opts.SetClientID(clientid)
+		opts.SetUsername(username)
+		opts.SetPassword(password)
+		opts.SetAutoReconnect(false)
+		client := mqtt.NewClient(opts)
+		token := client.Connect()
+		token.Wait()
+		return client, token.Error()
+	}
+
+	mustConnect := func(clientid, username string) mqtt.Client {
+		client, err := connect(clientid, username, "secret")
+		ExpectWithOffset(1, err).NotTo(HaveOccurred())
+		return client
+	}
+
+	subscribe := func(client mqtt.Client, filter string, qos byte) chan mqtt.Message {
+		ch := make(chan mqtt.Message, 10)
+		token := client.Subscribe(filter, qos, func(_ mqtt.Client, msg mqtt.Message) {
+			ch <- msg
+		})
+		token.Wait()
+		ExpectWithOffset(1, token.Error()).NotTo(HaveOccurred())
+		return ch
+	}
+
+	publish := func(client mqtt.Client, topic string, qos byte, retained bool, payload string) {
+		token := client.Publish(topic, qos, retained, payload)
+		token.Wait()
+		ExpectWithOffset(1, token.Error()).NotTo(HaveOccurred())
+	}
+
+	It("should reject bad credentials", func() {
+		_, err := connect("c1", "user", "wrong")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should deliver messages to subscribers", func() {
+		sub := mustConnect("sub", "user")
+		defer sub.Disconnect(0)
+		pub := mustConnect("pub", "user")
+		defer pub.Disconnect(0)
+
+		ch := subscribe(sub, "a/+/c", 2)
+		for qos := byte(0); qos <= 2; qos++ {
+			publish(pub, "a/b/c", qos, false, "hello")
+			var msg mqtt.Message
+			Eventually(ch).Should(Receive(&msg))
+			Expect(msg.Topic()).To(Equal("a/b/c"))
+			Expect(string(msg.Payload())).To(Equal("hello"))
+			Expect(msg.Qos()).To(Equal(qos))
+		}
+	})
+
+	It("should deliver retained messages to new subscribers", func() {
+		pub := mustConnect("pub", "user")
+		defer pub.Disconnect(0)
+		publish(pub, "status", 1, true, "online")
+
+		sub := mustConnect("sub", "user")
+		defer sub.Disconnect(0)
+		ch := subscribe(sub, "status", 1)
+
+		var msg mqtt.Message
+		Eventually(ch).Should(Receive(&msg))
+		Expect(msg.Retained()).To(BeTrue())
+		Expect(string(msg.Payload())).To(Equal("online"))
+	})
+
+	It("should apply access control", func() {
+		sub := mustConnect("sub", "user")
+		defer sub.Disconnect(0)
+		admin := mustConnect("admin", "admin")
+		defer admin.Disconnect(0)
+
+		token := sub.Subscribe("private", 1, nil)
+		token.Wait()
+		Expect(token.(*mqtt.SubscribeToken).Result()["private"]).To(Equal(byte(0x80)))
+
+		ch := subscribe(admin, "private", 1)
+		publish(sub, "private", 1, false, "denied")
+		Consistently(ch, 200*time.Millisecond).ShouldNot(Receive())
+		publish(admin, "private", 1, false, "allowed")
+		Eventually(ch).Should(Receive())
+	})
+
+	It("should dispatch messages to in-process handlers", func() {
+		ch := make(chan *packet.Publish, 1)
+		Expect(srv.Subscribe("api/#", 1, func(msg *packet.Publish) {
+			ch <- msg
+		})).To(Succeed())
+
+		client := mustConnect("client", "user")
+		defer client.Disconnect(0)
+		publish(client, "api/v1/me", 1, false, "{}")
+
+		var msg *packet.Publish
+		Eventually(ch).Should(Receive(&msg))
+		Expect(msg.Topic).To(Equal("api/v1/me"))
+
+		replies := subscribe(client, "reply", 0)
+		srv.Publish(&packet.Publish{Topic: "reply", Payload: []byte("ok")})
+		Eventually(replies).Should(Receive())
+	})
+
+	It("should deliver messages to one subscriber of share group", func() {
+		sub1 := mustConnect("sub1", "user")
+		defer sub1.Disconnect(0)
+		sub2 := mustConnect("sub2", "user")
+		defer sub2.Disconnect(0)
+		other := mustConnect("other", "user")
+		defer other.Disconnect(0)
+		pub := mustConnect("pub", "user")
+		defer pub.Disconnect(0)
+
+		// paho routes messages of shared subscriptions by the topic filter
+		// without the share prefix
+		ch1 := subscribe(sub1, "$share/workers/jobs/+", 1)
+		ch2 := subscribe(sub2, "$share/workers/jobs/+", 1)
+		ch3 := subscribe(other, "$share/others/jobs/+", 1)
+
+		for i := 0; i < 8; i++ {
+			publish(pub, "jobs/1", 1, false, "job")
+		}
+		Eventually(func() int { return len(ch3) }).Should(Equal(8))
+		Eventually(func() int { return len(ch1) + len(ch2) }).Should(Equal(8))
+		Consistently(func() int { return len(ch1) + len(ch2) }, 200*time.Millisecond).Should(Equal(8))
+
+		// Retained messages are not sent to shared subscriptions
+		publish(pub, "jobs/2", 1, true, "retained")
+		late := mustConnect("late", "user")
+		defer late.Disconnect(0)
+		ch4 := subscribe(late, "$share/late/jobs/+", 1)
+		Consistently(ch4, 200*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("should unsubscribe shared subscriptions", func() {
+		client := mustConnect("client", "user")
+		defer client.Disconnect(0)
+
+		// The shared and non-shared subscriptions are routed to the same
+		// handler by paho, so each message is received twice
+		subscribe(client, "$share/group/x", 1)
+		ch := subscribe(client, "x", 1)
+		srv.Publish(&packet.Publish{Topic: "x", QoS: 1})
+		Eventually(func() int { return len(ch) }).Should(Equal(2))
+		<-ch
+		<-ch
+
+		token := client.Unsubscribe("$share/group/x")
+		token.Wait()
+		Expect(token.Error()).NotTo(HaveOccurred())
+
+		srv.Publish(&packet.Publish{Topic: "x", QoS: 1})
+		Eventually(ch).Should(Receive())
+		Consistently(ch, 200*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("should queue messages for offline persistent sessions", func() {
+		opts := mqtt.NewClientOptions()
+		opts.AddBroker("tcp://" + addr)
+		opts.SetClientID("persistent")
+		opts.SetCleanSession(false)
+		opts.SetAutoReconnect(false)
+
+		ch := make(chan mqtt.Message, 10)
+		opts.SetDefaultPublishHandler(func(_ mqtt.Client, msg mqtt.Message) {
+			ch <- msg
+		})
+
+		client := mqtt.NewClient(opts)
+		Expect(client.Connect().Wait()).To(BeTrue())
+		token := client.Subscribe("queued", 1, nil)
+		token.Wait()
+		Expect(token.Error()).NotTo(HaveOccurred())
+		client.Disconnect(0)
+
+		pub := mustConnect("pub", "user")
+		defer pub.Disconnect(0)
+		publish(pub, "queued", 1, false, "while offline")
+
+		client = mqtt.NewClient(opts)
+		token2 := client.Connect()
+		token2.Wait()
+		Expect(token2.Error()).NotTo(HaveOccurred())
+		defer client.Disconnect(0)
+
+		var msg mqtt.Message
+		Eventually(ch).Should(Receive(&msg))
+		Expect(string(msg.Payload())).To(Equal("while offline"))
+	})
+
+	It("should not resume sessions of other users", func() {
+		opts := mqtt.NewClientOptions()
+		opts.AddBroker("tcp://" + addr)
+		opts.SetClientID("persistent")
+		opts.SetUsername("user")
+		opts.SetPassword("secret")
+		opts.SetCleanSession(false)
+		opts.SetAutoReconnect(false)
+
+		ch := make(chan mqtt.Message, 10)
+		opts.SetDefaultPublishHandler(func(_ mqtt.Client, msg mqtt.Message) {
+			ch <- msg
+		})
+
+		client := mqtt.NewClient(opts)
+		Expect(client.Connect().Wait()).To(BeTrue())
+		token := client.Subscribe("queued", 1, nil)
+		token.Wait()
+		Expect(token.Error()).NotTo(HaveOccurred())
+		client.Disconnect(0)
+
+		pub := mustConnect("pub", "user")
+		defer pub.Disconnect(0)
+		publish(pub, "queued", 1, false, "while offline")
+
+		opts.SetUsername("other")
+		client = mqtt.NewClient(opts)
+		token2 := client.Connect()
+		token2.Wait()
+		Expect(token2.Error()).NotTo(HaveOccurred())
+		defer client.Disconnect(0)
+		Expect(token2.(*mqtt.ConnectToken).SessionPresent()).To(BeFalse())
+
+		publish(pub, "queued", 1, false, "after takeover")
+		Consistently(ch, "200ms").ShouldNot(Receive())
+	})
+
+	It("should publish will message on abnormal disconnection", func() {
+		sub := mustConnect("sub", "user")
+		defer sub.Disconnect(0)
+		ch := subscribe(sub, "will", 0)
+
+		nc, err := net.Dial("tcp", addr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(packet.Write(nc, &packet.Connect{
+			ProtocolName:    "MQTT",
+			ProtocolVersion: packet.V311,
+			CleanStart:      true,
+			ClientID:        "dying",
+			Will:            &packet.Will{Topic: "will", Payload: []byte("gone")},
+		}, packet.V311)).To(Succeed())
+		nc.Close()
+
+		var msg mqtt.Message
+		Eventually(ch).Should(Receive(&msg))
+		Expect(string(msg.Payload())).To(Equal("gone"))
+	})
+})
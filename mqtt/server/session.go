@@ -0,0 +1,262 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redhill42/iota/mqtt/packet"
+	"github.com/sirupsen/logrus"
+)
+
+// neverExpire is the session expiry interval of sessions that are kept
+// until the client reconnects with a clean start.
+const neverExpire = 0xFFFFFFFF
+
+// session holds the state of a client that survives reconnections: its
+// subscriptions and the QoS 1 and QoS 2 messages not yet acknowledged.
+type session struct {
+	server   *Server
+	clientID string
+	username string
+
+	// subscriptions are protected by server.mu
+	subscriptions map[string]*subscription
+
+	mu          sync.Mutex
+	conn        *conn
+	version     byte
+	inflight    map[uint16]*packet.Publish // outbound messages waiting for acknowledgement
+	released    map[uint16]bool            // outbound QoS 2 messages for which PUBREL was sent
+	received    map[uint16]bool            // inbound QoS 2 messages waiting for PUBREL
+	queue       []*packet.Publish
+	nextID      uint16
+	receiveMax  int
+	maxPacket   uint32
+	expiry      uint32
+	expiryTimer *time.Timer
+}
+
+func newSession(s *Server, clientID string) *session {
+	return &session{
+		server:        s,
+		clientID:      clientID,
+		subscriptions: make(map[string]*subscription),
+		inflight:      make(map[uint16]*packet.Publish),
+		released:      make(map[uint16]bool),
+		received:      make(map[uint16]bool),
+	}
+}
+
+func (sess *session) id() string {
+	return "c:" + sess.clientID
+}
+
+// owner returns the username of the last connection of the session.
+func (sess *session) owner() string {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.username
+}
+
+// deliver sends a message to the client, or queues the message if the
+// client is offline or has too many unacknowledged messages.
+func (sess *session) deliver(msg *packet.Publish, qos byte, retain bool, identifiers []int) {
+	pub := msg.Copy()
+	pub.QoS, pub.Retain, pub.Dup, pub.PacketID = qos, retain, false, 0
+	if msg.Properties != nil || identifiers != nil {
+		props := packet.Properties{}
+		if msg.Properties != nil {
+			props = *msg.Properties
+		}
+		props.TopicAlias = nil
+		props.SubscriptionIdentifiers = identifiers
+		pub.Properties = &props
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.maxPacket != 0 && len(packet.Encode(pub, sess.version)) > int(sess.maxPacket) {
+		logrus.Debugf("mqtt: message on %s exceeds maximum packet size of client %s", pub.Topic, sess.clientID)
+		return
+	}
+
+	if qos == 0 {
+		if sess.conn != nil {
+			sess.conn.send(pub)
+		}
+		return
+	}
+	if sess.conn == nil || len(sess.inflight) >= sess.inflightLimit() {
+		sess.enqueue(pub)
+		return
+	}
+	sess.sendInflight(pub)
+}
+
+func (sess *session) inflightLimit() int {
+	limit := sess.server.MaxInflight
+	if sess.receiveMax > 0 && sess.receiveMax < limit {
+		limit = sess.receiveMax
+	}
+	return limit
+}
+
+func (sess *session) enqueue(pub *packet.Publish) {
+	if len(sess.queue) >= sess.server.MaxQueued {
+		logrus.Debugf("mqtt: message queue of client %s is full, dropping oldest message", sess.clientID)
+		sess.queue[0] = nil
+		sess.queue = sess.queue[1:]
+	}
+	sess.queue = append(sess.queue, pub)
+}
+
+func (sess *session) sendInflight(pub *packet.Publish) {
+	for {
+		sess.nextID++
+		if sess.nextID == 0 {
+			sess.nextID = 1
+		}
+		if _, used := sess.inflight[sess.nextID]; !used {
+			break
+		}
+	}
+	pub.PacketID = sess.nextID
+	sess.inflight[pub.PacketID] = pub
+	sess.conn.send(pub)
+}
+
+// drain sends queued messages while the inflight window allows.
+func (sess *session) drain() {
+	for sess.conn != nil && len(sess.queue) > 0 && len(sess.inflight) < sess.inflightLimit() {
+		pub := sess.queue[0]
+		sess.queue[0] = nil
+		sess.queue = sess.queue[1:]
+		sess.sendInflight(pub)
+	}
+}
+
+// acknowledge completes the delivery of an outbound message on PUBACK or
+// PUBCOMP.
+func (sess *session) acknowledge(id uint16) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	delete(sess.inflight, id)
+	delete(sess.released, id)
+	sess.drain()
+}
+
+// pubrec handles the PUBREC of an outbound QoS 2 message.
+func (sess *session) pubrec(ack *packet.Ack) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if _, ok := sess.inflight[ack.PacketID]; !ok {
+		if sess.conn != nil {
+			sess.conn.send(&packet.Ack{PacketType: packet.PUBREL, PacketID: ack.PacketID, ReasonCode: packet.PacketIdentifierNotFound})
+		}
+		return
+	}
+	if ack.ReasonCode >= 0x80 {
+		delete(sess.inflight, ack.PacketID)
+		sess.drain()
+		return
+	}
+	sess.released[ack.PacketID] = true
+	if sess.conn != nil {
+		sess.conn.send(&packet.Ack{PacketType: packet.PUBREL, PacketID: ack.PacketID})
+	}
+}
+
+// attach attaches a new connection to the session and resends the
+// messages that were not acknowledged on the previous connection.
+func (sess *session) attach(c *conn, connect *packet.Connect) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.expiryTimer != nil {
+		sess.expiryTimer.Stop()
+		sess.expiryTimer = nil
+	}
+
+	sess.conn = c
+	sess.username = connect.Username
+	sess.version = connect.ProtocolVersion
+	sess.receiveMax, sess.maxPacket = 0, 0
+	if connect.ProtocolVersion >= packet.V5 {
+		sess.expiry = 0
+		if props := connect.Properties; props != nil {
+			if props.SessionExpiryInterval != nil {
+				sess.expiry = *props.SessionExpiryInterval
+			}
+			if props.ReceiveMaximum != nil {
+				sess.receiveMax = int(*props.ReceiveMaximum)
+			}
+			if props.MaximumPacketSize != nil {
+				sess.maxPacket = *props.MaximumPacketSize
+			}
+		}
+	} else if connect.CleanStart {
+		sess.expiry = 0
+	} else {
+		sess.expiry = neverExpire
+	}
+}
+
+// resume resends unacknowledged messages and queued messages after the
+// CONNACK has been sent.
+func (sess *session) resume() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.conn == nil {
+		return
+	}
+
+	ids := make([]int, 0, len(sess.inflight))
+	for id := range sess.inflight {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		pid := uint16(id)
+		if sess.released[pid] {
+			sess.conn.send(&packet.Ack{PacketType: packet.PUBREL, PacketID: pid})
+		} else {
+			pub := sess.inflight[pid].Copy()
+			pub.Dup = true
+			sess.conn.send(pub)
+		}
+	}
+	sess.drain()
+}
+
+// detach detaches the connection from the session. The session is removed
+// or scheduled for removal according to its expiry interval.
+func (sess *session) detach(c *conn) {
+	sess.mu.Lock()
+	if sess.conn != c {
+		sess.mu.Unlock()
+		return
+	}
+	sess.conn = nil
+	expiry := sess.expiry
+	if expiry != 0 && expiry != neverExpire {
+		sess.expiryTimer = time.AfterFunc(time.Duration(expiry)*time.Second, sess.expire)
+	}
+	sess.mu.Unlock()
+
+	if expiry == 0 {
+		sess.server.removeSession(sess)
+	}
+}
+
+func (sess *session) expire() {
+	sess.mu.Lock()
+	online := sess.conn != nil
+	sess.mu.Unlock()
+	if !online {
+		sess.server.removeSession(sess)
+	}
+}
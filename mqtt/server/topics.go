@@ -0,0 +1,213 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/redhill42/iota/mqtt/packet"
+)
+
+// validTopic checks that a topic name used in PUBLISH is well formed. Topic
+// names must not be empty and must not contain wildcard characters.
+func validTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00")
+}
+
+// sharePrefix is the prefix of shared subscription topic filters, which
+// have the form $share/<group>/<filter>.
+const sharePrefix = "$share/"
+
+// parseShared splits a shared subscription topic filter into the share
+// group and the topic filter. The group is empty for non-shared filters.
+func parseShared(filter string) (group, topic string, ok bool) {
+	if !strings.HasPrefix(filter, sharePrefix) {
+		return "", filter, true
+	}
+	sp := strings.SplitN(filter[len(sharePrefix):], "/", 2)
+	if len(sp) != 2 || sp[0] == "" || strings.ContainsAny(sp[0], "+#") {
+		return "", "", false
+	}
+	return sp[0], sp[1], true
+}
+
+// validFilter checks that a topic filter used in SUBSCRIBE is well formed.
+// The multi-level wildcard '#' must be the last character and must occupy
+// an entire level, as must the single-level wildcard '+'.
+func validFilter(filter string) bool {
+	_, filter, ok := parseShared(filter)
+	if !ok || filter == "" || strings.ContainsRune(filter, 0) {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) != 1 {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// subscriber receives messages that match a subscription.
+type subscriber interface {
+	// id identifies the subscriber. A subscriber can only have one
+	// subscription for a topic filter.
+	id() string
+}
+
+// subscription is a subscription of a subscriber on a topic filter.
+type subscription struct {
+	subscriber subscriber
+	filter     string
+	group      string // share group of shared subscriptions
+	packet.Subscription
+
+	// Subscription identifier requested by MQTT 5 clients
+	identifier int
+}
+
+// key identifies the subscription in a topic node. A subscriber can have a
+// shared subscription in addition to a non-shared one on the same filter.
+func (sub *subscription) key() string {
+	return subscriptionKey(sub.group, sub.subscriber.id())
+}
+
+func subscriptionKey(group, id string) string {
+	if group == "" {
+		return id
+	}
+	return sharePrefix + group + "/" + id
+}
+
+// topicNode is a node in the subscription tree. Each node represents a
+// level in topic filters.
+type topicNode struct {
+	children      map[string]*topicNode
+	subscriptions map[string]*subscription
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children:      make(map[string]*topicNode),
+		subscriptions: make(map[string]*subscription),
+	}
+}
+
+// topicTree stores subscriptions by topic filter levels for fast matching
+// of topic names.
+type topicTree struct {
+	root *topicNode
+}
+
+func newTopicTree() *topicTree {
+	return &topicTree{newTopicNode()}
+}
+
+// add adds a subscription to the tree. Returns true if the subscriber had
+// an existing subscription for the same filter, which is replaced.
+func (t *topicTree) add(sub *subscription) bool {
+	node := t.root
+	for _, level := range strings.Split(sub.filter, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	_, exists := node.subscriptions[sub.key()]
+	node.subscriptions[sub.key()] = sub
+	return exists
+}
+
+// remove removes the subscription of the subscriber on a topic filter,
+// which may be a shared subscription filter. Returns false if no such
+// subscription exists.
+func (t *topicTree) remove(filter string, s subscriber) bool {
+	group, filter, ok := parseShared(filter)
+	if !ok {
+		return false
+	}
+	return t.root.remove(strings.Split(filter, "/"), subscriptionKey(group, s.id()))
+}
+
+func (n *topicNode) remove(levels []string, id string) bool {
+	if len(levels) == 0 {
+		if _, ok := n.subscriptions[id]; !ok {
+			return false
+		}
+		delete(n.subscriptions, id)
+		return true
+	}
+
+	child, ok := n.children[levels[0]]
+	if !ok || !child.remove(levels[1:], id) {
+		return false
+	}
+	if len(child.children) == 0 && len(child.subscriptions) == 0 {
+		delete(n.children, levels[0])
+	}
+	return true
+}
+
+// match calls the function for each subscription that matches the topic name.
+func (t *topicTree) match(topic string, f func(sub *subscription)) {
+	levels := strings.Split(topic, "/")
+
+	// Topic names starting with '$' are not matched by wildcards on the
+	// first level
+	if strings.HasPrefix(topic, "$") {
+		if child, ok := t.root.children[levels[0]]; ok {
+			child.match(levels[1:], f)
+		}
+	} else {
+		t.root.match(levels, f)
+	}
+}
+
+func (n *topicNode) match(levels []string, f func(sub *subscription)) {
+	if len(levels) == 0 {
+		for _, sub := range n.subscriptions {
+			f(sub)
+		}
+		// "a/#" also matches the parent level "a"
+		if child, ok := n.children["#"]; ok {
+			for _, sub := range child.subscriptions {
+				f(sub)
+			}
+		}
+		return
+	}
+
+	if child, ok := n.children["#"]; ok {
+		for _, sub := range child.subscriptions {
+			f(sub)
+		}
+	}
+	if child, ok := n.children["+"]; ok {
+		child.match(levels[1:], f)
+	}
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], f)
+	}
+}
+
+// matchTopic returns true if the topic name matches the topic filter.
+func matchTopic(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || (f != "+" && f != ts[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
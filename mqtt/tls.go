@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/redhill42/iota/config"
+)
+
+// brokerURL normalizes the MQTT broker URL. The "mqtt" and "mqtts" schemes
+// are accepted as aliases of "tcp" and "tcps" respectively.
+func brokerURL(server string) (string, bool, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", false, err
+	}
+
+	switch u.Scheme {
+	case "mqtt":
+		u.Scheme = "tcp"
+	case "mqtts":
+		u.Scheme = "tcps"
+	}
+
+	switch u.Scheme {
+	case "tcp", "ws":
+		return u.String(), false, nil
+	case "ssl", "tls", "tcps", "wss":
+		return u.String(), true, nil
+	default:
+		return "", false, errors.New("mqtt: unsupported URL scheme: " + u.Scheme)
+	}
+}
+
+// configureTLS creates the TLS configuration of the connection to MQTT
+// broker. The following options are used:
+//
+//	mqtt.ca          PEM encoded CA certificates to verify the broker,
+//	                 the system CA certificates are used if not set
+//	mqtt.cert        PEM encoded client certificate
+//	mqtt.key         PEM encoded private key of the client certificate
+//	mqtt.serverName  the name to verify the broker certificate against,
+//	                 the host name of the URL is used if not set
+func configureTLS() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: config.Get("mqtt.serverName"),
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if ca := config.Get("mqtt.ca"); ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("mqtt: no CA certificates found in " + ca)
+		}
+	}
+
+	cert, key := config.Get("mqtt.cert"), config.Get("mqtt.key")
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errors.New("mqtt: both client certificate and key must be configured")
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	return tlsConfig, nil
+}
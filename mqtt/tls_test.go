@@ -0,0 +1,182 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhill42/iota/mqtt/server"
+)
+
+// testCert is a certificate signed by the test CA
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(cn string, parent *testCert, server bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else if server {
+		tmpl.DNSNames = []string{cn}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return &testCert{cert, key, der}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func (c *testCert) write(dir, name string) (certFile, keyFile string) {
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	Expect(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)).To(Succeed())
+	der, err := x509.MarshalECPrivateKey(c.key)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)).To(Succeed())
+	return
+}
+
+var _ = Describe("Broker URL", func() {
+	It("should accept mqtt schemes", func() {
+		u, secure, err := brokerURL("mqtts://example.com:8883")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u).To(Equal("tcps://example.com:8883"))
+		Expect(secure).To(BeTrue())
+
+		u, secure, err = brokerURL("mqtt://example.com:1883")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u).To(Equal("tcp://example.com:1883"))
+		Expect(secure).To(BeFalse())
+
+		_, secure, err = brokerURL("wss://example.com/mqtt")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secure).To(BeTrue())
+
+		_, _, err = brokerURL("http://example.com")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("TLS connection", func() {
+	var (
+		dir    string
+		srv    *server.Server
+		broker *Broker
+	)
+
+	env := map[string]string{}
+	setenv := func(key, value string) {
+		env[key] = value
+		os.Setenv(key, value)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "mqtt-tls")
+		Expect(err).NotTo(HaveOccurred())
+
+		ca := newTestCert("Test CA", nil, false)
+		serverCert := newTestCert("broker.local", ca, true)
+		clientCert := newTestCert("apiserver", ca, false)
+
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{serverCert.tlsCertificate()},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		srv = server.New(nil, nil)
+		go srv.Serve(l)
+
+		caFile, _ := ca.write(dir, "ca")
+		certFile, keyFile := clientCert.write(dir, "client")
+		setenv("IOTA_MQTT_URL", "mqtts://"+l.Addr().String())
+		setenv("IOTA_MQTT_CLIENTID", "apiserver")
+		setenv("IOTA_MQTT_CA", caFile)
+		setenv("IOTA_MQTT_CERT", certFile)
+		setenv("IOTA_MQTT_KEY", keyFile)
+		setenv("IOTA_MQTT_SERVERNAME", "broker.local")
+	})
+
+	AfterEach(func() {
+		if broker != nil {
+			broker.Close()
+			broker = nil
+		}
+		srv.Close()
+		for key := range env {
+			os.Unsetenv(key)
+		}
+		os.RemoveAll(dir)
+	})
+
+	It("should connect with client certificate", func() {
+		var err error
+		broker, err = NewBroker("", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(broker.Forward(http.NotFoundHandler())).To(Succeed())
+		Expect(broker.IsConnected()).To(BeTrue())
+	})
+
+	It("should verify server name", func() {
+		setenv("IOTA_MQTT_SERVERNAME", "other.local")
+		var err error
+		broker, err = NewBroker("", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(broker.Forward(http.NotFoundHandler())).NotTo(Succeed())
+	})
+
+	It("should require both client certificate and key", func() {
+		os.Unsetenv("IOTA_MQTT_KEY")
+		_, err := NewBroker("", "")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should not connect without trusted CA", func() {
+		os.Unsetenv("IOTA_MQTT_CA")
+		var err error
+		broker, err = NewBroker("", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(broker.Forward(http.NotFoundHandler())).NotTo(Succeed())
+	})
+})
@@ -62,6 +62,12 @@ func (cli *Client) Delete(ctx context.Context, path string, query url.Values, he
 	return cli.sendRequest(ctx, "DELETE", path, query, nil, headers)
 }
 
+// DeleteWithBody sends an http request to the API server using the method
+// DELETE with the object as request body
+func (cli *Client) DeleteWithBody(ctx context.Context, path string, query url.Values, obj interface{}, headers map[string][]string) (*ServerResponse, error) {
+	return cli.sendRequest(ctx, "DELETE", path, query, obj, headers)
+}
+
 func (cli *Client) sendRequest(ctx context.Context, method, path string, query url.Values, obj interface{}, headers map[string][]string) (*ServerResponse, error) {
 	var body io.Reader
 